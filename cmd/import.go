@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/ponytojas/go-mqtt-timescale/config"
+	"github.com/ponytojas/go-mqtt-timescale/internal/logging"
+	"github.com/ponytojas/go-mqtt-timescale/internal/models"
+	"github.com/ponytojas/go-mqtt-timescale/internal/mqtt"
+)
+
+// runImport loads a file of readings, one payload per line, into the
+// database through the same parsing, validation and batched inserts as
+// messages received from the broker. It exits with status 1 if any line or
+// row failed.
+func runImport(args []string) {
+	flags := config.NewImportFlagSet("import")
+	flags.Parse(args)
+
+	path, _ := flags.GetString("file")
+	if path == "" {
+		fatal("The import command requires --file")
+	}
+
+	cfg, err := config.LoadConfig(".", flags)
+	if err != nil {
+		fatal("Failed to load configuration", "error", err)
+	}
+	if err := cfg.Validate(); err != nil {
+		fatal("Invalid configuration:\n" + err.Error())
+	}
+	if cfg.MQTT.PayloadFormat == "protobuf" {
+		fatal("The import command reads JSON or CSV lines, not protobuf")
+	}
+	if err := logging.Setup(cfg.Logging); err != nil {
+		fatal("Failed to configure logging", "error", err)
+	}
+
+	// There is no broker to publish to, and an archive is imported as fast
+	// as the database takes it rather than at live rates
+	cfg.DeadLetter.Topic = ""
+	cfg.MQTT.ErrorTopic = ""
+	cfg.MQTT.WillTopic = ""
+	cfg.Ingest.PerDeviceRate = 0
+	cfg.Ingest.OverflowPolicy = "block"
+
+	file, err := os.Open(path)
+	if err != nil {
+		fatal("Failed to open import file", "error", err)
+	}
+	defer file.Close()
+
+	db, err := connectDatabase("import", cfg)
+	if err != nil {
+		fatal("Failed to set up database", "error", err)
+	}
+	var inserted, insertErrors atomic.Int64
+	db.SetInsertHook(func(_ string, batch []*models.SensorData) {
+		inserted.Add(int64(len(batch)))
+	})
+	db.SetErrorHook(func(_ string, batch []*models.SensorData, _ error) {
+		insertErrors.Add(int64(len(batch)))
+	})
+
+	importer, err := mqtt.NewImporter(cfg, db)
+	if err != nil {
+		db.Close(context.Background())
+		fatal("Failed to set up import", "error", err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	slog.Info("Importing readings", "file", path, "table", cfg.Timescale.TableName)
+	result, err := importer.Import(ctx, cfg.Timescale.TableName, cfg.MQTT.Topic, file)
+	if err != nil {
+		slog.Error("Import stopped early", "error", err)
+	}
+
+	// Closing the database writes the rows still buffered
+	importer.Disconnect()
+	if err := db.Close(context.Background()); err != nil {
+		slog.Error("Error closing database", "error", err)
+	}
+
+	slog.Info("Import finished",
+		"lines", result.Lines,
+		"failed_lines", result.Failed,
+		"rows_inserted", inserted.Load(),
+		"rows_failed", insertErrors.Load(),
+	)
+	if err != nil || result.Failed > 0 || insertErrors.Load() > 0 {
+		os.Exit(1)
+	}
+}
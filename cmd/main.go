@@ -1,64 +1,176 @@
 package main
 
 import (
-	"log"
+	"context"
+	"log/slog"
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
+
+	"github.com/spf13/pflag"
 
 	"github.com/ponytojas/go-mqtt-timescale/config"
-	"github.com/ponytojas/go-mqtt-timescale/internal/database"
-	"github.com/ponytojas/go-mqtt-timescale/internal/mqtt"
+	"github.com/ponytojas/go-mqtt-timescale/internal/httpserver"
+	"github.com/ponytojas/go-mqtt-timescale/internal/logging"
+	"github.com/ponytojas/go-mqtt-timescale/internal/metrics"
+	"github.com/ponytojas/go-mqtt-timescale/internal/tracing"
 )
 
 func main() {
-	log.Println("Starting MQTT to TimescaleDB service...")
+	if len(os.Args) > 1 && os.Args[1] == "import" {
+		runImport(os.Args[2:])
+		return
+	}
+	os.Exit(run())
+}
+
+// run runs the service until it is stopped and returns the exit code, 1
+// when readings were lost
+func run() int {
+	flags := config.NewFlagSet(os.Args[0])
+	flags.Parse(os.Args[1:])
+
+	// Load configuration. Falling back to the defaults would connect to the
+	// default broker and database with default credentials, so any error,
+	// such as an unreadable password file, is fatal.
+	cfg, err := config.LoadConfig(".", flags)
+	if err != nil {
+		fatal("Failed to load configuration", "error", err)
+	}
+
+	if printConfig, _ := flags.GetBool("print-config"); printConfig {
+		if err := config.PrintEffective(os.Stdout); err != nil {
+			fatal("Failed to print configuration", "error", err)
+		}
+		return 0
+	}
+
+	if err := cfg.Validate(); err != nil {
+		fatal("Invalid configuration:\n" + err.Error())
+	}
+
+	// Configure logging
+	if err := logging.Setup(cfg.Logging); err != nil {
+		fatal("Failed to configure logging", "error", err)
+	}
+
+	slog.Info("Starting MQTT to TimescaleDB service")
 
-	// Load configuration
-	cfg, err := config.LoadConfig(".")
+	// Configure tracing
+	shutdownTracing, err := tracing.Setup(context.Background(), cfg.OTel)
 	if err != nil {
-		log.Printf("Error loading config: %v. Using default configuration.", err)
-		cfg = config.GetDefaultConfig()
+		fatal("Failed to configure tracing", "error", err)
 	}
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := shutdownTracing(ctx); err != nil {
+			slog.Error("Error shutting down tracing", "error", err)
+		}
+	}()
 
-	// Initialize database connection
-	log.Println("Connecting to TimescaleDB...")
-	db, err := database.NewTimescaleDB(cfg)
+	// Start the pipelines, each an MQTT client and the database or sink it
+	// writes to
+	running, err := startPipelines(cfg)
 	if err != nil {
-		log.Fatalf("Failed to connect to database: %v", err)
+		fatal("Failed to start pipelines", "error", err)
+	}
+
+	// Start HTTP servers for health checks and metrics
+	servers := startHTTPServers(cfg, running)
+	defer shutdownHTTPServers(servers)
+
+	slog.Info("Service is running", "pipelines", len(running))
+
+	// Wait for interrupt signal, reloading the configuration on SIGHUP
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	for s := <-sig; s == syscall.SIGHUP; s = <-sig {
+		reloadConfig(flags, running)
 	}
-	defer db.Close()
 
-	// Initialize table
-	log.Println("Initializing database table...")
-	if err := db.InitializeTable(); err != nil {
-		log.Fatalf("Failed to initialize table: %v", err)
+	slog.Info("Shutting down")
+
+	// Unsubscribe and stop accepting messages, and let in-flight ones drain
+	// before disconnecting and flushing the insert buffers
+	running.stop()
+
+	// Close with an account of the data handled, so a restart that lost
+	// data is obvious from the log and the exit code
+	summary := metrics.Summarize()
+	if summary.Dropped() > 0 {
+		slog.Error("Shutdown complete, readings were lost", summary.LogArgs()...)
+		return 1
 	}
+	slog.Info("Shutdown complete", summary.LogArgs()...)
+	return 0
+}
 
-	// Initialize MQTT client
-	log.Println("Setting up MQTT client...")
-	mqttClient, err := mqtt.NewClient(cfg, db)
+// reloadConfig reloads the configuration and applies the settings that can
+// change at runtime to every pipeline. Changes to other settings are logged
+// and only take effect after a restart.
+func reloadConfig(flags *pflag.FlagSet, running pipelines) {
+	slog.Info("Reloading configuration")
+
+	newCfg, err := config.LoadConfig(".", flags)
 	if err != nil {
-		log.Fatalf("Failed to create MQTT client: %v", err)
+		slog.Error("Error reloading config, keeping current configuration", "error", err)
+		return
+	}
+	if err := newCfg.Validate(); err != nil {
+		slog.Error("Invalid configuration, keeping current configuration:\n" + err.Error())
+		return
+	}
+	running.reload(newCfg)
+}
+
+// startHTTPServers starts the health check and metrics servers. Both are
+// served from a single server when they are configured on the same port.
+// The service is ready once every pipeline is.
+func startHTTPServers(cfg *config.Config, running pipelines) []*httpserver.Server {
+	var servers []*httpserver.Server
+
+	var healthServer *httpserver.Server
+	if cfg.HTTP.Port > 0 {
+		healthServer = httpserver.New(cfg.HTTP.Port)
+		healthServer.HandleHealth(running, running)
+		if db := running.readings(); cfg.HTTP.EnableAPI && db != nil {
+			healthServer.HandleReadings(db)
+		}
+		servers = append(servers, healthServer)
 	}
 
-	// Connect to MQTT broker
-	if err := mqttClient.Connect(); err != nil {
-		log.Fatalf("Failed to connect to MQTT broker: %v", err)
+	if cfg.Metrics.Port > 0 {
+		metricsServer := healthServer
+		if cfg.Metrics.Port != cfg.HTTP.Port {
+			metricsServer = httpserver.New(cfg.Metrics.Port)
+			servers = append(servers, metricsServer)
+		}
+		metricsServer.Handle("/metrics", metrics.Handler())
+		metricsServer.Handle("/stats", metrics.StatsHandler())
 	}
-	defer mqttClient.Disconnect()
 
-	// Subscribe to topic
-	if err := mqttClient.Subscribe(); err != nil {
-		log.Fatalf("Failed to subscribe to topic: %v", err)
+	for _, server := range servers {
+		server.Start()
 	}
+	return servers
+}
 
-	log.Printf("Service is running. Subscribed to topic: %s", cfg.MQTT.Topic)
+// shutdownHTTPServers gracefully stops the given servers
+func shutdownHTTPServers(servers []*httpserver.Server) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
 
-	// Wait for interrupt signal
-	sig := make(chan os.Signal, 1)
-	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
-	<-sig
+	for _, server := range servers {
+		if err := server.Shutdown(ctx); err != nil {
+			slog.Error("Error shutting down HTTP server", "error", err)
+		}
+	}
+}
 
-	log.Println("Shutting down...")
+// fatal logs an error and exits, like log.Fatal for slog
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
 }
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os/signal"
+	"sync"
+	"syscall"
+
+	"github.com/ponytojas/go-mqtt-timescale/config"
+	"github.com/ponytojas/go-mqtt-timescale/internal/alert"
+	"github.com/ponytojas/go-mqtt-timescale/internal/database"
+	"github.com/ponytojas/go-mqtt-timescale/internal/httpserver"
+	"github.com/ponytojas/go-mqtt-timescale/internal/logging"
+	"github.com/ponytojas/go-mqtt-timescale/internal/metrics"
+	"github.com/ponytojas/go-mqtt-timescale/internal/models"
+	"github.com/ponytojas/go-mqtt-timescale/internal/mqtt"
+	"github.com/ponytojas/go-mqtt-timescale/internal/sink"
+)
+
+// storage is where readings are written: the database or a sink
+type storage interface {
+	mqtt.Storage
+	httpserver.Pinger
+}
+
+// pipeline is an MQTT client and the database or sink it writes to
+type pipeline struct {
+	name    string
+	cfg     *config.Config
+	client  *mqtt.Client
+	db      *database.TimescaleDB // nil when writing to a sink
+	sink    *sink.Sink            // nil when writing to the database
+	storage storage
+	alerter *alert.Alerter // nil without an alert webhook
+}
+
+// startPipeline connects a pipeline's storage and broker and subscribes to
+// its topics. Anything already opened is closed again if a step fails.
+func startPipeline(name string, cfg *config.Config) (*pipeline, error) {
+	p := &pipeline{name: name, cfg: cfg}
+
+	// Set up where readings are written, the database unless a sink
+	// without one is configured
+	if cfg.Sink.Type == "timescale" {
+		db, err := connectDatabase(name, cfg)
+		if err != nil {
+			return nil, err
+		}
+		p.db, p.storage = db, db
+	} else {
+		slog.Info("Writing readings to sink instead of the database", "pipeline", name, "type", cfg.Sink.Type)
+		out, err := sink.New(cfg.Sink, cfg.Timescale.TableName)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open sink: %w", err)
+		}
+		p.sink, p.storage = out, out
+	}
+
+	slog.Info("Setting up MQTT client", "pipeline", name)
+	client, err := mqtt.NewClient(cfg, p.storage)
+	if err != nil {
+		p.closeStorage()
+		return nil, fmt.Errorf("failed to create MQTT client: %w", err)
+	}
+	p.client = client
+	p.alerter = alert.New(cfg.Alert, name)
+	onInsertError := func(tableName string, batch []*models.SensorData, err error) {
+		client.PublishInsertError(tableName, batch, err)
+		p.alerter.InsertFailed()
+	}
+	if p.db != nil {
+		p.db.SetInsertHook(client.PublishDeviceStatus)
+		p.db.SetErrorHook(onInsertError)
+	} else {
+		p.sink.SetInsertHook(client.PublishDeviceStatus)
+		p.sink.SetErrorHook(onInsertError)
+	}
+	client.OnConnect(metrics.MQTTConnected.Inc)
+	client.OnConnectionLost(func(error) {
+		metrics.MQTTConnected.Dec()
+		metrics.MQTTConnectionsLost.Inc()
+		// No more messages arrive to fill the current batch until the
+		// client reconnects
+		if p.db != nil {
+			p.db.RequestFlush()
+		}
+	})
+
+	if err := client.Connect(); err != nil {
+		p.closeStorage()
+		return nil, fmt.Errorf("failed to connect to MQTT broker: %w", err)
+	}
+	if err := client.Subscribe(); err != nil {
+		client.Disconnect()
+		p.closeStorage()
+		return nil, fmt.Errorf("failed to subscribe to topic: %w", err)
+	}
+
+	slog.Info("Pipeline is running", "pipeline", name, "subscriptions", len(cfg.GetSubscriptions()))
+	return p, nil
+}
+
+// connectDatabase connects to the database and creates the tables, giving
+// up on the connection retries if the service is stopped while the
+// database is still starting
+func connectDatabase(name string, cfg *config.Config) (*database.TimescaleDB, error) {
+	slog.Info("Connecting to TimescaleDB", "pipeline", name)
+	startupCtx, stopStartup := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	db, err := database.NewTimescaleDB(startupCtx, cfg)
+	stopStartup()
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to database: %w", err)
+	}
+
+	slog.Info("Initializing database table", "pipeline", name)
+	if err := db.InitializeTable(context.Background()); err != nil {
+		if closeErr := db.Close(context.Background()); closeErr != nil {
+			slog.Error("Error closing database", "pipeline", name, "error", closeErr)
+		}
+		return nil, fmt.Errorf("failed to initialize table: %w", err)
+	}
+	return db, nil
+}
+
+// stop unsubscribes and stops accepting messages, lets in-flight ones drain,
+// then disconnects and flushes the insert buffer
+func (p *pipeline) stop() {
+	slog.Info("Stopping pipeline", "pipeline", p.name)
+	p.client.Stop()
+	p.client.WaitForStop(p.cfg.ShutdownTimeout)
+	p.client.Disconnect()
+	p.closeStorage()
+}
+
+// closeStorage closes the database or sink, and the alerter watching its
+// inserts
+func (p *pipeline) closeStorage() {
+	defer p.alerter.Close()
+	if p.db != nil {
+		if err := p.db.Close(context.Background()); err != nil {
+			slog.Error("Error closing database", "pipeline", p.name, "error", err)
+		}
+	}
+	if p.sink != nil {
+		if err := p.sink.Close(context.Background()); err != nil {
+			slog.Error("Error closing sink", "pipeline", p.name, "error", err)
+		}
+	}
+}
+
+// reload applies the runtime settings of next, logging changes to other
+// settings that only take effect after a restart. It reports whether
+// anything changed.
+func (p *pipeline) reload(next *config.Config) bool {
+	changes := p.cfg.Diff(next)
+	if len(changes) == 0 {
+		return false
+	}
+
+	for _, key := range changes {
+		if config.IsReloadable(key) {
+			slog.Info("Applying configuration change", "pipeline", p.name, "key", key)
+		} else {
+			slog.Warn("Configuration change requires a restart", "pipeline", p.name, "key", key)
+		}
+	}
+
+	p.cfg = p.cfg.Reload(next)
+	if err := logging.SetLevel(p.cfg.Logging.Level); err != nil {
+		slog.Error("Error applying log level", "error", err)
+	}
+	if p.db != nil {
+		p.db.SetVerboseInserts(p.cfg.Logging.VerboseInserts)
+	}
+	p.client.Reload(p.cfg)
+	return true
+}
+
+// pipelines are the running pipelines
+type pipelines []*pipeline
+
+// startPipelines starts every configured pipeline concurrently, so a slow
+// broker or database only delays its own pipeline. If any of them fails
+// the others are stopped again.
+func startPipelines(cfg *config.Config) (pipelines, error) {
+	configured := cfg.GetPipelines()
+	started := make(pipelines, len(configured))
+	errs := make([]error, len(configured))
+
+	var wg sync.WaitGroup
+	for i, pc := range configured {
+		wg.Add(1)
+		go func(i int, pc config.Pipeline) {
+			defer wg.Done()
+			p, err := startPipeline(pc.Name, pc.Config)
+			if err != nil {
+				errs[i] = fmt.Errorf("pipeline %s: %w", pc.Name, err)
+				return
+			}
+			started[i] = p
+		}(i, pc)
+	}
+	wg.Wait()
+
+	if err := errors.Join(errs...); err != nil {
+		var running pipelines
+		for _, p := range started {
+			if p != nil {
+				running = append(running, p)
+			}
+		}
+		running.stop()
+		return nil, err
+	}
+	return started, nil
+}
+
+// stop stops every pipeline concurrently, each draining within its own
+// shutdown timeout
+func (ps pipelines) stop() {
+	var wg sync.WaitGroup
+	for _, p := range ps {
+		wg.Add(1)
+		go func(p *pipeline) {
+			defer wg.Done()
+			p.stop()
+		}(p)
+	}
+	wg.Wait()
+}
+
+// reload applies the reloaded configuration to each pipeline by name.
+// Pipelines that were added or removed only change after a restart.
+func (ps pipelines) reload(cfg *config.Config) {
+	next := make(map[string]*config.Config)
+	for _, pc := range cfg.GetPipelines() {
+		next[pc.Name] = pc.Config
+	}
+
+	added := len(next) != len(ps)
+	changed := false
+	for _, p := range ps {
+		pc, ok := next[p.name]
+		if !ok {
+			added = true
+			continue
+		}
+		if p.reload(pc) {
+			changed = true
+		}
+	}
+	if added {
+		slog.Warn("Adding or removing pipelines requires a restart")
+	} else if !changed {
+		slog.Info("Configuration unchanged")
+	}
+}
+
+// IsConnected reports whether every pipeline is connected to its broker
+func (ps pipelines) IsConnected() bool {
+	for _, p := range ps {
+		if !p.client.IsConnected() {
+			return false
+		}
+	}
+	return true
+}
+
+// Ping checks that the storage of every pipeline is reachable
+func (ps pipelines) Ping(ctx context.Context) error {
+	for _, p := range ps {
+		if err := p.storage.Ping(ctx); err != nil {
+			if len(ps) == 1 {
+				return err
+			}
+			return fmt.Errorf("pipeline %s: %w", p.name, err)
+		}
+	}
+	return nil
+}
+
+// readings returns the database the readings API serves, the first
+// pipeline's that writes to one
+func (ps pipelines) readings() *database.TimescaleDB {
+	for _, p := range ps {
+		if p.db != nil {
+			return p.db
+		}
+	}
+	return nil
+}
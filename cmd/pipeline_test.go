@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	mochi "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/hooks/auth"
+	"github.com/mochi-mqtt/server/v2/listeners"
+	"github.com/spf13/viper"
+
+	"github.com/ponytojas/go-mqtt-timescale/config"
+	"github.com/ponytojas/go-mqtt-timescale/internal/logging"
+	"github.com/ponytojas/go-mqtt-timescale/internal/models"
+	"github.com/ponytojas/go-mqtt-timescale/internal/mqtt"
+)
+
+// discard is an mqtt.Storage dropping every reading
+type discard struct{}
+
+func (discard) InsertSensorData(ctx context.Context, data *models.SensorData) error {
+	return nil
+}
+
+func (discard) InsertSensorDataBatch(ctx context.Context, batch []*models.SensorData) error {
+	return nil
+}
+
+func (discard) EnqueueSensorDataInto(ctx context.Context, tableName string, data *models.SensorData) error {
+	return nil
+}
+
+func (discard) Close(ctx context.Context) error {
+	return nil
+}
+
+// discardLogs discards the logs written with cfg's logging settings, with
+// the default logger reset once the test ends
+func discardLogs(t *testing.T, cfg *config.Config) {
+	t.Helper()
+	previous := slog.Default()
+	t.Cleanup(func() {
+		slog.SetDefault(previous)
+		logging.SetLevel(config.GetDefaultConfig().Logging.Level)
+	})
+	if err := logging.SetupWriter(io.Discard, cfg.Logging); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// newTestPipeline returns a pipeline running cfg whose client isn't
+// connected, with the default logger reset once the test ends
+func newTestPipeline(t *testing.T, cfg *config.Config) *pipeline {
+	t.Helper()
+	discardLogs(t, cfg)
+	client, err := mqtt.NewClient(cfg, discard{})
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+	t.Cleanup(client.Disconnect)
+	return &pipeline{name: "test", cfg: cfg, client: client}
+}
+
+func TestReloadAppliesTheLogLevel(t *testing.T) {
+	cfg := config.GetDefaultConfig()
+	p := newTestPipeline(t, cfg)
+	if slog.Default().Enabled(context.Background(), slog.LevelDebug) {
+		t.Fatal("debug logging enabled before the reload")
+	}
+
+	next := config.GetDefaultConfig()
+	next.Logging.Level = "debug"
+	next.MQTT.ClientID = "renamed"
+	if !p.reload(next) {
+		t.Fatal("reload reported no changes")
+	}
+
+	if !slog.Default().Enabled(context.Background(), slog.LevelDebug) {
+		t.Error("debug logging not enabled by the reload")
+	}
+	if p.cfg.Logging.Level != "debug" {
+		t.Errorf("running level = %q, want debug", p.cfg.Logging.Level)
+	}
+	// The client id only changes on a restart
+	if p.cfg.MQTT.ClientID != cfg.MQTT.ClientID {
+		t.Errorf("running client id = %q, want %q", p.cfg.MQTT.ClientID, cfg.MQTT.ClientID)
+	}
+}
+
+// startBroker starts an embedded broker accepting any client on a free
+// port, stopped once the test ends
+func startBroker(t *testing.T) (*mochi.Server, string) {
+	t.Helper()
+	server := mochi.New(&mochi.Options{
+		InlineClient: true,
+		Logger:       slog.New(slog.NewTextHandler(io.Discard, nil)),
+	})
+	if err := server.AddHook(new(auth.AllowHook), nil); err != nil {
+		t.Fatal(err)
+	}
+	tcp := listeners.NewTCP(listeners.Config{ID: "tcp", Address: "127.0.0.1:0"})
+	if err := server.AddListener(tcp); err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve()
+	t.Cleanup(func() { server.Close() })
+	return server, tcp.Address()
+}
+
+// publishUntilWritten publishes payload to topic until path holds more
+// lines than before, since the subscription may not be active on the
+// broker at first, and returns the lines written
+func publishUntilWritten(t *testing.T, server *mochi.Server, topic, payload, path string) []string {
+	t.Helper()
+	before, _ := os.ReadFile(path)
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if err := server.Publish(topic, []byte(payload), false, 0); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(20 * time.Millisecond)
+		if data, _ := os.ReadFile(path); len(data) > len(before) {
+			return strings.Split(strings.TrimSpace(string(data[len(before):])), "\n")
+		}
+	}
+	t.Fatalf("nothing more written to %s", path)
+	return nil
+}
+
+func TestPipelinesRunIndependently(t *testing.T) {
+	brokerA, addressA := startBroker(t)
+	brokerB, addressB := startBroker(t)
+	dir := t.TempDir()
+	sinkA, sinkB := filepath.Join(dir, "a.jsonl"), filepath.Join(dir, "b.jsonl")
+
+	viper.Reset()
+	t.Cleanup(viper.Reset)
+	yaml := fmt.Sprintf(`
+mqtt:
+  store_timezone: ""
+  connect_timeout: 5s
+sink:
+  type: file
+pipelines:
+  - name: plant-a
+    mqtt:
+      broker: tcp://%s
+      client_id: plant-a
+    sink:
+      file:
+        path: %s
+  - name: plant-b
+    mqtt:
+      broker: tcp://%s
+      client_id: plant-b
+    sink:
+      file:
+        path: %s
+`, addressA, sinkA, addressB, sinkB)
+	if err := os.WriteFile(filepath.Join(dir, "config.yaml"), []byte(yaml), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := config.LoadConfig(dir, nil)
+	if err != nil {
+		t.Fatalf("LoadConfig: %v", err)
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("Validate: %v", err)
+	}
+	discardLogs(t, cfg)
+
+	running, err := startPipelines(cfg)
+	if err != nil {
+		t.Fatalf("startPipelines: %v", err)
+	}
+	stopped := false
+	t.Cleanup(func() {
+		if !stopped {
+			running.stop()
+		}
+	})
+	if !running.IsConnected() {
+		t.Fatal("pipelines not connected")
+	}
+
+	// Each pipeline only writes the readings of its own broker
+	tests := []struct {
+		name   string
+		broker *mochi.Server
+		device string
+		path   string
+	}{
+		{"plant-a", brokerA, "device-a", sinkA},
+		{"plant-b", brokerB, "device-b", sinkB},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			payload := fmt.Sprintf(`{"device_id":%q,"temperature":21.5}`, tt.device)
+			for _, line := range publishUntilWritten(t, tt.broker, "sensor/"+tt.device, payload, tt.path) {
+				if !strings.Contains(line, tt.device) {
+					t.Errorf("%s wrote %s, want only readings of %s", tt.name, line, tt.device)
+				}
+			}
+		})
+	}
+
+	// Stopping one pipeline leaves the other running
+	running[0].stop()
+	stopped = true
+	defer running[1:].stop()
+	if !running[1].client.IsConnected() {
+		t.Fatal("plant-b disconnected when plant-a stopped")
+	}
+	publishUntilWritten(t, brokerB, "sensor/device-b", `{"device_id":"device-b","temperature":22}`, sinkB)
+}
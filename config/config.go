@@ -2,27 +2,196 @@ package config
 
 import (
 	"fmt"
-	"log"
+	"log/slog"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
 	"strings"
+	"time"
 
+	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
 )
 
 // Config holds all configuration for the application
 type Config struct {
-	MQTT      MQTTConfig      `mapstructure:"mqtt"`
-	Database  DatabaseConfig  `mapstructure:"database"`
-	Timescale TimescaleConfig `mapstructure:"timescale"`
+	MQTT       MQTTConfig       `mapstructure:"mqtt"`
+	Database   DatabaseConfig   `mapstructure:"database"`
+	Timescale  TimescaleConfig  `mapstructure:"timescale"`
+	Metrics    MetricsConfig    `mapstructure:"metrics"`
+	OTel       OTelConfig       `mapstructure:"otel"`
+	HTTP       HTTPConfig       `mapstructure:"http"`
+	Logging    LoggingConfig    `mapstructure:"logging"`
+	DeadLetter DeadLetterConfig `mapstructure:"deadletter"`
+	Status     StatusConfig     `mapstructure:"status"`
+	Spool      SpoolConfig      `mapstructure:"spool"`
+	Sink       SinkConfig       `mapstructure:"sink"`
+	Devices    DevicesConfig    `mapstructure:"devices"`
+	Ingest     IngestConfig     `mapstructure:"ingest"`
+	Validation ValidationConfig `mapstructure:"validation"`
+	Alert      AlertConfig      `mapstructure:"alert"`
+
+	// ShutdownTimeout bounds how long in-flight messages may take to drain on exit
+	ShutdownTimeout time.Duration `mapstructure:"shutdown_timeout"`
+
+	// pipelines are loaded from the pipelines list, see GetPipelines
+	pipelines []Pipeline
 }
 
 // MQTTConfig holds MQTT connection configuration
 type MQTTConfig struct {
-	Broker   string `mapstructure:"broker"`
-	Port     int    `mapstructure:"port"`
-	ClientID string `mapstructure:"client_id"`
-	Topic    string `mapstructure:"topic"`
-	Username string `mapstructure:"username"`
-	Password string `mapstructure:"password"`
+	// Brokers lists one or more broker addresses to fail over between; a
+	// single string or a comma separated list is also accepted. Port is
+	// added to broker URLs without one, 0 uses the scheme's default port.
+	Brokers  []string `mapstructure:"broker"`
+	Port     int      `mapstructure:"port"`
+	ClientID string   `mapstructure:"client_id"`
+	Topic    string   `mapstructure:"topic"`
+	Username string   `mapstructure:"username"`
+	Password string   `mapstructure:"password"`
+	QoS      byte     `mapstructure:"qos"`
+
+	// ClientIDAppendHostname and ClientIDAppendRandom append the hostname
+	// and a random suffix to ClientID, giving each replica its own id
+	ClientIDAppendHostname bool `mapstructure:"client_id_append_hostname"`
+	ClientIDAppendRandom   bool `mapstructure:"client_id_append_random"`
+
+	// WSPath is the websocket endpoint path of ws:// and wss:// brokers
+	// given without one, such as /mqtt
+	WSPath string `mapstructure:"ws_path"`
+
+	// PasswordFile names a file, such as a mounted secret, holding the
+	// password; it takes precedence over Password
+	PasswordFile string `mapstructure:"password_file"`
+
+	// ProtocolVersion selects MQTT 3.1.1 (3) or MQTT 5 (5)
+	ProtocolVersion int `mapstructure:"protocol_version"`
+
+	// SessionExpiryInterval is how long an MQTT 5 broker keeps the session
+	// after disconnecting; 0 ends it with the connection
+	SessionExpiryInterval time.Duration `mapstructure:"session_expiry_interval"`
+
+	// CleanSession discards the broker session on every connect. A persistent
+	// session (false) keeps subscriptions and queued QoS 1/2 messages.
+	CleanSession bool `mapstructure:"clean_session"`
+
+	// UnsubscribeOnStop unsubscribes from every topic on shutdown so the
+	// broker stops sending while in-flight messages drain. With a persistent
+	// session, false keeps the subscriptions so messages are queued for the
+	// next run instead.
+	UnsubscribeOnStop bool `mapstructure:"unsubscribe_on_stop"`
+
+	// StoreDir persists in-flight messages to disk for persistent sessions,
+	// so they survive a restart; empty keeps them in memory
+	StoreDir string `mapstructure:"store_dir"`
+
+	ReconnectInitialInterval time.Duration `mapstructure:"reconnect_initial_interval"`
+	ReconnectMaxInterval     time.Duration `mapstructure:"reconnect_max_interval"`
+	ConnectTimeout           time.Duration `mapstructure:"connect_timeout"`
+
+	// KeepAlive is how often the connection is pinged when idle, and
+	// PingTimeout how long MQTT 3.1.1 waits for the answer before treating
+	// the connection as lost
+	KeepAlive   time.Duration `mapstructure:"keep_alive"`
+	PingTimeout time.Duration `mapstructure:"ping_timeout"`
+
+	// Last Will and Testament, only configured when WillTopic is set
+	WillTopic     string `mapstructure:"will_topic"`
+	WillPayload   string `mapstructure:"will_payload"`
+	WillQoS       byte   `mapstructure:"will_qos"`
+	WillRetained  bool   `mapstructure:"will_retained"`
+	OnlinePayload string `mapstructure:"online_payload"`
+
+	// ErrorTopic receives a JSON event for parse, validation and insert
+	// errors when set. ErrorRate and ErrorBurst limit how many events of
+	// each kind are published per second.
+	ErrorTopic string  `mapstructure:"error_topic"`
+	ErrorQoS   byte    `mapstructure:"error_qos"`
+	ErrorRate  float64 `mapstructure:"error_rate"`
+	ErrorBurst int     `mapstructure:"error_burst"`
+
+	// TLS settings for ssl:// and wss:// brokers
+	TLSCAFile             string `mapstructure:"tls_ca_file"`
+	TLSCertFile           string `mapstructure:"tls_cert_file"`
+	TLSKeyFile            string `mapstructure:"tls_key_file"`
+	TLSInsecureSkipVerify bool   `mapstructure:"tls_insecure_skip_verify"`
+
+	// PayloadFormat is the encoding of incoming payloads: json, csv or protobuf
+	PayloadFormat string `mapstructure:"payload_format"`
+
+	// MaxPayloadBytes rejects larger payloads before they are decoded, or 0
+	// for no limit
+	MaxPayloadBytes int `mapstructure:"max_payload_bytes"`
+
+	// HMACSecret, when set, requires JSON payloads to carry a hex encoded
+	// HMAC-SHA256 of their canonical JSON in HMACField
+	HMACSecret string `mapstructure:"hmac_secret"`
+	HMACField  string `mapstructure:"hmac_field"`
+
+	// PayloadSchema is a JSON Schema file JSON payloads must match, or "" to
+	// accept any payload
+	PayloadSchema string `mapstructure:"payload_schema"`
+
+	// CSVColumns names the fields of a CSV line in order; "" skips a field
+	CSVColumns []string `mapstructure:"csv_columns"`
+
+	// FieldMap renames payload keys to the fields they hold, for example
+	// temp_c: temperature. Keys are matched case-insensitively since the
+	// config loader lowercases them; unmapped keys keep their own name.
+	FieldMap map[string]string `mapstructure:"field_map"`
+
+	// FieldPaths reads fields from nested objects by dot separated path,
+	// for example temperature: readings.temperature. A field whose path is
+	// missing from a payload falls back to its top-level key.
+	FieldPaths map[string]string `mapstructure:"field_paths"`
+
+	// FieldScale multiplies the values of a field once they are extracted,
+	// for example temperature: 0.01 for a device sending hundredths of a
+	// degree. Fields without a factor are stored as sent.
+	FieldScale map[string]float64 `mapstructure:"field_scale"`
+
+	// BurstFields may hold an array of samples taken BurstIntervalField
+	// milliseconds apart, which are stored as one row per sample
+	BurstFields        []string `mapstructure:"burst_fields"`
+	BurstIntervalField string   `mapstructure:"burst_interval_field"`
+
+	// BoolAsNumber stores true and false sensor values as 1 and 0 instead
+	// of rejecting the reading
+	BoolAsNumber bool `mapstructure:"bool_as_number"`
+
+	// TimestampField and DeviceIDField name the payload keys holding the
+	// timestamp and device id, taking precedence over FieldMap
+	TimestampField string `mapstructure:"timestamp_field"`
+	DeviceIDField  string `mapstructure:"device_id_field"`
+
+	// TimestampLayouts are the Go time layouts string timestamps are parsed
+	// with, tried in order; the first that matches wins
+	TimestampLayouts []string `mapstructure:"timestamp_layouts"`
+
+	// TopicTemplate binds topic segments to payload fields, for example
+	// "sensor/+device_id/data"; "{device_id}" is accepted for "+device_id"
+	TopicTemplate string `mapstructure:"topic_template"`
+
+	// TopicColumns are named topic template segments stored in TEXT columns
+	// of their own, such as site and line in "factory/+site/+line/+device_id"
+	TopicColumns []string `mapstructure:"topic_columns"`
+
+	// Subscriptions takes precedence over Topic/QoS when set
+	Subscriptions []SubscriptionConfig `mapstructure:"subscriptions"`
+
+	// SharedGroup subscribes to every topic as $share/<group>/<topic>, so
+	// the broker splits its messages between the replicas in the group;
+	// empty subscribes normally
+	SharedGroup string `mapstructure:"shared_group"`
+}
+
+// SubscriptionConfig holds a single topic subscription and the table its
+// messages are written to
+type SubscriptionConfig struct {
+	Topic string `mapstructure:"topic"`
+	QoS   byte   `mapstructure:"qos"`
+	Table string `mapstructure:"table"`
 }
 
 // DatabaseConfig holds Postgres connection configuration
@@ -33,39 +202,447 @@ type DatabaseConfig struct {
 	Password string `mapstructure:"password"`
 	DBName   string `mapstructure:"dbname"`
 	SSLMode  string `mapstructure:"sslmode"`
+	MaxConns int    `mapstructure:"max_conns"`
+
+	// Schema holds the sensor data and device tables
+	Schema string `mapstructure:"schema"`
+
+	// SSLRootCert names the CA certificate file the server certificate is
+	// verified against, and SSLCert and SSLKey the client certificate
+	// files; they are passed to the connection as sslrootcert, sslcert and
+	// sslkey
+	SSLRootCert string `mapstructure:"ssl_root_cert"`
+	SSLCert     string `mapstructure:"ssl_cert"`
+	SSLKey      string `mapstructure:"ssl_key"`
+
+	// PasswordFile names a file, such as a mounted secret, holding the
+	// password; it takes precedence over Password
+	PasswordFile string `mapstructure:"password_file"`
+
+	// OperationTimeout bounds every database operation other than inserts,
+	// including waiting for a pooled connection
+	OperationTimeout time.Duration `mapstructure:"operation_timeout"`
+
+	// InsertTimeout bounds each insert attempt in place of OperationTimeout,
+	// since an insert may wait on a chunk being compressed
+	InsertTimeout time.Duration `mapstructure:"insert_timeout"`
+
+	// Retry policy for the initial connection, so the service can start
+	// before the database is up
+	ConnectRetries       int           `mapstructure:"connect_retries"`
+	ConnectRetryInterval time.Duration `mapstructure:"connect_retry_interval"`
+
+	// Retry policy for transient insert failures
+	MaxRetries           int           `mapstructure:"max_retries"`
+	RetryInitialInterval time.Duration `mapstructure:"retry_initial_interval"`
+	RetryMaxInterval     time.Duration `mapstructure:"retry_max_interval"`
 }
 
 // TimescaleConfig holds Timescale specific configuration
 type TimescaleConfig struct {
-	TableName string `mapstructure:"table_name"`
+	// Enabled converts tables into hypertables and applies the Timescale
+	// policies; when false, or when the extension is missing, tables are
+	// plain Postgres tables
+	Enabled bool `mapstructure:"enabled"`
+
+	TableName     string        `mapstructure:"table_name"`
+	BatchSize     int           `mapstructure:"batch_size"`
+	FlushInterval time.Duration `mapstructure:"flush_interval"`
+
+	// AdaptiveBatching starts at BatchSize and adjusts the batch size
+	// between MinBatchSize and MaxBatchSize, shrinking it when an insert
+	// takes longer than TargetLatency and growing it while they are faster
+	AdaptiveBatching bool          `mapstructure:"adaptive_batching"`
+	MinBatchSize     int           `mapstructure:"min_batch_size"`
+	MaxBatchSize     int           `mapstructure:"max_batch_size"`
+	TargetLatency    time.Duration `mapstructure:"target_latency"`
+
+	// ChunkTimeInterval is applied when a hypertable is created; 0 keeps
+	// TimescaleDB's default of 7 days
+	ChunkTimeInterval time.Duration `mapstructure:"chunk_time_interval"`
+
+	// SpacePartitions adds a device_id space dimension with this many
+	// partitions when a hypertable is created; 0 partitions by time only
+	SpacePartitions int `mapstructure:"space_partitions"`
+
+	// Retention drops chunks older than this; 0 keeps data forever
+	Retention time.Duration `mapstructure:"retention"`
+
+	// CompressAfter compresses chunks older than this; 0 disables compression
+	CompressAfter time.Duration `mapstructure:"compress_after"`
+
+	// TagColumns are string payload fields stored in TEXT columns of their
+	// own, such as firmware_version; readings without one store NULL
+	TagColumns []string `mapstructure:"tag_columns"`
+
+	// TimeColumn names the column holding each reading's timestamp, which
+	// is the hypertable's time dimension
+	TimeColumn string `mapstructure:"time_column"`
+
+	// AllowedTables are the tables a payload may select with its table field
+	AllowedTables []string `mapstructure:"allowed_tables"`
+
+	// Upsert creates a unique index on ConflictColumns and updates the
+	// existing row when a reading with the same key arrives again
+	Upsert          bool     `mapstructure:"upsert"`
+	ConflictColumns []string `mapstructure:"conflict_columns"`
+
+	// TrackIngestTime adds an ingest_time column holding when the service
+	// received each reading, next to the device-reported time
+	TrackIngestTime bool `mapstructure:"track_ingest_time"`
+
+	// TrackRetained adds a retained column marking readings that came from
+	// retained messages, such as the backlog delivered on subscribe
+	TrackRetained bool `mapstructure:"track_retained"`
+
+	// MaintainLatest upserts the newest reading of each device into
+	// LatestTable on every insert, keyed on device_id
+	MaintainLatest bool   `mapstructure:"maintain_latest"`
+	LatestTable    string `mapstructure:"latest_table"`
+
+	// StoreTimezone is the IANA zone reading timestamps are converted to,
+	// UTC by default; "" keeps the offset each device sent
+	StoreTimezone string `mapstructure:"store_timezone"`
+
+	// ContinuousAggregate maintains a view of per-device averages for
+	// dashboards
+	ContinuousAggregate ContinuousAggregateConfig `mapstructure:"continuous_aggregate"`
+}
+
+// ContinuousAggregateConfig holds the continuous aggregate created for each
+// table, named <table>_aggregate
+type ContinuousAggregateConfig struct {
+	Enabled     bool          `mapstructure:"enabled"`
+	BucketWidth time.Duration `mapstructure:"bucket_width"`
+
+	// The refresh policy re-materializes buckets between StartOffset and
+	// EndOffset ago every ScheduleInterval
+	StartOffset      time.Duration `mapstructure:"start_offset"`
+	EndOffset        time.Duration `mapstructure:"end_offset"`
+	ScheduleInterval time.Duration `mapstructure:"schedule_interval"`
+}
+
+// MetricsConfig holds Prometheus metrics configuration
+type MetricsConfig struct {
+	Port int `mapstructure:"port"` // 0 disables the metrics server
+}
+
+// OTelConfig holds the OpenTelemetry trace exporter configuration
+type OTelConfig struct {
+	Endpoint    string  `mapstructure:"endpoint"` // OTLP/gRPC host:port, empty disables tracing
+	Insecure    bool    `mapstructure:"insecure"` // connect without TLS
+	ServiceName string  `mapstructure:"service_name"`
+	SampleRatio float64 `mapstructure:"sample_ratio"` // fraction of messages traced
+}
+
+// HTTPConfig holds configuration for the health check HTTP server
+type HTTPConfig struct {
+	Port      int  `mapstructure:"port"`       // 0 disables the HTTP server
+	EnableAPI bool `mapstructure:"enable_api"` // serve the /readings API
+}
+
+// LoggingConfig holds log output configuration
+type LoggingConfig struct {
+	Level  string `mapstructure:"level"`  // debug, info, warn or error
+	Format string `mapstructure:"format"` // text or json
+
+	// RepeatInterval limits repeated connection-loss and reconnect logs to
+	// one line per interval; 0 logs every event
+	RepeatInterval time.Duration `mapstructure:"repeat_interval"`
+
+	// VerboseInserts logs every single-row insert and its affected rows at
+	// debug level; they dominate debug logs at high volume
+	VerboseInserts bool `mapstructure:"verbose_inserts"`
+}
+
+// DeadLetterConfig holds where unprocessable messages are sent. Either or
+// both destinations may be set; when neither is, they are discarded.
+type DeadLetterConfig struct {
+	File  string `mapstructure:"file"`  // JSON-lines file
+	Topic string `mapstructure:"topic"` // MQTT topic to re-publish to
+}
+
+// StatusConfig holds the status messages published back to the broker
+type StatusConfig struct {
+	// Enabled publishes a retained {"device_id","last_time"} message to
+	// DeviceTopic, where {device_id} is replaced, after a device's readings
+	// are inserted
+	Enabled     bool   `mapstructure:"enabled"`
+	DeviceTopic string `mapstructure:"device_topic"`
+	QoS         byte   `mapstructure:"qos"`
+
+	// HeartbeatInterval publishes a service heartbeat to HeartbeatTopic this
+	// often; 0 disables it
+	HeartbeatTopic    string        `mapstructure:"heartbeat_topic"`
+	HeartbeatInterval time.Duration `mapstructure:"heartbeat_interval"`
+}
+
+// SpoolConfig holds the disk spool used to keep sensor data while the
+// database is unreachable
+type SpoolConfig struct {
+	Dir            string        `mapstructure:"dir"`         // empty disables spooling
+	MaxSizeMB      int           `mapstructure:"max_size_mb"` // oldest data is dropped beyond this
+	ReplayInterval time.Duration `mapstructure:"replay_interval"`
+}
+
+// SinkConfig selects where readings are written
+type SinkConfig struct {
+	// Type is timescale, or stdout or file to write JSON lines without a
+	// database
+	Type string         `mapstructure:"type"`
+	File FileSinkConfig `mapstructure:"file"`
+}
+
+// FileSinkConfig holds the JSON-lines file written by the file sink, which
+// is rotated once it reaches MaxSizeMB
+type FileSinkConfig struct {
+	Path       string `mapstructure:"path"`
+	MaxSizeMB  int    `mapstructure:"max_size_mb"` // 0 disables rotation
+	MaxBackups int    `mapstructure:"max_backups"` // rotated files kept as path.1, path.2, ...
+}
+
+// DevicesConfig holds the device metadata lookup used to enrich readings
+// with the device's location and type
+type DevicesConfig struct {
+	Table           string        `mapstructure:"table"` // empty disables enrichment
+	RefreshInterval time.Duration `mapstructure:"refresh_interval"`
 }
 
-// LoadConfig loads configuration from file and/or environment variables
-func LoadConfig(path string) (*Config, error) {
+// IngestConfig holds limits applied to incoming readings
+type IngestConfig struct {
+	PerDeviceRate  float64 `mapstructure:"per_device_rate"`  // readings per second per device, 0 disables limiting
+	PerDeviceBurst int     `mapstructure:"per_device_burst"` // readings a device may send at once
+
+	// DeviceTTL is how long per-device state, such as a device's rate limit
+	// bucket or cached metadata, is kept after the device was last seen, so
+	// ephemeral device ids don't accumulate
+	DeviceTTL time.Duration `mapstructure:"device_ttl"`
+
+	// DedupWindow drops a reading whose device_id and timestamp were already
+	// seen within this window; 0 disables deduplication
+	DedupWindow     time.Duration `mapstructure:"dedup_window"`
+	DedupMaxEntries int           `mapstructure:"dedup_max_entries"` // bounds the memory used by deduplication
+
+	// QueueSize bounds the readings waiting for the database writer. When
+	// the queue is full OverflowPolicy either blocks the MQTT handler
+	// ("block") or drops the reading ("drop").
+	QueueSize      int    `mapstructure:"queue_size"`
+	OverflowPolicy string `mapstructure:"overflow_policy"`
+
+	// DryRun parses, validates and logs readings without inserting them
+	DryRun bool `mapstructure:"dry_run"`
+
+	// WarnUnknownFields counts and logs payload fields that are dropped
+	// because they aren't stored in any column
+	WarnUnknownFields bool `mapstructure:"warn_unknown_fields"`
+
+	// Workers processes messages on this many goroutines, 0 on the MQTT
+	// client's own. OrderByDevice routes each device's messages to the same
+	// worker so they are processed in the order they arrived.
+	Workers       int  `mapstructure:"workers"`
+	OrderByDevice bool `mapstructure:"order_by_device"`
+}
+
+// AlertConfig holds the webhook alerting on failed inserts
+type AlertConfig struct {
+	// WebhookURL receives a JSON post once Threshold inserts failed within
+	// Window, and another once none failed for a whole Window; empty
+	// disables alerting
+	WebhookURL string        `mapstructure:"webhook_url"`
+	Threshold  int           `mapstructure:"threshold"`
+	Window     time.Duration `mapstructure:"window"`
+}
+
+// ValidationConfig holds the accepted range of each sensor value
+type ValidationConfig struct {
+	// Mode is what happens to an out-of-range reading: "reject" sends it to
+	// the dead-letter sink, "drop" discards it and "null" stores it with the
+	// offending values set to NULL
+	Mode        string      `mapstructure:"mode"`
+	Temperature RangeConfig `mapstructure:"temperature"`
+	Humidity    RangeConfig `mapstructure:"humidity"`
+	Light       RangeConfig `mapstructure:"light"`
+}
+
+// RangeConfig holds inclusive bounds for a value; a nil bound is unchecked
+type RangeConfig struct {
+	Min *float64 `mapstructure:"min"`
+	Max *float64 `mapstructure:"max"`
+}
+
+// Contains reports whether v lies within the range
+func (r RangeConfig) Contains(v float64) bool {
+	return (r.Min == nil || v >= *r.Min) && (r.Max == nil || v <= *r.Max)
+}
+
+// LoadConfig loads configuration from file, environment variables and the
+// given command line flags, which may be nil
+func LoadConfig(path string, flags *pflag.FlagSet) (*Config, error) {
 	// Set default values first (lowest precedence)
 	defaultConfig := GetDefaultConfig()
-	viper.SetDefault("mqtt.broker", defaultConfig.MQTT.Broker)
+	viper.SetDefault("mqtt.broker", defaultConfig.MQTT.Brokers)
 	viper.SetDefault("mqtt.port", defaultConfig.MQTT.Port)
+	viper.SetDefault("mqtt.ws_path", defaultConfig.MQTT.WSPath)
 	viper.SetDefault("mqtt.client_id", defaultConfig.MQTT.ClientID)
+	viper.SetDefault("mqtt.client_id_append_hostname", defaultConfig.MQTT.ClientIDAppendHostname)
+	viper.SetDefault("mqtt.client_id_append_random", defaultConfig.MQTT.ClientIDAppendRandom)
 	viper.SetDefault("mqtt.topic", defaultConfig.MQTT.Topic)
 	viper.SetDefault("mqtt.username", defaultConfig.MQTT.Username)
 	viper.SetDefault("mqtt.password", defaultConfig.MQTT.Password)
+	viper.SetDefault("mqtt.password_file", defaultConfig.MQTT.PasswordFile)
+	viper.SetDefault("mqtt.qos", defaultConfig.MQTT.QoS)
+	viper.SetDefault("mqtt.topic_template", defaultConfig.MQTT.TopicTemplate)
+	viper.SetDefault("mqtt.topic_columns", defaultConfig.MQTT.TopicColumns)
+	viper.SetDefault("mqtt.shared_group", defaultConfig.MQTT.SharedGroup)
+	viper.SetDefault("mqtt.payload_format", defaultConfig.MQTT.PayloadFormat)
+	viper.SetDefault("mqtt.payload_schema", defaultConfig.MQTT.PayloadSchema)
+	viper.SetDefault("mqtt.csv_columns", defaultConfig.MQTT.CSVColumns)
+	viper.SetDefault("mqtt.timestamp_layouts", defaultConfig.MQTT.TimestampLayouts)
+	viper.SetDefault("mqtt.field_map", defaultConfig.MQTT.FieldMap)
+	viper.SetDefault("mqtt.field_paths", defaultConfig.MQTT.FieldPaths)
+	viper.SetDefault("mqtt.field_scale", defaultConfig.MQTT.FieldScale)
+	viper.SetDefault("mqtt.max_payload_bytes", defaultConfig.MQTT.MaxPayloadBytes)
+	viper.SetDefault("mqtt.hmac_secret", defaultConfig.MQTT.HMACSecret)
+	viper.SetDefault("mqtt.hmac_field", defaultConfig.MQTT.HMACField)
+	viper.SetDefault("mqtt.burst_fields", defaultConfig.MQTT.BurstFields)
+	viper.SetDefault("mqtt.burst_interval_field", defaultConfig.MQTT.BurstIntervalField)
+	viper.SetDefault("mqtt.timestamp_field", defaultConfig.MQTT.TimestampField)
+	viper.SetDefault("mqtt.bool_as_number", defaultConfig.MQTT.BoolAsNumber)
+	viper.SetDefault("mqtt.device_id_field", defaultConfig.MQTT.DeviceIDField)
+	viper.SetDefault("mqtt.protocol_version", defaultConfig.MQTT.ProtocolVersion)
+	viper.SetDefault("mqtt.session_expiry_interval", defaultConfig.MQTT.SessionExpiryInterval)
+	viper.SetDefault("mqtt.clean_session", defaultConfig.MQTT.CleanSession)
+	viper.SetDefault("mqtt.unsubscribe_on_stop", defaultConfig.MQTT.UnsubscribeOnStop)
+	viper.SetDefault("mqtt.store_dir", defaultConfig.MQTT.StoreDir)
+	viper.SetDefault("mqtt.reconnect_initial_interval", defaultConfig.MQTT.ReconnectInitialInterval)
+	viper.SetDefault("mqtt.reconnect_max_interval", defaultConfig.MQTT.ReconnectMaxInterval)
+	viper.SetDefault("mqtt.connect_timeout", defaultConfig.MQTT.ConnectTimeout)
+	viper.SetDefault("mqtt.keep_alive", defaultConfig.MQTT.KeepAlive)
+	viper.SetDefault("mqtt.ping_timeout", defaultConfig.MQTT.PingTimeout)
+	viper.SetDefault("mqtt.will_topic", defaultConfig.MQTT.WillTopic)
+	viper.SetDefault("mqtt.will_payload", defaultConfig.MQTT.WillPayload)
+	viper.SetDefault("mqtt.will_qos", defaultConfig.MQTT.WillQoS)
+	viper.SetDefault("mqtt.will_retained", defaultConfig.MQTT.WillRetained)
+	viper.SetDefault("mqtt.online_payload", defaultConfig.MQTT.OnlinePayload)
+	viper.SetDefault("mqtt.error_topic", defaultConfig.MQTT.ErrorTopic)
+	viper.SetDefault("mqtt.error_qos", defaultConfig.MQTT.ErrorQoS)
+	viper.SetDefault("mqtt.error_rate", defaultConfig.MQTT.ErrorRate)
+	viper.SetDefault("mqtt.error_burst", defaultConfig.MQTT.ErrorBurst)
+	viper.SetDefault("mqtt.tls_ca_file", defaultConfig.MQTT.TLSCAFile)
+	viper.SetDefault("mqtt.tls_cert_file", defaultConfig.MQTT.TLSCertFile)
+	viper.SetDefault("mqtt.tls_key_file", defaultConfig.MQTT.TLSKeyFile)
+	viper.SetDefault("mqtt.tls_insecure_skip_verify", defaultConfig.MQTT.TLSInsecureSkipVerify)
 
 	viper.SetDefault("database.host", defaultConfig.Database.Host)
 	viper.SetDefault("database.port", defaultConfig.Database.Port)
 	viper.SetDefault("database.user", defaultConfig.Database.User)
 	viper.SetDefault("database.password", defaultConfig.Database.Password)
+	viper.SetDefault("database.password_file", defaultConfig.Database.PasswordFile)
 	viper.SetDefault("database.dbname", defaultConfig.Database.DBName)
 	viper.SetDefault("database.sslmode", defaultConfig.Database.SSLMode)
+	viper.SetDefault("database.ssl_root_cert", defaultConfig.Database.SSLRootCert)
+	viper.SetDefault("database.ssl_cert", defaultConfig.Database.SSLCert)
+	viper.SetDefault("database.ssl_key", defaultConfig.Database.SSLKey)
+	viper.SetDefault("database.max_conns", defaultConfig.Database.MaxConns)
+	viper.SetDefault("database.schema", defaultConfig.Database.Schema)
+	viper.SetDefault("database.operation_timeout", defaultConfig.Database.OperationTimeout)
+	viper.SetDefault("database.insert_timeout", defaultConfig.Database.InsertTimeout)
+	viper.SetDefault("database.connect_retries", defaultConfig.Database.ConnectRetries)
+	viper.SetDefault("database.connect_retry_interval", defaultConfig.Database.ConnectRetryInterval)
+	viper.SetDefault("database.max_retries", defaultConfig.Database.MaxRetries)
+	viper.SetDefault("database.retry_initial_interval", defaultConfig.Database.RetryInitialInterval)
+	viper.SetDefault("database.retry_max_interval", defaultConfig.Database.RetryMaxInterval)
 
+	viper.SetDefault("timescale.enabled", defaultConfig.Timescale.Enabled)
 	viper.SetDefault("timescale.table_name", defaultConfig.Timescale.TableName)
+	viper.SetDefault("timescale.batch_size", defaultConfig.Timescale.BatchSize)
+	viper.SetDefault("timescale.flush_interval", defaultConfig.Timescale.FlushInterval)
+	viper.SetDefault("timescale.adaptive_batching", defaultConfig.Timescale.AdaptiveBatching)
+	viper.SetDefault("timescale.min_batch_size", defaultConfig.Timescale.MinBatchSize)
+	viper.SetDefault("timescale.max_batch_size", defaultConfig.Timescale.MaxBatchSize)
+	viper.SetDefault("timescale.target_latency", defaultConfig.Timescale.TargetLatency)
+	viper.SetDefault("timescale.chunk_time_interval", defaultConfig.Timescale.ChunkTimeInterval)
+	viper.SetDefault("timescale.space_partitions", defaultConfig.Timescale.SpacePartitions)
+	viper.SetDefault("timescale.retention", defaultConfig.Timescale.Retention)
+	viper.SetDefault("timescale.compress_after", defaultConfig.Timescale.CompressAfter)
+	viper.SetDefault("timescale.allowed_tables", defaultConfig.Timescale.AllowedTables)
+	viper.SetDefault("timescale.upsert", defaultConfig.Timescale.Upsert)
+	viper.SetDefault("timescale.conflict_columns", defaultConfig.Timescale.ConflictColumns)
+	viper.SetDefault("timescale.time_column", defaultConfig.Timescale.TimeColumn)
+	viper.SetDefault("timescale.tag_columns", defaultConfig.Timescale.TagColumns)
+	viper.SetDefault("timescale.track_ingest_time", defaultConfig.Timescale.TrackIngestTime)
+	viper.SetDefault("timescale.track_retained", defaultConfig.Timescale.TrackRetained)
+	viper.SetDefault("timescale.maintain_latest", defaultConfig.Timescale.MaintainLatest)
+	viper.SetDefault("timescale.latest_table", defaultConfig.Timescale.LatestTable)
+	viper.SetDefault("timescale.store_timezone", defaultConfig.Timescale.StoreTimezone)
+	viper.SetDefault("timescale.continuous_aggregate.enabled", defaultConfig.Timescale.ContinuousAggregate.Enabled)
+	viper.SetDefault("timescale.continuous_aggregate.bucket_width", defaultConfig.Timescale.ContinuousAggregate.BucketWidth)
+	viper.SetDefault("timescale.continuous_aggregate.start_offset", defaultConfig.Timescale.ContinuousAggregate.StartOffset)
+	viper.SetDefault("timescale.continuous_aggregate.end_offset", defaultConfig.Timescale.ContinuousAggregate.EndOffset)
+	viper.SetDefault("timescale.continuous_aggregate.schedule_interval", defaultConfig.Timescale.ContinuousAggregate.ScheduleInterval)
+
+	viper.SetDefault("metrics.port", defaultConfig.Metrics.Port)
+
+	viper.SetDefault("otel.endpoint", defaultConfig.OTel.Endpoint)
+	viper.SetDefault("otel.insecure", defaultConfig.OTel.Insecure)
+	viper.SetDefault("otel.service_name", defaultConfig.OTel.ServiceName)
+	viper.SetDefault("otel.sample_ratio", defaultConfig.OTel.SampleRatio)
+
+	viper.SetDefault("http.port", defaultConfig.HTTP.Port)
+	viper.SetDefault("http.enable_api", defaultConfig.HTTP.EnableAPI)
+
+	viper.SetDefault("logging.level", defaultConfig.Logging.Level)
+	viper.SetDefault("logging.format", defaultConfig.Logging.Format)
+	viper.SetDefault("logging.repeat_interval", defaultConfig.Logging.RepeatInterval)
+	viper.SetDefault("logging.verbose_inserts", defaultConfig.Logging.VerboseInserts)
+
+	viper.SetDefault("deadletter.file", defaultConfig.DeadLetter.File)
+	viper.SetDefault("deadletter.topic", defaultConfig.DeadLetter.Topic)
+
+	viper.SetDefault("status.enabled", defaultConfig.Status.Enabled)
+	viper.SetDefault("status.device_topic", defaultConfig.Status.DeviceTopic)
+	viper.SetDefault("status.qos", defaultConfig.Status.QoS)
+	viper.SetDefault("status.heartbeat_topic", defaultConfig.Status.HeartbeatTopic)
+	viper.SetDefault("status.heartbeat_interval", defaultConfig.Status.HeartbeatInterval)
+
+	viper.SetDefault("spool.dir", defaultConfig.Spool.Dir)
+	viper.SetDefault("spool.max_size_mb", defaultConfig.Spool.MaxSizeMB)
+	viper.SetDefault("spool.replay_interval", defaultConfig.Spool.ReplayInterval)
+
+	viper.SetDefault("sink.type", defaultConfig.Sink.Type)
+	viper.SetDefault("sink.file.path", defaultConfig.Sink.File.Path)
+	viper.SetDefault("sink.file.max_size_mb", defaultConfig.Sink.File.MaxSizeMB)
+	viper.SetDefault("sink.file.max_backups", defaultConfig.Sink.File.MaxBackups)
+
+	viper.SetDefault("devices.table", defaultConfig.Devices.Table)
+	viper.SetDefault("devices.refresh_interval", defaultConfig.Devices.RefreshInterval)
+
+	viper.SetDefault("ingest.per_device_rate", defaultConfig.Ingest.PerDeviceRate)
+	viper.SetDefault("ingest.per_device_burst", defaultConfig.Ingest.PerDeviceBurst)
+	viper.SetDefault("ingest.device_ttl", defaultConfig.Ingest.DeviceTTL)
+	viper.SetDefault("ingest.dedup_window", defaultConfig.Ingest.DedupWindow)
+	viper.SetDefault("ingest.dedup_max_entries", defaultConfig.Ingest.DedupMaxEntries)
+	viper.SetDefault("ingest.queue_size", defaultConfig.Ingest.QueueSize)
+	viper.SetDefault("ingest.overflow_policy", defaultConfig.Ingest.OverflowPolicy)
+	viper.SetDefault("ingest.workers", defaultConfig.Ingest.Workers)
+	viper.SetDefault("ingest.order_by_device", defaultConfig.Ingest.OrderByDevice)
+	viper.SetDefault("ingest.dry_run", defaultConfig.Ingest.DryRun)
+	viper.SetDefault("ingest.warn_unknown_fields", defaultConfig.Ingest.WarnUnknownFields)
+
+	viper.SetDefault("validation.mode", defaultConfig.Validation.Mode)
+
+	viper.SetDefault("alert.webhook_url", defaultConfig.Alert.WebhookURL)
+	viper.SetDefault("alert.threshold", defaultConfig.Alert.Threshold)
+	viper.SetDefault("alert.window", defaultConfig.Alert.Window)
+
+	viper.SetDefault("shutdown_timeout", defaultConfig.ShutdownTimeout)
 
 	// Try to load from config file (medium precedence)
 	viper.AddConfigPath(path)
 	viper.SetConfigName("config")
 	viper.SetConfigType("yaml")
 
-	// Set up environment variable support (highest precedence)
+	// Set up environment variable support (high precedence)
 	viper.SetEnvPrefix("") // No prefix
 	// Keep backward compatibility with MQTT_BROKER_URL
 	viper.BindEnv("mqtt.broker", "MQTT_BROKER_URL")
@@ -79,29 +656,190 @@ func LoadConfig(path string) (*Config, error) {
 	// MQTT configuration
 	viper.BindEnv("mqtt.broker", "MQTT_BROKER")
 	viper.BindEnv("mqtt.port", "MQTT_PORT")
+	viper.BindEnv("mqtt.ws_path", "MQTT_WS_PATH")
 	viper.BindEnv("mqtt.client_id", "MQTT_CLIENT_ID")
+	viper.BindEnv("mqtt.client_id_append_hostname", "MQTT_CLIENT_ID_APPEND_HOSTNAME")
+	viper.BindEnv("mqtt.client_id_append_random", "MQTT_CLIENT_ID_APPEND_RANDOM")
 	viper.BindEnv("mqtt.topic", "MQTT_TOPIC")
 	viper.BindEnv("mqtt.username", "MQTT_USERNAME")
 	viper.BindEnv("mqtt.password", "MQTT_PASSWORD")
+	viper.BindEnv("mqtt.password_file", "MQTT_PASSWORD_FILE")
+	viper.BindEnv("mqtt.qos", "MQTT_QOS")
+	viper.BindEnv("mqtt.topic_template", "MQTT_TOPIC_TEMPLATE")
+	viper.BindEnv("mqtt.topic_columns", "MQTT_TOPIC_COLUMNS")
+	viper.BindEnv("mqtt.shared_group", "MQTT_SHARED_GROUP")
+	viper.BindEnv("mqtt.payload_format", "MQTT_PAYLOAD_FORMAT")
+	viper.BindEnv("mqtt.payload_schema", "MQTT_PAYLOAD_SCHEMA")
+	viper.BindEnv("mqtt.csv_columns", "MQTT_CSV_COLUMNS")
+	viper.BindEnv("mqtt.timestamp_layouts", "MQTT_TIMESTAMP_LAYOUTS")
+	viper.BindEnv("mqtt.timestamp_field", "MQTT_TIMESTAMP_FIELD")
+	viper.BindEnv("mqtt.bool_as_number", "MQTT_BOOL_AS_NUMBER")
+	viper.BindEnv("mqtt.device_id_field", "MQTT_DEVICE_ID_FIELD")
+	viper.BindEnv("mqtt.max_payload_bytes", "MQTT_MAX_PAYLOAD_BYTES")
+	viper.BindEnv("mqtt.hmac_secret", "MQTT_HMAC_SECRET")
+	viper.BindEnv("mqtt.hmac_field", "MQTT_HMAC_FIELD")
+	viper.BindEnv("mqtt.burst_fields", "MQTT_BURST_FIELDS")
+	viper.BindEnv("mqtt.burst_interval_field", "MQTT_BURST_INTERVAL_FIELD")
+	viper.BindEnv("mqtt.protocol_version", "MQTT_PROTOCOL_VERSION")
+	viper.BindEnv("mqtt.session_expiry_interval", "MQTT_SESSION_EXPIRY_INTERVAL")
+	viper.BindEnv("mqtt.clean_session", "MQTT_CLEAN_SESSION")
+	viper.BindEnv("mqtt.unsubscribe_on_stop", "MQTT_UNSUBSCRIBE_ON_STOP")
+	viper.BindEnv("mqtt.store_dir", "MQTT_STORE_DIR")
+	viper.BindEnv("mqtt.reconnect_initial_interval", "MQTT_RECONNECT_INITIAL_INTERVAL")
+	viper.BindEnv("mqtt.reconnect_max_interval", "MQTT_RECONNECT_MAX_INTERVAL")
+	viper.BindEnv("mqtt.connect_timeout", "MQTT_CONNECT_TIMEOUT")
+	viper.BindEnv("mqtt.keep_alive", "MQTT_KEEP_ALIVE")
+	viper.BindEnv("mqtt.ping_timeout", "MQTT_PING_TIMEOUT")
+	viper.BindEnv("mqtt.will_topic", "MQTT_WILL_TOPIC")
+	viper.BindEnv("mqtt.will_payload", "MQTT_WILL_PAYLOAD")
+	viper.BindEnv("mqtt.will_qos", "MQTT_WILL_QOS")
+	viper.BindEnv("mqtt.will_retained", "MQTT_WILL_RETAINED")
+	viper.BindEnv("mqtt.online_payload", "MQTT_ONLINE_PAYLOAD")
+	viper.BindEnv("mqtt.error_topic", "MQTT_ERROR_TOPIC")
+	viper.BindEnv("mqtt.error_qos", "MQTT_ERROR_QOS")
+	viper.BindEnv("mqtt.error_rate", "MQTT_ERROR_RATE")
+	viper.BindEnv("mqtt.error_burst", "MQTT_ERROR_BURST")
+	viper.BindEnv("mqtt.tls_ca_file", "MQTT_TLS_CA_FILE")
+	viper.BindEnv("mqtt.tls_cert_file", "MQTT_TLS_CERT_FILE")
+	viper.BindEnv("mqtt.tls_key_file", "MQTT_TLS_KEY_FILE")
+	viper.BindEnv("mqtt.tls_insecure_skip_verify", "MQTT_TLS_INSECURE_SKIP_VERIFY")
 
 	// Database configuration
 	viper.BindEnv("database.host", "DATABASE_HOST")
 	viper.BindEnv("database.port", "DATABASE_PORT")
 	viper.BindEnv("database.user", "DATABASE_USER")
 	viper.BindEnv("database.password", "DATABASE_PASSWORD")
+	viper.BindEnv("database.password_file", "DATABASE_PASSWORD_FILE")
 	viper.BindEnv("database.dbname", "DATABASE_DBNAME")
 	viper.BindEnv("database.sslmode", "DATABASE_SSLMODE")
+	viper.BindEnv("database.ssl_root_cert", "DATABASE_SSL_ROOT_CERT")
+	viper.BindEnv("database.ssl_cert", "DATABASE_SSL_CERT")
+	viper.BindEnv("database.ssl_key", "DATABASE_SSL_KEY")
+	viper.BindEnv("database.max_conns", "DATABASE_MAX_CONNS")
+	viper.BindEnv("database.schema", "DATABASE_SCHEMA")
+	viper.BindEnv("database.operation_timeout", "DATABASE_OPERATION_TIMEOUT")
+	viper.BindEnv("database.insert_timeout", "DATABASE_INSERT_TIMEOUT")
+	viper.BindEnv("database.connect_retries", "DATABASE_CONNECT_RETRIES")
+	viper.BindEnv("database.connect_retry_interval", "DATABASE_CONNECT_RETRY_INTERVAL")
+	viper.BindEnv("database.max_retries", "DATABASE_MAX_RETRIES")
+	viper.BindEnv("database.retry_initial_interval", "DATABASE_RETRY_INITIAL_INTERVAL")
+	viper.BindEnv("database.retry_max_interval", "DATABASE_RETRY_MAX_INTERVAL")
 
 	// Timescale configuration
+	viper.BindEnv("timescale.enabled", "TIMESCALE_ENABLED")
 	viper.BindEnv("timescale.table_name", "TIMESCALE_TABLE_NAME")
+	viper.BindEnv("timescale.batch_size", "TIMESCALE_BATCH_SIZE")
+	viper.BindEnv("timescale.flush_interval", "TIMESCALE_FLUSH_INTERVAL")
+	viper.BindEnv("timescale.adaptive_batching", "TIMESCALE_ADAPTIVE_BATCHING")
+	viper.BindEnv("timescale.min_batch_size", "TIMESCALE_MIN_BATCH_SIZE")
+	viper.BindEnv("timescale.max_batch_size", "TIMESCALE_MAX_BATCH_SIZE")
+	viper.BindEnv("timescale.target_latency", "TIMESCALE_TARGET_LATENCY")
+	viper.BindEnv("timescale.chunk_time_interval", "TIMESCALE_CHUNK_TIME_INTERVAL")
+	viper.BindEnv("timescale.space_partitions", "TIMESCALE_SPACE_PARTITIONS")
+	viper.BindEnv("timescale.retention", "TIMESCALE_RETENTION")
+	viper.BindEnv("timescale.compress_after", "TIMESCALE_COMPRESS_AFTER")
+	viper.BindEnv("timescale.allowed_tables", "TIMESCALE_ALLOWED_TABLES")
+	viper.BindEnv("timescale.upsert", "TIMESCALE_UPSERT")
+	viper.BindEnv("timescale.conflict_columns", "TIMESCALE_CONFLICT_COLUMNS")
+	viper.BindEnv("timescale.time_column", "TIMESCALE_TIME_COLUMN")
+	viper.BindEnv("timescale.tag_columns", "TIMESCALE_TAG_COLUMNS")
+	viper.BindEnv("timescale.track_ingest_time", "TIMESCALE_TRACK_INGEST_TIME")
+	viper.BindEnv("timescale.track_retained", "TIMESCALE_TRACK_RETAINED")
+	viper.BindEnv("timescale.maintain_latest", "TIMESCALE_MAINTAIN_LATEST")
+	viper.BindEnv("timescale.latest_table", "TIMESCALE_LATEST_TABLE")
+	viper.BindEnv("timescale.store_timezone", "TIMESCALE_STORE_TIMEZONE")
+	viper.BindEnv("timescale.continuous_aggregate.enabled", "TIMESCALE_CONTINUOUS_AGGREGATE_ENABLED")
+	viper.BindEnv("timescale.continuous_aggregate.bucket_width", "TIMESCALE_CONTINUOUS_AGGREGATE_BUCKET_WIDTH")
+	viper.BindEnv("timescale.continuous_aggregate.start_offset", "TIMESCALE_CONTINUOUS_AGGREGATE_START_OFFSET")
+	viper.BindEnv("timescale.continuous_aggregate.end_offset", "TIMESCALE_CONTINUOUS_AGGREGATE_END_OFFSET")
+	viper.BindEnv("timescale.continuous_aggregate.schedule_interval", "TIMESCALE_CONTINUOUS_AGGREGATE_SCHEDULE_INTERVAL")
+
+	// Metrics configuration
+	viper.BindEnv("metrics.port", "METRICS_PORT")
+
+	// OpenTelemetry configuration
+	viper.BindEnv("otel.endpoint", "OTEL_ENDPOINT")
+	viper.BindEnv("otel.insecure", "OTEL_INSECURE")
+	viper.BindEnv("otel.service_name", "OTEL_SERVICE_NAME")
+	viper.BindEnv("otel.sample_ratio", "OTEL_SAMPLE_RATIO")
+
+	// HTTP configuration
+	viper.BindEnv("http.port", "HTTP_PORT")
+	viper.BindEnv("http.enable_api", "HTTP_ENABLE_API")
+
+	// Logging configuration
+	viper.BindEnv("logging.level", "LOGGING_LEVEL")
+	viper.BindEnv("logging.format", "LOGGING_FORMAT")
+	viper.BindEnv("logging.repeat_interval", "LOGGING_REPEAT_INTERVAL")
+	viper.BindEnv("logging.verbose_inserts", "LOGGING_VERBOSE_INSERTS")
+
+	// Dead-letter configuration
+	viper.BindEnv("deadletter.file", "DEADLETTER_FILE")
+	viper.BindEnv("deadletter.topic", "DEADLETTER_TOPIC")
+
+	// Status configuration
+	viper.BindEnv("status.enabled", "STATUS_ENABLED")
+	viper.BindEnv("status.device_topic", "STATUS_DEVICE_TOPIC")
+	viper.BindEnv("status.qos", "STATUS_QOS")
+	viper.BindEnv("status.heartbeat_topic", "STATUS_HEARTBEAT_TOPIC")
+	viper.BindEnv("status.heartbeat_interval", "STATUS_HEARTBEAT_INTERVAL")
+
+	// Spool configuration
+	viper.BindEnv("spool.dir", "SPOOL_DIR")
+	viper.BindEnv("spool.max_size_mb", "SPOOL_MAX_SIZE_MB")
+	viper.BindEnv("spool.replay_interval", "SPOOL_REPLAY_INTERVAL")
+
+	// Sink configuration
+	viper.BindEnv("sink.type", "SINK_TYPE")
+	viper.BindEnv("sink.file.path", "SINK_FILE_PATH")
+	viper.BindEnv("sink.file.max_size_mb", "SINK_FILE_MAX_SIZE_MB")
+	viper.BindEnv("sink.file.max_backups", "SINK_FILE_MAX_BACKUPS")
+
+	// Device metadata configuration
+	viper.BindEnv("devices.table", "DEVICES_TABLE")
+	viper.BindEnv("devices.refresh_interval", "DEVICES_REFRESH_INTERVAL")
+
+	// Ingest configuration
+	viper.BindEnv("ingest.per_device_rate", "INGEST_PER_DEVICE_RATE")
+	viper.BindEnv("ingest.per_device_burst", "INGEST_PER_DEVICE_BURST")
+	viper.BindEnv("ingest.device_ttl", "INGEST_DEVICE_TTL")
+	viper.BindEnv("ingest.dedup_window", "INGEST_DEDUP_WINDOW")
+	viper.BindEnv("ingest.dedup_max_entries", "INGEST_DEDUP_MAX_ENTRIES")
+	viper.BindEnv("ingest.queue_size", "INGEST_QUEUE_SIZE")
+	viper.BindEnv("ingest.overflow_policy", "INGEST_OVERFLOW_POLICY")
+	viper.BindEnv("ingest.workers", "INGEST_WORKERS")
+	viper.BindEnv("ingest.order_by_device", "INGEST_ORDER_BY_DEVICE")
+	viper.BindEnv("ingest.dry_run", "INGEST_DRY_RUN")
+	viper.BindEnv("ingest.warn_unknown_fields", "INGEST_WARN_UNKNOWN_FIELDS")
+
+	// Validation configuration
+	viper.BindEnv("validation.mode", "VALIDATION_MODE")
+	viper.BindEnv("validation.temperature.min", "VALIDATION_TEMPERATURE_MIN")
+	viper.BindEnv("validation.temperature.max", "VALIDATION_TEMPERATURE_MAX")
+	viper.BindEnv("validation.humidity.min", "VALIDATION_HUMIDITY_MIN")
+	viper.BindEnv("validation.humidity.max", "VALIDATION_HUMIDITY_MAX")
+	viper.BindEnv("validation.light.min", "VALIDATION_LIGHT_MIN")
+	viper.BindEnv("validation.light.max", "VALIDATION_LIGHT_MAX")
+
+	// Alert configuration
+	viper.BindEnv("alert.webhook_url", "ALERT_WEBHOOK_URL")
+	viper.BindEnv("alert.threshold", "ALERT_THRESHOLD")
+	viper.BindEnv("alert.window", "ALERT_WINDOW")
+
+	viper.BindEnv("shutdown_timeout", "SHUTDOWN_TIMEOUT")
+
+	// Command line flags override everything else
+	if err := bindFlags(flags); err != nil {
+		return nil, err
+	}
 
 	// Try to read config file, but don't fail if it doesn't exist
 	if err := viper.ReadInConfig(); err != nil {
 		if _, ok := err.(viper.ConfigFileNotFoundError); !ok {
 			// Config file was found but another error was produced
-			log.Printf("Warning: error reading config file: %v", err)
+			slog.Warn("Error reading config file", "error", err)
 		} else {
-			log.Println("No config file found, using environment variables and defaults")
+			slog.Info("No config file found, using environment variables and defaults")
 		}
 		// We'll continue with environment variables and defaults
 	}
@@ -111,19 +849,79 @@ func LoadConfig(path string) (*Config, error) {
 		return nil, fmt.Errorf("unable to decode config into struct: %w", err)
 	}
 
+	if err := readPasswordFile(&config.MQTT.Password, config.MQTT.PasswordFile); err != nil {
+		return nil, err
+	}
+	if err := readPasswordFile(&config.Database.Password, config.Database.PasswordFile); err != nil {
+		return nil, err
+	}
+
+	pipelines, err := loadPipelines()
+	if err != nil {
+		return nil, err
+	}
+	config.pipelines = pipelines
+
 	return &config, nil
 }
 
+// readPasswordFile replaces password with the contents of path, without
+// trailing newlines, when path is set
+func readPasswordFile(password *string, path string) error {
+	if path == "" {
+		return nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read password file: %w", err)
+	}
+	*password = strings.TrimRight(string(data), "\r\n")
+	return nil
+}
+
 // GetDefaultConfig returns default configuration
 func GetDefaultConfig() *Config {
 	return &Config{
 		MQTT: MQTTConfig{
-			Broker:   "https://mqtt.ponytojas.dev", // Updated default
-			Port:     8883,                         // Updated default port for TLS
+			Brokers:  []string{"https://mqtt.ponytojas.dev"}, // Updated default
+			Port:     0,                                      // Default port of each broker's scheme
 			ClientID: "go-mqtt-client",
 			Topic:    "sensor/#",
 			Username: "",
 			Password: "",
+			QoS:      0,
+
+			ProtocolVersion:  3,
+			PayloadFormat:    "json",
+			CSVColumns:       []string{"device_id", "temperature", "humidity", "light", "timestamp"},
+			TimestampLayouts: []string{time.RFC3339, time.RFC3339Nano},
+			TimestampField:   "timestamp",
+			DeviceIDField:    "device_id",
+			CleanSession:     false,
+
+			UnsubscribeOnStop: true,
+
+			BurstIntervalField: "interval_ms",
+			MaxPayloadBytes:    1 << 20,
+			HMACField:          "hmac",
+
+			ReconnectInitialInterval: 2 * time.Second,
+			ReconnectMaxInterval:     10 * time.Minute,
+			ConnectTimeout:           30 * time.Second,
+
+			KeepAlive:   30 * time.Second,
+			PingTimeout: 10 * time.Second,
+
+			WillTopic:     "",
+			WillPayload:   "offline",
+			WillQoS:       1,
+			WillRetained:  true,
+			OnlinePayload: "online",
+
+			ErrorTopic: "",
+			ErrorQoS:   1,
+			ErrorRate:  1,
+			ErrorBurst: 10,
 		},
 		Database: DatabaseConfig{
 			Host:     "localhost",
@@ -132,67 +930,271 @@ func GetDefaultConfig() *Config {
 			Password: "postgres",
 			DBName:   "iot_data",
 			SSLMode:  "disable",
+			MaxConns: 10,
+			Schema:   "public",
+
+			OperationTimeout: 10 * time.Second,
+			InsertTimeout:    30 * time.Second,
+
+			ConnectRetries:       10,
+			ConnectRetryInterval: time.Second,
+
+			MaxRetries:           5,
+			RetryInitialInterval: 100 * time.Millisecond,
+			RetryMaxInterval:     5 * time.Second,
 		},
 		Timescale: TimescaleConfig{
-			TableName: "sensor_data",
+			Enabled:         true,
+			TableName:       "sensor_data",
+			TimeColumn:      "time",
+			BatchSize:       100,
+			FlushInterval:   time.Second,
+			ConflictColumns: []string{"device_id", "time"},
+			StoreTimezone:   "UTC",
+			LatestTable:     "device_latest",
+
+			AdaptiveBatching: false,
+			MinBatchSize:     10,
+			MaxBatchSize:     5000,
+			TargetLatency:    200 * time.Millisecond,
+
+			ContinuousAggregate: ContinuousAggregateConfig{
+				BucketWidth:      time.Hour,
+				StartOffset:      72 * time.Hour,
+				EndOffset:        time.Hour,
+				ScheduleInterval: time.Hour,
+			},
+		},
+		Metrics: MetricsConfig{
+			Port: 2112,
+		},
+		OTel: OTelConfig{
+			ServiceName: "go-mqtt-timescale",
+			SampleRatio: 1,
+		},
+		HTTP: HTTPConfig{
+			Port: 8080,
 		},
+		Logging: LoggingConfig{
+			Level:          "info",
+			Format:         "text",
+			RepeatInterval: time.Minute,
+		},
+		Status: StatusConfig{
+			DeviceTopic:    "status/{device_id}",
+			HeartbeatTopic: "status/heartbeat",
+		},
+		Spool: SpoolConfig{
+			MaxSizeMB:      100,
+			ReplayInterval: 10 * time.Second,
+		},
+		Sink: SinkConfig{
+			Type: "timescale",
+			File: FileSinkConfig{
+				Path:       "readings.jsonl",
+				MaxSizeMB:  100,
+				MaxBackups: 5,
+			},
+		},
+		Devices: DevicesConfig{
+			RefreshInterval: 5 * time.Minute,
+		},
+		Ingest: IngestConfig{
+			PerDeviceBurst:  10,
+			DeviceTTL:       5 * time.Minute,
+			DedupMaxEntries: 100000,
+			QueueSize:       10000,
+			OverflowPolicy:  "block",
+		},
+		Validation: ValidationConfig{
+			Mode: "reject",
+		},
+		Alert: AlertConfig{
+			Threshold: 5,
+			Window:    time.Minute,
+		},
+		ShutdownTimeout: 10 * time.Second,
 	}
 }
 
+// GetSubscriptions returns the configured subscriptions, falling back to the
+// single mqtt.topic setting. Entries without a table use the default table.
+func (c *Config) GetSubscriptions() []SubscriptionConfig {
+	if len(c.MQTT.Subscriptions) == 0 {
+		return []SubscriptionConfig{{
+			Topic: c.MQTT.Topic,
+			QoS:   c.MQTT.QoS,
+			Table: c.Timescale.TableName,
+		}}
+	}
+
+	subs := make([]SubscriptionConfig, len(c.MQTT.Subscriptions))
+	for i, sub := range c.MQTT.Subscriptions {
+		if sub.Table == "" {
+			sub.Table = c.Timescale.TableName
+		}
+		subs[i] = sub
+	}
+	return subs
+}
+
+// GetTableNames returns the default table and every distinct table referenced
+// by a subscription or allowed as a payload override
+func (c *Config) GetTableNames() []string {
+	tables := []string{c.Timescale.TableName}
+	seen := map[string]bool{c.Timescale.TableName: true}
+	for _, sub := range c.GetSubscriptions() {
+		if !seen[sub.Table] {
+			seen[sub.Table] = true
+			tables = append(tables, sub.Table)
+		}
+	}
+	for _, table := range c.Timescale.AllowedTables {
+		if !seen[table] {
+			seen[table] = true
+			tables = append(tables, table)
+		}
+	}
+	return tables
+}
+
+// IsAllowedTable reports whether a payload may direct its reading to table
+func (c *Config) IsAllowedTable(table string) bool {
+	for _, allowed := range c.Timescale.AllowedTables {
+		if table == allowed {
+			return true
+		}
+	}
+	return false
+}
+
 // GetDBConnString returns the database connection string
 func (c *Config) GetDBConnString() string {
 	// log the URI
-	log.Printf("Connecting to database at 'host=%s port=%d user=%s dbname=%s sslmode=%s'",
-		c.Database.Host,
-		c.Database.Port,
-		c.Database.User,
-		c.Database.DBName,
-		c.Database.SSLMode,
+	slog.Info("Connecting to database",
+		"host", c.Database.Host,
+		"port", c.Database.Port,
+		"user", c.Database.User,
+		"dbname", c.Database.DBName,
+		"sslmode", c.Database.SSLMode,
 	)
-	return fmt.Sprintf("host=%s port=%d user=%s password=%s dbname=%s sslmode=%s",
-		c.Database.Host,
+	connString := fmt.Sprintf("host=%s port=%d user=%s password=%s dbname=%s sslmode=%s",
+		connValue(c.Database.Host),
 		c.Database.Port,
-		c.Database.User,
-		c.Database.Password,
-		c.Database.DBName,
-		c.Database.SSLMode,
+		connValue(c.Database.User),
+		connValue(c.Database.Password),
+		connValue(c.Database.DBName),
+		connValue(c.Database.SSLMode),
 	)
+	for _, param := range []struct{ key, value string }{
+		{"sslrootcert", c.Database.SSLRootCert},
+		{"sslcert", c.Database.SSLCert},
+		{"sslkey", c.Database.SSLKey},
+	} {
+		if param.value != "" {
+			connString += " " + param.key + "=" + connValue(param.value)
+		}
+	}
+	return connString
+}
+
+// connValue quotes a connection string value, so values such as passwords
+// and file paths may hold spaces and quotes
+func connValue(value string) string {
+	value = strings.ReplaceAll(value, `\`, `\\`)
+	value = strings.ReplaceAll(value, `'`, `\'`)
+	return "'" + value + "'"
 }
 
-// GetMQTTBrokerURL returns the MQTT broker URL
+// GetMQTTBrokerURL returns the URL of the first MQTT broker
 func (c *Config) GetMQTTBrokerURL() string {
-	brokerURL := c.MQTT.Broker
-
-	// If the URL already has a protocol, use it as is
-	if strings.HasPrefix(brokerURL, "tcp://") ||
-		strings.HasPrefix(brokerURL, "ssl://") ||
-		strings.HasPrefix(brokerURL, "ws://") ||
-		strings.HasPrefix(brokerURL, "wss://") {
-		// If there's no port in the URL, add the default port
-		if !strings.Contains(brokerURL[6:], ":") {
-			brokerURL = fmt.Sprintf("%s:%d", brokerURL, c.MQTT.Port)
-		}
-		return brokerURL
+	if len(c.MQTT.Brokers) == 0 {
+		return ""
 	}
+	return c.brokerURL(c.MQTT.Brokers[0])
+}
 
-	// Handle http:// and https:// protocols by converting to mqtt protocols
-	if strings.HasPrefix(brokerURL, "http://") {
-		host := brokerURL[7:]
-		if !strings.Contains(host, ":") {
-			host = fmt.Sprintf("%s:%d", host, c.MQTT.Port)
-		}
-		return fmt.Sprintf("tcp://%s", host)
+// GetMQTTBrokerURLs returns the URLs of every MQTT broker in failover order
+func (c *Config) GetMQTTBrokerURLs() []string {
+	urls := make([]string, len(c.MQTT.Brokers))
+	for i, broker := range c.MQTT.Brokers {
+		urls[i] = c.brokerURL(broker)
+	}
+	return urls
+}
+
+// GetRedactedMQTTBrokerURLs returns the broker URLs with any embedded
+// password masked, for logging
+func (c *Config) GetRedactedMQTTBrokerURLs() []string {
+	urls := c.GetMQTTBrokerURLs()
+	for i, u := range urls {
+		urls[i] = redactURL(u)
 	}
+	return urls
+}
 
-	if strings.HasPrefix(brokerURL, "https://") {
-		host := brokerURL[8:]
-		if !strings.Contains(host, ":") {
-			host = fmt.Sprintf("%s:%d", host, c.MQTT.Port)
+// redactURL masks the password of a URL with embedded credentials. Strings
+// that don't parse have everything before the last @ masked instead.
+func redactURL(raw string) string {
+	// Without a scheme "user:pass@host" parses as an opaque URL
+	u, err := url.Parse(raw)
+	if err == nil && u.Opaque == "" {
+		return u.Redacted()
+	}
+	if at := strings.LastIndex(raw, "@"); at >= 0 {
+		start := 0
+		if i := strings.Index(raw, "://"); i >= 0 && i < at {
+			start = i + len("://")
 		}
-		return fmt.Sprintf("ssl://%s", host)
+		return raw[:start] + "xxxxx" + raw[at:]
+	}
+	return raw
+}
+
+// defaultPorts are the ports brokers listen on by default for each scheme
+var defaultPorts = map[string]int{
+	"tcp": 1883,
+	"ssl": 8883,
+	"ws":  80,
+	"wss": 443,
+}
+
+// brokerURL normalizes a broker address into a URL paho understands. http
+// and https are converted to tcp and ssl, and addresses without a scheme use
+// tcp. When the address has no port the configured port is added, or the
+// scheme's default port when none is configured. The path of a ws or wss URL
+// is kept, or set to ws_path when it has none.
+func (c *Config) brokerURL(broker string) string {
+	brokerURL := strings.TrimSpace(broker)
+
+	scheme, rest, ok := strings.Cut(brokerURL, "://")
+	if !ok {
+		slog.Warn("No protocol specified in broker URL, defaulting to tcp://", "broker", redactURL(brokerURL))
+		scheme, rest = "tcp", brokerURL
+	}
+	switch scheme {
+	case "http":
+		scheme = "tcp"
+	case "https":
+		scheme = "ssl"
+	case "tcp", "ssl", "ws", "wss":
+	default:
+		return brokerURL
 	}
 
-	// If no protocol is specified, use tcp:// with the configured port
-	log.Printf("No protocol specified in broker URL '%s', defaulting to tcp://", brokerURL)
-	return fmt.Sprintf("tcp://%s:%d", brokerURL, c.MQTT.Port)
+	u, err := url.Parse(scheme + "://" + rest)
+	if err != nil {
+		return scheme + "://" + rest
+	}
+	if u.Port() == "" {
+		port := c.MQTT.Port
+		if port == 0 {
+			port = defaultPorts[scheme]
+		}
+		u.Host = net.JoinHostPort(u.Hostname(), strconv.Itoa(port))
+	}
+	if (scheme == "ws" || scheme == "wss") && (u.Path == "" || u.Path == "/") && c.MQTT.WSPath != "" {
+		u.Path = "/" + strings.TrimPrefix(c.MQTT.WSPath, "/")
+	}
+	return u.String()
 }
@@ -0,0 +1,97 @@
+package config
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+	"gopkg.in/yaml.v3"
+)
+
+// flagKeys maps command line flags to the configuration keys they override
+var flagKeys = map[string]string{
+	"broker":  "mqtt.broker",
+	"topic":   "mqtt.topic",
+	"table":   "timescale.table_name",
+	"dry-run": "ingest.dry_run",
+}
+
+// NewFlagSet returns the command line flags. Flags take precedence over
+// environment variables and the config file.
+func NewFlagSet(name string) *pflag.FlagSet {
+	flags := pflag.NewFlagSet(name, pflag.ExitOnError)
+	flags.String("config", "", "path to the config file (default ./config.yaml)")
+	flags.StringSlice("broker", nil, "MQTT broker URL, may be repeated or comma-separated")
+	flags.String("topic", "", "MQTT topic to subscribe to")
+	flags.String("table", "", "table to store sensor data in")
+	flags.Bool("dry-run", false, "parse and validate messages without inserting them")
+	flags.Bool("print-config", false, "print the effective configuration and exit")
+	return flags
+}
+
+// NewImportFlagSet returns the flags of the import command. The shared
+// flags override the same configuration keys as the service's flags.
+func NewImportFlagSet(name string) *pflag.FlagSet {
+	flags := pflag.NewFlagSet(name, pflag.ExitOnError)
+	flags.String("config", "", "path to the config file (default ./config.yaml)")
+	flags.String("file", "", "file of readings to import, one payload per line")
+	flags.String("table", "", "table to store sensor data in")
+	flags.String("topic", "", "topic the readings are treated as received on, for topic templates")
+	return flags
+}
+
+// bindFlags binds the flags that were set to their configuration keys and
+// points viper at the --config file when one is given
+func bindFlags(flags *pflag.FlagSet) error {
+	if flags == nil {
+		return nil
+	}
+	if path, _ := flags.GetString("config"); path != "" {
+		viper.SetConfigFile(path)
+	}
+	for name, key := range flagKeys {
+		if flag := flags.Lookup(name); flag != nil {
+			if err := viper.BindPFlag(key, flag); err != nil {
+				return fmt.Errorf("failed to bind --%s flag: %w", name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// PrintEffective writes the effective configuration, after defaults, the
+// config file, environment variables and flags are merged, as YAML.
+// Passwords and secrets are masked.
+func PrintEffective(w io.Writer) error {
+	settings := viper.AllSettings()
+	redactPasswords(settings)
+
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(2)
+	if err := enc.Encode(settings); err != nil {
+		return fmt.Errorf("failed to encode config: %w", err)
+	}
+	return enc.Close()
+}
+
+// redactPasswords masks every non-empty password, secret and webhook URL
+// in the nested settings
+func redactPasswords(settings map[string]interface{}) {
+	for key, value := range settings {
+		switch v := value.(type) {
+		case map[string]interface{}:
+			redactPasswords(v)
+		case []interface{}:
+			for _, item := range v {
+				if m, ok := item.(map[string]interface{}); ok {
+					redactPasswords(m)
+				}
+			}
+		case string:
+			if (key == "password" || key == "hmac_secret" || key == "webhook_url") && v != "" {
+				settings[key] = "********"
+			}
+		}
+	}
+}
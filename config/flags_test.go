@@ -0,0 +1,95 @@
+package config
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestFlagPrecedence(t *testing.T) {
+	tests := []struct {
+		name string
+		yaml string
+		env  string
+		args []string
+		want string
+	}{
+		{"default", "", "", nil, GetDefaultConfig().MQTT.Topic},
+		{"file over default", "mqtt:\n  topic: file/#\n", "", nil, "file/#"},
+		{"env over file", "mqtt:\n  topic: file/#\n", "env/#", nil, "env/#"},
+		{"flag over env", "mqtt:\n  topic: file/#\n", "env/#", []string{"--topic", "flag/#"}, "flag/#"},
+		{"unset flag keeps env", "", "env/#", []string{"--table", "readings"}, "env/#"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.env != "" {
+				t.Setenv("MQTT_TOPIC", tt.env)
+			}
+			cfg, err := loadConfig(t, tt.yaml, tt.args...)
+			if err != nil {
+				t.Fatalf("LoadConfig: %v", err)
+			}
+			if cfg.MQTT.Topic != tt.want {
+				t.Errorf("topic = %q, want %q", cfg.MQTT.Topic, tt.want)
+			}
+		})
+	}
+}
+
+func TestFlags(t *testing.T) {
+	t.Setenv("TIMESCALE_TABLE_NAME", "from_env")
+	cfg, err := loadConfig(t, "", "--broker", "tcp://a:1883,tcp://b:1883", "--table", "readings", "--dry-run")
+	if err != nil {
+		t.Fatalf("LoadConfig: %v", err)
+	}
+	if want := []string{"tcp://a:1883", "tcp://b:1883"}; !slices.Equal(cfg.MQTT.Brokers, want) {
+		t.Errorf("brokers = %v, want %v", cfg.MQTT.Brokers, want)
+	}
+	if cfg.Timescale.TableName != "readings" {
+		t.Errorf("table = %q, want readings", cfg.Timescale.TableName)
+	}
+	if !cfg.Ingest.DryRun {
+		t.Error("dry run not enabled")
+	}
+}
+
+func TestConfigFlagPicksTheFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "custom.yaml")
+	if err := os.WriteFile(path, []byte("timescale:\n  table_name: custom\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	// The directory's own config.yaml is ignored
+	cfg, err := loadConfig(t, "timescale:\n  table_name: default_file\n", "--config", path)
+	if err != nil {
+		t.Fatalf("LoadConfig: %v", err)
+	}
+	if cfg.Timescale.TableName != "custom" {
+		t.Errorf("table = %q, want custom", cfg.Timescale.TableName)
+	}
+}
+
+func TestPrintEffectiveMasksSecrets(t *testing.T) {
+	t.Setenv("DATABASE_PASSWORD", "hunter2")
+	t.Setenv("ALERT_WEBHOOK_URL", "https://hooks.example.com/services/T0KEN")
+	if _, err := loadConfig(t, "", "--table", "readings"); err != nil {
+		t.Fatalf("LoadConfig: %v", err)
+	}
+
+	var buf bytes.Buffer
+	if err := PrintEffective(&buf); err != nil {
+		t.Fatal(err)
+	}
+	out := buf.String()
+	if strings.Contains(out, "hunter2") {
+		t.Errorf("printed configuration leaks the password:\n%s", out)
+	}
+	if strings.Contains(out, "T0KEN") {
+		t.Errorf("printed configuration leaks the webhook URL:\n%s", out)
+	}
+	if !strings.Contains(out, "table_name: readings") {
+		t.Errorf("printed configuration lacks the flag value:\n%s", out)
+	}
+}
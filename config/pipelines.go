@@ -0,0 +1,93 @@
+package config
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+// sharedKeys are the top-level settings used by the whole process, which a
+// pipeline can't override
+var sharedKeys = map[string]bool{
+	"metrics":          true,
+	"otel":             true,
+	"http":             true,
+	"logging":          true,
+	"shutdown_timeout": true,
+}
+
+// Pipeline is one MQTT broker to database or sink pipeline. Pipelines run
+// independently of each other in the same process.
+type Pipeline struct {
+	Name   string
+	Config *Config
+
+	// shared lists the shared settings the pipeline tried to override
+	shared []string
+}
+
+// GetPipelines returns the configured pipelines, or a single pipeline
+// named default running the top-level settings when none are configured
+func (c *Config) GetPipelines() []Pipeline {
+	if len(c.pipelines) == 0 {
+		return []Pipeline{{Name: "default", Config: c}}
+	}
+	return c.pipelines
+}
+
+// loadPipelines decodes the pipelines list. Each pipeline starts from the
+// top-level settings, so it only needs the sections that differ, such as
+// its own mqtt and database.
+func loadPipelines() ([]Pipeline, error) {
+	raw, ok := viper.Get("pipelines").([]interface{})
+	if !ok {
+		if viper.IsSet("pipelines") {
+			return nil, fmt.Errorf("pipelines must be a list")
+		}
+		return nil, nil
+	}
+
+	pipelines := make([]Pipeline, 0, len(raw))
+	for i, entry := range raw {
+		overrides, ok := entry.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("pipelines[%d] must be a map", i)
+		}
+
+		// AllSettings returns fresh maps, so merging doesn't touch the
+		// top-level settings
+		settings := viper.AllSettings()
+		delete(settings, "pipelines")
+		v := viper.New()
+		if err := v.MergeConfigMap(settings); err != nil {
+			return nil, fmt.Errorf("failed to merge pipelines[%d]: %w", i, err)
+		}
+		if err := v.MergeConfigMap(overrides); err != nil {
+			return nil, fmt.Errorf("failed to merge pipelines[%d]: %w", i, err)
+		}
+
+		var config Config
+		if err := v.Unmarshal(&config); err != nil {
+			return nil, fmt.Errorf("unable to decode pipelines[%d]: %w", i, err)
+		}
+		if err := readPasswordFile(&config.MQTT.Password, config.MQTT.PasswordFile); err != nil {
+			return nil, err
+		}
+		if err := readPasswordFile(&config.Database.Password, config.Database.PasswordFile); err != nil {
+			return nil, err
+		}
+
+		name, _ := overrides["name"].(string)
+		var shared []string
+		for key := range overrides {
+			if sharedKeys[strings.ToLower(key)] {
+				shared = append(shared, key)
+			}
+		}
+		sort.Strings(shared)
+		pipelines = append(pipelines, Pipeline{Name: name, Config: &config, shared: shared})
+	}
+	return pipelines, nil
+}
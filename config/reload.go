@@ -0,0 +1,68 @@
+package config
+
+import (
+	"reflect"
+	"strings"
+)
+
+// reloadableKeys are the settings, or sections of settings, that can be
+// applied to a running service without a restart
+var reloadableKeys = []string{
+	"logging.level",
+	"logging.verbose_inserts",
+	"validation",
+	"ingest.per_device_rate",
+	"ingest.per_device_burst",
+}
+
+// IsReloadable reports whether the setting key can be changed without a
+// restart
+func IsReloadable(key string) bool {
+	for _, reloadable := range reloadableKeys {
+		if key == reloadable || strings.HasPrefix(key, reloadable+".") {
+			return true
+		}
+	}
+	return false
+}
+
+// Reload returns a copy of c with the reloadable settings taken from next.
+// Other settings keep their running values, so a later Diff still reports
+// them until the service is restarted.
+func (c *Config) Reload(next *Config) *Config {
+	reloaded := *c
+	reloaded.Logging.Level = next.Logging.Level
+	reloaded.Logging.VerboseInserts = next.Logging.VerboseInserts
+	reloaded.Validation = next.Validation
+	reloaded.Ingest.PerDeviceRate = next.Ingest.PerDeviceRate
+	reloaded.Ingest.PerDeviceBurst = next.Ingest.PerDeviceBurst
+	return &reloaded
+}
+
+// Diff returns the keys of every setting that differs between c and other,
+// such as "mqtt.client_id"
+func (c *Config) Diff(other *Config) []string {
+	return diffStruct("", reflect.ValueOf(*c), reflect.ValueOf(*other))
+}
+
+// diffStruct compares two structs field by field, recursing into nested
+// config sections and naming fields by their mapstructure tag
+func diffStruct(prefix string, a, b reflect.Value) []string {
+	var keys []string
+	for i := 0; i < a.NumField(); i++ {
+		field := a.Type().Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		key := prefix + field.Tag.Get("mapstructure")
+
+		if field.Type.Kind() == reflect.Struct {
+			keys = append(keys, diffStruct(key+".", a.Field(i), b.Field(i))...)
+			continue
+		}
+		if !reflect.DeepEqual(a.Field(i).Interface(), b.Field(i).Interface()) {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
@@ -0,0 +1,50 @@
+package config
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestIsReloadable(t *testing.T) {
+	for key, want := range map[string]bool{
+		"logging.level":           true,
+		"validation.mode":         true,
+		"validation.humidity.max": true,
+		"ingest.per_device_rate":  true,
+		"ingest.dedup_window":     false,
+		"mqtt.client_id":          false,
+		"mqtt.broker":             false,
+		"logging.levels":          false,
+	} {
+		if got := IsReloadable(key); got != want {
+			t.Errorf("IsReloadable(%q) = %v, want %v", key, got, want)
+		}
+	}
+}
+
+func TestReload(t *testing.T) {
+	running := GetDefaultConfig()
+	next := GetDefaultConfig()
+	next.Logging.Level = "debug"
+	next.Validation.Mode = "drop"
+	next.Ingest.PerDeviceRate = 5
+	next.MQTT.ClientID = "renamed"
+	next.MQTT.Brokers = []string{"tcp://elsewhere:1883"}
+
+	if got, want := running.Diff(next), []string{"mqtt.broker", "mqtt.client_id", "logging.level", "ingest.per_device_rate", "validation.mode"}; !slices.Equal(got, want) {
+		t.Errorf("diff = %v, want %v", got, want)
+	}
+
+	reloaded := running.Reload(next)
+	if reloaded.Logging.Level != "debug" || reloaded.Validation.Mode != "drop" || reloaded.Ingest.PerDeviceRate != 5 {
+		t.Errorf("reloadable settings not applied: %+v, %+v, %+v", reloaded.Logging, reloaded.Validation, reloaded.Ingest)
+	}
+	// Settings that need a restart keep their running values and so are
+	// still reported on the next reload
+	if got, want := reloaded.Diff(next), []string{"mqtt.broker", "mqtt.client_id"}; !slices.Equal(got, want) {
+		t.Errorf("diff after reload = %v, want %v", got, want)
+	}
+	if running.Logging.Level != "info" {
+		t.Errorf("running configuration modified: level %q", running.Logging.Level)
+	}
+}
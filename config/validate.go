@@ -0,0 +1,589 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// identifierPattern matches SQL identifiers that are safe to use unquoted
+var identifierPattern = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// IsValidIdentifier reports whether name is a safe SQL identifier
+func IsValidIdentifier(name string) bool {
+	return identifierPattern.MatchString(name)
+}
+
+// Validate checks the configuration and returns an error listing every
+// problem found, or nil if the configuration is usable. When pipelines are
+// configured each of them is checked, since the top-level settings are only
+// used through them.
+func (c *Config) Validate() error {
+	if len(c.pipelines) == 0 {
+		return errors.Join(c.problems()...)
+	}
+
+	var errs []error
+	names := make(map[string]bool, len(c.pipelines))
+	for i, p := range c.pipelines {
+		if p.Name == "" {
+			errs = append(errs, fmt.Errorf("pipelines[%d].name is required", i))
+		} else if names[p.Name] {
+			errs = append(errs, fmt.Errorf("pipelines[%d].name %q is used by another pipeline", i, p.Name))
+		}
+		names[p.Name] = true
+
+		for _, key := range p.shared {
+			errs = append(errs, fmt.Errorf("pipelines[%d].%s is shared by all pipelines and must be set at the top level", i, key))
+		}
+		for _, err := range p.Config.problems() {
+			errs = append(errs, fmt.Errorf("pipelines[%d]: %w", i, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// problems returns every problem found in the settings of one pipeline
+func (c *Config) problems() []error {
+	var errs []error
+	add := func(format string, args ...interface{}) {
+		errs = append(errs, fmt.Errorf(format, args...))
+	}
+
+	// MQTT configuration
+	if len(c.MQTT.Brokers) == 0 {
+		add("mqtt.broker is required")
+	}
+	for i, broker := range c.MQTT.Brokers {
+		if strings.TrimSpace(broker) == "" {
+			add("mqtt.broker[%d] must not be empty", i)
+		}
+	}
+	if c.MQTT.Port < 0 || c.MQTT.Port > 65535 {
+		add("mqtt.port %d must be between 0 and 65535", c.MQTT.Port)
+	}
+	if c.MQTT.ClientID == "" {
+		add("mqtt.client_id is required")
+	}
+	if len(c.MQTT.Subscriptions) == 0 && c.MQTT.Topic == "" {
+		add("mqtt.topic is required when mqtt.subscriptions is empty")
+	}
+	if c.MQTT.QoS > 2 {
+		add("mqtt.qos %d must be 0, 1 or 2", c.MQTT.QoS)
+	}
+	if c.MQTT.ProtocolVersion != 3 && c.MQTT.ProtocolVersion != 5 {
+		add("mqtt.protocol_version %d must be 3 or 5", c.MQTT.ProtocolVersion)
+	}
+	if c.MQTT.SessionExpiryInterval < 0 || c.MQTT.SessionExpiryInterval.Seconds() > math.MaxUint32 {
+		add("mqtt.session_expiry_interval %s must be between 0 and %ds", c.MQTT.SessionExpiryInterval, uint32(math.MaxUint32))
+	}
+	switch c.MQTT.PayloadFormat {
+	case "json", "protobuf":
+	case "csv":
+		if len(c.MQTT.CSVColumns) == 0 {
+			add("mqtt.csv_columns is required when mqtt.payload_format is csv")
+		}
+	default:
+		add("mqtt.payload_format %q must be json, csv or protobuf", c.MQTT.PayloadFormat)
+	}
+	if c.MQTT.PayloadSchema != "" && c.MQTT.PayloadFormat != "json" {
+		add("mqtt.payload_schema requires mqtt.payload_format json")
+	}
+	for _, key := range sortedKeys(c.MQTT.FieldMap) {
+		switch field := c.MQTT.FieldMap[key]; field {
+		case "device_id", "timestamp", "temperature", "humidity", "light":
+		default:
+			add("mqtt.field_map %q maps to %q, which must be one of device_id, timestamp, temperature, humidity or light", key, field)
+		}
+	}
+	for _, field := range sortedKeys(c.MQTT.FieldPaths) {
+		path := c.MQTT.FieldPaths[field]
+		for _, key := range strings.Split(path, ".") {
+			if key == "" {
+				add("mqtt.field_paths %q path %q must be keys separated by single dots", field, path)
+				break
+			}
+		}
+	}
+	for _, field := range sortedKeys(c.MQTT.FieldScale) {
+		factor := c.MQTT.FieldScale[field]
+		switch field {
+		case "device_id", "timestamp", "table":
+			add("mqtt.field_scale %q must name a sensor value or metrics field", field)
+		}
+		if factor == 0 || math.IsNaN(factor) || math.IsInf(factor, 0) {
+			add("mqtt.field_scale %q factor %v must be a non-zero number", field, factor)
+		}
+	}
+	for _, field := range c.MQTT.BurstFields {
+		switch field {
+		case "", "device_id", "timestamp", "table":
+			add("mqtt.burst_fields %q must name a sensor value or metrics field", field)
+		}
+	}
+	if len(c.MQTT.BurstFields) > 0 && c.MQTT.BurstIntervalField == "" {
+		add("mqtt.burst_interval_field is required when mqtt.burst_fields is set")
+	}
+	if c.MQTT.HMACSecret != "" {
+		if c.MQTT.PayloadFormat != "json" {
+			add("mqtt.hmac_secret requires mqtt.payload_format json")
+		}
+		if c.MQTT.HMACField == "" {
+			add("mqtt.hmac_field is required when mqtt.hmac_secret is set")
+		}
+	}
+	if c.MQTT.MaxPayloadBytes < 0 {
+		add("mqtt.max_payload_bytes %d must not be negative", c.MQTT.MaxPayloadBytes)
+	}
+	c.validateTopicColumns(add)
+	c.validateTagColumns(add)
+	if c.MQTT.TimestampField == "" {
+		add("mqtt.timestamp_field is required")
+	}
+	if c.MQTT.DeviceIDField == "" {
+		add("mqtt.device_id_field is required")
+	}
+	if len(c.MQTT.TimestampLayouts) == 0 {
+		add("mqtt.timestamp_layouts must list at least one layout")
+	}
+	if c.MQTT.StoreDir != "" && c.MQTT.CleanSession {
+		add("mqtt.store_dir requires mqtt.clean_session to be false")
+	}
+	if c.MQTT.WillQoS > 2 {
+		add("mqtt.will_qos %d must be 0, 1 or 2", c.MQTT.WillQoS)
+	}
+	if c.MQTT.ErrorTopic != "" {
+		if c.MQTT.ErrorQoS > 2 {
+			add("mqtt.error_qos %d must be 0, 1 or 2", c.MQTT.ErrorQoS)
+		}
+		if c.MQTT.ErrorRate <= 0 {
+			add("mqtt.error_rate %v must be positive", c.MQTT.ErrorRate)
+		}
+		if c.MQTT.ErrorBurst < 1 {
+			add("mqtt.error_burst %d must be at least 1", c.MQTT.ErrorBurst)
+		}
+	}
+	if c.MQTT.ReconnectInitialInterval <= 0 {
+		add("mqtt.reconnect_initial_interval %s must be positive", c.MQTT.ReconnectInitialInterval)
+	}
+	if c.MQTT.ReconnectMaxInterval <= 0 {
+		add("mqtt.reconnect_max_interval %s must be positive", c.MQTT.ReconnectMaxInterval)
+	} else if c.MQTT.ReconnectMaxInterval < c.MQTT.ReconnectInitialInterval {
+		add("mqtt.reconnect_max_interval %s must not be less than mqtt.reconnect_initial_interval %s",
+			c.MQTT.ReconnectMaxInterval, c.MQTT.ReconnectInitialInterval)
+	}
+	if c.MQTT.ConnectTimeout <= 0 {
+		add("mqtt.connect_timeout %s must be positive", c.MQTT.ConnectTimeout)
+	}
+	// The keep alive is sent to the broker in whole seconds as a 16-bit value
+	if c.MQTT.KeepAlive < time.Second || c.MQTT.KeepAlive > math.MaxUint16*time.Second {
+		add("mqtt.keep_alive %s must be between 1s and %s", c.MQTT.KeepAlive, math.MaxUint16*time.Second)
+	}
+	if c.MQTT.PingTimeout <= 0 {
+		add("mqtt.ping_timeout %s must be positive", c.MQTT.PingTimeout)
+	}
+	for i, sub := range c.MQTT.Subscriptions {
+		if sub.Topic == "" {
+			add("mqtt.subscriptions[%d].topic is required", i)
+		}
+		if sub.QoS > 2 {
+			add("mqtt.subscriptions[%d].qos %d must be 0, 1 or 2", i, sub.QoS)
+		}
+		if sub.Table != "" && !IsValidIdentifier(sub.Table) {
+			add("mqtt.subscriptions[%d].table %q is not a valid SQL identifier", i, sub.Table)
+		}
+	}
+	if c.MQTT.SharedGroup != "" {
+		if strings.ContainsAny(c.MQTT.SharedGroup, "/+#") {
+			add("mqtt.shared_group %q must not contain /, + or #", c.MQTT.SharedGroup)
+		}
+		for _, sub := range c.GetSubscriptions() {
+			if strings.HasPrefix(sub.Topic, "$share/") {
+				add("topic %q is already a shared subscription, which mqtt.shared_group can't be applied to", sub.Topic)
+			}
+		}
+	}
+
+	// Logging configuration
+	switch strings.ToLower(c.Logging.Level) {
+	case "debug", "info", "warn", "error":
+	default:
+		add("logging.level %q must be debug, info, warn or error", c.Logging.Level)
+	}
+	switch strings.ToLower(c.Logging.Format) {
+	case "text", "json":
+	default:
+		add("logging.format %q must be text or json", c.Logging.Format)
+	}
+	if c.Logging.RepeatInterval < 0 {
+		add("logging.repeat_interval %s must not be negative", c.Logging.RepeatInterval)
+	}
+
+	// Database configuration
+	if c.Database.Host == "" {
+		add("database.host is required")
+	}
+	if c.Database.DBName == "" {
+		add("database.dbname is required")
+	}
+	if !IsValidIdentifier(c.Database.Schema) {
+		add("database.schema %q is not a valid SQL identifier", c.Database.Schema)
+	}
+	if (c.Database.SSLCert == "") != (c.Database.SSLKey == "") {
+		add("database.ssl_cert and database.ssl_key must be set together")
+	}
+	if c.Database.SSLMode == "verify-ca" || c.Database.SSLMode == "verify-full" {
+		for _, file := range []struct{ key, path string }{
+			{"ssl_root_cert", c.Database.SSLRootCert},
+			{"ssl_cert", c.Database.SSLCert},
+			{"ssl_key", c.Database.SSLKey},
+		} {
+			if file.path == "" {
+				continue
+			}
+			if _, err := os.Stat(file.path); err != nil {
+				add("database.%s %q can't be read: %v", file.key, file.path, err)
+			}
+		}
+	}
+	if c.Database.OperationTimeout <= 0 {
+		add("database.operation_timeout %s must be positive", c.Database.OperationTimeout)
+	}
+	if c.Database.InsertTimeout <= 0 {
+		add("database.insert_timeout %s must be positive", c.Database.InsertTimeout)
+	}
+	if c.Database.ConnectRetries < 0 {
+		add("database.connect_retries %d must not be negative", c.Database.ConnectRetries)
+	}
+	if c.Database.ConnectRetryInterval <= 0 {
+		add("database.connect_retry_interval %s must be positive", c.Database.ConnectRetryInterval)
+	}
+	if c.Database.MaxRetries < 0 {
+		add("database.max_retries %d must not be negative", c.Database.MaxRetries)
+	}
+	if c.Database.RetryInitialInterval <= 0 {
+		add("database.retry_initial_interval %s must be positive", c.Database.RetryInitialInterval)
+	}
+	if c.Database.RetryMaxInterval < c.Database.RetryInitialInterval {
+		add("database.retry_max_interval %s must not be less than database.retry_initial_interval %s",
+			c.Database.RetryMaxInterval, c.Database.RetryInitialInterval)
+	}
+
+	// Timescale configuration
+	if !IsValidIdentifier(c.Timescale.TableName) {
+		add("timescale.table_name %q is not a valid SQL identifier", c.Timescale.TableName)
+	}
+	for i, table := range c.Timescale.AllowedTables {
+		if !IsValidIdentifier(table) {
+			add("timescale.allowed_tables[%d] %q is not a valid SQL identifier", i, table)
+		}
+	}
+	if c.Timescale.BatchSize < 1 {
+		add("timescale.batch_size %d must be at least 1", c.Timescale.BatchSize)
+	}
+	if c.Timescale.AdaptiveBatching {
+		if c.Timescale.MinBatchSize < 1 {
+			add("timescale.min_batch_size %d must be at least 1", c.Timescale.MinBatchSize)
+		}
+		if c.Timescale.BatchSize < c.Timescale.MinBatchSize || c.Timescale.BatchSize > c.Timescale.MaxBatchSize {
+			add("timescale.batch_size %d must be between timescale.min_batch_size %d and timescale.max_batch_size %d",
+				c.Timescale.BatchSize, c.Timescale.MinBatchSize, c.Timescale.MaxBatchSize)
+		}
+		if c.Timescale.TargetLatency <= 0 {
+			add("timescale.target_latency %s must be positive", c.Timescale.TargetLatency)
+		}
+	}
+	switch c.Timescale.TimeColumn {
+	case "":
+		add("timescale.time_column is required")
+	case "temperature", "humidity", "light", "device_id", "metrics", "location", "type", "ingest_time", "retained":
+		add("timescale.time_column %q is already used for another column", c.Timescale.TimeColumn)
+	}
+	if c.Timescale.Upsert {
+		hasTime, hasDeviceID := false, false
+		for _, column := range c.Timescale.ConflictColumns {
+			switch column {
+			case "time":
+				hasTime = true
+			case "device_id":
+				hasDeviceID = true
+			case "temperature", "humidity", "light":
+			default:
+				add("timescale.conflict_columns %q must be one of time, device_id, temperature, humidity or light", column)
+			}
+		}
+		// Unique indexes on a hypertable must include the partitioning columns
+		if !hasTime {
+			add("timescale.conflict_columns must include time")
+		}
+		if c.Timescale.SpacePartitions > 0 && !hasDeviceID {
+			add("timescale.conflict_columns must include device_id when timescale.space_partitions is set")
+		}
+	}
+	if c.Timescale.SpacePartitions < 0 {
+		add("timescale.space_partitions %d must not be negative", c.Timescale.SpacePartitions)
+	}
+	if c.Timescale.ChunkTimeInterval < 0 {
+		add("timescale.chunk_time_interval %s must not be negative", c.Timescale.ChunkTimeInterval)
+	}
+	if c.Timescale.Retention < 0 {
+		add("timescale.retention %s must not be negative", c.Timescale.Retention)
+	}
+	if c.Timescale.CompressAfter < 0 {
+		add("timescale.compress_after %s must not be negative", c.Timescale.CompressAfter)
+	}
+	if c.Timescale.StoreTimezone != "" {
+		if _, err := time.LoadLocation(c.Timescale.StoreTimezone); err != nil {
+			add("timescale.store_timezone %q is not a known time zone", c.Timescale.StoreTimezone)
+		}
+	}
+	if c.Timescale.MaintainLatest {
+		if !IsValidIdentifier(c.Timescale.LatestTable) {
+			add("timescale.latest_table %q is not a valid table name", c.Timescale.LatestTable)
+		}
+		for _, table := range c.GetTableNames() {
+			if table == c.Timescale.LatestTable {
+				add("timescale.latest_table %q is also a sensor data table", table)
+			}
+		}
+		if c.Devices.Table != "" && c.Timescale.LatestTable == c.Devices.Table {
+			add("timescale.latest_table %q is also devices.table", c.Timescale.LatestTable)
+		}
+	}
+	if agg := c.Timescale.ContinuousAggregate; agg.Enabled {
+		if agg.BucketWidth <= 0 {
+			add("timescale.continuous_aggregate.bucket_width %s must be positive", agg.BucketWidth)
+		}
+		if agg.ScheduleInterval <= 0 {
+			add("timescale.continuous_aggregate.schedule_interval %s must be positive", agg.ScheduleInterval)
+		}
+		if agg.EndOffset < 0 {
+			add("timescale.continuous_aggregate.end_offset %s must not be negative", agg.EndOffset)
+		}
+		// TimescaleDB requires the refresh window to cover at least two buckets
+		if agg.StartOffset < agg.EndOffset+2*agg.BucketWidth {
+			add("timescale.continuous_aggregate.start_offset %s must be at least end_offset plus two bucket widths", agg.StartOffset)
+		}
+	}
+
+	// Status configuration
+	if c.Status.Enabled && c.Status.DeviceTopic == "" {
+		add("status.device_topic is required when status.enabled is true")
+	}
+	if c.Status.QoS > 2 {
+		add("status.qos %d must be 0, 1 or 2", c.Status.QoS)
+	}
+	if c.Status.HeartbeatInterval < 0 {
+		add("status.heartbeat_interval %s must not be negative", c.Status.HeartbeatInterval)
+	}
+	if c.Status.HeartbeatInterval > 0 && c.Status.HeartbeatTopic == "" {
+		add("status.heartbeat_topic is required when status.heartbeat_interval is set")
+	}
+
+	// OpenTelemetry configuration
+	if c.OTel.Endpoint != "" {
+		if c.OTel.ServiceName == "" {
+			add("otel.service_name is required when otel.endpoint is set")
+		}
+		if c.OTel.SampleRatio < 0 || c.OTel.SampleRatio > 1 {
+			add("otel.sample_ratio %v must be between 0 and 1", c.OTel.SampleRatio)
+		}
+	}
+
+	// Sink configuration
+	switch c.Sink.Type {
+	case "timescale", "stdout":
+	case "file":
+		if c.Sink.File.Path == "" {
+			add("sink.file.path is required when sink.type is file")
+		}
+		if c.Sink.File.MaxSizeMB < 0 {
+			add("sink.file.max_size_mb %d must not be negative", c.Sink.File.MaxSizeMB)
+		}
+		if c.Sink.File.MaxBackups < 0 {
+			add("sink.file.max_backups %d must not be negative", c.Sink.File.MaxBackups)
+		}
+	default:
+		add("sink.type %q must be timescale, stdout or file", c.Sink.Type)
+	}
+	if c.Sink.Type != "timescale" && c.HTTP.EnableAPI {
+		add("http.enable_api requires sink.type timescale")
+	}
+
+	// Spool configuration
+	if c.Spool.Dir != "" {
+		if c.Spool.MaxSizeMB <= 0 {
+			add("spool.max_size_mb %d must be positive", c.Spool.MaxSizeMB)
+		}
+		if c.Spool.ReplayInterval <= 0 {
+			add("spool.replay_interval %s must be positive", c.Spool.ReplayInterval)
+		}
+	}
+
+	// Device metadata configuration
+	if c.Devices.Table != "" {
+		if !IsValidIdentifier(c.Devices.Table) {
+			add("devices.table %q is not a valid table name", c.Devices.Table)
+		}
+		if c.Devices.RefreshInterval <= 0 {
+			add("devices.refresh_interval %s must be positive", c.Devices.RefreshInterval)
+		}
+	}
+
+	// Ingest configuration
+	if c.Ingest.PerDeviceRate < 0 {
+		add("ingest.per_device_rate %v must not be negative", c.Ingest.PerDeviceRate)
+	}
+	if c.Ingest.PerDeviceRate > 0 && c.Ingest.PerDeviceBurst < 1 {
+		add("ingest.per_device_burst %d must be at least 1", c.Ingest.PerDeviceBurst)
+	}
+	if c.Ingest.DeviceTTL <= 0 {
+		add("ingest.device_ttl %s must be positive", c.Ingest.DeviceTTL)
+	}
+	if c.Ingest.DedupWindow < 0 {
+		add("ingest.dedup_window %s must not be negative", c.Ingest.DedupWindow)
+	}
+	if c.Ingest.DedupWindow > 0 && c.Ingest.DedupMaxEntries < 1 {
+		add("ingest.dedup_max_entries %d must be at least 1", c.Ingest.DedupMaxEntries)
+	}
+	if c.Ingest.QueueSize < 1 {
+		add("ingest.queue_size %d must be at least 1", c.Ingest.QueueSize)
+	}
+	switch c.Ingest.OverflowPolicy {
+	case "block", "drop":
+	default:
+		add("ingest.overflow_policy %q must be block or drop", c.Ingest.OverflowPolicy)
+	}
+	if c.Ingest.Workers < 0 {
+		add("ingest.workers %d must not be negative", c.Ingest.Workers)
+	}
+	if c.Ingest.OrderByDevice && c.Ingest.Workers == 0 {
+		add("ingest.order_by_device requires ingest.workers")
+	}
+
+	// Validation configuration
+	switch c.Validation.Mode {
+	case "reject", "drop", "null":
+	default:
+		add("validation.mode %q must be reject, drop or null", c.Validation.Mode)
+	}
+	for _, r := range []struct {
+		name string
+		RangeConfig
+	}{
+		{"temperature", c.Validation.Temperature},
+		{"humidity", c.Validation.Humidity},
+		{"light", c.Validation.Light},
+	} {
+		if r.Min != nil && r.Max != nil && *r.Min > *r.Max {
+			add("validation.%s.min %v must not be greater than validation.%s.max %v", r.name, *r.Min, r.name, *r.Max)
+		}
+	}
+
+	// Alert configuration
+	if c.Alert.WebhookURL != "" {
+		if u, err := url.Parse(c.Alert.WebhookURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			// The URL isn't shown, webhook URLs often embed a token
+			add("alert.webhook_url must be an http or https URL")
+		}
+		if c.Alert.Threshold < 1 {
+			add("alert.threshold %d must be at least 1", c.Alert.Threshold)
+		}
+		if c.Alert.Window < time.Second {
+			add("alert.window %s must be at least 1s", c.Alert.Window)
+		}
+	}
+
+	return errs
+}
+
+// builtinColumns are the columns every sensor data table has, which topic
+// columns must not shadow
+var builtinColumns = map[string]bool{
+	"time": true, "temperature": true, "humidity": true, "light": true, "device_id": true,
+	"metrics": true, "location": true, "type": true, "ingest_time": true, "retained": true,
+}
+
+// validateTagColumns checks that tag columns are valid identifiers that
+// don't clash with the built-in, time or topic columns
+func (c *Config) validateTagColumns(add func(format string, args ...interface{})) {
+	taken := make(map[string]bool, len(c.MQTT.TopicColumns)+len(c.Timescale.TagColumns))
+	for _, column := range c.MQTT.TopicColumns {
+		taken[column] = true
+	}
+	for _, column := range c.Timescale.TagColumns {
+		switch {
+		case !IsValidIdentifier(column):
+			add("timescale.tag_columns %q is not a valid SQL identifier", column)
+		case builtinColumns[column] || column == c.Timescale.TimeColumn:
+			add("timescale.tag_columns %q is a built-in column", column)
+		case taken[column]:
+			add("timescale.tag_columns %q is listed twice or is also a topic column", column)
+		}
+		taken[column] = true
+	}
+}
+
+// validateTopicColumns checks that every named segment of the topic
+// template is bound to a payload field or a topic column, and that every
+// topic column is a named segment
+func (c *Config) validateTopicColumns(add func(format string, args ...interface{})) {
+	// names keeps the template's order, so problems are reported in it
+	var names []string
+	named := make(map[string]bool)
+	for _, seg := range strings.Split(c.MQTT.TopicTemplate, "/") {
+		var name string
+		switch {
+		case strings.HasPrefix(seg, "{") && strings.HasSuffix(seg, "}") && len(seg) > 2:
+			name = seg[1 : len(seg)-1]
+		case strings.HasPrefix(seg, "+") && len(seg) > 1:
+			name = seg[1:]
+		default:
+			continue
+		}
+		if !named[name] {
+			names = append(names, name)
+		}
+		named[name] = true
+	}
+
+	columns := make(map[string]bool, len(c.MQTT.TopicColumns))
+	for _, column := range c.MQTT.TopicColumns {
+		switch {
+		case !IsValidIdentifier(column):
+			add("mqtt.topic_columns %q is not a valid SQL identifier", column)
+		case builtinColumns[column]:
+			add("mqtt.topic_columns %q is a built-in column", column)
+		case !named[column]:
+			add("mqtt.topic_columns %q is not a named segment of mqtt.topic_template %q", column, c.MQTT.TopicTemplate)
+		}
+		columns[column] = true
+	}
+
+	for _, name := range names {
+		switch name {
+		case "device_id", "timestamp", "table", "temperature", "humidity", "light":
+		default:
+			if !columns[name] {
+				add("mqtt.topic_template segment %q must be a known field or listed in mqtt.topic_columns", name)
+			}
+		}
+	}
+}
+
+// sortedKeys returns the keys of m in order, so problems with map settings
+// are reported the same way every time
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
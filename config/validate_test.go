@@ -0,0 +1,448 @@
+package config
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDefaultConfigIsValid(t *testing.T) {
+	if err := GetDefaultConfig().Validate(); err != nil {
+		t.Fatalf("default configuration is invalid: %v", err)
+	}
+}
+
+func TestValidateReportsEveryProblem(t *testing.T) {
+	cfg := GetDefaultConfig()
+	cfg.MQTT.Brokers = nil
+	cfg.MQTT.QoS = 3
+	cfg.Database.Host = ""
+	cfg.Timescale.BatchSize = 0
+
+	err := cfg.Validate()
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	for _, want := range []string{
+		"mqtt.broker is required",
+		"mqtt.qos 3 must be 0, 1 or 2",
+		"database.host is required",
+		"timescale.batch_size 0 must be at least 1",
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error does not mention %q:\n%v", want, err)
+		}
+	}
+	if lines := strings.Count(err.Error(), "\n") + 1; lines != 4 {
+		t.Errorf("got %d problems, want 4:\n%v", lines, err)
+	}
+}
+
+func TestValidateReportsProblemsInOrder(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(*Config)
+		want   []string
+	}{
+		{"ranges", func(c *Config) {
+			lo, hi := 1.0, 0.0
+			for _, r := range []*RangeConfig{&c.Validation.Light, &c.Validation.Temperature, &c.Validation.Humidity} {
+				r.Min, r.Max = &lo, &hi
+			}
+		}, []string{
+			"validation.temperature.min 1 must not be greater than validation.temperature.max 0",
+			"validation.humidity.min 1 must not be greater than validation.humidity.max 0",
+			"validation.light.min 1 must not be greater than validation.light.max 0",
+		}},
+		{"ssl files", func(c *Config) {
+			c.Database.SSLMode = "verify-full"
+			c.Database.SSLKey = "/nonexistent/client.key"
+			c.Database.SSLCert = "/nonexistent/client.crt"
+			c.Database.SSLRootCert = "/nonexistent/ca.crt"
+		}, []string{
+			`database.ssl_root_cert "/nonexistent/ca.crt" can't be read: stat /nonexistent/ca.crt: no such file or directory`,
+			`database.ssl_cert "/nonexistent/client.crt" can't be read: stat /nonexistent/client.crt: no such file or directory`,
+			`database.ssl_key "/nonexistent/client.key" can't be read: stat /nonexistent/client.key: no such file or directory`,
+		}},
+		{"field map", func(c *Config) {
+			c.MQTT.FieldMap = map[string]string{"t": "temp", "h": "hum", "l": "lux"}
+		}, []string{
+			`mqtt.field_map "h" maps to "hum", which must be one of device_id, timestamp, temperature, humidity or light`,
+			`mqtt.field_map "l" maps to "lux", which must be one of device_id, timestamp, temperature, humidity or light`,
+			`mqtt.field_map "t" maps to "temp", which must be one of device_id, timestamp, temperature, humidity or light`,
+		}},
+		{"field paths", func(c *Config) {
+			c.MQTT.FieldPaths = map[string]string{"temperature": "env..temp", "humidity": ".hum", "light": "lux."}
+		}, []string{
+			`mqtt.field_paths "humidity" path ".hum" must be keys separated by single dots`,
+			`mqtt.field_paths "light" path "lux." must be keys separated by single dots`,
+			`mqtt.field_paths "temperature" path "env..temp" must be keys separated by single dots`,
+		}},
+		{"field scale", func(c *Config) {
+			c.MQTT.FieldScale = map[string]float64{"temperature": 0, "table": 2, "humidity": math.NaN()}
+		}, []string{
+			`mqtt.field_scale "humidity" factor NaN must be a non-zero number`,
+			`mqtt.field_scale "table" must name a sensor value or metrics field`,
+			`mqtt.field_scale "temperature" factor 0 must be a non-zero number`,
+		}},
+		{"topic template segments", func(c *Config) {
+			c.MQTT.TopicTemplate = "sensors/{site}/+building/{device_id}/{room}/{site}"
+		}, []string{
+			`mqtt.topic_template segment "site" must be a known field or listed in mqtt.topic_columns`,
+			`mqtt.topic_template segment "building" must be a known field or listed in mqtt.topic_columns`,
+			`mqtt.topic_template segment "room" must be a known field or listed in mqtt.topic_columns`,
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := GetDefaultConfig()
+			tt.modify(cfg)
+			want := strings.Join(tt.want, "\n")
+			// Map iteration order is random, so a few runs catch one leaking
+			for i := 0; i < 20; i++ {
+				if err := cfg.Validate(); err == nil || err.Error() != want {
+					t.Fatalf("Validate() = %v, want:\n%s", err, want)
+				}
+			}
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(*Config)
+		want   string // substring of the error, "" when valid
+	}{
+		{"batch size 1", func(c *Config) { c.Timescale.BatchSize = 1 }, ""},
+		{"zero batch size", func(c *Config) { c.Timescale.BatchSize = 0 }, "timescale.batch_size 0 must be at least 1"},
+		{"negative batch size", func(c *Config) { c.Timescale.BatchSize = -5 }, "timescale.batch_size -5 must be at least 1"},
+		{"adaptive batch size out of range", func(c *Config) {
+			c.Timescale.AdaptiveBatching = true
+			c.Timescale.BatchSize = c.Timescale.MaxBatchSize + 1
+		}, "must be between timescale.min_batch_size"},
+		{"zero min batch size", func(c *Config) {
+			c.Timescale.AdaptiveBatching = true
+			c.Timescale.MinBatchSize = 0
+		}, "timescale.min_batch_size 0 must be at least 1"},
+		{"zero target latency", func(c *Config) {
+			c.Timescale.AdaptiveBatching = true
+			c.Timescale.TargetLatency = 0
+		}, "timescale.target_latency 0s must be positive"},
+		{"adaptive bounds unchecked when disabled", func(c *Config) { c.Timescale.MinBatchSize = 0 }, ""},
+		{"qos 2", func(c *Config) { c.MQTT.QoS = 2 }, ""},
+		{"qos out of range", func(c *Config) { c.MQTT.QoS = 3 }, "mqtt.qos 3 must be 0, 1 or 2"},
+		{"zero reconnect interval", func(c *Config) { c.MQTT.ReconnectInitialInterval = 0 }, "mqtt.reconnect_initial_interval 0s must be positive"},
+		{"negative max reconnect interval", func(c *Config) { c.MQTT.ReconnectMaxInterval = -time.Second }, "mqtt.reconnect_max_interval -1s must be positive"},
+		{"max reconnect interval below initial", func(c *Config) {
+			c.MQTT.ReconnectInitialInterval = time.Minute
+			c.MQTT.ReconnectMaxInterval = time.Second
+		}, "must not be less than mqtt.reconnect_initial_interval"},
+		{"zero connect timeout", func(c *Config) { c.MQTT.ConnectTimeout = 0 }, "mqtt.connect_timeout 0s must be positive"},
+		{"empty broker entry", func(c *Config) { c.MQTT.Brokers = []string{"tcp://a:1883", " "} }, "mqtt.broker[1] must not be empty"},
+		{"port out of range", func(c *Config) { c.MQTT.Port = 70000 }, "mqtt.port 70000 must be between 0 and 65535"},
+		{"missing database name", func(c *Config) { c.Database.DBName = "" }, "database.dbname is required"},
+		{"unsafe table name", func(c *Config) { c.Timescale.TableName = "sensor-data" }, `timescale.table_name "sensor-data"`},
+		{"unsafe allowed table", func(c *Config) { c.Timescale.AllowedTables = []string{"tenant_a", "tenant;b"} }, `timescale.allowed_tables[1] "tenant;b" is not a valid SQL identifier`},
+		{"upsert on device and time", func(c *Config) { c.Timescale.Upsert = true }, ""},
+		{"upsert without time", func(c *Config) {
+			c.Timescale.Upsert = true
+			c.Timescale.ConflictColumns = []string{"device_id"}
+		}, "timescale.conflict_columns must include time"},
+		{"upsert on an unknown column", func(c *Config) {
+			c.Timescale.Upsert = true
+			c.Timescale.ConflictColumns = []string{"time", "metrics"}
+		}, `timescale.conflict_columns "metrics" must be one of`},
+		{"continuous aggregate", func(c *Config) { c.Timescale.ContinuousAggregate.Enabled = true }, ""},
+		{"continuous aggregate without a bucket width", func(c *Config) {
+			c.Timescale.ContinuousAggregate.Enabled = true
+			c.Timescale.ContinuousAggregate.BucketWidth = 0
+		}, "timescale.continuous_aggregate.bucket_width 0s must be positive"},
+		{"continuous aggregate refresh window under two buckets", func(c *Config) {
+			c.Timescale.ContinuousAggregate.Enabled = true
+			c.Timescale.ContinuousAggregate.StartOffset = 2 * time.Hour
+		}, "timescale.continuous_aggregate.start_offset 2h0m0s must be at least end_offset plus two bucket widths"},
+		{"drop on overflow", func(c *Config) { c.Ingest.OverflowPolicy = "drop" }, ""},
+		{"unknown overflow policy", func(c *Config) { c.Ingest.OverflowPolicy = "spill" }, `ingest.overflow_policy "spill" must be block or drop`},
+		{"zero queue size", func(c *Config) { c.Ingest.QueueSize = 0 }, "ingest.queue_size 0 must be at least 1"},
+		{"empty client id", func(c *Config) { c.MQTT.ClientID = "" }, "mqtt.client_id is required"},
+		{"unknown payload format", func(c *Config) { c.MQTT.PayloadFormat = "xml" }, `mqtt.payload_format "xml"`},
+		{"store dir with a persistent session", func(c *Config) {
+			c.MQTT.CleanSession = false
+			c.MQTT.StoreDir = "/var/lib/ingest"
+		}, ""},
+		{"store dir with a clean session", func(c *Config) {
+			c.MQTT.CleanSession = true
+			c.MQTT.StoreDir = "/var/lib/ingest"
+		}, "mqtt.store_dir requires mqtt.clean_session to be false"},
+		{"unknown validation mode", func(c *Config) { c.Validation.Mode = "clamp" }, `validation.mode "clamp" must be reject, drop or null`},
+		{"inverted range", func(c *Config) {
+			lo, hi := 60.0, -40.0
+			c.Validation.Temperature = RangeConfig{Min: &lo, Max: &hi}
+		}, "validation.temperature.min 60 must not be greater than validation.temperature.max -40"},
+		{"status without a device topic", func(c *Config) {
+			c.Status.Enabled = true
+			c.Status.DeviceTopic = ""
+		}, "status.device_topic is required when status.enabled is true"},
+		{"status qos out of range", func(c *Config) { c.Status.QoS = 3 }, "status.qos 3 must be 0, 1 or 2"},
+		{"negative heartbeat interval", func(c *Config) { c.Status.HeartbeatInterval = -time.Second }, "status.heartbeat_interval -1s must not be negative"},
+		{"heartbeat without a topic", func(c *Config) {
+			c.Status.HeartbeatInterval = time.Minute
+			c.Status.HeartbeatTopic = ""
+		}, "status.heartbeat_topic is required when status.heartbeat_interval is set"},
+		{"field map to a known field", func(c *Config) { c.MQTT.FieldMap = map[string]string{"temp_c": "temperature"} }, ""},
+		{"field map to an unknown field", func(c *Config) { c.MQTT.FieldMap = map[string]string{"temp_c": "temp"} },
+			`mqtt.field_map "temp_c" maps to "temp", which must be one of`},
+		{"no timestamp field", func(c *Config) { c.MQTT.TimestampField = "" }, "mqtt.timestamp_field is required"},
+		{"no device id field", func(c *Config) { c.MQTT.DeviceIDField = "" }, "mqtt.device_id_field is required"},
+		{"otel without a service name", func(c *Config) {
+			c.OTel.Endpoint = "collector:4317"
+			c.OTel.ServiceName = ""
+		}, "otel.service_name is required when otel.endpoint is set"},
+		{"otel sample ratio out of range", func(c *Config) {
+			c.OTel.Endpoint = "collector:4317"
+			c.OTel.SampleRatio = 1.5
+		}, "otel.sample_ratio 1.5 must be between 0 and 1"},
+		{"schema", func(c *Config) { c.Database.Schema = "iot" }, ""},
+		{"unsafe schema", func(c *Config) { c.Database.Schema = "iot; DROP" }, `database.schema "iot; DROP" is not a valid SQL identifier`},
+		{"no connect retries", func(c *Config) { c.Database.ConnectRetries = 0 }, ""},
+		{"negative connect retries", func(c *Config) { c.Database.ConnectRetries = -1 }, "database.connect_retries -1 must not be negative"},
+		{"zero connect retry interval", func(c *Config) { c.Database.ConnectRetryInterval = 0 }, "database.connect_retry_interval 0s must be positive"},
+		{"topic columns", func(c *Config) {
+			c.MQTT.TopicTemplate = "factory/+site/+line/+device_id"
+			c.MQTT.TopicColumns = []string{"site", "line"}
+		}, ""},
+		{"unbound topic segment", func(c *Config) {
+			c.MQTT.TopicTemplate = "factory/+site/+line/+device_id"
+			c.MQTT.TopicColumns = []string{"site"}
+		}, `mqtt.topic_template segment "line" must be a known field or listed in mqtt.topic_columns`},
+		{"topic column outside the template", func(c *Config) {
+			c.MQTT.TopicTemplate = "factory/+site/+device_id"
+			c.MQTT.TopicColumns = []string{"site", "line"}
+		}, `mqtt.topic_columns "line" is not a named segment of mqtt.topic_template`},
+		{"topic column shadowing a built-in", func(c *Config) {
+			c.MQTT.TopicTemplate = "factory/+location/+device_id"
+			c.MQTT.TopicColumns = []string{"location"}
+		}, `mqtt.topic_columns "location" is a built-in column`},
+		{"space partitions", func(c *Config) { c.Timescale.SpacePartitions = 4 }, ""},
+		{"space partitions without device_id in the conflict columns", func(c *Config) {
+			c.Timescale.Upsert = true
+			c.Timescale.ConflictColumns = []string{"time"}
+			c.Timescale.SpacePartitions = 4
+		}, "timescale.conflict_columns must include device_id when timescale.space_partitions is set"},
+		{"negative space partitions", func(c *Config) { c.Timescale.SpacePartitions = -1 }, "timescale.space_partitions -1 must not be negative"},
+		{"stdout sink", func(c *Config) { c.Sink.Type = "stdout" }, ""},
+		{"file sink", func(c *Config) {
+			c.Sink.Type = "file"
+			c.Sink.File = FileSinkConfig{Path: "/var/lib/ingest/readings.jsonl", MaxSizeMB: 10, MaxBackups: 3}
+		}, ""},
+		{"file sink without a path", func(c *Config) {
+			c.Sink.Type = "file"
+			c.Sink.File.Path = ""
+		}, "sink.file.path is required when sink.type is file"},
+		{"negative sink file size", func(c *Config) {
+			c.Sink.Type = "file"
+			c.Sink.File = FileSinkConfig{Path: "readings.jsonl", MaxSizeMB: -1}
+		}, "sink.file.max_size_mb -1 must not be negative"},
+		{"negative sink file backups", func(c *Config) {
+			c.Sink.Type = "file"
+			c.Sink.File = FileSinkConfig{Path: "readings.jsonl", MaxBackups: -1}
+		}, "sink.file.max_backups -1 must not be negative"},
+		{"unknown sink", func(c *Config) { c.Sink.Type = "kafka" }, `sink.type "kafka" must be timescale, stdout or file`},
+		{"readings API without the database", func(c *Config) {
+			c.Sink.Type = "stdout"
+			c.HTTP.EnableAPI = true
+		}, "http.enable_api requires sink.type timescale"},
+		{"payload schema with csv payloads", func(c *Config) {
+			c.MQTT.PayloadSchema = "reading.schema.json"
+			c.MQTT.PayloadFormat = "csv"
+			c.MQTT.CSVColumns = []string{"device_id", "temperature"}
+		}, "mqtt.payload_schema requires mqtt.payload_format json"},
+		{"zero insert timeout", func(c *Config) { c.Database.InsertTimeout = 0 }, "database.insert_timeout 0s must be positive"},
+		{"error qos", func(c *Config) {
+			c.MQTT.ErrorTopic = "errors"
+			c.MQTT.ErrorQoS = 3
+		}, "mqtt.error_qos 3 must be 0, 1 or 2"},
+		{"zero error rate", func(c *Config) {
+			c.MQTT.ErrorTopic = "errors"
+			c.MQTT.ErrorRate = 0
+		}, "mqtt.error_rate 0 must be positive"},
+		{"zero error burst", func(c *Config) {
+			c.MQTT.ErrorTopic = "errors"
+			c.MQTT.ErrorBurst = 0
+		}, "mqtt.error_burst 0 must be at least 1"},
+		{"default port by scheme", func(c *Config) { c.MQTT.Port = 0 }, ""},
+		{"negative port", func(c *Config) { c.MQTT.Port = -1 }, "mqtt.port -1 must be between 0 and 65535"},
+		{"nested field path", func(c *Config) { c.MQTT.FieldPaths = map[string]string{"temperature": "readings.temperature"} }, ""},
+		{"field path with an empty key", func(c *Config) { c.MQTT.FieldPaths = map[string]string{"temperature": "readings..temperature"} }, `mqtt.field_paths "temperature" path "readings..temperature" must be keys separated by single dots`},
+		{"burst fields", func(c *Config) { c.MQTT.BurstFields = []string{"temperature", "vibration"} }, ""},
+		{"burst of device ids", func(c *Config) { c.MQTT.BurstFields = []string{"device_id"} }, `mqtt.burst_fields "device_id" must name a sensor value or metrics field`},
+		{"burst without an interval field", func(c *Config) {
+			c.MQTT.BurstFields = []string{"temperature"}
+			c.MQTT.BurstIntervalField = ""
+		}, "mqtt.burst_interval_field is required when mqtt.burst_fields is set"},
+		{"no payload size limit", func(c *Config) { c.MQTT.MaxPayloadBytes = 0 }, ""},
+		{"negative payload size limit", func(c *Config) { c.MQTT.MaxPayloadBytes = -1 }, "mqtt.max_payload_bytes -1 must not be negative"},
+		{"hmac secret", func(c *Config) { c.MQTT.HMACSecret = "s3cret" }, ""},
+		{"hmac secret with csv payloads", func(c *Config) {
+			c.MQTT.HMACSecret = "s3cret"
+			c.MQTT.PayloadFormat = "csv"
+			c.MQTT.CSVColumns = []string{"device_id", "temperature"}
+		}, "mqtt.hmac_secret requires mqtt.payload_format json"},
+		{"hmac secret without a field", func(c *Config) {
+			c.MQTT.HMACSecret = "s3cret"
+			c.MQTT.HMACField = ""
+		}, "mqtt.hmac_field is required when mqtt.hmac_secret is set"},
+		{"custom time column", func(c *Config) { c.Timescale.TimeColumn = "ts" }, ""},
+		{"no time column", func(c *Config) { c.Timescale.TimeColumn = "" }, "timescale.time_column is required"},
+		{"time column clashes", func(c *Config) { c.Timescale.TimeColumn = "device_id" }, `timescale.time_column "device_id" is already used`},
+		{"tag columns", func(c *Config) { c.Timescale.TagColumns = []string{"firmware_version", "model"} }, ""},
+		{"unsafe tag column", func(c *Config) { c.Timescale.TagColumns = []string{"model; DROP"} }, `timescale.tag_columns "model; DROP" is not a valid SQL identifier`},
+		{"tag column shadowing a built-in", func(c *Config) { c.Timescale.TagColumns = []string{"type"} }, `timescale.tag_columns "type" is a built-in column`},
+		{"tag column shadowing the time column", func(c *Config) { c.Timescale.TagColumns = []string{"time"} }, `timescale.tag_columns "time" is a built-in column`},
+		{"tag column listed twice", func(c *Config) { c.Timescale.TagColumns = []string{"model", "model"} }, `timescale.tag_columns "model" is listed twice`},
+		{"tag column also a topic column", func(c *Config) {
+			c.MQTT.TopicTemplate = "factory/+site/+device_id"
+			c.MQTT.TopicColumns = []string{"site"}
+			c.Timescale.TagColumns = []string{"site"}
+		}, `timescale.tag_columns "site" is listed twice or is also a topic column`},
+		{"short keep alive", func(c *Config) { c.MQTT.KeepAlive = time.Second }, ""},
+		{"sub-second keep alive", func(c *Config) { c.MQTT.KeepAlive = 500 * time.Millisecond }, "mqtt.keep_alive 500ms must be between 1s and 18h12m15s"},
+		{"keep alive over the protocol limit", func(c *Config) { c.MQTT.KeepAlive = 19 * time.Hour }, "mqtt.keep_alive 19h0m0s must be between 1s and 18h12m15s"},
+		{"zero ping timeout", func(c *Config) { c.MQTT.PingTimeout = 0 }, "mqtt.ping_timeout 0s must be positive"},
+		{"ordered workers", func(c *Config) {
+			c.Ingest.Workers = 4
+			c.Ingest.OrderByDevice = true
+		}, ""},
+		{"negative workers", func(c *Config) { c.Ingest.Workers = -1 }, "ingest.workers -1 must not be negative"},
+		{"ordered without workers", func(c *Config) { c.Ingest.OrderByDevice = true }, "ingest.order_by_device requires ingest.workers"},
+		{"alert webhook", func(c *Config) { c.Alert.WebhookURL = "https://hooks.example.com/services/T0KEN" }, ""},
+		{"no alert webhook ignores its settings", func(c *Config) { c.Alert.Threshold = 0 }, ""},
+		{"alert webhook not http", func(c *Config) { c.Alert.WebhookURL = "ftp://hooks.example.com/T0KEN" }, "alert.webhook_url must be an http or https URL"},
+		{"alert webhook without a host", func(c *Config) { c.Alert.WebhookURL = "https:///T0KEN" }, "alert.webhook_url must be an http or https URL"},
+		{"zero alert threshold", func(c *Config) {
+			c.Alert.WebhookURL = "https://hooks.example.com"
+			c.Alert.Threshold = 0
+		}, "alert.threshold 0 must be at least 1"},
+		{"sub-second alert window", func(c *Config) {
+			c.Alert.WebhookURL = "https://hooks.example.com"
+			c.Alert.Window = 100 * time.Millisecond
+		}, "alert.window 100ms must be at least 1s"},
+		{"field scale", func(c *Config) { c.MQTT.FieldScale = map[string]float64{"temperature": 0.01, "co2": 10} }, ""},
+		{"scaled device id", func(c *Config) { c.MQTT.FieldScale = map[string]float64{"device_id": 2} }, `mqtt.field_scale "device_id" must name a sensor value or metrics field`},
+		{"scaled timestamp", func(c *Config) { c.MQTT.FieldScale = map[string]float64{"timestamp": 1000} }, `mqtt.field_scale "timestamp" must name a sensor value or metrics field`},
+		{"zero scale", func(c *Config) { c.MQTT.FieldScale = map[string]float64{"temperature": 0} }, `mqtt.field_scale "temperature" factor 0 must be a non-zero number`},
+		{"NaN scale", func(c *Config) { c.MQTT.FieldScale = map[string]float64{"temperature": math.NaN()} }, `mqtt.field_scale "temperature" factor NaN must be a non-zero number`},
+		{"shared group", func(c *Config) { c.MQTT.SharedGroup = "ingest" }, ""},
+		{"shared group with a slash", func(c *Config) { c.MQTT.SharedGroup = "a/b" }, `mqtt.shared_group "a/b" must not contain /, + or #`},
+		{"shared group with a wildcard", func(c *Config) { c.MQTT.SharedGroup = "a#" }, `mqtt.shared_group "a#" must not contain /, + or #`},
+		{"shared group on a shared topic", func(c *Config) {
+			c.MQTT.SharedGroup = "ingest"
+			c.MQTT.Topic = "$share/other/sensor/#"
+		}, `topic "$share/other/sensor/#" is already a shared subscription`},
+		{"shared topic without a group", func(c *Config) { c.MQTT.Topic = "$share/other/sensor/#" }, ""},
+		{"verified CA bundle", func(c *Config) {
+			c.Database.SSLMode = "verify-full"
+			c.Database.SSLRootCert = "validate_test.go"
+		}, ""},
+		{"missing CA bundle", func(c *Config) {
+			c.Database.SSLMode = "verify-full"
+			c.Database.SSLRootCert = "testdata/missing-ca.pem"
+		}, `database.ssl_root_cert "testdata/missing-ca.pem" can't be read`},
+		{"missing client key", func(c *Config) {
+			c.Database.SSLMode = "verify-ca"
+			c.Database.SSLCert = "validate_test.go"
+			c.Database.SSLKey = "testdata/missing.key"
+		}, `database.ssl_key "testdata/missing.key" can't be read`},
+		{"files unchecked without verification", func(c *Config) {
+			c.Database.SSLMode = "require"
+			c.Database.SSLRootCert = "testdata/missing-ca.pem"
+		}, ""},
+		{"client certificate without a key", func(c *Config) { c.Database.SSLCert = "validate_test.go" }, "database.ssl_cert and database.ssl_key must be set together"},
+		{"time column named retained", func(c *Config) { c.Timescale.TimeColumn = "retained" }, `timescale.time_column "retained" is already used`},
+		{"tag column named retained", func(c *Config) { c.Timescale.TagColumns = []string{"retained"} }, `timescale.tag_columns "retained" is a built-in column`},
+		{"latest table", func(c *Config) { c.Timescale.MaintainLatest = true }, ""},
+		{"latest table not maintained", func(c *Config) { c.Timescale.LatestTable = "bad;name" }, ""},
+		{"unsafe latest table", func(c *Config) {
+			c.Timescale.MaintainLatest = true
+			c.Timescale.LatestTable = "latest; DROP"
+		}, `timescale.latest_table "latest; DROP" is not a valid table name`},
+		{"latest table is the sensor table", func(c *Config) {
+			c.Timescale.MaintainLatest = true
+			c.Timescale.LatestTable = c.Timescale.TableName
+		}, `timescale.latest_table "sensor_data" is also a sensor data table`},
+		{"latest table is the devices table", func(c *Config) {
+			c.Timescale.MaintainLatest = true
+			c.Devices.Table = "device_latest"
+		}, `timescale.latest_table "device_latest" is also devices.table`},
+		{"device ttl", func(c *Config) { c.Ingest.DeviceTTL = time.Hour }, ""},
+		{"zero device ttl", func(c *Config) { c.Ingest.DeviceTTL = 0 }, "ingest.device_ttl 0s must be positive"},
+		{"negative device ttl", func(c *Config) { c.Ingest.DeviceTTL = -time.Minute }, "ingest.device_ttl -1m0s must be positive"},
+		{"bad protocol version", func(c *Config) { c.MQTT.ProtocolVersion = 4 }, "mqtt.protocol_version 4"},
+		{"unknown store timezone", func(c *Config) { c.Timescale.StoreTimezone = "Mars/Olympus_Mons" }, `timescale.store_timezone "Mars/Olympus_Mons" is not a known time zone`},
+		{"offsets kept as sent", func(c *Config) { c.Timescale.StoreTimezone = "" }, ""},
+		{"no timestamp layouts", func(c *Config) { c.MQTT.TimestampLayouts = nil }, "mqtt.timestamp_layouts must list at least one layout"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := GetDefaultConfig()
+			tt.modify(cfg)
+			assertValidation(t, cfg.Validate(), tt.want)
+		})
+	}
+}
+
+// assertValidation fails unless err is nil when want is empty, or mentions
+// want
+func assertValidation(t *testing.T, err error, want string) {
+	t.Helper()
+	switch {
+	case want == "" && err != nil:
+		t.Fatalf("unexpected error: %v", err)
+	case want != "" && err == nil:
+		t.Fatalf("expected an error mentioning %q", want)
+	case want != "" && !strings.Contains(err.Error(), want):
+		t.Fatalf("error does not mention %q:\n%v", want, err)
+	}
+}
+
+func TestIsValidIdentifier(t *testing.T) {
+	tests := []struct {
+		name  string
+		valid bool
+	}{
+		{"sensor_data", true},
+		{"_readings2", true},
+		{"SensorData", true},
+		{"foo;DROP TABLE bar", false},
+		{`"weird name"`, false},
+		{"weird name", false},
+		{"2readings", false},
+		{"sensor-data", false},
+		{"public.sensor_data", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got := IsValidIdentifier(tt.name); got != tt.valid {
+			t.Errorf("IsValidIdentifier(%q) = %v, want %v", tt.name, got, tt.valid)
+		}
+	}
+}
+
+func TestValidateRejectsUnsafeTableNames(t *testing.T) {
+	for _, name := range []string{"foo;DROP TABLE bar", `"weird name"`} {
+		cfg := GetDefaultConfig()
+		cfg.Timescale.TableName = name
+		assertValidation(t, cfg.Validate(), fmt.Sprintf("timescale.table_name %q is not a valid SQL identifier", name))
+	}
+}
+
+func TestValidateDoesNotShowTheWebhookURL(t *testing.T) {
+	cfg := GetDefaultConfig()
+	cfg.Alert.WebhookURL = "ftp://hooks.example.com/T0KEN"
+	if err := cfg.Validate(); err == nil || strings.Contains(err.Error(), "T0KEN") {
+		t.Errorf("Validate() = %v, want an error without the URL", err)
+	}
+}
@@ -0,0 +1,177 @@
+package alert
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/ponytojas/go-mqtt-timescale/config"
+)
+
+const (
+	// postTimeout bounds each webhook request
+	postTimeout = 10 * time.Second
+	// maxCheckInterval is how often, at most, the failure rate is checked
+	maxCheckInterval = time.Second
+)
+
+// Alert states
+const (
+	statusFiring   = "firing"
+	statusResolved = "resolved"
+)
+
+// event is posted to the webhook when an alert fires or resolves. Text
+// makes it readable as a Slack incoming webhook message.
+type event struct {
+	Text     string    `json:"text"`
+	Status   string    `json:"status"`
+	Pipeline string    `json:"pipeline"`
+	Failures int       `json:"failures"`
+	Window   string    `json:"window"`
+	Time     time.Time `json:"time"`
+}
+
+// Alerter posts to a webhook once inserts have failed threshold times
+// within the window, and again once no insert has failed for a whole
+// window. Failures are only recorded on the insert path; the webhook is
+// called from a goroutine of its own.
+type Alerter struct {
+	url       string
+	pipeline  string
+	threshold int
+	window    time.Duration
+	client    *http.Client
+
+	mu       sync.Mutex
+	failures []time.Time // the most recent failures, at most threshold
+	firing   bool
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+// New starts an alerter for the inserts of pipeline, or returns nil when no
+// webhook is configured
+func New(cfg config.AlertConfig, pipeline string) *Alerter {
+	if cfg.WebhookURL == "" {
+		return nil
+	}
+
+	a := &Alerter{
+		url:       cfg.WebhookURL,
+		pipeline:  pipeline,
+		threshold: cfg.Threshold,
+		window:    cfg.Window,
+		client:    &http.Client{Timeout: postTimeout},
+		done:      make(chan struct{}),
+	}
+	a.wg.Add(1)
+	go a.run()
+	return a
+}
+
+// InsertFailed records a failed insert. It is safe to call on a nil
+// alerter.
+func (a *Alerter) InsertFailed() {
+	if a == nil {
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if len(a.failures) == a.threshold {
+		a.failures = a.failures[1:]
+	}
+	a.failures = append(a.failures, time.Now())
+}
+
+// run checks the failure rate until the alerter is closed
+func (a *Alerter) run() {
+	defer a.wg.Done()
+
+	interval := a.window / 10
+	if interval > maxCheckInterval {
+		interval = maxCheckInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			if ev := a.check(now); ev != nil {
+				a.post(ev)
+			}
+		case <-a.done:
+			return
+		}
+	}
+}
+
+// check returns the event to post when the alert fires or resolves at
+// now, or nil when its state is unchanged
+func (a *Alerter) check(now time.Time) *event {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	switch {
+	case !a.firing && len(a.failures) == a.threshold && now.Sub(a.failures[0]) <= a.window:
+		a.firing = true
+		return a.event(now, statusFiring, fmt.Sprintf(
+			"Inserts are failing in pipeline %s: %d failures within %s", a.pipeline, len(a.failures), a.window))
+	case a.firing && now.Sub(a.failures[len(a.failures)-1]) > a.window:
+		a.firing = false
+		a.failures = a.failures[:0]
+		return a.event(now, statusResolved, fmt.Sprintf(
+			"Inserts recovered in pipeline %s: no failures for %s", a.pipeline, a.window))
+	}
+	return nil
+}
+
+// event creates an event with the current failure count
+func (a *Alerter) event(now time.Time, status, text string) *event {
+	return &event{
+		Text:     text,
+		Status:   status,
+		Pipeline: a.pipeline,
+		Failures: len(a.failures),
+		Window:   a.window.String(),
+		Time:     now.UTC(),
+	}
+}
+
+// post sends ev to the webhook, logging a failure instead of retrying
+func (a *Alerter) post(ev *event) {
+	body, err := json.Marshal(ev)
+	if err != nil {
+		slog.Error("Error encoding alert", "error", err)
+		return
+	}
+
+	resp, err := a.client.Post(a.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		slog.Error("Error posting alert", "pipeline", a.pipeline, "status", ev.Status, "error", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		slog.Error("Alert webhook rejected the alert", "pipeline", a.pipeline, "status", ev.Status, "code", resp.StatusCode)
+		return
+	}
+	slog.Info("Posted alert", "pipeline", a.pipeline, "status", ev.Status)
+}
+
+// Close stops checking the failure rate, waiting for a webhook request in
+// progress. It is safe to call on a nil alerter.
+func (a *Alerter) Close() {
+	if a == nil {
+		return
+	}
+	close(a.done)
+	a.wg.Wait()
+}
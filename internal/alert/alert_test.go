@@ -0,0 +1,207 @@
+package alert
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ponytojas/go-mqtt-timescale/config"
+)
+
+// webhook is a fake webhook server recording the events posted to it
+type webhook struct {
+	*httptest.Server
+	mu     sync.Mutex
+	events []event
+}
+
+// newWebhook starts a webhook answering with code, closed once the test
+// ends
+func newWebhook(t *testing.T, code int) *webhook {
+	t.Helper()
+	w := &webhook{}
+	w.Server = httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		var ev event
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("webhook got %s with content type %q, want a JSON post", r.Method, r.Header.Get("Content-Type"))
+		}
+		if err := json.NewDecoder(r.Body).Decode(&ev); err != nil {
+			t.Errorf("webhook body is not an event: %v", err)
+		}
+		w.mu.Lock()
+		w.events = append(w.events, ev)
+		w.mu.Unlock()
+		rw.WriteHeader(code)
+	}))
+	t.Cleanup(w.Close)
+	return w
+}
+
+// statuses returns the status of each event posted so far
+func (w *webhook) statuses() []string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	statuses := make([]string, len(w.events))
+	for i, ev := range w.events {
+		statuses[i] = ev.Status
+	}
+	return statuses
+}
+
+// waitForPosts waits until the webhook received n events
+func waitForPosts(t *testing.T, w *webhook, n int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for len(w.statuses()) < n {
+		if time.Now().After(deadline) {
+			t.Fatalf("webhook received %v, want %d posts", w.statuses(), n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestNewWithoutAWebhookIsDisabled(t *testing.T) {
+	a := New(config.GetDefaultConfig().Alert, "default")
+	if a != nil {
+		t.Fatalf("New without a webhook = %v, want nil", a)
+	}
+	// A nil alerter can sit on the insert path unconditionally
+	a.InsertFailed()
+	a.Close()
+}
+
+func TestCheck(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	ago := func(d ...time.Duration) []time.Time {
+		times := make([]time.Time, len(d))
+		for i, d := range d {
+			times[i] = now.Add(-d)
+		}
+		return times
+	}
+	tests := []struct {
+		name       string
+		firing     bool
+		failures   []time.Time
+		wantStatus string // "" when nothing is posted
+		wantFiring bool
+	}{
+		{"no failures", false, nil, "", false},
+		{"below the threshold", false, ago(20*time.Second, 10*time.Second), "", false},
+		{"threshold within the window", false, ago(50*time.Second, 30*time.Second, 10*time.Second), statusFiring, true},
+		{"threshold spread over more than the window", false, ago(90*time.Second, 30*time.Second, 10*time.Second), "", false},
+		{"still failing", true, ago(50*time.Second, 30*time.Second, 10*time.Second), "", true},
+		// Firing is debounced: one failure a window keeps the alert open
+		{"failing slowly", true, ago(50 * time.Second), "", true},
+		{"no failures for a window", true, ago(3*time.Minute, 2*time.Minute, 61*time.Second), statusResolved, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := &Alerter{pipeline: "default", threshold: 3, window: time.Minute, firing: tt.firing, failures: tt.failures}
+			ev := a.check(now)
+			if a.firing != tt.wantFiring {
+				t.Errorf("firing = %v, want %v", a.firing, tt.wantFiring)
+			}
+			if tt.wantStatus == "" {
+				if ev != nil {
+					t.Errorf("posted %+v, want nothing", ev)
+				}
+				return
+			}
+			if ev == nil || ev.Status != tt.wantStatus {
+				t.Fatalf("posted %+v, want a %s event", ev, tt.wantStatus)
+			}
+			if ev.Pipeline != "default" || ev.Window != "1m0s" || !ev.Time.Equal(now) || ev.Text == "" {
+				t.Errorf("event = %+v", ev)
+			}
+		})
+	}
+}
+
+func TestFailuresAreBoundedByTheThreshold(t *testing.T) {
+	a := &Alerter{threshold: 3, window: time.Minute}
+	for i := 0; i < 100; i++ {
+		a.InsertFailed()
+	}
+	if len(a.failures) != 3 {
+		t.Errorf("kept %d failures, want the latest 3", len(a.failures))
+	}
+}
+
+func TestWebhookFiresAndRecovers(t *testing.T) {
+	w := newWebhook(t, http.StatusOK)
+	a := New(config.AlertConfig{WebhookURL: w.URL, Threshold: 3, Window: 200 * time.Millisecond}, "plant-a")
+	t.Cleanup(a.Close)
+
+	for i := 0; i < 3; i++ {
+		a.InsertFailed()
+	}
+	waitForPosts(t, w, 1)
+
+	// The alert resolves once no insert failed for a whole window
+	waitForPosts(t, w, 2)
+	if got := w.statuses(); len(got) != 2 || got[0] != statusFiring || got[1] != statusResolved {
+		t.Fatalf("posted %v, want firing then resolved", got)
+	}
+	w.mu.Lock()
+	firing := w.events[0]
+	w.mu.Unlock()
+	if firing.Pipeline != "plant-a" || firing.Failures != 3 || firing.Window != "200ms" {
+		t.Errorf("firing event = %+v", firing)
+	}
+
+	// Nothing more is posted while inserts succeed
+	time.Sleep(300 * time.Millisecond)
+	if got := w.statuses(); len(got) != 2 {
+		t.Errorf("posted %v after recovering, want no more", got)
+	}
+}
+
+func TestBelowTheThresholdNothingIsPosted(t *testing.T) {
+	w := newWebhook(t, http.StatusOK)
+	a := New(config.AlertConfig{WebhookURL: w.URL, Threshold: 3, Window: 100 * time.Millisecond}, "default")
+	a.InsertFailed()
+	a.InsertFailed()
+	time.Sleep(300 * time.Millisecond)
+	a.Close()
+	if got := w.statuses(); len(got) != 0 {
+		t.Errorf("posted %v, want nothing", got)
+	}
+}
+
+func TestInsertFailedDoesNotWaitForTheWebhook(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) { <-release }))
+	t.Cleanup(server.Close)
+
+	a := New(config.AlertConfig{WebhookURL: server.URL, Threshold: 1, Window: 100 * time.Millisecond}, "default")
+	t.Cleanup(a.Close)
+	// Close waits for the post in progress
+	t.Cleanup(func() { close(release) })
+	a.InsertFailed()
+
+	// The webhook hangs, yet failures keep being recorded at once
+	time.Sleep(50 * time.Millisecond)
+	start := time.Now()
+	for i := 0; i < 100; i++ {
+		a.InsertFailed()
+	}
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Errorf("recording failures took %s while the webhook hung", elapsed)
+	}
+}
+
+func TestRejectedPostDoesNotStopAlerting(t *testing.T) {
+	w := newWebhook(t, http.StatusInternalServerError)
+	a := New(config.AlertConfig{WebhookURL: w.URL, Threshold: 1, Window: 100 * time.Millisecond}, "default")
+	t.Cleanup(a.Close)
+
+	a.InsertFailed()
+	waitForPosts(t, w, 2)
+	if got := w.statuses(); got[0] != statusFiring || got[1] != statusResolved {
+		t.Errorf("posted %v, want firing then resolved", got)
+	}
+}
@@ -0,0 +1,72 @@
+package database
+
+import (
+	"sync"
+	"time"
+
+	"github.com/ponytojas/go-mqtt-timescale/config"
+	"github.com/ponytojas/go-mqtt-timescale/internal/metrics"
+)
+
+// batchSizer adapts the batch size to the observed insert latency. It halves
+// the size when an insert takes longer than the target and grows it by a
+// tenth when a full batch is inserted within the target, so latency stays
+// bounded under load while quiet periods go back to larger, cheaper batches.
+type batchSizer struct {
+	min    int
+	max    int
+	target time.Duration
+
+	mu   sync.Mutex
+	size int
+}
+
+// newBatchSizer creates a sizer starting at the configured batch size
+func newBatchSizer(cfg config.TimescaleConfig) *batchSizer {
+	b := &batchSizer{
+		min:    cfg.MinBatchSize,
+		max:    cfg.MaxBatchSize,
+		target: cfg.TargetLatency,
+		size:   cfg.BatchSize,
+	}
+	metrics.BatchSize.Set(float64(b.size))
+	return b
+}
+
+// Size returns the current batch size
+func (b *batchSizer) Size() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.size
+}
+
+// Observe adjusts the batch size after an insert of rows took latency.
+// Partial batches written by the flush timer don't show whether a larger
+// batch would still be fast, so they only ever shrink the size.
+func (b *batchSizer) Observe(rows int, latency time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	size := b.size
+	switch {
+	case latency > b.target:
+		size /= 2
+	case rows >= b.size:
+		step := b.size / 10
+		if step < 1 {
+			step = 1
+		}
+		size += step
+	}
+	if size < b.min {
+		size = b.min
+	}
+	if size > b.max {
+		size = b.max
+	}
+
+	if size != b.size {
+		b.size = size
+		metrics.BatchSize.Set(float64(size))
+	}
+}
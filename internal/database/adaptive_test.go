@@ -0,0 +1,85 @@
+package database
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/ponytojas/go-mqtt-timescale/config"
+	"github.com/ponytojas/go-mqtt-timescale/internal/metrics"
+)
+
+// observation is an insert of rows that took latency
+type observation struct {
+	rows    int
+	latency time.Duration
+}
+
+func TestBatchSizer(t *testing.T) {
+	fast, slow := 10*time.Millisecond, time.Second
+	tests := []struct {
+		name     string
+		start    int
+		observed []observation
+		want     []int // the size after each observation
+	}{
+		{"grows by a tenth while fast", 100, []observation{{100, fast}, {110, fast}, {121, fast}}, []int{110, 121, 133}},
+		{"grows by at least one", 10, []observation{{10, fast}, {11, fast}}, []int{11, 12}},
+		{"halves when slow", 400, []observation{{400, slow}, {200, slow}}, []int{200, 100}},
+		{"latency at the target is fast", 100, []observation{{100, 200 * time.Millisecond}}, []int{110}},
+		{"partial batches don't grow it", 100, []observation{{40, fast}, {99, fast}}, []int{100, 100}},
+		{"partial batches shrink it", 100, []observation{{40, slow}}, []int{50}},
+		{"bounded below", 30, []observation{{30, slow}, {15, slow}, {10, slow}}, []int{15, 10, 10}},
+		{"bounded above", 950, []observation{{950, fast}, {1000, fast}}, []int{1000, 1000}},
+		{"recovers after a slow insert", 100, []observation{{100, slow}, {50, fast}, {55, fast}}, []int{50, 55, 60}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newBatchSizer(config.TimescaleConfig{
+				BatchSize:     tt.start,
+				MinBatchSize:  10,
+				MaxBatchSize:  1000,
+				TargetLatency: 200 * time.Millisecond,
+			})
+			if got := b.Size(); got != tt.start {
+				t.Fatalf("initial size = %d, want %d", got, tt.start)
+			}
+			for i, o := range tt.observed {
+				b.Observe(o.rows, o.latency)
+				if got := b.Size(); got != tt.want[i] {
+					t.Fatalf("after %d rows in %s: size = %d, want %d", o.rows, o.latency, got, tt.want[i])
+				}
+				// The effective size is reported by the metrics and /stats
+				if got := testutil.ToFloat64(metrics.BatchSize); got != float64(tt.want[i]) {
+					t.Errorf("batch size gauge = %v, want %d", got, tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestBatchSizeIsAdaptiveWhenEnabled(t *testing.T) {
+	tests := []struct {
+		name     string
+		adaptive bool
+		want     int
+	}{
+		{"fixed", false, 100},
+		{"adaptive", true, 50},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := config.GetDefaultConfig()
+			cfg.Timescale.BatchSize = 100
+			db := newTestDB(cfg)
+			if tt.adaptive {
+				db.batchSizer = newBatchSizer(cfg.Timescale)
+				db.batchSizer.Observe(100, cfg.Timescale.TargetLatency+time.Second)
+			}
+			if got := db.batchSize(); got != tt.want {
+				t.Errorf("batch size = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
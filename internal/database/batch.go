@@ -0,0 +1,318 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/ponytojas/go-mqtt-timescale/internal/metrics"
+	"github.com/ponytojas/go-mqtt-timescale/internal/models"
+)
+
+// EnqueueSensorData adds sensor data to the insert buffer of the default table
+func (db *TimescaleDB) EnqueueSensorData(ctx context.Context, data *models.SensorData) error {
+	return db.EnqueueSensorDataInto(ctx, db.config.Timescale.TableName, data)
+}
+
+// errDatabaseClosed is returned for readings enqueued once the database is
+// closed
+var errDatabaseClosed = errors.New("database is closed")
+
+// queuedReading is a reading waiting for the writer goroutine, along with
+// the span of the message it came from
+type queuedReading struct {
+	table string
+	data  *models.SensorData
+	span  trace.SpanContext
+}
+
+// EnqueueSensorDataInto queues sensor data for the writer goroutine, which
+// buffers it per table. When the queue is full it blocks until there is
+// room or ctx is done, or drops the reading if the overflow policy is drop.
+// Once the database is closed readings are rejected with an error.
+func (db *TimescaleDB) EnqueueSensorDataInto(ctx context.Context, tableName string, data *models.SensorData) error {
+	// Close waits for enqueues in progress before draining the queue a last
+	// time, so a reading is either rejected here or written
+	db.closeMu.RLock()
+	defer db.closeMu.RUnlock()
+	select {
+	case <-db.done:
+		return errDatabaseClosed
+	default:
+	}
+
+	db.stampIngestTime(data)
+	item := queuedReading{table: tableName, data: data, span: trace.SpanContextFromContext(ctx)}
+
+	if db.config.Ingest.OverflowPolicy == "drop" {
+		select {
+		case db.queue <- item:
+		default:
+			metrics.QueueDropped.Inc()
+			slog.Debug("Dropping sensor data, writer queue is full", "table", tableName, "device_id", data.Device_ID)
+			return nil
+		}
+	} else {
+		select {
+		case db.queue <- item:
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-db.done:
+			return errDatabaseClosed
+		}
+	}
+
+	metrics.QueueDepth.Set(float64(len(db.queue)))
+	return nil
+}
+
+// writeLoop moves queued readings into the insert buffers until the database
+// is closed, then drains whatever is still queued
+func (db *TimescaleDB) writeLoop() {
+	defer db.wg.Done()
+
+	for {
+		select {
+		case item := <-db.queue:
+			if err := db.buffer(item); err != nil {
+				slog.Error("Error writing sensor data", "table", item.table, "error", err)
+			}
+		case <-db.flushNow:
+			if err := errors.Join(db.drainQueue(), db.Flush(context.Background())); err != nil {
+				slog.Error("Error flushing buffered sensor data", "error", err)
+			}
+		case <-db.done:
+			if err := db.drainQueue(); err != nil {
+				slog.Error("Error writing sensor data", "error", err)
+			}
+			return
+		}
+	}
+}
+
+// drainQueue moves every reading currently queued into the insert buffers,
+// returning the errors of the full batches that failed to be written
+func (db *TimescaleDB) drainQueue() error {
+	var errs []error
+	for {
+		select {
+		case item := <-db.queue:
+			errs = append(errs, db.buffer(item))
+		default:
+			return errors.Join(errs...)
+		}
+	}
+}
+
+// RequestFlush asks the writer goroutine to write every queued and buffered
+// reading without waiting for a full batch or the flush interval, so
+// readings already received are stored even if no more arrive. It doesn't
+// wait for the write.
+func (db *TimescaleDB) RequestFlush() {
+	select {
+	case db.flushNow <- struct{}{}:
+	default:
+		// A flush is already pending
+	}
+}
+
+// buffer adds a reading to its table's insert buffer. The buffer is written
+// once it reaches the configured batch size, otherwise it is flushed when
+// flushLoop requests it every flush interval.
+func (db *TimescaleDB) buffer(item queuedReading) error {
+	metrics.QueueDepth.Set(float64(len(db.queue)))
+
+	db.mu.Lock()
+	db.buffers[item.table] = append(db.buffers[item.table], item.data)
+	if item.span.IsValid() {
+		db.links[item.table] = append(db.links[item.table], trace.Link{SpanContext: item.span})
+	}
+	var batch []*models.SensorData
+	var links []trace.Link
+	if len(db.buffers[item.table]) >= db.batchSize() {
+		batch, links = db.buffers[item.table], db.links[item.table]
+		delete(db.buffers, item.table)
+		delete(db.links, item.table)
+	}
+	db.mu.Unlock()
+
+	if batch == nil {
+		return nil
+	}
+	return db.writeBatch(withLinks(context.Background(), links), item.table, batch)
+}
+
+// batchSize returns the number of buffered rows that triggers a write
+func (db *TimescaleDB) batchSize() int {
+	if db.batchSizer != nil {
+		return db.batchSizer.Size()
+	}
+	return db.config.Timescale.BatchSize
+}
+
+// Flush writes all buffered sensor data to the database, returning the
+// errors of every table that failed to be written
+func (db *TimescaleDB) Flush(ctx context.Context) error {
+	db.mu.Lock()
+	buffers, links := db.buffers, db.links
+	db.buffers = make(map[string][]*models.SensorData)
+	db.links = make(map[string][]trace.Link)
+	db.mu.Unlock()
+
+	var errs []error
+	for tableName, batch := range buffers {
+		errs = append(errs, db.writeBatch(withLinks(ctx, links[tableName]), tableName, batch))
+	}
+	return errors.Join(errs...)
+}
+
+// writeBatch inserts a batch, spooling it to disk if the database is
+// unreachable or ctx is cancelled so it can be replayed later. Batches the
+// database rejects outright are not spooled since replaying would fail too.
+func (db *TimescaleDB) writeBatch(ctx context.Context, tableName string, batch []*models.SensorData) error {
+	err := db.InsertSensorDataBatchInto(ctx, tableName, batch)
+	if err != nil && db.spool != nil && (isRetryable(err) || ctx.Err() != nil) {
+		spoolErr := db.spool.Enqueue(tableName, batch)
+		if spoolErr == nil {
+			slog.Warn("Spooled sensor data after failed insert", "table", tableName, "rows", len(batch), "error", err)
+			return nil
+		}
+		err = errors.Join(err, spoolErr)
+	}
+	if err != nil {
+		metrics.RowsLost.Add(float64(len(batch)))
+	}
+	return err
+}
+
+// replayLoop periodically replays the spool into the database until the
+// database is closed
+func (db *TimescaleDB) replayLoop(interval time.Duration) {
+	defer db.wg.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if db.spool.Len() == 0 {
+				continue
+			}
+			if err := db.Ping(context.Background()); err != nil {
+				slog.Debug("Database still unreachable, not replaying spool", "error", err)
+				continue
+			}
+			replayed, err := db.spool.Replay(context.Background(), db.InsertSensorDataBatchInto, isRetryable)
+			if replayed > 0 {
+				slog.Info("Replayed spooled sensor data", "rows", replayed)
+			}
+			if err != nil {
+				slog.Warn("Error replaying spooled sensor data", "error", err)
+			}
+		case <-db.done:
+			return
+		}
+	}
+}
+
+// flushLoop asks the writer goroutine to flush the buffers every interval
+// until the database is closed. Only the writer goroutine writes batches, so
+// a table's batches are written one at a time in the order their readings
+// were queued, even while a write is retrying.
+func (db *TimescaleDB) flushLoop(interval time.Duration) {
+	defer db.wg.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			db.RequestFlush()
+		case <-db.done:
+			return
+		}
+	}
+}
+
+// InsertSensorDataBatch inserts multiple sensor data rows into the default
+// table using CopyFrom
+func (db *TimescaleDB) InsertSensorDataBatch(ctx context.Context, batch []*models.SensorData) error {
+	return db.InsertSensorDataBatchInto(ctx, db.config.Timescale.TableName, batch)
+}
+
+// InsertSensorDataBatchInto inserts multiple sensor data rows into the given
+// table using CopyFrom
+func (db *TimescaleDB) InsertSensorDataBatchInto(ctx context.Context, tableName string, batch []*models.SensorData) error {
+	if len(batch) == 0 {
+		return nil
+	}
+	ident, err := db.quoteTable(tableName)
+	if err != nil {
+		return err
+	}
+
+	rows := make([][]interface{}, len(batch))
+	for i, data := range batch {
+		rows[i] = db.row(data)
+	}
+
+	statement := "COPY " + ident
+	if db.config.Timescale.Upsert {
+		statement = db.insertSQL(ident)
+	}
+	ctx, span := startInsertSpan(ctx, tableName, statement, len(batch))
+	defer span.End()
+
+	// COPY and the upsert transaction are atomic, so a failed attempt can be
+	// retried without duplicating rows
+	var count int64
+	err = db.withRetry(ctx, func(ctx context.Context) error {
+		ctx, cancel := db.withInsertTimeout(ctx)
+		defer cancel()
+
+		start := time.Now()
+		var err error
+		if db.config.Timescale.Upsert {
+			count, err = db.upsertBatch(ctx, ident, rows)
+		} else {
+			count, err = db.pool.CopyFrom(
+				ctx,
+				db.tableIdentifier(tableName),
+				db.columns,
+				pgx.CopyFromRows(rows),
+			)
+		}
+		elapsed := time.Since(start)
+		metrics.DBInsertDuration.Observe(elapsed.Seconds())
+
+		// Only successful and timed out attempts say how fast the database is
+		if db.batchSizer != nil && (err == nil || errors.Is(err, context.DeadlineExceeded)) {
+			db.batchSizer.Observe(len(batch), elapsed)
+		}
+
+		if err != nil {
+			metrics.DBInsertErrors.Inc()
+		}
+		return err
+	})
+	if err != nil {
+		spanError(span, err)
+		err = fmt.Errorf("failed to copy %d sensor data rows into %s: %w", len(batch), tableName, err)
+		db.failed(tableName, batch, err)
+		return err
+	}
+
+	metrics.DBInserts.Add(float64(count))
+	slog.Debug("DB COPY", "table", tableName, "rows", count)
+	db.inserted(tableName, batch)
+	db.updateLatest(ctx, batch)
+
+	return nil
+}
@@ -0,0 +1,398 @@
+package database
+
+import (
+	"context"
+	"log/slog"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/ponytojas/go-mqtt-timescale/config"
+	"github.com/ponytojas/go-mqtt-timescale/internal/metrics"
+	"github.com/ponytojas/go-mqtt-timescale/internal/models"
+)
+
+// newStalledDB returns a database whose writer queue holds size readings
+// and is never drained, as if the writer were stuck on a slow insert
+func newStalledDB(policy string, size int) *TimescaleDB {
+	cfg := config.GetDefaultConfig()
+	cfg.Ingest.OverflowPolicy = policy
+	db := newTestDB(cfg)
+	db.queue = make(chan queuedReading, size)
+	db.done = make(chan struct{})
+	return db
+}
+
+// enqueue queues a reading of d1 in the background, returning its result
+func enqueue(ctx context.Context, db *TimescaleDB) <-chan error {
+	result := make(chan error, 1)
+	go func() {
+		result <- db.EnqueueSensorData(ctx, &models.SensorData{Device_ID: "d1", Timestamp: time.Now()})
+	}()
+	return result
+}
+
+func TestDropPolicyDropsWhenTheQueueIsFull(t *testing.T) {
+	db := newStalledDB("drop", 2)
+	before := testutil.ToFloat64(metrics.QueueDropped)
+
+	for i := 0; i < 5; i++ {
+		select {
+		case err := <-enqueue(context.Background(), db):
+			if err != nil {
+				t.Fatalf("enqueue %d: %v", i+1, err)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("enqueue %d blocked", i+1)
+		}
+	}
+	if len(db.queue) != 2 {
+		t.Errorf("queue holds %d readings, want 2", len(db.queue))
+	}
+	if dropped := testutil.ToFloat64(metrics.QueueDropped) - before; dropped != 3 {
+		t.Errorf("dropped %v readings, want 3", dropped)
+	}
+}
+
+func TestBlockPolicyWaitsForRoom(t *testing.T) {
+	db := newStalledDB("block", 2)
+	for i := 0; i < 2; i++ {
+		if err := <-enqueue(context.Background(), db); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	blocked := enqueue(context.Background(), db)
+	select {
+	case err := <-blocked:
+		t.Fatalf("enqueue into a full queue returned %v, want it to block", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// The writer catching up makes room
+	<-db.queue
+	select {
+	case err := <-blocked:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("enqueue still blocked with room in the queue")
+	}
+}
+
+func TestBlockPolicyGivesUp(t *testing.T) {
+	tests := []struct {
+		name    string
+		unblock func(db *TimescaleDB, cancel context.CancelFunc)
+		want    string
+	}{
+		{"cancelled context", func(_ *TimescaleDB, cancel context.CancelFunc) { cancel() }, context.Canceled.Error()},
+		{"closed database", func(db *TimescaleDB, _ context.CancelFunc) { close(db.done) }, "database is closed"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := newStalledDB("block", 1)
+			if err := <-enqueue(context.Background(), db); err != nil {
+				t.Fatal(err)
+			}
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			blocked := enqueue(ctx, db)
+
+			tt.unblock(db, cancel)
+			select {
+			case err := <-blocked:
+				if err == nil || err.Error() != tt.want {
+					t.Errorf("error = %v, want %q", err, tt.want)
+				}
+			case <-time.After(time.Second):
+				t.Fatal("enqueue still blocked")
+			}
+		})
+	}
+}
+
+func TestEnqueueAfterCloseIsRejected(t *testing.T) {
+	for _, policy := range []string{"drop", "block"} {
+		t.Run(policy, func(t *testing.T) {
+			db := newStalledDB(policy, 1)
+			close(db.done)
+			before := testutil.ToFloat64(metrics.QueueDropped)
+
+			select {
+			case err := <-enqueue(context.Background(), db):
+				if err == nil || err.Error() != "database is closed" {
+					t.Errorf("error = %v, want %q", err, "database is closed")
+				}
+			case <-time.After(time.Second):
+				t.Fatal("enqueue blocked")
+			}
+			if len(db.queue) != 0 {
+				t.Errorf("queue holds %d readings after close, want 0", len(db.queue))
+			}
+			if dropped := testutil.ToFloat64(metrics.QueueDropped) - before; dropped != 0 {
+				t.Errorf("dropped %v readings, want them rejected", dropped)
+			}
+		})
+	}
+}
+
+func TestCloseKeepsEveryAcceptedReading(t *testing.T) {
+	tests := []struct {
+		policy    string
+		queueSize int
+	}{
+		// Room for every reading, so the drop policy never drops
+		{"drop", 4000},
+		// Enqueues wait for room as the database closes
+		{"block", 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.policy, func(t *testing.T) {
+			captureLogs(t, slog.LevelError)
+			cfg := config.GetDefaultConfig()
+			cfg.Ingest.OverflowPolicy = tt.policy
+			cfg.Ingest.QueueSize = tt.queueSize
+			cfg.Timescale.BatchSize = 100000
+			db := unreachableDB(t, cfg)
+			db.queue = make(chan queuedReading, cfg.Ingest.QueueSize)
+			db.flushNow = make(chan struct{}, 1)
+			db.buffers = make(map[string][]*models.SensorData)
+			db.links = make(map[string][]trace.Link)
+			db.done = make(chan struct{})
+			db.unregisterPool = func() {}
+
+			var written atomic.Int64
+			db.SetErrorHook(func(_ string, batch []*models.SensorData, _ error) { written.Add(int64(len(batch))) })
+			db.wg.Add(1)
+			go db.writeLoop()
+
+			// Enqueue from several goroutines while the database closes
+			var accepted atomic.Int64
+			var wg sync.WaitGroup
+			start := make(chan struct{})
+			for i := 0; i < 8; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					<-start
+					for j := 0; j < 500; j++ {
+						if err := db.EnqueueSensorData(context.Background(), &models.SensorData{Device_ID: "d1", Timestamp: time.Now()}); err == nil {
+							accepted.Add(1)
+						}
+					}
+				}()
+			}
+			close(start)
+			for accepted.Load() < 100 {
+				runtime.Gosched()
+			}
+			// Every write fails, which Close reports
+			if err := db.Close(context.Background()); err == nil {
+				t.Error("Close returned no error for rows it couldn't write")
+			}
+			wg.Wait()
+
+			if got, want := written.Load(), accepted.Load(); got != want {
+				t.Errorf("wrote %d readings on close, want the %d accepted", got, want)
+			}
+		})
+	}
+}
+
+func TestCloseReturnsTheFlushError(t *testing.T) {
+	captureLogs(t, slog.LevelError)
+	cfg := config.GetDefaultConfig()
+	cfg.Timescale.BatchSize = 100
+	db := unreachableDB(t, cfg)
+	db.queue = make(chan queuedReading, cfg.Ingest.QueueSize)
+	db.buffers = make(map[string][]*models.SensorData)
+	db.links = make(map[string][]trace.Link)
+	db.done = make(chan struct{})
+	db.unregisterPool = func() {}
+
+	for _, table := range []string{"sensor_data", "outdoor"} {
+		if err := db.EnqueueSensorDataInto(context.Background(), table, &models.SensorData{Device_ID: "d1", Timestamp: time.Now()}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err := db.Close(context.Background())
+	if err == nil {
+		t.Fatal("Close returned no error for rows it couldn't write")
+	}
+	for _, want := range []string{"1 sensor data rows into sensor_data", "1 sensor data rows into outdoor"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error = %q, want it to mention %q", err, want)
+		}
+	}
+}
+
+// writingDB returns an unreachable database with its writer goroutine
+// running and no flush interval, so buffered readings are only written
+// once the batch fills or a flush is requested. It reports the rows of
+// every failed write on the returned channel.
+func writingDB(t *testing.T) (*TimescaleDB, <-chan int) {
+	t.Helper()
+	captureLogs(t, slog.LevelError)
+	cfg := config.GetDefaultConfig()
+	cfg.Timescale.BatchSize = 100
+	db := unreachableDB(t, cfg)
+	db.queue = make(chan queuedReading, cfg.Ingest.QueueSize)
+	db.flushNow = make(chan struct{}, 1)
+	db.buffers = make(map[string][]*models.SensorData)
+	db.links = make(map[string][]trace.Link)
+	db.done = make(chan struct{})
+
+	written := make(chan int, 10)
+	db.SetErrorHook(func(_ string, batch []*models.SensorData, _ error) { written <- len(batch) })
+	db.wg.Add(1)
+	go db.writeLoop()
+	t.Cleanup(func() {
+		close(db.done)
+		db.wg.Wait()
+	})
+	return db, written
+}
+
+func TestRequestFlushWritesAPartialBatch(t *testing.T) {
+	db, written := writingDB(t)
+	for i := 0; i < 3; i++ {
+		if err := db.EnqueueSensorData(context.Background(), &models.SensorData{Device_ID: "d1", Timestamp: time.Now()}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	select {
+	case rows := <-written:
+		t.Fatalf("wrote %d rows of a partial batch before a flush was requested", rows)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	db.RequestFlush()
+	select {
+	case rows := <-written:
+		if rows != 3 {
+			t.Errorf("flushed %d rows, want the 3 queued", rows)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("requesting a flush wrote nothing")
+	}
+}
+
+func TestRequestFlushDoesNotBlock(t *testing.T) {
+	// Without a writer to take them, requests coalesce into one pending flush
+	db := newTestDB(config.GetDefaultConfig())
+	db.flushNow = make(chan struct{}, 1)
+
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				db.RequestFlush()
+			}()
+		}
+		wg.Wait()
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("RequestFlush blocked while a flush was pending")
+	}
+	if len(db.flushNow) != 1 {
+		t.Errorf("%d flushes pending, want 1", len(db.flushNow))
+	}
+}
+
+func TestFlushIntervalWritesBatchesInOrder(t *testing.T) {
+	captureLogs(t, slog.LevelError)
+	cfg := config.GetDefaultConfig()
+	cfg.Timescale.BatchSize = 2
+	db := unreachableDB(t, cfg)
+	db.queue = make(chan queuedReading, cfg.Ingest.QueueSize)
+	db.flushNow = make(chan struct{}, 1)
+	db.buffers = make(map[string][]*models.SensorData)
+	db.links = make(map[string][]trace.Link)
+	db.done = make(chan struct{})
+
+	// The first write stalls until released, like one backing off between
+	// retries, and every write records the devices of its batch
+	release := make(chan struct{})
+	var releaseOnce sync.Once
+	unstall := func() { releaseOnce.Do(func() { close(release) }) }
+	var mu sync.Mutex
+	var writes []string
+	db.SetErrorHook(func(_ string, batch []*models.SensorData, _ error) {
+		var devices []string
+		for _, data := range batch {
+			devices = append(devices, data.Device_ID)
+		}
+		mu.Lock()
+		writes = append(writes, strings.Join(devices, ","))
+		first := len(writes) == 1
+		mu.Unlock()
+		if first {
+			<-release
+		}
+	})
+	written := func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return slices.Clone(writes)
+	}
+	waitForWrites := func(n int) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for len(written()) < n {
+			if time.Now().After(deadline) {
+				t.Fatalf("timed out waiting for %d writes, got %v", n, written())
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	db.wg.Add(2)
+	go db.writeLoop()
+	go db.flushLoop(10 * time.Millisecond)
+	t.Cleanup(func() {
+		unstall()
+		close(db.done)
+		db.wg.Wait()
+	})
+
+	enqueue := func(device string) {
+		t.Helper()
+		if err := db.EnqueueSensorData(context.Background(), &models.SensorData{Device_ID: device, Timestamp: time.Now()}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A partial batch flushed on the interval stalls
+	enqueue("d1")
+	waitForWrites(1)
+
+	// A full batch queued meanwhile waits for the stalled one
+	enqueue("d2")
+	enqueue("d3")
+	time.Sleep(100 * time.Millisecond)
+	if got := written(); len(got) != 1 {
+		t.Fatalf("wrote %v while the first batch was still being written", got)
+	}
+
+	unstall()
+	waitForWrites(2)
+	if got, want := written(), []string{"d1", "d2,d3"}; !slices.Equal(got, want) {
+		t.Errorf("wrote batches %v, want %v", got, want)
+	}
+}
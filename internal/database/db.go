@@ -2,54 +2,317 @@ package database
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"go.opentelemetry.io/otel/trace"
 
 	"github.com/ponytojas/go-mqtt-timescale/config"
+	"github.com/ponytojas/go-mqtt-timescale/internal/metrics"
 	"github.com/ponytojas/go-mqtt-timescale/internal/models"
+	"github.com/ponytojas/go-mqtt-timescale/internal/spool"
 )
 
 // TimescaleDB handles database operations
 type TimescaleDB struct {
-	conn   *pgx.Conn
+	pool   *pgxpool.Pool
 	config *config.Config
+
+	// columns are written for every reading, in the order row returns them
+	columns []string
+
+	// queue carries readings from the MQTT handlers to the writer goroutine
+	queue chan queuedReading
+
+	// flushNow asks the writer goroutine to write everything queued and
+	// buffered, see RequestFlush
+	flushNow chan struct{}
+
+	// Buffered rows per table waiting to be written with CopyFrom, with
+	// links to the traces of the messages they came from
+	mu      sync.Mutex
+	buffers map[string][]*models.SensorData
+	links   map[string][]trace.Link
+	done    chan struct{}
+	wg      sync.WaitGroup
+
+	// closeMu is held for reading by enqueues and for writing by Close once
+	// done is closed, see EnqueueSensorDataInto
+	closeMu sync.RWMutex
+
+	// spool keeps batches that failed to insert until the database recovers
+	spool *spool.Spool
+
+	// devices caches device metadata, nil when enrichment is disabled
+	devices *deviceCache
+
+	// insertHook is called with every batch written to the database
+	insertHook atomic.Pointer[InsertHook]
+
+	// batchSizer adapts the batch size, nil unless adaptive batching is enabled
+	batchSizer *batchSizer
+
+	// errorHook is called with every batch that failed to insert
+	errorHook atomic.Pointer[ErrorHook]
+
+	// verboseInserts logs every single-row insert, see SetVerboseInserts
+	verboseInserts atomic.Bool
+
+	// unregisterPool removes the pool from the pool metrics
+	unregisterPool func()
+}
+
+// SetVerboseInserts sets whether every single-row insert and its affected
+// rows are logged at debug level. It may be changed while running.
+func (db *TimescaleDB) SetVerboseInserts(verbose bool) {
+	db.verboseInserts.Store(verbose)
+}
+
+// InsertHook is called with the rows written to a table
+type InsertHook func(tableName string, batch []*models.SensorData)
+
+// SetInsertHook sets a function called after rows are written to the
+// database, including rows replayed from the spool
+func (db *TimescaleDB) SetInsertHook(hook InsertHook) {
+	db.insertHook.Store(&hook)
 }
 
-// NewTimescaleDB creates a new TimescaleDB instance
-func NewTimescaleDB(cfg *config.Config) (*TimescaleDB, error) {
-	conn, err := pgx.Connect(context.Background(), cfg.GetDBConnString())
+// inserted records the insert and calls the insert hook, if any
+func (db *TimescaleDB) inserted(tableName string, batch []*models.SensorData) {
+	metrics.RecordInsert()
+	if hook := db.insertHook.Load(); hook != nil {
+		(*hook)(tableName, batch)
+	}
+}
+
+// ErrorHook is called with rows that failed to be written to a table
+type ErrorHook func(tableName string, batch []*models.SensorData, err error)
+
+// SetErrorHook sets a function called when an insert fails after its
+// retries, whether or not the rows are then spooled
+func (db *TimescaleDB) SetErrorHook(hook ErrorHook) {
+	db.errorHook.Store(&hook)
+}
+
+// failed calls the error hook, if any
+func (db *TimescaleDB) failed(tableName string, batch []*models.SensorData, err error) {
+	if hook := db.errorHook.Load(); hook != nil {
+		(*hook)(tableName, batch, err)
+	}
+}
+
+// NewTimescaleDB creates a new TimescaleDB instance. The initial connection
+// is retried until the database answers, the retries are exhausted or ctx
+// is cancelled.
+func NewTimescaleDB(ctx context.Context, cfg *config.Config) (*TimescaleDB, error) {
+	poolConfig, err := newPoolConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	pool, err := pgxpool.NewWithConfig(ctx, poolConfig)
 	if err != nil {
 		return nil, fmt.Errorf("failed to connect to database: %w", err)
 	}
 
-	return &TimescaleDB{
-		conn:   conn,
-		config: cfg,
-	}, nil
+	// The pool connects lazily, so ping to surface connection errors early
+	if err := connectWithRetry(ctx, cfg.Database, pool.Ping); err != nil {
+		pool.Close()
+		return nil, fmt.Errorf("failed to connect to database: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, cfg.Database.OperationTimeout)
+	defer cancel()
+
+	db := &TimescaleDB{
+		pool:     pool,
+		config:   cfg,
+		columns:  insertColumns(cfg),
+		queue:    make(chan queuedReading, cfg.Ingest.QueueSize),
+		flushNow: make(chan struct{}, 1),
+		buffers:  make(map[string][]*models.SensorData),
+		links:    make(map[string][]trace.Link),
+		done:     make(chan struct{}),
+	}
+	db.verboseInserts.Store(cfg.Logging.VerboseInserts)
+	db.unregisterPool = metrics.RegisterPool(db.poolStats)
+	if cfg.Timescale.AdaptiveBatching {
+		db.batchSizer = newBatchSizer(cfg.Timescale)
+	} else {
+		metrics.BatchSize.Set(float64(cfg.Timescale.BatchSize))
+	}
+
+	if cfg.Spool.Dir != "" {
+		db.spool, err = spool.New(cfg.Spool.Dir, int64(cfg.Spool.MaxSizeMB)*1024*1024)
+		if err != nil {
+			db.unregisterPool()
+			pool.Close()
+			return nil, err
+		}
+		db.wg.Add(1)
+		go db.replayLoop(cfg.Spool.ReplayInterval)
+	}
+
+	if cfg.Devices.Table != "" {
+		db.devices = newDeviceCache(cfg.Ingest.DeviceTTL, cfg.Devices.RefreshInterval)
+		if err := db.loadDevices(ctx); err != nil {
+			slog.Warn("Error loading device metadata, readings are stored without it until the next refresh", "error", err)
+		}
+		db.wg.Add(1)
+		go db.deviceRefreshLoop(cfg.Devices.RefreshInterval)
+	}
+
+	db.wg.Add(1)
+	go db.writeLoop()
+
+	if cfg.Timescale.FlushInterval > 0 {
+		db.wg.Add(1)
+		go db.flushLoop(cfg.Timescale.FlushInterval)
+	}
+
+	return db, nil
+}
+
+// newPoolConfig returns the connection pool configuration. Single inserts
+// run as named prepared statements, see execInsert; other statements use
+// pgx's default statement cache.
+func newPoolConfig(cfg *config.Config) (*pgxpool.Config, error) {
+	poolConfig, err := pgxpool.ParseConfig(cfg.GetDBConnString())
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse database config: %w", err)
+	}
+	if cfg.Database.MaxConns > 0 {
+		poolConfig.MaxConns = int32(cfg.Database.MaxConns)
+	}
+	poolConfig.ConnConfig.OnNotice = logNotice
+	return poolConfig, nil
+}
+
+// Close writes any queued and buffered rows and closes the connection pool.
+// The pool is closed even if some rows couldn't be written; the errors of
+// writing them are returned.
+func (db *TimescaleDB) Close(ctx context.Context) error {
+	close(db.done)
+	// Wait for enqueues in progress, later ones see done closed and are
+	// rejected. Readings they queued after the writer drained the queue
+	// are buffered here.
+	db.closeMu.Lock()
+	db.closeMu.Unlock()
+	db.wg.Wait()
+	err := errors.Join(db.drainQueue(), db.Flush(ctx))
+
+	db.devices.close()
+	db.unregisterPool()
+	db.pool.Close()
+	if err != nil {
+		return fmt.Errorf("failed to write buffered sensor data on close: %w", err)
+	}
+	return nil
+}
+
+// poolStats reads the connection pool statistics for the pool metrics
+func (db *TimescaleDB) poolStats() metrics.PoolStats {
+	stat := db.pool.Stat()
+	return metrics.PoolStats{
+		AcquiredConns:          stat.AcquiredConns(),
+		IdleConns:              stat.IdleConns(),
+		TotalConns:             stat.TotalConns(),
+		MaxConns:               stat.MaxConns(),
+		Acquires:               stat.AcquireCount(),
+		EmptyAcquires:          stat.EmptyAcquireCount(),
+		AcquireDurationSeconds: stat.AcquireDuration().Seconds(),
+	}
+}
+
+// Ping checks that the database is reachable
+func (db *TimescaleDB) Ping(ctx context.Context) error {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+	return db.pool.Ping(ctx)
+}
+
+// withTimeout derives a context bounded by the configured operation timeout
+func (db *TimescaleDB) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(ctx, db.config.Database.OperationTimeout)
 }
 
-// Close closes the database connection
-func (db *TimescaleDB) Close() error {
-	return db.conn.Close(context.Background())
+// withInsertTimeout derives a context bounded by the configured insert
+// timeout. An attempt that runs out of time fails as retryable, so it is
+// retried and then spooled rather than lost.
+func (db *TimescaleDB) withInsertTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(ctx, db.config.Database.InsertTimeout)
 }
 
-// InitializeTable checks if the table exists and creates it if it doesn't
-func (db *TimescaleDB) InitializeTable() error {
-	ctx := context.Background()
-	tableName := db.config.Timescale.TableName
+// InitializeTable checks if the default table and every table referenced by
+// a subscription exist and creates any that don't. When Timescale is
+// disabled or its extension isn't installed, they are created as plain
+// Postgres tables. The latest table is created too when it is maintained.
+func (db *TimescaleDB) InitializeTable(ctx context.Context) error {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+
+	timescale := db.config.Timescale.Enabled
+	if timescale {
+		installed, err := db.hasTimescaleExtension(ctx)
+		if err != nil {
+			return err
+		}
+		if !installed {
+			slog.Warn("TimescaleDB extension is not installed, using plain Postgres tables without hypertables or policies")
+			timescale = false
+		}
+	}
+
+	for _, tableName := range db.config.GetTableNames() {
+		if err := db.initializeTable(ctx, tableName, timescale); err != nil {
+			return err
+		}
+	}
+	if db.config.Timescale.MaintainLatest {
+		return db.initializeLatestTable(ctx)
+	}
+
+	return nil
+}
+
+// hasTimescaleExtension reports whether the timescaledb extension is
+// installed in the database
+func (db *TimescaleDB) hasTimescaleExtension(ctx context.Context) (bool, error) {
+	var installed bool
+	err := db.pool.QueryRow(ctx, `
+		SELECT EXISTS (SELECT FROM pg_extension WHERE extname = 'timescaledb')
+	`).Scan(&installed)
+	if err != nil {
+		return false, fmt.Errorf("failed to check for the timescaledb extension: %w", err)
+	}
+	return installed, nil
+}
+
+// initializeTable checks if a single table exists and creates it if it
+// doesn't, as a hypertable when timescale is set
+func (db *TimescaleDB) initializeTable(ctx context.Context, tableName string, timescale bool) error {
+	ident, err := db.quoteTable(tableName)
+	if err != nil {
+		return err
+	}
 
 	// Check if table exists
 	var exists bool
-	err := db.conn.QueryRow(ctx, `
+	err = db.pool.QueryRow(ctx, `
 		SELECT EXISTS (
 			SELECT FROM information_schema.tables
-			WHERE table_schema = 'public'
-			AND table_name = $1
+			WHERE table_schema = $1
+			AND table_name = $2
 		)
-	`, tableName).Scan(&exists)
+	`, db.config.Database.Schema, tableName).Scan(&exists)
 
 	if err != nil {
 		return fmt.Errorf("failed to check if table exists: %w", err)
@@ -57,64 +320,319 @@ func (db *TimescaleDB) InitializeTable() error {
 
 	// If table doesn't exist, create it
 	if !exists {
-		log.Printf("Creating table %s...", tableName)
-		_, err = db.conn.Exec(ctx, fmt.Sprintf(`
-			CREATE TABLE %s (
-				time TIMESTAMPTZ NOT NULL,
-				temperature DOUBLE PRECISION,
-				humidity DOUBLE PRECISION,
-				light DOUBLE PRECISION,
-				device_id TEXT NOT NULL
-			)
-		`, tableName))
-
+		slog.Info("Creating table", "table", tableName)
+		_, err = db.pool.Exec(ctx, createTableSQL(ident, tableColumns(db.config)))
 		if err != nil {
 			return fmt.Errorf("failed to create table: %w", err)
 		}
+		slog.Info("Table created", "table", tableName)
+	} else {
+		slog.Info("Table already exists", "table", tableName)
 
-		// Convert to hypertable
-		_, err = db.conn.Exec(ctx, fmt.Sprintf(`
-			SELECT create_hypertable('%s', 'time', if_not_exists => TRUE)
-		`, tableName))
+		// Tables created by an older version or by hand, or before a tag
+		// column was configured, lack some columns
+		if _, err := db.pool.Exec(ctx, addColumnsSQL(ident, tableColumns(db.config))); err != nil {
+			return fmt.Errorf("failed to add missing columns: %w", err)
+		}
+	}
 
-		if err != nil {
-			return fmt.Errorf("failed to convert table to hypertable: %w", err)
+	if db.config.Timescale.Upsert {
+		if err := db.createUniqueIndex(ctx, tableName, ident); err != nil {
+			return err
 		}
+	}
 
-		log.Printf("Table %s created and converted to hypertable", tableName)
-	} else {
-		log.Printf("Table %s already exists", tableName)
+	if !timescale {
+		return nil
+	}
+	if hypertable, err := db.ensureHypertable(ctx, tableName, ident); err != nil || !hypertable {
+		return err
+	}
+	if err := db.applyRetentionPolicy(ctx, tableName, ident); err != nil {
+		return err
+	}
+	if err := db.applyCompressionPolicy(ctx, tableName, ident); err != nil {
+		return err
+	}
+	return db.applyContinuousAggregate(ctx, tableName, ident)
+}
+
+// tableColumn is a column of a sensor data table and its type
+type tableColumn struct {
+	name       string
+	definition string
+	// key columns are NOT NULL, so they can't be added to a table with rows
+	key bool
+}
+
+// tableColumns returns the columns of a sensor data table in the order they
+// are created
+func tableColumns(cfg *config.Config) []tableColumn {
+	cols := []tableColumn{
+		{name: cfg.Timescale.TimeColumn, definition: "TIMESTAMPTZ NOT NULL", key: true},
+		{name: "temperature", definition: "DOUBLE PRECISION"},
+		{name: "humidity", definition: "DOUBLE PRECISION"},
+		{name: "light", definition: "DOUBLE PRECISION"},
+		{name: "device_id", definition: "TEXT NOT NULL", key: true},
+		{name: "metrics", definition: "JSONB"},
+		{name: "location", definition: "TEXT"},
+		{name: "type", definition: "TEXT"},
+	}
+	if cfg.Timescale.TrackIngestTime {
+		cols = append(cols, tableColumn{name: "ingest_time", definition: "TIMESTAMPTZ DEFAULT now()"})
+	}
+	if cfg.Timescale.TrackRetained {
+		cols = append(cols, tableColumn{name: "retained", definition: "BOOLEAN NOT NULL DEFAULT false"})
+	}
+	for _, column := range textColumns(cfg) {
+		cols = append(cols, tableColumn{name: column, definition: "TEXT"})
+	}
+	return cols
+}
+
+// createTableSQL returns the statement creating a table with cols
+func createTableSQL(ident string, cols []tableColumn) string {
+	defs := make([]string, len(cols))
+	for i, col := range cols {
+		defs[i] = pgx.Identifier{col.name}.Sanitize() + " " + col.definition
+	}
+	return fmt.Sprintf("CREATE TABLE %s (\n\t%s\n)", ident, strings.Join(defs, ",\n\t"))
+}
+
+// addColumnsSQL returns the statement adding whichever of cols an existing
+// table lacks. Columns are only ever added, so rerunning it is harmless. The
+// key columns are left out since every sensor data table has them.
+func addColumnsSQL(ident string, cols []tableColumn) string {
+	var adds []string
+	for _, col := range cols {
+		if !col.key {
+			adds = append(adds, "ADD COLUMN IF NOT EXISTS "+pgx.Identifier{col.name}.Sanitize()+" "+col.definition)
+		}
+	}
+	return fmt.Sprintf("ALTER TABLE %s\n\t%s", ident, strings.Join(adds, ",\n\t"))
+}
+
+// ensureHypertable converts a table into a hypertable unless it already is
+// one, so initialization can be re-run against a migrated table. Depending
+// on the TimescaleDB version, converting a table that already is a
+// hypertable reports a notice or an error; both are treated as success.
+// Plain tables that already hold data are left alone with a warning, since
+// migrating them can take long and locks the table, and false is returned.
+func (db *TimescaleDB) ensureHypertable(ctx context.Context, tableName, ident string) (bool, error) {
+	var exists bool
+	err := db.pool.QueryRow(ctx, `
+		SELECT EXISTS (
+			SELECT FROM timescaledb_information.hypertables
+			WHERE hypertable_schema = $1 AND hypertable_name = $2
+		)
+	`, db.config.Database.Schema, tableName).Scan(&exists)
+	if err != nil {
+		return false, fmt.Errorf("failed to check if %s is a hypertable: %w", tableName, err)
+	}
+	if exists {
+		slog.Info("Table is already a hypertable", "table", tableName)
+		return true, db.checkSpacePartitions(ctx, tableName)
 	}
 
+	query, args := hypertableSQL(ident, db.config.Timescale.TimeColumn, db.config.Timescale.ChunkTimeInterval)
+	_, err = db.pool.Exec(ctx, query, args...)
+	switch {
+	case hasMessage(err, "already a hypertable"):
+		slog.Info("Table is already a hypertable", "table", tableName)
+		return true, nil
+	case hasMessage(err, "is not empty"):
+		slog.Warn("Table holds data and is not a hypertable, skipping Timescale setup; convert it with create_hypertable and migrate_data => true",
+			"table", tableName)
+		return false, nil
+	case err != nil:
+		return false, fmt.Errorf("failed to convert table to hypertable: %w", err)
+	}
+	slog.Info("Table converted to hypertable", "table", tableName)
+
+	if partitions := db.config.Timescale.SpacePartitions; partitions > 0 {
+		query, args := spaceDimensionSQL(ident, partitions)
+		if _, err := db.pool.Exec(ctx, query, args...); err != nil {
+			return false, fmt.Errorf("failed to add device_id space dimension to %s: %w", tableName, err)
+		}
+		slog.Info("Added device_id space dimension", "table", tableName, "partitions", partitions)
+	}
+	return true, nil
+}
+
+// checkSpacePartitions warns when an existing hypertable's device_id space
+// dimension doesn't match the configured partitions, which are only applied
+// when a hypertable is created
+func (db *TimescaleDB) checkSpacePartitions(ctx context.Context, tableName string) error {
+	var partitions int
+	err := db.pool.QueryRow(ctx, `
+		SELECT COALESCE(max(num_partitions), 0) FROM timescaledb_information.dimensions
+		WHERE hypertable_schema = $1 AND hypertable_name = $2 AND column_name = 'device_id'
+	`, db.config.Database.Schema, tableName).Scan(&partitions)
+	if err != nil {
+		return fmt.Errorf("failed to check the space dimension of %s: %w", tableName, err)
+	}
+	if configured := db.config.Timescale.SpacePartitions; partitions != configured {
+		slog.Warn("Hypertable space partitions differ from timescale.space_partitions, which is only applied when a table is created",
+			"table", tableName, "partitions", partitions, "space_partitions", configured)
+	}
 	return nil
 }
 
-// InsertSensorData inserts sensor data into the database
-func (db *TimescaleDB) InsertSensorData(data *models.SensorData) error {
-	ctx := context.Background()
-	tableName := db.config.Timescale.TableName
+// hasMessage reports whether err is a server error whose message contains s
+func hasMessage(err error, s string) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && strings.Contains(pgErr.Message, s)
+}
+
+// logNotice logs notices sent by the server, such as the one an idempotent
+// create_hypertable sends for a table that already is a hypertable, at
+// debug level
+func logNotice(_ *pgconn.PgConn, notice *pgconn.Notice) {
+	slog.Debug("Database notice", "severity", notice.Severity, "code", notice.Code, "message", notice.Message)
+}
+
+// hypertableSQL returns the statement and arguments converting a table into a
+// hypertable partitioned by timeColumn, with an explicit chunk interval when
+// one is configured
+func hypertableSQL(ident, timeColumn string, chunkInterval time.Duration) (string, []interface{}) {
+	if chunkInterval <= 0 {
+		return `SELECT create_hypertable($1::regclass, $2::name, if_not_exists => TRUE)`,
+			[]interface{}{ident, timeColumn}
+	}
+	return `SELECT create_hypertable($1::regclass, $2::name, chunk_time_interval => $3::interval, if_not_exists => TRUE)`,
+		[]interface{}{ident, timeColumn, formatInterval(chunkInterval)}
+}
+
+// spaceDimensionSQL returns the statement and arguments adding a device_id
+// space dimension with the given number of partitions to a hypertable
+func spaceDimensionSQL(ident string, partitions int) (string, []interface{}) {
+	return `SELECT add_dimension($1::regclass, 'device_id', number_partitions => $2, if_not_exists => TRUE)`,
+		[]interface{}{ident, partitions}
+}
+
+// formatInterval renders a duration as a Postgres interval literal
+func formatInterval(d time.Duration) string {
+	return fmt.Sprintf("%d milliseconds", d.Milliseconds())
+}
+
+// InsertSensorData inserts sensor data into the default table
+func (db *TimescaleDB) InsertSensorData(ctx context.Context, data *models.SensorData) error {
+	return db.InsertSensorDataInto(ctx, db.config.Timescale.TableName, data)
+}
+
+// InsertSensorDataInto inserts sensor data into the given table
+func (db *TimescaleDB) InsertSensorDataInto(ctx context.Context, tableName string, data *models.SensorData) error {
+	ident, err := db.quoteTable(tableName)
+	if err != nil {
+		return err
+	}
+	db.stampIngestTime(data)
 
 	// Verbose logging of the insert statement and parameters for diagnostics
-	log.Printf(
-		"DB INSERT -> table=%s time=%s temperature=%.3f humidity=%.3f light=%.3f device_id=%s",
-		tableName,
-		data.Timestamp.UTC().Format(time.RFC3339),
-		data.Temperature,
-		data.Humidity,
-		data.Light,
-		data.Device_ID,
-	)
-
-	cmdTag, err := db.conn.Exec(ctx, fmt.Sprintf(`
-		INSERT INTO %s (time, temperature, humidity, light, device_id)
-		VALUES ($1, $2, $3, $4, $5)
-	`, tableName), data.Timestamp, data.Temperature, data.Humidity, data.Light, data.Device_ID)
+	verbose := db.verboseInserts.Load()
+	if verbose {
+		slog.Debug("DB INSERT",
+			"table", tableName,
+			"time", data.Timestamp.UTC().Format(time.RFC3339),
+			"temperature", models.Value(data.Temperature),
+			"humidity", models.Value(data.Humidity),
+			"light", models.Value(data.Light),
+			"device_id", data.Device_ID,
+		)
+	}
 
+	query := db.insertSQL(ident)
+	ctx, span := startInsertSpan(ctx, tableName, query, 1)
+	defer span.End()
+
+	var rowsAffected int64
+	err = db.withRetry(ctx, func(ctx context.Context) error {
+		ctx, cancel := db.withInsertTimeout(ctx)
+		defer cancel()
+
+		start := time.Now()
+		cmdTag, err := db.execInsert(ctx, tableName, query, db.row(data))
+		metrics.DBInsertDuration.Observe(time.Since(start).Seconds())
+
+		if err != nil {
+			metrics.DBInsertErrors.Inc()
+			return err
+		}
+		rowsAffected = cmdTag.RowsAffected()
+		return nil
+	})
 	if err != nil {
-		return fmt.Errorf("failed to insert sensor data: %w", err)
+		spanError(span, err)
+		err = fmt.Errorf("failed to insert sensor data: %w", err)
+		db.failed(tableName, []*models.SensorData{data}, err)
+		return err
 	}
 
-	log.Printf("DB INSERT affected rows: %d", cmdTag.RowsAffected())
+	metrics.DBInserts.Add(float64(rowsAffected))
+	if verbose {
+		slog.Debug("DB INSERT affected rows", "table", tableName, "rows", rowsAffected)
+	}
+	db.inserted(tableName, []*models.SensorData{data})
+	db.updateLatest(ctx, []*models.SensorData{data})
 
 	return nil
 }
+
+// quoteTable validates a table name and returns it qualified with the
+// configured schema and quoted for safe interpolation into SQL
+func (db *TimescaleDB) quoteTable(name string) (string, error) {
+	if !config.IsValidIdentifier(name) {
+		return "", fmt.Errorf("invalid table name %q", name)
+	}
+	return db.tableIdentifier(name).Sanitize(), nil
+}
+
+// tableIdentifier returns a table name qualified with the configured schema
+func (db *TimescaleDB) tableIdentifier(name string) pgx.Identifier {
+	return pgx.Identifier{db.config.Database.Schema, name}
+}
+
+// row returns the values written for a reading, in the order of db.columns
+func (db *TimescaleDB) row(data *models.SensorData) []interface{} {
+	location, deviceType := db.devices.lookup(data.Device_ID)
+	row := []interface{}{data.Timestamp, data.Temperature, data.Humidity, data.Light, data.Device_ID, metricsValue(data), location, deviceType}
+	if db.config.Timescale.TrackIngestTime {
+		row = append(row, data.IngestTime)
+	}
+	if db.config.Timescale.TrackRetained {
+		row = append(row, data.Retained)
+	}
+	for _, column := range textColumns(db.config) {
+		row = append(row, tagValue(data, column))
+	}
+	return row
+}
+
+// tagValue returns a topic or tag column's value, or nil so that readings
+// from topics that didn't match the template, or without the tag, are
+// stored as NULL
+func tagValue(data *models.SensorData, column string) interface{} {
+	if value, ok := data.Tags[column]; ok {
+		return value
+	}
+	return nil
+}
+
+// stampIngestTime records the server clock as the reading's ingest time when
+// ingest time is tracked. Readings that already have one, such as those
+// replayed from the spool, keep it.
+func (db *TimescaleDB) stampIngestTime(data *models.SensorData) {
+	if db.config.Timescale.TrackIngestTime && data.IngestTime == nil {
+		now := time.Now()
+		data.IngestTime = &now
+	}
+}
+
+// metricsValue returns the dynamic fields for the metrics JSONB column,
+// or nil so that readings without extra fields are stored as NULL
+func metricsValue(data *models.SensorData) interface{} {
+	if len(data.Fields) == 0 {
+		return nil
+	}
+	return data.Fields
+}
@@ -0,0 +1,1186 @@
+package database
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgproto3"
+	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/ponytojas/go-mqtt-timescale/config"
+	"github.com/ponytojas/go-mqtt-timescale/internal/metrics"
+	"github.com/ponytojas/go-mqtt-timescale/internal/models"
+	"github.com/ponytojas/go-mqtt-timescale/internal/spool"
+)
+
+// newTestDB returns a database without a pool, enough to build statements
+// and rows
+func newTestDB(cfg *config.Config) *TimescaleDB {
+	return &TimescaleDB{config: cfg, columns: insertColumns(cfg)}
+}
+
+func TestPoolConfigCachesStatements(t *testing.T) {
+	cfg := config.GetDefaultConfig()
+	cfg.Database.MaxConns = 7
+
+	poolConfig, err := newPoolConfig(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode := poolConfig.ConnConfig.DefaultQueryExecMode; mode != pgx.QueryExecModeCacheStatement {
+		t.Errorf("query exec mode = %v, want the statement cache", mode)
+	}
+	if poolConfig.ConnConfig.StatementCacheCapacity <= 0 {
+		t.Errorf("statement cache capacity = %d, want positive", poolConfig.ConnConfig.StatementCacheCapacity)
+	}
+	if poolConfig.MaxConns != 7 {
+		t.Errorf("max conns = %d, want 7", poolConfig.MaxConns)
+	}
+}
+
+func TestInsertSQLIsStablePerTable(t *testing.T) {
+	db := newTestDB(config.GetDefaultConfig())
+	a, _ := db.quoteTable("a")
+	b, _ := db.quoteTable("b")
+
+	// Each connection prepares the statement of a table once, so its SQL
+	// must never change
+	if db.insertSQL(a) != db.insertSQL(a) {
+		t.Error("insert SQL differs between calls for the same table")
+	}
+	if db.insertSQL(a) == db.insertSQL(b) {
+		t.Error("insert SQL is the same for different tables")
+	}
+}
+
+func TestInsertsReuseTheNamedStatement(t *testing.T) {
+	cfg := config.GetDefaultConfig()
+	// A single connection, so every insert runs on the one that prepared
+	cfg.Database.MaxConns = 1
+	db, server := fakePostgresDB(t, cfg)
+	ctx := context.Background()
+
+	inserts := map[string]int{"sensor_data": 3, "outdoor": 2}
+	for table, n := range inserts {
+		for i := 0; i < n; i++ {
+			if err := db.InsertSensorDataInto(ctx, table, &models.SensorData{Device_ID: "d1", Timestamp: time.Now()}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	if conns := server.connections(); conns != 1 {
+		t.Fatalf("inserts opened %d connections, want 1", conns)
+	}
+	for table, n := range inserts {
+		name := insertStatementName(table)
+		// Prepared by the first insert and executed by name by every one
+		if parsed, executed := server.statement(name); parsed != 1 || executed != n {
+			t.Errorf("%s parsed %d times and executed %d times, want once and %d times", name, parsed, executed, n)
+		}
+	}
+	if unnamed := server.unnamed(); unnamed != 0 {
+		t.Errorf("%d statements ran unnamed, want every insert to run by name", unnamed)
+	}
+}
+
+func TestInsertSQLUsesTheTimeColumn(t *testing.T) {
+	tests := []struct {
+		timeColumn string
+		want       string // the first quoted column
+	}{
+		{"time", `("time", "temperature"`},
+		{"ts", `("ts", "temperature"`},
+		{"Event Time", `("Event Time", "temperature"`},
+		{`a"b`, `("a""b", "temperature"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.timeColumn, func(t *testing.T) {
+			cfg := config.GetDefaultConfig()
+			cfg.Timescale.TimeColumn = tt.timeColumn
+			db := newTestDB(cfg)
+			if db.columns[0] != tt.timeColumn {
+				t.Errorf("columns = %v, want %s first", db.columns, tt.timeColumn)
+			}
+			if sql := db.insertSQL(`"public"."t"`); !strings.Contains(sql, tt.want) {
+				t.Errorf("insert SQL lacks %s:\n%s", tt.want, sql)
+			}
+		})
+	}
+}
+
+func TestConflictClause(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(*config.Config)
+		want   string
+	}{
+		{"upserts disabled", func(c *config.Config) { c.Timescale.Upsert = false }, ""},
+		{"device and time", func(c *config.Config) { c.Timescale.Upsert = true },
+			` ON CONFLICT ("device_id", "time") DO UPDATE SET "temperature" = EXCLUDED."temperature", "humidity" = EXCLUDED."humidity", ` +
+				`"light" = EXCLUDED."light", "metrics" = EXCLUDED."metrics", "location" = EXCLUDED."location", "type" = EXCLUDED."type"`},
+		{"custom time column", func(c *config.Config) {
+			c.Timescale.Upsert = true
+			c.Timescale.TimeColumn = "ts"
+			c.Timescale.ConflictColumns = []string{"time", "device_id", "temperature", "humidity", "light"}
+		}, ` ON CONFLICT ("ts", "device_id", "temperature", "humidity", "light") DO UPDATE SET "metrics" = EXCLUDED."metrics", ` +
+			`"location" = EXCLUDED."location", "type" = EXCLUDED."type"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := config.GetDefaultConfig()
+			tt.modify(cfg)
+			db := newTestDB(cfg)
+			if got := db.conflictClause(); got != tt.want {
+				t.Errorf("conflict clause =\n%s\nwant\n%s", got, tt.want)
+			}
+			if sql := db.insertSQL(`"public"."t"`); !strings.Contains(sql, tt.want) {
+				t.Errorf("insert SQL lacks the conflict clause:\n%s", sql)
+			}
+		})
+	}
+}
+
+func TestRowMatchesColumns(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(*config.Config)
+	}{
+		{"default", func(*config.Config) {}},
+		{"ingest time", func(c *config.Config) { c.Timescale.TrackIngestTime = true }},
+		{"retained", func(c *config.Config) { c.Timescale.TrackRetained = true }},
+		{"text columns", func(c *config.Config) {
+			c.MQTT.TopicColumns = []string{"site"}
+			c.Timescale.TagColumns = []string{"firmware"}
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := config.GetDefaultConfig()
+			tt.modify(cfg)
+			db := newTestDB(cfg)
+
+			// CopyFrom pairs values with columns by position
+			row := db.row(&models.SensorData{Device_ID: "d1", Timestamp: time.Now()})
+			if len(row) != len(db.columns) {
+				t.Fatalf("row has %d values for %d columns %v", len(row), len(db.columns), db.columns)
+			}
+			if row[0] == nil || db.columns[0] != cfg.Timescale.TimeColumn {
+				t.Errorf("first column %s = %v, want the timestamp", db.columns[0], row[0])
+			}
+		})
+	}
+}
+
+func TestIngestTime(t *testing.T) {
+	earlier := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name    string
+		track   bool
+		ingest  *time.Time // the reading's ingest time before the insert
+		wantNow bool       // stamped with the server clock
+	}{
+		{"not tracked", false, nil, false},
+		{"stamped with the server clock", true, nil, true},
+		{"replayed reading keeps its time", true, &earlier, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := config.GetDefaultConfig()
+			cfg.Timescale.TrackIngestTime = tt.track
+			db := newTestDB(cfg)
+			data := &models.SensorData{Device_ID: "d1", Timestamp: earlier.Add(-time.Hour), IngestTime: tt.ingest}
+
+			before := time.Now()
+			db.stampIngestTime(data)
+			row := db.row(data)
+
+			column := slices.Index(db.columns, "ingest_time")
+			if (column >= 0) != tt.track {
+				t.Fatalf("ingest_time column in %v, want %v", db.columns, tt.track)
+			}
+			created := slices.ContainsFunc(tableColumns(cfg), func(col tableColumn) bool {
+				return col.name == "ingest_time" && col.definition == "TIMESTAMPTZ DEFAULT now()"
+			})
+			if created != tt.track {
+				t.Errorf("ingest_time column created = %v, want %v", created, tt.track)
+			}
+			if !tt.track {
+				if data.IngestTime != nil {
+					t.Errorf("ingest time = %s, want none", data.IngestTime)
+				}
+				return
+			}
+
+			got, ok := row[column].(*time.Time)
+			if !ok || got == nil {
+				t.Fatalf("ingest_time value = %#v, want a time", row[column])
+			}
+			if tt.wantNow && (got.Before(before) || got.After(time.Now())) {
+				t.Errorf("ingest time = %s, want the server clock", got)
+			}
+			if !tt.wantNow && !got.Equal(*tt.ingest) {
+				t.Errorf("ingest time = %s, want %s", got, tt.ingest)
+			}
+			// The event time is written as sent
+			if !row[0].(time.Time).Equal(data.Timestamp) {
+				t.Errorf("event time = %v, want %s", row[0], data.Timestamp)
+			}
+		})
+	}
+}
+
+func TestRetainedColumn(t *testing.T) {
+	tests := []struct {
+		name     string
+		track    bool
+		retained bool
+		want     interface{} // the retained value, nil without the column
+	}{
+		{"not tracked", false, true, nil},
+		{"live message", true, false, false},
+		{"retained message", true, true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := config.GetDefaultConfig()
+			cfg.Timescale.TrackRetained = tt.track
+			db := newTestDB(cfg)
+
+			created := slices.ContainsFunc(tableColumns(cfg), func(col tableColumn) bool {
+				return col.name == "retained" && col.definition == "BOOLEAN NOT NULL DEFAULT false"
+			})
+			if created != tt.track {
+				t.Errorf("retained column created = %v, want %v", created, tt.track)
+			}
+			column := slices.Index(db.columns, "retained")
+			if (column >= 0) != tt.track {
+				t.Fatalf("retained column in %v, want %v", db.columns, tt.track)
+			}
+			if !tt.track {
+				return
+			}
+			row := db.row(&models.SensorData{Device_ID: "d1", Timestamp: time.Now(), Retained: tt.retained})
+			if row[column] != tt.want {
+				t.Errorf("retained value = %v, want %v", row[column], tt.want)
+			}
+		})
+	}
+}
+
+func TestTopicColumnsAreWritten(t *testing.T) {
+	cfg := config.GetDefaultConfig()
+	cfg.MQTT.TopicTemplate = "factory/+site/+line/+device_id"
+	cfg.MQTT.TopicColumns = []string{"site", "line"}
+	db := newTestDB(cfg)
+
+	var created []string
+	for _, col := range tableColumns(cfg) {
+		if col.definition == "TEXT" && (col.name == "site" || col.name == "line") {
+			created = append(created, col.name)
+		}
+	}
+	if !slices.Equal(created, cfg.MQTT.TopicColumns) {
+		t.Fatalf("created TEXT columns %v, want %v", created, cfg.MQTT.TopicColumns)
+	}
+
+	tests := []struct {
+		name string
+		tags map[string]string
+		want []interface{} // the site and line values
+	}{
+		{"bound segments", map[string]string{"site": "north", "line": "line2"}, []interface{}{"north", "line2"}},
+		{"topic outside the template", nil, []interface{}{nil, nil}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			row := db.row(&models.SensorData{Device_ID: "d1", Timestamp: time.Now(), Tags: tt.tags})
+			got := []interface{}{row[slices.Index(db.columns, "site")], row[slices.Index(db.columns, "line")]}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("site and line = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTagColumnsAreWritten(t *testing.T) {
+	cfg := config.GetDefaultConfig()
+	cfg.Timescale.TagColumns = []string{"firmware_version", "model"}
+	db := newTestDB(cfg)
+
+	sql := createTableSQL(`"public"."t"`, tableColumns(cfg))
+	for _, want := range []string{`"firmware_version" TEXT`, `"model" TEXT`} {
+		if !strings.Contains(sql, want) {
+			t.Errorf("CREATE TABLE lacks %s:\n%s", want, sql)
+		}
+	}
+
+	tests := []struct {
+		name string
+		tags map[string]string
+		want []interface{} // the firmware_version and model values
+	}{
+		{"every tag", map[string]string{"firmware_version": "1.4.2", "model": "th-100"}, []interface{}{"1.4.2", "th-100"}},
+		{"some tags", map[string]string{"firmware_version": "1.4.2"}, []interface{}{"1.4.2", nil}},
+		{"no tags", nil, []interface{}{nil, nil}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			row := db.row(&models.SensorData{Device_ID: "d1", Timestamp: time.Now(), Tags: tt.tags})
+			got := []interface{}{row[slices.Index(db.columns, "firmware_version")], row[slices.Index(db.columns, "model")]}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("firmware_version and model = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAddColumnsSQL(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(*config.Config)
+		want   []string // the columns added, in order
+	}{
+		{"default", func(*config.Config) {}, []string{
+			`"temperature" DOUBLE PRECISION`, `"humidity" DOUBLE PRECISION`, `"light" DOUBLE PRECISION`,
+			`"metrics" JSONB`, `"location" TEXT`, `"type" TEXT`,
+		}},
+		{"ingest time and text columns", func(c *config.Config) {
+			c.Timescale.TrackIngestTime = true
+			c.Timescale.TagColumns = []string{"model"}
+		}, []string{
+			`"temperature" DOUBLE PRECISION`, `"humidity" DOUBLE PRECISION`, `"light" DOUBLE PRECISION`,
+			`"metrics" JSONB`, `"location" TEXT`, `"type" TEXT`,
+			`"ingest_time" TIMESTAMPTZ DEFAULT now()`, `"model" TEXT`,
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := config.GetDefaultConfig()
+			tt.modify(cfg)
+			sql := addColumnsSQL(`"public"."t"`, tableColumns(cfg))
+
+			header, adds, _ := strings.Cut(sql, "\n\t")
+			if header != `ALTER TABLE "public"."t"` {
+				t.Errorf("statement starts %q", header)
+			}
+			var got []string
+			for _, add := range strings.Split(adds, ",\n\t") {
+				column, ok := strings.CutPrefix(add, "ADD COLUMN IF NOT EXISTS ")
+				if !ok {
+					t.Fatalf("%q doesn't add a column if it's missing", add)
+				}
+				got = append(got, column)
+			}
+			// The NOT NULL key columns can't be added to a table with rows
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("adds\n%v\nwant\n%v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRowIsEnrichedWithDeviceMetadata(t *testing.T) {
+	db := newTestDB(config.GetDefaultConfig())
+	location, deviceType := slices.Index(db.columns, "location"), slices.Index(db.columns, "type")
+	if location < 0 || deviceType < 0 {
+		t.Fatalf("columns %v lack location and type", db.columns)
+	}
+	meta := func(device string) (*string, *string) {
+		row := db.row(&models.SensorData{Device_ID: device, Timestamp: time.Now()})
+		return row[location].(*string), row[deviceType].(*string)
+	}
+
+	// Without enrichment every device has NULL metadata
+	if l, ty := meta("d1"); l != nil || ty != nil {
+		t.Errorf("metadata without a cache = %v, %v, want NULL", l, ty)
+	}
+
+	db.devices = newDeviceCache(time.Hour, time.Minute)
+	defer db.devices.close()
+	db.devices.replace(map[string]deviceMeta{"d1": {location: str("kitchen"), deviceType: str("thermometer")}, "d2": {location: str("garden")}})
+	tests := []struct {
+		device               string
+		location, deviceType *string
+	}{
+		{"d1", str("kitchen"), str("thermometer")},
+		{"d2", str("garden"), nil},
+		{"unknown", nil, nil},
+	}
+	for _, tt := range tests {
+		l, ty := meta(tt.device)
+		if !equalString(l, tt.location) || !equalString(ty, tt.deviceType) {
+			t.Errorf("%s: metadata = %v, %v, want %v, %v", tt.device, l, ty, tt.location, tt.deviceType)
+		}
+	}
+
+	// A refresh replaces the metadata as a whole
+	db.devices.replace(map[string]deviceMeta{"d2": {location: str("shed")}})
+	if l, _ := meta("d1"); l != nil {
+		t.Errorf("d1 location after refresh = %q, want NULL", *l)
+	}
+	if l, _ := meta("d2"); !equalString(l, str("shed")) {
+		t.Errorf("d2 location after refresh = %v, want shed", l)
+	}
+}
+
+// equalString reports whether two optional strings are both NULL or equal
+func equalString(a, b *string) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+func TestDynamicFieldsAreStoredAsJSONB(t *testing.T) {
+	db := newTestDB(config.GetDefaultConfig())
+	metrics := slices.Index(db.columns, "metrics")
+	if metrics < 0 {
+		t.Fatalf("columns %v lack metrics", db.columns)
+	}
+	if sql := createTableSQL(`"public"."t"`, tableColumns(db.config)); !strings.Contains(sql, `"metrics" JSONB`) {
+		t.Errorf("create table lacks a JSONB metrics column:\n%s", sql)
+	}
+
+	// Readings without extra fields store NULL rather than an empty object
+	tests := []struct {
+		name   string
+		fields map[string]float64
+		null   bool
+	}{
+		{"no fields", nil, true},
+		{"empty fields", map[string]float64{}, true},
+		{"fields", map[string]float64{"co2": 415}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			row := db.row(&models.SensorData{Device_ID: "d1", Timestamp: time.Now(), Fields: tt.fields})
+			if (row[metrics] == nil) != tt.null {
+				t.Errorf("metrics value = %v, want NULL = %v", row[metrics], tt.null)
+			}
+		})
+	}
+}
+
+func TestMissingValuesAreWrittenAsNULL(t *testing.T) {
+	db := newTestDB(config.GetDefaultConfig())
+	zero := 0.0
+	row := db.row(&models.SensorData{Device_ID: "d1", Timestamp: time.Now(), Temperature: &zero})
+
+	// pgx writes a nil *float64 as NULL
+	for column, want := range map[string]*float64{"temperature": &zero, "humidity": nil, "light": nil} {
+		i := slices.Index(db.columns, column)
+		if i < 0 {
+			t.Fatalf("columns %v lack %s", db.columns, column)
+		}
+		got, ok := row[i].(*float64)
+		if !ok {
+			t.Fatalf("%s value is a %T, want *float64", column, row[i])
+		}
+		if (got == nil) != (want == nil) || got != nil && *got != *want {
+			t.Errorf("%s = %v, want %v", column, got, want)
+		}
+	}
+}
+
+func TestAlreadyAHypertable(t *testing.T) {
+	notice := &pgconn.PgError{Severity: "NOTICE", Code: "TS201", Message: `table "sensor_data" is already a hypertable, skipping`}
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"server error", notice, true},
+		{"wrapped server error", fmt.Errorf("exec: %w", notice), true},
+		{"other server error", &pgconn.PgError{Code: "42P01", Message: `relation "sensor_data" does not exist`}, false},
+		{"not from the server", errors.New("table is already a hypertable"), false},
+		{"no error", nil, false},
+	}
+	for _, tt := range tests {
+		if got := hasMessage(tt.err, "already a hypertable"); got != tt.want {
+			t.Errorf("%s: hasMessage = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestNoticesAreLoggedAtDebug(t *testing.T) {
+	notice := &pgconn.Notice{Severity: "NOTICE", Code: "TS201", Message: `table "sensor_data" is already a hypertable, skipping`}
+	tests := []struct {
+		level slog.Level
+		want  bool
+	}{
+		{slog.LevelInfo, false},
+		{slog.LevelDebug, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.level.String(), func(t *testing.T) {
+			logs := captureLogs(t, tt.level)
+			logNotice(nil, notice)
+			if logged := strings.Contains(logs.String(), "already a hypertable"); logged != tt.want {
+				t.Errorf("notice logged = %v, want %v:\n%s", logged, tt.want, logs)
+			}
+		})
+	}
+
+	poolConfig, err := newPoolConfig(config.GetDefaultConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if poolConfig.ConnConfig.OnNotice == nil {
+		t.Error("notices aren't handled by the pool's connections")
+	}
+}
+
+func TestQuoteTable(t *testing.T) {
+	tests := []struct {
+		name    string
+		want    string
+		wantErr bool
+	}{
+		{"sensor_data", `"public"."sensor_data"`, false},
+		{"Readings", `"public"."Readings"`, false},
+		{"foo;DROP TABLE bar", "", true},
+		{`"weird name"`, "", true},
+		{"", "", true},
+	}
+	db := newTestDB(config.GetDefaultConfig())
+	for _, tt := range tests {
+		got, err := db.quoteTable(tt.name)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("quoteTable(%q) = %q, %v, want %q, error %v", tt.name, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestTablesAreQualifiedWithTheSchema(t *testing.T) {
+	tests := []struct {
+		schema string
+		want   string
+	}{
+		{"public", `"public"."sensor_data"`},
+		{"iot", `"iot"."sensor_data"`},
+		{"Plant_1", `"Plant_1"."sensor_data"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.schema, func(t *testing.T) {
+			cfg := config.GetDefaultConfig()
+			cfg.Database.Schema = tt.schema
+			db := newTestDB(cfg)
+			ident, err := db.quoteTable("sensor_data")
+			if err != nil || ident != tt.want {
+				t.Fatalf("quoteTable = %q, %v, want %q", ident, err, tt.want)
+			}
+			if got := db.tableIdentifier("sensor_data").Sanitize(); got != tt.want {
+				t.Errorf("tableIdentifier = %q, want %q", got, tt.want)
+			}
+			for name, sql := range map[string]string{
+				"create": createTableSQL(ident, tableColumns(cfg)),
+				"insert": db.insertSQL(ident),
+			} {
+				if !strings.Contains(sql, " "+tt.want+" ") {
+					t.Errorf("%s statement is not qualified with %q:\n%s", name, tt.want, sql)
+				}
+			}
+		})
+	}
+}
+
+// captureLogs sends the default logger's records of level and higher to
+// the returned buffer until the test ends
+func captureLogs(t testing.TB, level slog.Level) *bytes.Buffer {
+	t.Helper()
+	previous := slog.Default()
+	t.Cleanup(func() { slog.SetDefault(previous) })
+	var logs bytes.Buffer
+	slog.SetDefault(slog.New(slog.NewTextHandler(&logs, &slog.HandlerOptions{Level: level})))
+	return &logs
+}
+
+// unreachableDB returns a database whose pool dials a closed port, so every
+// statement fails at once without being retried
+func unreachableDB(t *testing.T, cfg *config.Config) *TimescaleDB {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Database.MaxRetries = 0
+	l.Close()
+	return dialDB(t, cfg, l.Addr().(*net.TCPAddr).Port)
+}
+
+// stalledDB returns a database whose pool dials a server that accepts
+// connections but never answers, so every statement runs out of time
+func stalledDB(t *testing.T, cfg *config.Config) *TimescaleDB {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var mu sync.Mutex
+	var conns []net.Conn
+	t.Cleanup(func() {
+		l.Close()
+		mu.Lock()
+		defer mu.Unlock()
+		for _, conn := range conns {
+			conn.Close()
+		}
+	})
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			conns = append(conns, conn)
+			mu.Unlock()
+		}
+	}()
+	return dialDB(t, cfg, l.Addr().(*net.TCPAddr).Port)
+}
+
+// fakePostgres is a server speaking just enough of the PostgreSQL protocol
+// to prepare and execute statements, counting the statements each is sent
+type fakePostgres struct {
+	mu       sync.Mutex
+	conns    int
+	parsed   map[string]int // Parse messages by statement name
+	executed map[string]int // Bind messages by statement name
+}
+
+// connections returns the number of connections the server accepted
+func (s *fakePostgres) connections() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.conns
+}
+
+// statement returns how often the statement called name was parsed and
+// executed
+func (s *fakePostgres) statement(name string) (parsed, executed int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.parsed[name], s.executed[name]
+}
+
+// unnamed returns how often an unnamed statement was parsed
+func (s *fakePostgres) unnamed() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.parsed[""]
+}
+
+// serve answers the messages of a single connection. Every statement takes
+// the parameters oids describes and returns no rows.
+func (s *fakePostgres) serve(conn net.Conn, oids []uint32) {
+	defer conn.Close()
+	backend := pgproto3.NewBackend(conn, conn)
+	if _, err := backend.ReceiveStartupMessage(); err != nil {
+		return
+	}
+	s.mu.Lock()
+	s.conns++
+	s.mu.Unlock()
+	backend.Send(&pgproto3.AuthenticationOk{})
+	backend.Send(&pgproto3.ReadyForQuery{TxStatus: 'I'})
+	if err := backend.Flush(); err != nil {
+		return
+	}
+
+	for {
+		msg, err := backend.Receive()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		switch msg := msg.(type) {
+		case *pgproto3.Parse:
+			s.parsed[msg.Name]++
+			backend.Send(&pgproto3.ParseComplete{})
+		case *pgproto3.Describe:
+			backend.Send(&pgproto3.ParameterDescription{ParameterOIDs: oids})
+			backend.Send(&pgproto3.NoData{})
+		case *pgproto3.Bind:
+			s.executed[msg.PreparedStatement]++
+			backend.Send(&pgproto3.BindComplete{})
+		case *pgproto3.Execute:
+			backend.Send(&pgproto3.CommandComplete{CommandTag: []byte("INSERT 0 1")})
+		case *pgproto3.Sync:
+			backend.Send(&pgproto3.ReadyForQuery{TxStatus: 'I'})
+		case *pgproto3.Query:
+			backend.Send(&pgproto3.EmptyQueryResponse{})
+			backend.Send(&pgproto3.ReadyForQuery{TxStatus: 'I'})
+		case *pgproto3.Terminate:
+			s.mu.Unlock()
+			return
+		}
+		s.mu.Unlock()
+		if err := backend.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+// fakePostgresDB returns a database whose pool dials a fakePostgres, which
+// describes every statement with the parameters of the insert
+func fakePostgresDB(t *testing.T, cfg *config.Config) (*TimescaleDB, *fakePostgres) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	db := dialDB(t, cfg, l.Addr().(*net.TCPAddr).Port)
+	oids := make([]uint32, len(db.columns))
+	for i, column := range db.columns {
+		switch column {
+		case cfg.Timescale.TimeColumn:
+			oids[i] = pgtype.TimestamptzOID
+		case "device_id", "location", "type":
+			oids[i] = pgtype.TextOID
+		case "metrics":
+			oids[i] = pgtype.JSONBOID
+		default:
+			oids[i] = pgtype.Float8OID
+		}
+	}
+
+	server := &fakePostgres{parsed: make(map[string]int), executed: make(map[string]int)}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go server.serve(conn, oids)
+		}
+	}()
+	return db, server
+}
+
+// dialDB returns a database whose pool dials port on the loopback address
+func dialDB(t *testing.T, cfg *config.Config, port int) *TimescaleDB {
+	t.Helper()
+	cfg.Database.Host = "127.0.0.1"
+	cfg.Database.Port = port
+	poolConfig, err := newPoolConfig(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool, err := pgxpool.NewWithConfig(context.Background(), poolConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(pool.Close)
+	db := newTestDB(cfg)
+	db.pool = pool
+	return db
+}
+
+func TestVerboseInserts(t *testing.T) {
+	tests := []struct {
+		name    string
+		verbose bool
+	}{
+		{"disabled", false},
+		{"enabled", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logs := captureLogs(t, slog.LevelDebug)
+			cfg := config.GetDefaultConfig()
+			cfg.Logging.VerboseInserts = !tt.verbose
+			db := unreachableDB(t, cfg)
+			// Toggled at runtime, as on a reload
+			db.SetVerboseInserts(tt.verbose)
+
+			if err := db.InsertSensorData(context.Background(), &models.SensorData{Device_ID: "d1", Timestamp: time.Now()}); err == nil {
+				t.Fatal("expected the insert to fail")
+			}
+			if logged := strings.Contains(logs.String(), `msg="DB INSERT"`); logged != tt.verbose {
+				t.Errorf("insert logged = %v, want %v:\n%s", logged, tt.verbose, logs.String())
+			}
+		})
+	}
+}
+
+func TestErrorHookSeesFailedInserts(t *testing.T) {
+	batch := []*models.SensorData{{Device_ID: "d1", Timestamp: time.Now()}, {Device_ID: "d2", Timestamp: time.Now()}}
+	tests := []struct {
+		name     string
+		insert   func(*TimescaleDB) error
+		wantRows int
+	}{
+		{"single insert", func(db *TimescaleDB) error {
+			return db.InsertSensorDataInto(context.Background(), "readings", batch[0])
+		}, 1},
+		{"batch", func(db *TimescaleDB) error {
+			return db.InsertSensorDataBatchInto(context.Background(), "readings", batch)
+		}, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			captureLogs(t, slog.LevelError)
+			db := unreachableDB(t, config.GetDefaultConfig())
+			var gotTable string
+			var gotRows int
+			var hookErr error
+			db.SetErrorHook(func(tableName string, batch []*models.SensorData, err error) {
+				gotTable, gotRows, hookErr = tableName, len(batch), err
+			})
+
+			err := tt.insert(db)
+			if err == nil {
+				t.Fatal("expected the insert to fail")
+			}
+			if gotTable != "readings" || gotRows != tt.wantRows || hookErr == nil || hookErr.Error() != err.Error() {
+				t.Errorf("hook saw %d rows of %q with %v, want %d rows of readings with %v", gotRows, gotTable, hookErr, tt.wantRows, err)
+			}
+		})
+	}
+}
+
+func TestPoolStatsReadThePool(t *testing.T) {
+	cfg := config.GetDefaultConfig()
+	cfg.Database.MaxConns = 7
+	db := unreachableDB(t, cfg)
+
+	stats := db.poolStats()
+	if stats.MaxConns != 7 || stats.AcquiredConns != 0 || stats.TotalConns != 0 {
+		t.Errorf("pool stats = %+v, want 7 max conns and none open", stats)
+	}
+}
+
+func TestInsertIntoInvalidTableIsRejected(t *testing.T) {
+	db := newTestDB(config.GetDefaultConfig())
+
+	// Rejected before the pool is used
+	err := db.InsertSensorDataBatchInto(context.Background(), "foo;DROP TABLE bar", []*models.SensorData{{Device_ID: "d1", Timestamp: time.Now()}})
+	if err == nil || !strings.Contains(err.Error(), "invalid table name") {
+		t.Fatalf("error = %v, want an invalid table name", err)
+	}
+}
+
+func TestRejectedBatchesAreNotSpooled(t *testing.T) {
+	db := newTestDB(config.GetDefaultConfig())
+	var err error
+	if db.spool, err = spool.New(t.TempDir(), 0); err != nil {
+		t.Fatal(err)
+	}
+
+	// Replaying a batch the database rejects outright would fail again
+	err = db.writeBatch(context.Background(), "foo;DROP TABLE bar", []*models.SensorData{{Device_ID: "d1", Timestamp: time.Now()}})
+	if err == nil {
+		t.Fatal("expected the insert error")
+	}
+	if db.spool.Len() != 0 {
+		t.Errorf("spool holds %d segments, want 0", db.spool.Len())
+	}
+}
+
+func TestLostBatchesAreCounted(t *testing.T) {
+	batch := []*models.SensorData{{Device_ID: "d1", Timestamp: time.Now()}, {Device_ID: "d2", Timestamp: time.Now()}}
+	tests := []struct {
+		name     string
+		table    string
+		spool    bool
+		wantLost float64
+	}{
+		{"failed without a spool", "readings", false, 2},
+		{"spooled", "readings", true, 0},
+		{"rejected outright", "foo;DROP TABLE bar", true, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			captureLogs(t, slog.LevelError)
+			db := unreachableDB(t, config.GetDefaultConfig())
+			if tt.spool {
+				var err error
+				if db.spool, err = spool.New(t.TempDir(), 0); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			lost := testutil.ToFloat64(metrics.RowsLost)
+			err := db.writeBatch(context.Background(), tt.table, batch)
+			if (err != nil) != (tt.wantLost > 0) {
+				t.Errorf("error = %v, want one only when the batch is lost", err)
+			}
+			if got := testutil.ToFloat64(metrics.RowsLost) - lost; got != tt.wantLost {
+				t.Errorf("rows lost += %v, want %v", got, tt.wantLost)
+			}
+		})
+	}
+}
+
+func TestGetRecentReadingsRejectsNonPositiveLimits(t *testing.T) {
+	db := newTestDB(config.GetDefaultConfig())
+
+	// Rejected before the pool is used
+	for _, limit := range []int{0, -1} {
+		if _, err := db.GetRecentReadings(context.Background(), "d1", time.Time{}, limit); err == nil {
+			t.Errorf("limit %d: expected an error", limit)
+		}
+	}
+}
+
+func TestOperationTimeouts(t *testing.T) {
+	cfg := config.GetDefaultConfig()
+	cfg.Database.OperationTimeout = 3 * time.Second
+	cfg.Database.InsertTimeout = 7 * time.Second
+	db := newTestDB(cfg)
+
+	tests := []struct {
+		name   string
+		derive func(context.Context) (context.Context, context.CancelFunc)
+		want   time.Duration
+	}{
+		{"operation", db.withTimeout, 3 * time.Second},
+		{"insert", db.withInsertTimeout, 7 * time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := tt.derive(context.Background())
+			defer cancel()
+			deadline, ok := ctx.Deadline()
+			if !ok {
+				t.Fatal("no deadline")
+			}
+			if left := time.Until(deadline); left > tt.want || left < tt.want-time.Second {
+				t.Errorf("deadline in %s, want %s", left, tt.want)
+			}
+		})
+	}
+}
+
+func TestTimedOutInsertsAreRetried(t *testing.T) {
+	batch := []*models.SensorData{{Device_ID: "d1", Timestamp: time.Now()}}
+	tests := []struct {
+		name        string
+		insert      func(*TimescaleDB) error
+		wantSpooled int
+	}{
+		{"single insert", func(db *TimescaleDB) error {
+			return db.InsertSensorData(context.Background(), batch[0])
+		}, 0},
+		{"batch", func(db *TimescaleDB) error {
+			return db.writeBatch(context.Background(), db.config.Timescale.TableName, batch)
+		}, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			captureLogs(t, slog.LevelError)
+			cfg := config.GetDefaultConfig()
+			cfg.Database.InsertTimeout = 50 * time.Millisecond
+			cfg.Database.OperationTimeout = time.Hour
+			cfg.Database.MaxRetries = 2
+			cfg.Database.RetryInitialInterval = time.Millisecond
+			db := stalledDB(t, cfg)
+			var err error
+			if db.spool, err = spool.New(t.TempDir(), 0); err != nil {
+				t.Fatal(err)
+			}
+
+			retries := testutil.ToFloat64(metrics.DBInsertRetries)
+			start := time.Now()
+			err = tt.insert(db)
+			// Each attempt is cut short by the insert timeout, not the
+			// operation timeout
+			if elapsed := time.Since(start); elapsed > 5*time.Second {
+				t.Fatalf("insert took %s, want it bounded by the insert timeout", elapsed)
+			}
+			if got := testutil.ToFloat64(metrics.DBInsertRetries) - retries; got != 2 {
+				t.Errorf("retried %v times, want 2", got)
+			}
+			if tt.wantSpooled == 0 && !errors.Is(err, context.DeadlineExceeded) {
+				t.Errorf("error = %v, want the insert deadline", err)
+			}
+			if tt.wantSpooled > 0 && err != nil {
+				t.Errorf("error = %v, want the batch spooled", err)
+			}
+			if n := db.spool.Len(); n != tt.wantSpooled {
+				t.Errorf("spool holds %d segments, want %d", n, tt.wantSpooled)
+			}
+		})
+	}
+}
+
+func TestCancelledContextDoesNotBlock(t *testing.T) {
+	cfg := config.GetDefaultConfig()
+	cfg.Database.RetryInitialInterval = time.Hour
+	cfg.Database.ConnectRetryInterval = time.Hour
+	db := newTestDB(cfg)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	// An operation stalled until its context ends
+	stalled := func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	tests := []struct {
+		name string
+		run  func() error
+	}{
+		{"retried operation", func() error { return db.withRetry(ctx, stalled) }},
+		{"initial connection", func() error { return connectWithRetry(ctx, cfg.Database, stalled) }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			done := make(chan error, 1)
+			go func() { done <- tt.run() }()
+			select {
+			case err := <-done:
+				if !errors.Is(err, context.Canceled) {
+					t.Errorf("error = %v, want context.Canceled", err)
+				}
+			case <-time.After(time.Second):
+				t.Fatal("blocked despite the cancelled context")
+			}
+		})
+	}
+}
+
+func TestHypertableSQL(t *testing.T) {
+	tests := []struct {
+		name       string
+		timeColumn string
+		interval   time.Duration
+		wantArgs   []interface{} // the chunk interval comes third when set
+	}{
+		{"default chunks", "time", 0, []interface{}{`"public"."t"`, "time"}},
+		{"one day chunks", "time", 24 * time.Hour, []interface{}{`"public"."t"`, "time", "86400000 milliseconds"}},
+		// The column is a bound name, never spliced into the statement
+		{"custom time column", "Event Time", time.Hour, []interface{}{`"public"."t"`, "Event Time", "3600000 milliseconds"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			query, args := hypertableSQL(`"public"."t"`, tt.timeColumn, tt.interval)
+			if !strings.Contains(query, "create_hypertable($1::regclass, $2::name") {
+				t.Errorf("statement %q doesn't bind the time column", query)
+			}
+			if hasInterval := strings.Contains(query, "chunk_time_interval => $3::interval"); hasInterval != (tt.interval > 0) {
+				t.Errorf("statement %q sets a chunk interval = %v, want %v", query, hasInterval, tt.interval > 0)
+			}
+			if !strings.Contains(query, "if_not_exists => TRUE") {
+				t.Errorf("statement %q isn't idempotent", query)
+			}
+			if !slices.Equal(args, tt.wantArgs) {
+				t.Errorf("args = %v, want %v", args, tt.wantArgs)
+			}
+		})
+	}
+}
+
+func TestSpaceDimensionSQL(t *testing.T) {
+	for _, partitions := range []int{1, 4, 16} {
+		query, args := spaceDimensionSQL(`"public"."sensor_data"`, partitions)
+		if !strings.Contains(query, "add_dimension($1::regclass, 'device_id', number_partitions => $2") {
+			t.Errorf("query %q doesn't add a device_id dimension", query)
+		}
+		// Rerunning it on a table that has the dimension is harmless
+		if !strings.Contains(query, "if_not_exists => TRUE") {
+			t.Errorf("query %q isn't idempotent", query)
+		}
+		if want := []interface{}{`"public"."sensor_data"`, partitions}; !slices.Equal(args, want) {
+			t.Errorf("args = %v, want %v", args, want)
+		}
+	}
+}
+
+func TestContinuousAggregateSQL(t *testing.T) {
+	tests := []struct {
+		name        string
+		timeColumn  string
+		bucketWidth time.Duration
+		want        []string
+	}{
+		{"hourly", "time", time.Hour, []string{`time_bucket('3600000 milliseconds'::interval, "time") AS bucket`}},
+		{"quarter hours on a custom time column", "ts", 15 * time.Minute, []string{`time_bucket('900000 milliseconds'::interval, "ts") AS bucket`}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sql := continuousAggregateSQL(`"public"."t_aggregate"`, `"public"."t"`, tt.timeColumn, tt.bucketWidth)
+			for _, want := range append(tt.want,
+				`CREATE MATERIALIZED VIEW IF NOT EXISTS "public"."t_aggregate"`,
+				"WITH (timescaledb.continuous)",
+				`FROM "public"."t"`,
+				"avg(temperature) AS avg_temperature",
+				"GROUP BY bucket, device_id",
+				"WITH NO DATA",
+			) {
+				if !strings.Contains(sql, want) {
+					t.Errorf("statement lacks %q:\n%s", want, sql)
+				}
+			}
+		})
+	}
+}
+
+func TestFormatInterval(t *testing.T) {
+	for d, want := range map[time.Duration]string{
+		24 * time.Hour:          "86400000 milliseconds",
+		30 * 24 * time.Hour:     "2592000000 milliseconds",
+		1500 * time.Millisecond: "1500 milliseconds",
+	} {
+		if got := formatInterval(d); got != want {
+			t.Errorf("formatInterval(%s) = %q, want %q", d, got, want)
+		}
+	}
+}
+
+func TestPoliciesAreSkippedUnlessConfigured(t *testing.T) {
+	cfg := config.GetDefaultConfig()
+	cfg.Timescale.Retention = 0
+	cfg.Timescale.CompressAfter = 0
+	cfg.Timescale.ContinuousAggregate.Enabled = false
+	db := newTestDB(cfg)
+
+	// Without a pool any statement would panic
+	for name, apply := range map[string]func(context.Context, string, string) error{
+		"retention":            db.applyRetentionPolicy,
+		"compression":          db.applyCompressionPolicy,
+		"continuous aggregate": db.applyContinuousAggregate,
+	} {
+		if err := apply(context.Background(), "t", `"public"."t"`); err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+}
+
+func TestIsUnsupported(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"feature not supported", &pgconn.PgError{Code: "0A000"}, true},
+		{"missing policy function", &pgconn.PgError{Code: "42883"}, true},
+		{"undefined column", &pgconn.PgError{Code: "42703"}, false},
+		{"undefined table", &pgconn.PgError{Code: "42P01"}, false},
+		{"syntax error", &pgconn.PgError{Code: "42601"}, false},
+		{"not a server error", errors.New("connection reset"), false},
+		{"no error", nil, false},
+	}
+	for _, tt := range tests {
+		if got := isUnsupported(tt.err); got != tt.want {
+			t.Errorf("%s: isUnsupported = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/ponytojas/go-mqtt-timescale/internal/ttlmap"
+)
+
+// deviceMeta is the metadata of a device; NULL values are nil
+type deviceMeta struct {
+	location   *string
+	deviceType *string
+}
+
+// deviceCache holds the device metadata table in memory. A device is
+// forgotten once it has been neither looked up nor loaded by a refresh for
+// the TTL, so metadata doesn't outlive refreshes failing for that long.
+type deviceCache struct {
+	devices *ttlmap.Map[string, deviceMeta]
+}
+
+// newDeviceCache creates a cache forgetting devices unseen for ttl, see
+// deviceTTL. Close stops evicting expired devices.
+func newDeviceCache(ttl, refreshInterval time.Duration) *deviceCache {
+	return &deviceCache{devices: ttlmap.New[string, deviceMeta](deviceTTL(ttl, refreshInterval), 0)}
+}
+
+// deviceTTL returns how long a cached device is kept: ttl, but at least two
+// refresh intervals so a loaded device survives until the next refresh
+func deviceTTL(ttl, refreshInterval time.Duration) time.Duration {
+	if minTTL := 2 * refreshInterval; ttl < minTTL {
+		return minTTL
+	}
+	return ttl
+}
+
+// lookup returns the location and type of a device, or nils when the device
+// is unknown or the cache is nil
+func (c *deviceCache) lookup(deviceID string) (location, deviceType *string) {
+	if c == nil {
+		return nil, nil
+	}
+	meta, _ := c.devices.Get(deviceID)
+	return meta.location, meta.deviceType
+}
+
+// replace swaps in a freshly loaded set of devices, forgetting the devices
+// no longer in the table
+func (c *deviceCache) replace(devices map[string]deviceMeta) {
+	for _, deviceID := range c.devices.Keys() {
+		if _, ok := devices[deviceID]; !ok {
+			c.devices.Delete(deviceID)
+		}
+	}
+	for deviceID, meta := range devices {
+		c.devices.Update(deviceID, func(deviceMeta, bool) deviceMeta { return meta })
+	}
+}
+
+// close stops evicting expired devices; it does nothing on a nil cache
+func (c *deviceCache) close() {
+	if c != nil {
+		c.devices.Close()
+	}
+}
+
+// loadDevices reads the device metadata table into the cache
+func (db *TimescaleDB) loadDevices(ctx context.Context) error {
+	ident, err := db.quoteTable(db.config.Devices.Table)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+
+	rows, err := db.pool.Query(ctx, fmt.Sprintf(`SELECT device_id, location, type FROM %s`, ident))
+	if err != nil {
+		return fmt.Errorf("failed to query device metadata: %w", err)
+	}
+	defer rows.Close()
+
+	devices := make(map[string]deviceMeta)
+	for rows.Next() {
+		var deviceID string
+		var meta deviceMeta
+		if err := rows.Scan(&deviceID, &meta.location, &meta.deviceType); err != nil {
+			return fmt.Errorf("failed to scan device metadata: %w", err)
+		}
+		devices[deviceID] = meta
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to read device metadata: %w", err)
+	}
+
+	db.devices.replace(devices)
+	slog.Debug("Loaded device metadata", "table", db.config.Devices.Table, "devices", len(devices))
+	return nil
+}
+
+// deviceRefreshLoop periodically reloads the device metadata until the
+// database is closed. A failed refresh keeps the previous metadata.
+func (db *TimescaleDB) deviceRefreshLoop(interval time.Duration) {
+	defer db.wg.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := db.loadDevices(context.Background()); err != nil {
+				slog.Warn("Error refreshing device metadata", "error", err)
+			}
+		case <-db.done:
+			return
+		}
+	}
+}
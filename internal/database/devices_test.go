@@ -0,0 +1,98 @@
+package database
+
+import (
+	"testing"
+	"time"
+)
+
+// str returns a pointer to s
+func str(s string) *string { return &s }
+
+// waitForDevices waits up to a second for the cache to hold want devices
+func waitForDevices(t *testing.T, c *deviceCache, want int) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for c.devices.Len() != want {
+		if time.Now().After(deadline) {
+			t.Fatalf("caching %d devices, want %d", c.devices.Len(), want)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestDeviceTTL(t *testing.T) {
+	tests := []struct {
+		name         string
+		ttl, refresh time.Duration
+		want         time.Duration
+	}{
+		{"configured ttl", time.Hour, time.Minute, time.Hour},
+		// A loaded device must survive until the next refresh
+		{"at least two refreshes", 5 * time.Minute, 5 * time.Minute, 10 * time.Minute},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := deviceTTL(tt.ttl, tt.refresh); got != tt.want {
+				t.Errorf("deviceTTL(%s, %s) = %s, want %s", tt.ttl, tt.refresh, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIdleDevicesAreEvicted(t *testing.T) {
+	c := newDeviceCache(20*time.Millisecond, time.Millisecond)
+	defer c.close()
+	c.replace(map[string]deviceMeta{"d1": {location: str("kitchen")}, "d2": {location: str("garden")}})
+
+	// Neither a reading nor a refresh touches them, as while refreshes fail
+	waitForDevices(t, c, 0)
+	if l, _ := c.lookup("d1"); l != nil {
+		t.Errorf("evicted device location = %q, want NULL", *l)
+	}
+}
+
+func TestActiveDevicesSurvive(t *testing.T) {
+	const ttl = 30 * time.Millisecond
+	loaded := map[string]deviceMeta{"active": {location: str("kitchen")}, "idle": {location: str("garden")}}
+	tests := []struct {
+		name     string
+		touch    func(c *deviceCache)
+		wantIdle bool // the idle device is still cached
+	}{
+		{"looked up by readings", func(c *deviceCache) { c.lookup("active") }, false},
+		{"loaded by refreshes", func(c *deviceCache) { c.replace(loaded) }, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newDeviceCache(ttl, time.Millisecond)
+			defer c.close()
+			c.replace(loaded)
+
+			for deadline := time.Now().Add(5 * ttl); time.Now().Before(deadline); {
+				tt.touch(c)
+				time.Sleep(ttl / 5)
+			}
+			if l, _ := c.lookup("active"); !equalString(l, str("kitchen")) {
+				t.Errorf("active device location = %v, want kitchen", l)
+			}
+			if l, _ := c.lookup("idle"); (l != nil) != tt.wantIdle {
+				t.Errorf("idle device location = %v, want it cached = %v", l, tt.wantIdle)
+			}
+		})
+	}
+}
+
+func TestUnknownDevicesAreNotCached(t *testing.T) {
+	c := newDeviceCache(time.Hour, time.Minute)
+	defer c.close()
+	c.replace(map[string]deviceMeta{"d1": {location: str("kitchen")}})
+
+	for _, device := range []string{"ephemeral-1", "ephemeral-2"} {
+		if l, ty := c.lookup(device); l != nil || ty != nil {
+			t.Errorf("%s: metadata = %v, %v, want NULL", device, l, ty)
+		}
+	}
+	if n := c.devices.Len(); n != 1 {
+		t.Errorf("caching %d devices, want only d1", n)
+	}
+}
@@ -0,0 +1,1227 @@
+//go:build integration
+
+package database
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/testcontainers/testcontainers-go"
+	"github.com/testcontainers/testcontainers-go/wait"
+
+	"github.com/ponytojas/go-mqtt-timescale/config"
+	"github.com/ponytojas/go-mqtt-timescale/internal/metrics"
+	"github.com/ponytojas/go-mqtt-timescale/internal/models"
+	"github.com/ponytojas/go-mqtt-timescale/internal/mqtt"
+	"github.com/ponytojas/go-mqtt-timescale/internal/spool"
+)
+
+// The integration tests run against a TimescaleDB container started by
+// Docker, shared by every test in the package:
+//
+//	go test -tags integration ./internal/database
+//
+// They are skipped with -short.
+
+// timescaleImage is the image the tests run against
+const timescaleImage = "timescale/timescaledb:latest-pg16"
+
+// container is the TimescaleDB container, started by the first test that
+// needs it and removed once every test has run
+var container struct {
+	once sync.Once
+	c    testcontainers.Container
+	host string
+	port int
+	err  error
+}
+
+func TestMain(m *testing.M) {
+	code := m.Run()
+	if container.c != nil {
+		if err := container.c.Terminate(context.Background()); err != nil {
+			fmt.Fprintln(os.Stderr, "failed to remove TimescaleDB container:", err)
+		}
+	}
+	os.Exit(code)
+}
+
+// startTimescale starts the shared container unless it is running
+func startTimescale(t testing.TB) {
+	t.Helper()
+	if testing.Short() {
+		t.Skip("integration test skipped with -short")
+	}
+	container.once.Do(func() {
+		ctx := context.Background()
+		container.c, container.err = testcontainers.GenericContainer(ctx, testcontainers.GenericContainerRequest{
+			ContainerRequest: testcontainers.ContainerRequest{
+				Image:        timescaleImage,
+				ExposedPorts: []string{"5432/tcp"},
+				Env: map[string]string{
+					"POSTGRES_USER":     "postgres",
+					"POSTGRES_PASSWORD": "postgres",
+					"POSTGRES_DB":       "iot_data",
+				},
+				// The entrypoint restarts the server once initialized
+				WaitingFor: wait.ForLog("database system is ready to accept connections").
+					WithOccurrence(2).
+					WithStartupTimeout(2 * time.Minute),
+			},
+			Started: true,
+		})
+		if container.err != nil {
+			return
+		}
+		container.host, container.err = container.c.Host(ctx)
+		if container.err != nil {
+			return
+		}
+		port, err := container.c.MappedPort(ctx, "5432/tcp")
+		container.port, container.err = port.Int(), err
+	})
+	if container.err != nil {
+		t.Fatalf("failed to start TimescaleDB: %v", container.err)
+	}
+}
+
+// integrationConfig returns a configuration pointing at the container, with
+// a default table of the test's own
+func integrationConfig(t testing.TB) *config.Config {
+	t.Helper()
+	startTimescale(t)
+
+	cfg := config.GetDefaultConfig()
+	cfg.Database.Host = container.host
+	cfg.Database.Port = container.port
+	cfg.Database.ConnectRetries = 3
+	cfg.Timescale.TableName = testTableName(t)
+	cfg.Timescale.Retention = 0
+	cfg.Timescale.CompressAfter = 0
+	return cfg
+}
+
+// testTableName derives a table name unique to the test
+func testTableName(t testing.TB) string {
+	name := strings.ToLower(t.Name())
+	name = strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= '0' && r <= '9' {
+			return r
+		}
+		return '_'
+	}, name)
+	return name
+}
+
+// openTimescale connects to the container with cfg and initializes its
+// tables, closing the connection and dropping the tables once the test ends
+func openTimescale(t testing.TB, cfg *config.Config) *TimescaleDB {
+	t.Helper()
+	ctx := context.Background()
+	db, err := NewTimescaleDB(ctx, cfg)
+	if err != nil {
+		t.Fatalf("NewTimescaleDB: %v", err)
+	}
+	t.Cleanup(func() {
+		for _, table := range cfg.GetTableNames() {
+			ident, _ := db.quoteTable(table)
+			if _, err := db.pool.Exec(ctx, "DROP TABLE IF EXISTS "+ident+" CASCADE"); err != nil {
+				t.Errorf("failed to drop %s: %v", table, err)
+			}
+		}
+		db.Close(ctx)
+	})
+	if err := db.InitializeTable(ctx); err != nil {
+		t.Fatalf("InitializeTable: %v", err)
+	}
+	return db
+}
+
+// isHypertable reports whether table is a hypertable
+func isHypertable(t *testing.T, db *TimescaleDB, table string) bool {
+	t.Helper()
+	var exists bool
+	err := db.pool.QueryRow(context.Background(), `
+		SELECT EXISTS (
+			SELECT FROM timescaledb_information.hypertables
+			WHERE hypertable_schema = $1 AND hypertable_name = $2
+		)
+	`, db.config.Database.Schema, table).Scan(&exists)
+	if err != nil {
+		t.Fatalf("failed to look up hypertable %s: %v", table, err)
+	}
+	return exists
+}
+
+// countRows returns the number of rows in table
+func countRows(t testing.TB, db *TimescaleDB, table string) int {
+	t.Helper()
+	var count int
+	err := db.pool.QueryRow(context.Background(), "SELECT count(*) FROM "+db.tableIdentifier(table).Sanitize()).Scan(&count)
+	if err != nil {
+		t.Fatalf("failed to count rows of %s: %v", table, err)
+	}
+	return count
+}
+
+// waitForRows waits until table has want rows, failing the test if it
+// doesn't within a few seconds
+func waitForRows(t *testing.T, db *TimescaleDB, table string, want int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for n := countRows(t, db, table); n != want; n = countRows(t, db, table) {
+		if time.Now().After(deadline) {
+			t.Fatalf("table %s has %d rows, want %d", table, n, want)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// policyJobs returns the number of jobs running proc on table whose config
+// sets key to interval
+func policyJobs(t *testing.T, db *TimescaleDB, table, proc, key string, interval time.Duration) int {
+	t.Helper()
+	var n int
+	err := db.pool.QueryRow(context.Background(), `
+		SELECT count(*) FROM timescaledb_information.jobs
+		WHERE hypertable_schema = $1 AND hypertable_name = $2 AND proc_name = $3
+			AND (config->>$4)::interval = $5::interval
+	`, db.config.Database.Schema, table, proc, key, formatInterval(interval)).Scan(&n)
+	if err != nil {
+		t.Fatalf("failed to look up %s jobs of %s: %v", proc, table, err)
+	}
+	return n
+}
+
+// reading returns a reading of device at ts
+func reading(device string, ts time.Time, temperature float64) *models.SensorData {
+	return &models.SensorData{Device_ID: device, Timestamp: ts, Temperature: &temperature}
+}
+
+func TestIntegrationInitializeTableCreatesHypertable(t *testing.T) {
+	cfg := integrationConfig(t)
+	db := openTimescale(t, cfg)
+
+	if !isHypertable(t, db, cfg.Timescale.TableName) {
+		t.Fatalf("%s is not a hypertable", cfg.Timescale.TableName)
+	}
+	// Initializing again finds the table and hypertable in place
+	if err := db.InitializeTable(context.Background()); err != nil {
+		t.Fatalf("second InitializeTable: %v", err)
+	}
+}
+
+func TestIntegrationInitializeTableIsIdempotent(t *testing.T) {
+	cfg := integrationConfig(t)
+	cfg.Timescale.SpacePartitions = 4
+	db := openTimescale(t, cfg)
+	ctx := context.Background()
+
+	logs := captureLogs(t, slog.LevelInfo)
+	for i := 0; i < 2; i++ {
+		if err := db.InitializeTable(ctx); err != nil {
+			t.Fatalf("InitializeTable run %d: %v", i+2, err)
+		}
+	}
+	// create_hypertable on a hypertable only sends a notice
+	ident, _ := db.quoteTable(cfg.Timescale.TableName)
+	query, args := hypertableSQL(ident, cfg.Timescale.TimeColumn, 0)
+	if _, err := db.pool.Exec(ctx, query, args...); err != nil {
+		t.Fatalf("create_hypertable on a hypertable: %v", err)
+	}
+
+	if strings.Contains(logs.String(), "level=WARN") || strings.Contains(logs.String(), "level=ERROR") {
+		t.Errorf("initializing again logged warnings:\n%s", logs)
+	}
+	if !strings.Contains(logs.String(), `msg="Table is already a hypertable"`) {
+		t.Errorf("log lacks the existing hypertable:\n%s", logs)
+	}
+}
+
+func TestIntegrationMissingColumnsAreAdded(t *testing.T) {
+	cfg := integrationConfig(t)
+	cfg.Timescale.TrackIngestTime = true
+	cfg.Timescale.TagColumns = []string{"model"}
+	ctx := context.Background()
+
+	// A table created by an older version holding a reading
+	setupCfg := integrationConfig(t)
+	setupCfg.Timescale.TableName += "_setup"
+	setup := openTimescale(t, setupCfg)
+	ident, _ := setup.quoteTable(cfg.Timescale.TableName)
+	if _, err := setup.pool.Exec(ctx, "CREATE TABLE "+ident+" (time TIMESTAMPTZ NOT NULL, device_id TEXT NOT NULL, temperature DOUBLE PRECISION)"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := setup.pool.Exec(ctx, "INSERT INTO "+ident+" VALUES (now(), 'd0', 19)"); err != nil {
+		t.Fatal(err)
+	}
+
+	db := openTimescale(t, cfg)
+	if err := db.InitializeTable(ctx); err != nil {
+		t.Fatalf("InitializeTable run 2: %v", err)
+	}
+
+	rows, err := db.pool.Query(ctx, `
+		SELECT column_name FROM information_schema.columns
+		WHERE table_schema = $1 AND table_name = $2
+		ORDER BY ordinal_position
+	`, cfg.Database.Schema, cfg.Timescale.TableName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Existing columns keep their place and the missing ones follow
+	want := []string{"time", "device_id", "temperature", "humidity", "light", "metrics", "location", "type", "ingest_time", "model"}
+	if !slices.Equal(got, want) {
+		t.Errorf("columns = %v, want %v", got, want)
+	}
+
+	if err := db.InsertSensorData(ctx, reading("d1", time.Now(), 21.5)); err != nil {
+		t.Fatalf("InsertSensorData into the evolved table: %v", err)
+	}
+	if n := countRows(t, db, cfg.Timescale.TableName); n != 2 {
+		t.Errorf("table has %d rows, want the old and the new reading", n)
+	}
+}
+
+func TestIntegrationPlainPostgres(t *testing.T) {
+	tests := []struct {
+		name    string
+		enabled bool
+	}{
+		{"timescale disabled", false},
+		{"extension missing", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := integrationConfig(t)
+			cfg.Timescale.Enabled = tt.enabled
+			cfg.Timescale.Retention = 30 * 24 * time.Hour
+			if tt.enabled {
+				// template1 has the extension installed, template0 doesn't
+				cfg.Database.DBName = withoutTimescale(t, cfg)
+			}
+			db := openTimescale(t, cfg)
+
+			if hypertable := isPlainTableHypertable(t, db, cfg.Timescale.TableName); hypertable {
+				t.Errorf("%s is a hypertable, want a plain table", cfg.Timescale.TableName)
+			}
+			if err := db.InsertSensorData(context.Background(), reading("d1", time.Now(), 20)); err != nil {
+				t.Fatalf("InsertSensorData: %v", err)
+			}
+			if n := countRows(t, db, cfg.Timescale.TableName); n != 1 {
+				t.Errorf("table has %d rows, want 1", n)
+			}
+		})
+	}
+}
+
+// withoutTimescale creates a database without the timescaledb extension,
+// dropped once the test ends, and returns its name
+func withoutTimescale(t *testing.T, cfg *config.Config) string {
+	t.Helper()
+	ctx := context.Background()
+	admin := openTimescale(t, integrationConfig(t))
+	name := testTableName(t)
+	if _, err := admin.pool.Exec(ctx, "CREATE DATABASE "+pgx.Identifier{name}.Sanitize()+" TEMPLATE template0"); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if _, err := admin.pool.Exec(ctx, "DROP DATABASE IF EXISTS "+pgx.Identifier{name}.Sanitize()+" WITH (FORCE)"); err != nil {
+			t.Errorf("failed to drop database %s: %v", name, err)
+		}
+	})
+	return name
+}
+
+// isPlainTableHypertable reports whether table is a hypertable, without
+// assuming the timescaledb catalog exists
+func isPlainTableHypertable(t *testing.T, db *TimescaleDB, table string) bool {
+	t.Helper()
+	var installed bool
+	if err := db.pool.QueryRow(context.Background(), `SELECT EXISTS (SELECT FROM pg_extension WHERE extname = 'timescaledb')`).Scan(&installed); err != nil {
+		t.Fatal(err)
+	}
+	return installed && isHypertable(t, db, table)
+}
+
+func TestIntegrationInsertAndReadBack(t *testing.T) {
+	cfg := integrationConfig(t)
+	db := openTimescale(t, cfg)
+	ctx := context.Background()
+
+	start := time.Now().UTC().Truncate(time.Second).Add(-time.Hour)
+	batch := []*models.SensorData{
+		reading("d1", start, 20),
+		reading("d1", start.Add(time.Minute), 21),
+		reading("d2", start, 30),
+	}
+	batch[1].Fields = map[string]float64{"co2": 415}
+	if err := db.InsertSensorDataBatchInto(ctx, cfg.Timescale.TableName, batch); err != nil {
+		t.Fatalf("InsertSensorDataBatchInto: %v", err)
+	}
+
+	readings, err := db.GetRecentReadings(ctx, "d1", start, 10)
+	if err != nil {
+		t.Fatalf("GetRecentReadings: %v", err)
+	}
+	if len(readings) != 2 {
+		t.Fatalf("read %d readings of d1, want 2", len(readings))
+	}
+	newest := readings[0]
+	if !newest.Timestamp.Equal(start.Add(time.Minute)) || *newest.Temperature != 21 || newest.Fields["co2"] != 415 {
+		t.Errorf("newest reading = %s %v %v", newest.Timestamp, *newest.Temperature, newest.Fields)
+	}
+	if newest.Humidity != nil || newest.Light != nil {
+		t.Errorf("missing values read back as %v and %v, want NULL", newest.Humidity, newest.Light)
+	}
+}
+
+func TestIntegrationCustomTimeColumn(t *testing.T) {
+	cfg := integrationConfig(t)
+	cfg.Timescale.TimeColumn = "Event Time"
+	db := openTimescale(t, cfg)
+	ctx := context.Background()
+
+	if !isHypertable(t, db, cfg.Timescale.TableName) {
+		t.Fatalf("%s is not a hypertable", cfg.Timescale.TableName)
+	}
+	var dimension string
+	if err := db.pool.QueryRow(ctx, `
+		SELECT column_name FROM timescaledb_information.dimensions
+		WHERE hypertable_schema = $1 AND hypertable_name = $2 AND dimension_type = 'Time'
+	`, cfg.Database.Schema, cfg.Timescale.TableName).Scan(&dimension); err != nil {
+		t.Fatalf("failed to look up the time dimension: %v", err)
+	}
+	if dimension != "Event Time" {
+		t.Errorf("partitioned by %q, want the custom time column", dimension)
+	}
+
+	start := time.Now().UTC().Truncate(time.Second).Add(-time.Hour)
+	if err := db.InsertSensorDataBatchInto(ctx, cfg.Timescale.TableName, []*models.SensorData{
+		reading("d1", start, 20),
+		reading("d1", start.Add(time.Minute), 21),
+	}); err != nil {
+		t.Fatalf("InsertSensorDataBatchInto: %v", err)
+	}
+	if err := db.InsertSensorData(ctx, reading("d1", start.Add(2*time.Minute), 22)); err != nil {
+		t.Fatalf("InsertSensorData: %v", err)
+	}
+	readings, err := db.GetRecentReadings(ctx, "d1", start.Add(time.Minute), 10)
+	if err != nil {
+		t.Fatalf("GetRecentReadings: %v", err)
+	}
+	if len(readings) != 2 || !readings[0].Timestamp.Equal(start.Add(2*time.Minute)) {
+		t.Errorf("readings since the first = %v, want the last two, newest first", readings)
+	}
+}
+
+func TestIntegrationTagColumns(t *testing.T) {
+	cfg := integrationConfig(t)
+	cfg.Timescale.TagColumns = []string{"firmware_version", "model"}
+	db := openTimescale(t, cfg)
+	ctx := context.Background()
+
+	start := time.Now().UTC().Truncate(time.Second).Add(-time.Hour)
+	batch := []*models.SensorData{
+		reading("d1", start, 20),
+		reading("d2", start, 21),
+	}
+	firmware := "1.4.2"
+	batch[0].Tags = map[string]string{"firmware_version": firmware}
+	if err := db.InsertSensorDataBatchInto(ctx, cfg.Timescale.TableName, batch); err != nil {
+		t.Fatalf("InsertSensorDataBatchInto: %v", err)
+	}
+
+	tests := []struct {
+		device       string
+		wantFirmware *string
+	}{
+		{"d1", &firmware},
+		{"d2", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.device, func(t *testing.T) {
+			var gotFirmware, model *string
+			if err := db.pool.QueryRow(ctx, fmt.Sprintf(
+				"SELECT firmware_version, model FROM %s WHERE device_id = $1", db.tableIdentifier(cfg.Timescale.TableName).Sanitize(),
+			), tt.device).Scan(&gotFirmware, &model); err != nil {
+				t.Fatal(err)
+			}
+			if (gotFirmware == nil) != (tt.wantFirmware == nil) || gotFirmware != nil && *gotFirmware != *tt.wantFirmware {
+				t.Errorf("firmware_version = %v, want %v", gotFirmware, tt.wantFirmware)
+			}
+			if model != nil {
+				t.Errorf("model = %q, want NULL", *model)
+			}
+		})
+	}
+}
+
+func TestIntegrationIngestTime(t *testing.T) {
+	cfg := integrationConfig(t)
+	cfg.Timescale.TrackIngestTime = true
+	db := openTimescale(t, cfg)
+	ctx := context.Background()
+
+	sent := time.Now().UTC().Truncate(time.Second).Add(-time.Hour)
+	before := time.Now()
+	if err := db.InsertSensorData(ctx, reading("d1", sent, 20)); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.InsertSensorDataBatchInto(ctx, cfg.Timescale.TableName, []*models.SensorData{reading("d2", sent, 20)}); err != nil {
+		t.Fatal(err)
+	}
+
+	rows, err := db.pool.Query(ctx, "SELECT device_id, time, ingest_time FROM "+db.tableIdentifier(cfg.Timescale.TableName).Sanitize())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	n := 0
+	for rows.Next() {
+		var device string
+		var eventTime, ingestTime time.Time
+		if err := rows.Scan(&device, &eventTime, &ingestTime); err != nil {
+			t.Fatal(err)
+		}
+		n++
+		if !eventTime.Equal(sent) {
+			t.Errorf("%s: time = %s, want the device's %s", device, eventTime, sent)
+		}
+		if ingestTime.Before(before.Add(-time.Second)) || ingestTime.After(time.Now().Add(time.Second)) {
+			t.Errorf("%s: ingest_time = %s, want about now", device, ingestTime)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Errorf("read %d rows, want 2", n)
+	}
+}
+
+func TestIntegrationRetainedColumn(t *testing.T) {
+	cfg := integrationConfig(t)
+	cfg.Timescale.TrackRetained = true
+	db := openTimescale(t, cfg)
+	ctx := context.Background()
+
+	now := time.Now().UTC().Truncate(time.Second)
+	backfill := reading("d1", now, 20)
+	backfill.Retained = true
+	if err := db.InsertSensorDataBatchInto(ctx, cfg.Timescale.TableName, []*models.SensorData{backfill, reading("d2", now, 21)}); err != nil {
+		t.Fatal(err)
+	}
+
+	rows, err := db.pool.Query(ctx, "SELECT device_id, retained FROM "+db.tableIdentifier(cfg.Timescale.TableName).Sanitize())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	got := make(map[string]bool)
+	for rows.Next() {
+		var device string
+		var retained bool
+		if err := rows.Scan(&device, &retained); err != nil {
+			t.Fatal(err)
+		}
+		got[device] = retained
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]bool{"d1": true, "d2": false}; !maps.Equal(got, want) {
+		t.Errorf("retained = %v, want %v", got, want)
+	}
+}
+
+func TestIntegrationMaintainLatest(t *testing.T) {
+	cfg := integrationConfig(t)
+	cfg.Timescale.MaintainLatest = true
+	cfg.Timescale.LatestTable = cfg.Timescale.TableName + "_latest"
+	db := openTimescale(t, cfg)
+	ctx := context.Background()
+	latest, err := db.quoteTable(cfg.Timescale.LatestTable)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.pool.Exec(ctx, "DROP TABLE IF EXISTS "+latest) })
+
+	start := time.Now().UTC().Truncate(time.Second).Add(-time.Hour)
+	steps := []struct {
+		name   string
+		insert func() error
+		want   float64 // the temperature of d1 in the latest table
+	}{
+		{"first reading", func() error { return db.InsertSensorData(ctx, reading("d1", start, 20)) }, 20},
+		{"newer reading", func() error { return db.InsertSensorData(ctx, reading("d1", start.Add(time.Minute), 21)) }, 21},
+		// A late reading is stored but leaves the newer one in place
+		{"older reading", func() error { return db.InsertSensorData(ctx, reading("d1", start.Add(-time.Minute), 19)) }, 21},
+		{"batch", func() error {
+			return db.InsertSensorDataBatchInto(ctx, cfg.Timescale.TableName, []*models.SensorData{
+				reading("d1", start.Add(3*time.Minute), 23),
+				reading("d1", start.Add(2*time.Minute), 22),
+			})
+		}, 23},
+	}
+	for _, step := range steps {
+		if err := step.insert(); err != nil {
+			t.Fatalf("%s: %v", step.name, err)
+		}
+		var rows int
+		var temperature float64
+		if err := db.pool.QueryRow(ctx, "SELECT count(*), max(temperature) FROM "+latest+" WHERE device_id = 'd1'").Scan(&rows, &temperature); err != nil {
+			t.Fatalf("%s: %v", step.name, err)
+		}
+		if rows != 1 || temperature != step.want {
+			t.Errorf("%s: latest table holds %d rows of d1 at %v, want one at %v", step.name, rows, temperature, step.want)
+		}
+	}
+	if n := countRows(t, db, cfg.Timescale.TableName); n != 6 {
+		t.Errorf("stored %d readings, want every one of the 6", n)
+	}
+}
+
+func TestIntegrationVerboseInsertsLogAffectedRows(t *testing.T) {
+	tests := []struct {
+		name    string
+		verbose bool
+	}{
+		{"disabled", false},
+		{"enabled", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := integrationConfig(t)
+			cfg.Logging.VerboseInserts = tt.verbose
+			db := openTimescale(t, cfg)
+
+			logs := captureLogs(t, slog.LevelDebug)
+
+			if err := db.InsertSensorData(context.Background(), reading("d1", time.Now(), 20)); err != nil {
+				t.Fatal(err)
+			}
+			for _, msg := range []string{`msg="DB INSERT"`, `msg="DB INSERT affected rows"`} {
+				if logged := strings.Contains(logs.String(), msg); logged != tt.verbose {
+					t.Errorf("%s logged = %v, want %v", msg, logged, tt.verbose)
+				}
+			}
+		})
+	}
+}
+
+func TestIntegrationSchema(t *testing.T) {
+	cfg := integrationConfig(t)
+	cfg.Database.Schema = "iot"
+
+	// The schema is the operator's to create
+	adminCfg := integrationConfig(t)
+	adminCfg.Timescale.TableName += "_admin"
+	admin := openTimescale(t, adminCfg)
+	ctx := context.Background()
+	if _, err := admin.pool.Exec(ctx, "CREATE SCHEMA IF NOT EXISTS iot"); err != nil {
+		t.Fatal(err)
+	}
+	db := openTimescale(t, cfg)
+	if !isHypertable(t, db, cfg.Timescale.TableName) {
+		t.Fatalf("iot.%s is not a hypertable", cfg.Timescale.TableName)
+	}
+	if err := db.InsertSensorData(ctx, reading("d1", time.Now(), 21.5)); err != nil {
+		t.Fatal(err)
+	}
+	if n := countRows(t, db, cfg.Timescale.TableName); n != 1 {
+		t.Errorf("iot.%s has %d rows, want 1", cfg.Timescale.TableName, n)
+	}
+
+	// Nothing was created in the public schema
+	var inPublic bool
+	if err := admin.pool.QueryRow(ctx, `
+		SELECT EXISTS (
+			SELECT FROM information_schema.tables
+			WHERE table_schema = 'public' AND table_name = $1
+		)
+	`, cfg.Timescale.TableName).Scan(&inPublic); err != nil {
+		t.Fatal(err)
+	}
+	if inPublic {
+		t.Errorf("%s was created in the public schema", cfg.Timescale.TableName)
+	}
+}
+
+func TestIntegrationGetRecentReadings(t *testing.T) {
+	cfg := integrationConfig(t)
+	db := openTimescale(t, cfg)
+	ctx := context.Background()
+
+	start := time.Now().UTC().Truncate(time.Second).Add(-time.Hour)
+	var batch []*models.SensorData
+	for i := 0; i < 5; i++ {
+		batch = append(batch, reading("d1", start.Add(time.Duration(i)*time.Minute), float64(20+i)))
+	}
+	batch = append(batch, reading("d2", start.Add(10*time.Minute), 30))
+	if err := db.InsertSensorDataBatchInto(ctx, cfg.Timescale.TableName, batch); err != nil {
+		t.Fatalf("InsertSensorDataBatchInto: %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		device string
+		since  time.Time
+		limit  int
+		want   []float64 // temperatures, newest first
+	}{
+		{"every reading", "d1", start, 10, []float64{24, 23, 22, 21, 20}},
+		{"limited", "d1", start, 2, []float64{24, 23}},
+		{"since", "d1", start.Add(3 * time.Minute), 10, []float64{24, 23}},
+		{"other device", "d2", start, 10, []float64{30}},
+		{"unknown device", "d3", start, 10, []float64{}},
+		{"nothing since", "d1", start.Add(time.Hour), 10, []float64{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			readings, err := db.GetRecentReadings(ctx, tt.device, tt.since, tt.limit)
+			if err != nil {
+				t.Fatalf("GetRecentReadings: %v", err)
+			}
+			if readings == nil {
+				t.Fatal("readings = nil, want an empty slice")
+			}
+			got := make([]float64, len(readings))
+			for i, r := range readings {
+				got[i] = *r.Temperature
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("temperatures = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIntegrationEnqueueIsWrittenOnClose(t *testing.T) {
+	cfg := integrationConfig(t)
+	cfg.Timescale.FlushInterval = time.Hour
+	db := openTimescale(t, cfg)
+	ctx := context.Background()
+
+	// A second instance buffers readings well below the batch size, which
+	// only Close writes
+	writer, err := NewTimescaleDB(ctx, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := writer.EnqueueSensorData(ctx, reading("d1", time.Now().Add(time.Duration(i)*time.Second), 20)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := countRows(t, db, cfg.Timescale.TableName); n != 0 {
+		t.Errorf("table has %d rows before close, want 0", n)
+	}
+	if err := writer.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if n := countRows(t, db, cfg.Timescale.TableName); n != 3 {
+		t.Errorf("table has %d rows after close, want 3", n)
+	}
+}
+
+func TestIntegrationBufferedReadingsAreFlushed(t *testing.T) {
+	tests := []struct {
+		name          string
+		batchSize     int
+		flushInterval time.Duration
+		readings      int
+	}{
+		{"full batch", 3, time.Hour, 3},
+		{"flush interval", 1000, 100 * time.Millisecond, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := integrationConfig(t)
+			cfg.Timescale.BatchSize = tt.batchSize
+			cfg.Timescale.FlushInterval = tt.flushInterval
+			db := openTimescale(t, cfg)
+
+			start := time.Now().Add(-time.Minute)
+			for i := 0; i < tt.readings; i++ {
+				if err := db.EnqueueSensorData(context.Background(), reading("d1", start.Add(time.Duration(i)*time.Second), 20)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			waitForRows(t, db, cfg.Timescale.TableName, tt.readings)
+		})
+	}
+}
+
+func TestIntegrationRequestFlushWritesAPartialBatch(t *testing.T) {
+	cfg := integrationConfig(t)
+	cfg.Timescale.BatchSize = 100
+	cfg.Timescale.FlushInterval = time.Hour
+	db := openTimescale(t, cfg)
+	ctx := context.Background()
+
+	for i := 0; i < 3; i++ {
+		if err := db.EnqueueSensorData(ctx, reading("d1", time.Now().Add(time.Duration(i)*time.Second), 20)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// As the pipeline does once the broker connection is lost
+	db.RequestFlush()
+	waitForRows(t, db, cfg.Timescale.TableName, 3)
+}
+
+func TestIntegrationConcurrentInserts(t *testing.T) {
+	cfg := integrationConfig(t)
+	cfg.Database.MaxConns = 4
+	db := openTimescale(t, cfg)
+
+	// Far more writers than connections, so inserts wait for a connection
+	// instead of sharing one; run with -race
+	const writers = 100
+	start := time.Now().Add(-time.Hour)
+	errs := make(chan error, writers)
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs <- db.InsertSensorData(context.Background(), reading(fmt.Sprintf("d%d", i), start.Add(time.Duration(i)*time.Millisecond), 20))
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Errorf("InsertSensorData: %v", err)
+		}
+	}
+	if n := countRows(t, db, cfg.Timescale.TableName); n != writers {
+		t.Errorf("table has %d rows, want %d", n, writers)
+	}
+}
+
+func TestIntegrationCancelledInsertReturns(t *testing.T) {
+	cfg := integrationConfig(t)
+	db := openTimescale(t, cfg)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	err := db.InsertSensorData(ctx, reading("d1", time.Now(), 20))
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("error = %v, want context.Canceled", err)
+	}
+	if n := countRows(t, db, cfg.Timescale.TableName); n != 0 {
+		t.Errorf("table has %d rows, want 0", n)
+	}
+}
+
+func TestIntegrationFailedInsertIsSpooledAndReplayed(t *testing.T) {
+	cfg := integrationConfig(t)
+	db := openTimescale(t, cfg)
+	var err error
+	if db.spool, err = spool.New(t.TempDir(), 0); err != nil {
+		t.Fatal(err)
+	}
+
+	// A cancelled insert stands in for the database dropping away mid-write
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	batch := []*models.SensorData{reading("d1", time.Now().Add(-time.Minute), 20), reading("d2", time.Now(), 21)}
+	if err := db.writeBatch(ctx, cfg.Timescale.TableName, batch); err != nil {
+		t.Fatalf("writeBatch: %v, want the batch spooled", err)
+	}
+	if db.spool.Len() != 1 {
+		t.Fatalf("spool holds %d segments, want 1", db.spool.Len())
+	}
+
+	replayed, err := db.spool.Replay(context.Background(), db.InsertSensorDataBatchInto, isRetryable)
+	if err != nil || replayed != 2 {
+		t.Fatalf("Replay = %d, %v, want 2 rows", replayed, err)
+	}
+	if n := countRows(t, db, cfg.Timescale.TableName); n != 2 {
+		t.Errorf("table has %d rows, want 2", n)
+	}
+}
+
+func TestIntegrationUpsertUpdatesTheExistingRow(t *testing.T) {
+	tests := []struct {
+		name   string
+		insert func(db *TimescaleDB, table string, data *models.SensorData) error
+	}{
+		{"single insert", func(db *TimescaleDB, table string, data *models.SensorData) error {
+			return db.InsertSensorData(context.Background(), data)
+		}},
+		{"batch", func(db *TimescaleDB, table string, data *models.SensorData) error {
+			return db.InsertSensorDataBatchInto(context.Background(), table, []*models.SensorData{data})
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := integrationConfig(t)
+			cfg.Timescale.Upsert = true
+			db := openTimescale(t, cfg)
+			table := cfg.Timescale.TableName
+
+			ts := time.Now().UTC().Truncate(time.Second)
+			for _, temperature := range []float64{20, 25} {
+				if err := tt.insert(db, table, reading("d1", ts, temperature)); err != nil {
+					t.Fatalf("insert of %v: %v", temperature, err)
+				}
+			}
+			if n := countRows(t, db, table); n != 1 {
+				t.Fatalf("table has %d rows, want 1", n)
+			}
+			readings, err := db.GetRecentReadings(context.Background(), "d1", ts, 10)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(readings) != 1 || *readings[0].Temperature != 25 {
+				t.Errorf("readings = %v, want one updated to 25", readings)
+			}
+		})
+	}
+}
+
+func TestIntegrationDeviceMetadataEnrichment(t *testing.T) {
+	cfg := integrationConfig(t)
+	cfg.Devices.Table = testTableName(t) + "_devices"
+	cfg.Devices.RefreshInterval = 100 * time.Millisecond
+	ctx := context.Background()
+
+	// The lookup table must exist before the database loads it
+	setup := openTimescale(t, integrationConfig(t))
+	devices := setup.tableIdentifier(cfg.Devices.Table).Sanitize()
+	if _, err := setup.pool.Exec(ctx, "CREATE TABLE "+devices+" (device_id TEXT PRIMARY KEY, location TEXT, type TEXT)"); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { setup.pool.Exec(ctx, "DROP TABLE IF EXISTS "+devices) })
+	if _, err := setup.pool.Exec(ctx, "INSERT INTO "+devices+" VALUES ('d1', 'kitchen', 'thermometer')"); err != nil {
+		t.Fatal(err)
+	}
+
+	db := openTimescale(t, cfg)
+	table := db.tableIdentifier(cfg.Timescale.TableName).Sanitize()
+	// metadata returns the location and type stored with device's reading at ts
+	metadata := func(device string, ts time.Time) (location, deviceType *string) {
+		t.Helper()
+		err := db.pool.QueryRow(ctx, "SELECT location, type FROM "+table+" WHERE device_id = $1 AND time = $2", device, ts).Scan(&location, &deviceType)
+		if err != nil {
+			t.Fatalf("failed to read the metadata of %s: %v", device, err)
+		}
+		return location, deviceType
+	}
+
+	ts := time.Now().UTC().Truncate(time.Second)
+	if err := db.InsertSensorDataBatchInto(ctx, cfg.Timescale.TableName, []*models.SensorData{reading("d1", ts, 20), reading("d2", ts, 20)}); err != nil {
+		t.Fatal(err)
+	}
+	if location, deviceType := metadata("d1", ts); location == nil || *location != "kitchen" || deviceType == nil || *deviceType != "thermometer" {
+		t.Errorf("known device stored with %v, %v, want kitchen, thermometer", location, deviceType)
+	}
+	if location, deviceType := metadata("d2", ts); location != nil || deviceType != nil {
+		t.Errorf("unknown device stored with %v, %v, want NULL", location, deviceType)
+	}
+
+	// New metadata is picked up by the next refresh
+	if _, err := setup.pool.Exec(ctx, "INSERT INTO "+devices+" VALUES ('d2', 'garden', 'hygrometer')"); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for i := 1; ; i++ {
+		later := ts.Add(time.Duration(i) * time.Second)
+		if err := db.InsertSensorDataBatchInto(ctx, cfg.Timescale.TableName, []*models.SensorData{reading("d2", later, 20)}); err != nil {
+			t.Fatal(err)
+		}
+		if location, _ := metadata("d2", later); location != nil && *location == "garden" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("refreshed metadata never used")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestIntegrationChunkTimeInterval(t *testing.T) {
+	cfg := integrationConfig(t)
+	cfg.Timescale.ChunkTimeInterval = 24 * time.Hour
+	db := openTimescale(t, cfg)
+
+	var interval time.Duration
+	err := db.pool.QueryRow(context.Background(), `
+		SELECT time_interval FROM timescaledb_information.dimensions
+		WHERE hypertable_schema = $1 AND hypertable_name = $2 AND dimension_type = 'Time'
+	`, cfg.Database.Schema, cfg.Timescale.TableName).Scan(&interval)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if interval != 24*time.Hour {
+		t.Errorf("chunk interval = %s, want 24h", interval)
+	}
+}
+
+func TestIntegrationSpacePartitions(t *testing.T) {
+	cfg := integrationConfig(t)
+	cfg.Timescale.SpacePartitions = 4
+	db := openTimescale(t, cfg)
+	ctx := context.Background()
+
+	partitions := func() int {
+		t.Helper()
+		var n int
+		err := db.pool.QueryRow(ctx, `
+			SELECT COALESCE(max(num_partitions), 0) FROM timescaledb_information.dimensions
+			WHERE hypertable_schema = $1 AND hypertable_name = $2 AND column_name = 'device_id'
+		`, cfg.Database.Schema, cfg.Timescale.TableName).Scan(&n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+	if n := partitions(); n != 4 {
+		t.Fatalf("device_id dimension has %d partitions, want 4", n)
+	}
+	if err := db.InsertSensorData(ctx, reading("d1", time.Now(), 20)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Partitions are only applied at creation, a change is just reported
+	logs := captureLogs(t, slog.LevelInfo)
+	db.config.Timescale.SpacePartitions = 8
+	if err := db.InitializeTable(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if n := partitions(); n != 4 {
+		t.Errorf("device_id dimension has %d partitions after a change, want 4 kept", n)
+	}
+	if !strings.Contains(logs.String(), "Hypertable space partitions differ") {
+		t.Errorf("log lacks the partition mismatch:\n%s", logs)
+	}
+}
+
+func TestIntegrationRetentionPolicy(t *testing.T) {
+	cfg := integrationConfig(t)
+	cfg.Timescale.Retention = 30 * 24 * time.Hour
+	db := openTimescale(t, cfg)
+
+	// Initializing again, e.g. on a restart, replaces the policy
+	cfg.Timescale.Retention = 14 * 24 * time.Hour
+	if err := db.InitializeTable(context.Background()); err != nil {
+		t.Fatalf("second InitializeTable: %v", err)
+	}
+	if n := policyJobs(t, db, cfg.Timescale.TableName, "policy_retention", "drop_after", 14*24*time.Hour); n != 1 {
+		t.Errorf("found %d retention policies dropping after 14 days, want 1", n)
+	}
+	if n := policyJobs(t, db, cfg.Timescale.TableName, "policy_retention", "drop_after", 30*24*time.Hour); n != 0 {
+		t.Errorf("found %d retention policies dropping after 30 days, want the old one replaced", n)
+	}
+}
+
+func TestIntegrationCompressionPolicy(t *testing.T) {
+	cfg := integrationConfig(t)
+	cfg.Timescale.CompressAfter = 7 * 24 * time.Hour
+	db := openTimescale(t, cfg)
+
+	// Compression is already enabled on a restart
+	if err := db.InitializeTable(context.Background()); err != nil {
+		t.Fatalf("second InitializeTable: %v", err)
+	}
+	var enabled bool
+	err := db.pool.QueryRow(context.Background(), `
+		SELECT compression_enabled FROM timescaledb_information.hypertables
+		WHERE hypertable_schema = $1 AND hypertable_name = $2
+	`, cfg.Database.Schema, cfg.Timescale.TableName).Scan(&enabled)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !enabled {
+		t.Error("compression is not enabled")
+	}
+	if n := policyJobs(t, db, cfg.Timescale.TableName, "policy_compression", "compress_after", 7*24*time.Hour); n != 1 {
+		t.Errorf("found %d compression policies, want 1", n)
+	}
+}
+
+func TestIntegrationContinuousAggregate(t *testing.T) {
+	cfg := integrationConfig(t)
+	cfg.Timescale.ContinuousAggregate.Enabled = true
+	cfg.Timescale.ContinuousAggregate.BucketWidth = 15 * time.Minute
+	cfg.Timescale.ContinuousAggregate.ScheduleInterval = 30 * time.Minute
+	db := openTimescale(t, cfg)
+
+	// The view is kept and its policy replaced on a restart
+	if err := db.InitializeTable(context.Background()); err != nil {
+		t.Fatalf("second InitializeTable: %v", err)
+	}
+	var policies int
+	err := db.pool.QueryRow(context.Background(), `
+		SELECT count(*) FROM timescaledb_information.continuous_aggregates c
+		JOIN timescaledb_information.jobs j
+			ON j.hypertable_schema = c.materialization_hypertable_schema
+			AND j.hypertable_name = c.materialization_hypertable_name
+		WHERE c.view_schema = $1 AND c.view_name = $2
+			AND j.proc_name = 'policy_refresh_continuous_aggregate'
+			AND j.schedule_interval = $3::interval
+	`, cfg.Database.Schema, cfg.Timescale.TableName+"_aggregate", formatInterval(30*time.Minute)).Scan(&policies)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if policies != 1 {
+		t.Errorf("found %d refresh policies, want 1", policies)
+	}
+
+	// Refreshing by hand fills the configured buckets
+	start := time.Now().UTC().Add(-2 * time.Hour).Truncate(time.Hour)
+	batch := []*models.SensorData{reading("d1", start, 20), reading("d1", start.Add(5*time.Minute), 22), reading("d1", start.Add(20*time.Minute), 30)}
+	if err := db.InsertSensorDataBatchInto(context.Background(), cfg.Timescale.TableName, batch); err != nil {
+		t.Fatal(err)
+	}
+	view := db.tableIdentifier(cfg.Timescale.TableName + "_aggregate").Sanitize()
+	if _, err := db.pool.Exec(context.Background(), `CALL refresh_continuous_aggregate($1::regclass, NULL, NULL)`, view); err != nil {
+		t.Fatalf("refresh: %v", err)
+	}
+	var avg float64
+	if err := db.pool.QueryRow(context.Background(), "SELECT avg_temperature FROM "+view+" WHERE device_id = 'd1' AND bucket = $1", start).Scan(&avg); err != nil {
+		t.Fatal(err)
+	}
+	if avg != 21 {
+		t.Errorf("average of the first bucket = %v, want 21", avg)
+	}
+}
+
+// BenchmarkIntegrationInsertSensorData measures single inserts, which after
+// the first reuse the statement prepared for the table
+func BenchmarkIntegrationInsertSensorData(b *testing.B) {
+	cfg := integrationConfig(b)
+	db := openTimescale(b, cfg)
+	ctx := context.Background()
+	start := time.Now().Add(-time.Hour)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := db.InsertSensorData(ctx, reading("d1", start.Add(time.Duration(i)*time.Microsecond), 20)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestIntegrationInsertsReuseThePreparedStatement(t *testing.T) {
+	cfg := integrationConfig(t)
+	// A single connection, so every insert and the check below share it
+	cfg.Database.MaxConns = 1
+	other := cfg.Timescale.TableName + "_other"
+	cfg.MQTT.Subscriptions = []config.SubscriptionConfig{
+		{Topic: "a/#", Table: cfg.Timescale.TableName},
+		{Topic: "b/#", Table: other},
+	}
+	db := openTimescale(t, cfg)
+	ctx := context.Background()
+
+	start := time.Now().UTC().Add(-time.Hour)
+	inserts := map[string]int{cfg.Timescale.TableName: 3, other: 2}
+	for table, n := range inserts {
+		for i := 0; i < n; i++ {
+			if err := db.InsertSensorDataInto(ctx, table, reading("d1", start.Add(time.Duration(i)*time.Second), 20)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	for table, n := range inserts {
+		name := insertStatementName(table)
+		var statements, executions int
+		err := db.pool.QueryRow(ctx,
+			"SELECT count(*), coalesce(sum(generic_plans + custom_plans), 0) FROM pg_prepared_statements WHERE name = $1",
+			name).Scan(&statements, &executions)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Prepared once and executed by name for every insert
+		if statements != 1 || executions != n {
+			t.Errorf("%s: %d statements executed %d times, want one executed %d times", name, statements, executions, n)
+		}
+	}
+}
+
+func TestIntegrationImport(t *testing.T) {
+	cfg := integrationConfig(t)
+	cfg.Timescale.BatchSize = 2
+	db := openTimescale(t, cfg)
+	var inserted int
+	var mu sync.Mutex
+	db.SetInsertHook(func(_ string, batch []*models.SensorData) {
+		mu.Lock()
+		defer mu.Unlock()
+		inserted += len(batch)
+	})
+
+	importer, err := mqtt.NewImporter(cfg, db)
+	if err != nil {
+		t.Fatalf("NewImporter: %v", err)
+	}
+	lines := strings.Join([]string{
+		`{"device_id":"d1","timestamp":"2024-05-01T12:00:00Z","temperature":21.5}`,
+		`{"device_id":"d2","timestamp":"2024-05-01T12:00:00Z","temperature":19}`,
+		`{"device_id":"d1","timestamp":`,
+		`{"device_id":"d1","timestamp":"2024-05-01T12:01:00Z","temperature":22}`,
+		`{"device_id":"d2","timestamp":"2024-05-01T12:01:00Z","temperature":19.5}`,
+		`{"device_id":"d1","timestamp":"2024-05-01T12:02:00Z","temperature":23}`,
+	}, "\n")
+	result, err := importer.Import(context.Background(), cfg.Timescale.TableName, cfg.MQTT.Topic, strings.NewReader(lines))
+	importer.Disconnect()
+	if err != nil {
+		t.Fatalf("Import: %v", err)
+	}
+	if result != (mqtt.ImportResult{Lines: 6, Failed: 1}) {
+		t.Errorf("result = %+v, want 6 lines with 1 failed", result)
+	}
+
+	// Two full batches are written as they fill, the last row on a flush
+	db.RequestFlush()
+	waitForRows(t, db, cfg.Timescale.TableName, 5)
+	// The hook runs once the insert returns, just after the rows are visible
+	counted := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return inserted
+	}
+	for deadline := time.Now().Add(5 * time.Second); counted() != 5 && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := counted(); n != 5 {
+		t.Errorf("insert hook counted %d rows, want 5", n)
+	}
+}
+
+func TestIntegrationPoolMetrics(t *testing.T) {
+	cfg := integrationConfig(t)
+	db := openTimescale(t, cfg)
+	for i := 0; i < 3; i++ {
+		if err := db.InsertSensorData(context.Background(), reading("d1", time.Now().Add(time.Duration(i)*time.Second), 20)); err != nil {
+			t.Fatalf("InsertSensorData: %v", err)
+		}
+	}
+
+	stats := db.poolStats()
+	if stats.TotalConns < 1 || stats.Acquires < 3 || stats.MaxConns != int32(cfg.Database.MaxConns) {
+		t.Errorf("pool stats = %+v, want open connections and at least 3 acquires", stats)
+	}
+	// The pool is registered with the metrics, and /stats, until closed
+	if pool := metrics.Snapshot(1).Pool; pool == nil || pool.Acquires < stats.Acquires {
+		t.Errorf("stats pool = %+v, want at least this pool's %d acquires", pool, stats.Acquires)
+	}
+}
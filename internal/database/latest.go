@@ -0,0 +1,112 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+
+	"github.com/ponytojas/go-mqtt-timescale/internal/models"
+)
+
+// initializeLatestTable creates the latest table, keyed on device_id, unless
+// it exists, and adds any columns it lacks
+func (db *TimescaleDB) initializeLatestTable(ctx context.Context) error {
+	tableName := db.config.Timescale.LatestTable
+	ident, err := db.quoteTable(tableName)
+	if err != nil {
+		return err
+	}
+
+	cols := tableColumns(db.config)
+	if _, err := db.pool.Exec(ctx, createLatestTableSQL(ident, cols)); err != nil {
+		return fmt.Errorf("failed to create latest table: %w", err)
+	}
+	if _, err := db.pool.Exec(ctx, addColumnsSQL(ident, cols)); err != nil {
+		return fmt.Errorf("failed to add missing columns to latest table: %w", err)
+	}
+
+	slog.Info("Latest table ensured", "table", tableName)
+	return nil
+}
+
+// createLatestTableSQL returns the statement creating the latest table with
+// cols and device_id as its primary key
+func createLatestTableSQL(ident string, cols []tableColumn) string {
+	defs := make([]string, len(cols), len(cols)+1)
+	for i, col := range cols {
+		defs[i] = pgx.Identifier{col.name}.Sanitize() + " " + col.definition
+	}
+	defs = append(defs, "PRIMARY KEY (device_id)")
+	return fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (\n\t%s\n)", ident, strings.Join(defs, ",\n\t"))
+}
+
+// latestSQL returns the statement upserting a reading into the latest table
+// ident. The row is only replaced by a reading at least as new, so readings
+// arriving out of order or replayed from the spool don't overwrite newer ones.
+func (db *TimescaleDB) latestSQL(ident string) string {
+	quoted := make([]string, len(db.columns))
+	params := make([]string, len(db.columns))
+	var updates []string
+	for i, column := range db.columns {
+		quoted[i] = pgx.Identifier{column}.Sanitize()
+		params[i] = fmt.Sprintf("$%d", i+1)
+		if column != "device_id" {
+			updates = append(updates, fmt.Sprintf("%s = EXCLUDED.%s", quoted[i], quoted[i]))
+		}
+	}
+	timeColumn := pgx.Identifier{db.config.Timescale.TimeColumn}.Sanitize()
+	return fmt.Sprintf(`
+		INSERT INTO %s AS latest (%s)
+		VALUES (%s)
+		ON CONFLICT (device_id) DO UPDATE SET %s
+		WHERE latest.%s <= EXCLUDED.%s
+	`, ident, strings.Join(quoted, ", "), strings.Join(params, ", "), strings.Join(updates, ", "), timeColumn, timeColumn)
+}
+
+// newestPerDevice returns the newest reading of each device in batch
+func newestPerDevice(batch []*models.SensorData) []*models.SensorData {
+	index := make(map[string]int, len(batch))
+	var newest []*models.SensorData
+	for _, data := range batch {
+		i, ok := index[data.Device_ID]
+		if !ok {
+			index[data.Device_ID] = len(newest)
+			newest = append(newest, data)
+		} else if !data.Timestamp.Before(newest[i].Timestamp) {
+			newest[i] = data
+		}
+	}
+	return newest
+}
+
+// updateLatest upserts the newest reading of each device in batch into the
+// latest table when it is maintained. The rows are already stored, so a
+// failure is logged rather than failing the insert; the next reading of
+// each device corrects its row.
+func (db *TimescaleDB) updateLatest(ctx context.Context, batch []*models.SensorData) {
+	if !db.config.Timescale.MaintainLatest {
+		return
+	}
+	tableName := db.config.Timescale.LatestTable
+	ident, err := db.quoteTable(tableName)
+	if err != nil {
+		slog.Error("Error updating latest table", "table", tableName, "error", err)
+		return
+	}
+
+	newest := newestPerDevice(batch)
+	query := db.latestSQL(ident)
+	queued := &pgx.Batch{}
+	for _, data := range newest {
+		queued.Queue(query, db.row(data)...)
+	}
+
+	ctx, cancel := db.withInsertTimeout(ctx)
+	defer cancel()
+	if err := db.pool.SendBatch(ctx, queued).Close(); err != nil {
+		slog.Error("Error updating latest table", "table", tableName, "devices", len(newest), "error", err)
+	}
+}
@@ -0,0 +1,126 @@
+package database
+
+import (
+	"context"
+	"log/slog"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ponytojas/go-mqtt-timescale/config"
+	"github.com/ponytojas/go-mqtt-timescale/internal/models"
+)
+
+func TestNewestPerDevice(t *testing.T) {
+	t0 := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	reading := func(device string, offset time.Duration) *models.SensorData {
+		return &models.SensorData{Device_ID: device, Timestamp: t0.Add(offset)}
+	}
+	d1Old, d1New, d1Tie := reading("d1", 0), reading("d1", time.Minute), reading("d1", time.Minute)
+	d2 := reading("d2", -time.Hour)
+	tests := []struct {
+		name  string
+		batch []*models.SensorData
+		want  []*models.SensorData
+	}{
+		{"single reading", []*models.SensorData{d1Old}, []*models.SensorData{d1Old}},
+		{"newest last", []*models.SensorData{d1Old, d1New}, []*models.SensorData{d1New}},
+		{"newest first", []*models.SensorData{d1New, d1Old}, []*models.SensorData{d1New}},
+		// The later of two readings with the same time wins
+		{"same time", []*models.SensorData{d1New, d1Tie}, []*models.SensorData{d1Tie}},
+		{"devices in arrival order", []*models.SensorData{d1Old, d2, d1New}, []*models.SensorData{d1New, d2}},
+		{"empty", nil, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := newestPerDevice(tt.batch); !slices.Equal(got, tt.want) {
+				t.Errorf("newestPerDevice = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCreateLatestTableSQL(t *testing.T) {
+	cfg := config.GetDefaultConfig()
+	cfg.Timescale.TagColumns = []string{"model"}
+	sql := createLatestTableSQL(`"public"."device_latest"`, tableColumns(cfg))
+	for _, want := range []string{
+		`CREATE TABLE IF NOT EXISTS "public"."device_latest"`,
+		`"time" TIMESTAMPTZ NOT NULL`,
+		`"model" TEXT`,
+		"PRIMARY KEY (device_id)",
+	} {
+		if !strings.Contains(sql, want) {
+			t.Errorf("CREATE TABLE lacks %s:\n%s", want, sql)
+		}
+	}
+}
+
+func TestLatestSQL(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(*config.Config)
+		want   []string
+	}{
+		{"default", func(*config.Config) {}, []string{
+			`INSERT INTO "public"."device_latest" AS latest ("time", "temperature", "humidity", "light", "device_id", "metrics", "location", "type")`,
+			"VALUES ($1, $2, $3, $4, $5, $6, $7, $8)",
+			`ON CONFLICT (device_id) DO UPDATE SET "time" = EXCLUDED."time", "temperature" = EXCLUDED."temperature"`,
+			// Older readings don't replace a newer row
+			`WHERE latest."time" <= EXCLUDED."time"`,
+		}},
+		{"custom time column", func(c *config.Config) { c.Timescale.TimeColumn = "ts" }, []string{
+			`WHERE latest."ts" <= EXCLUDED."ts"`,
+		}},
+		{"extra columns", func(c *config.Config) {
+			c.Timescale.TrackIngestTime = true
+			c.Timescale.TagColumns = []string{"model"}
+		}, []string{
+			`"ingest_time" = EXCLUDED."ingest_time", "model" = EXCLUDED."model"`,
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := config.GetDefaultConfig()
+			tt.modify(cfg)
+			db := newTestDB(cfg)
+			sql := db.latestSQL(`"public"."device_latest"`)
+			for _, want := range tt.want {
+				if !strings.Contains(sql, want) {
+					t.Errorf("upsert lacks %s:\n%s", want, sql)
+				}
+			}
+			// The key itself is never updated
+			if strings.Contains(sql, `"device_id" = EXCLUDED`) {
+				t.Errorf("upsert updates device_id:\n%s", sql)
+			}
+		})
+	}
+}
+
+func TestUpdateLatest(t *testing.T) {
+	tests := []struct {
+		name     string
+		maintain bool
+		wantLog  bool
+	}{
+		// Not maintained, the pool is never used
+		{"not maintained", false, false},
+		// The readings are already stored, so a failure is only logged
+		{"failure is logged", true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logs := captureLogs(t, slog.LevelError)
+			cfg := config.GetDefaultConfig()
+			cfg.Timescale.MaintainLatest = tt.maintain
+			db := unreachableDB(t, cfg)
+
+			db.updateLatest(context.Background(), []*models.SensorData{{Device_ID: "d1", Timestamp: time.Now()}})
+			if got := strings.Contains(logs.String(), "Error updating latest table"); got != tt.wantLog {
+				t.Errorf("logged a failure = %v, want %v:\n%s", got, tt.wantLog, logs)
+			}
+		})
+	}
+}
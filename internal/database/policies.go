@@ -0,0 +1,160 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// applyRetentionPolicy replaces any existing retention policy on the table
+// with one dropping chunks older than the configured retention, so changing
+// the setting takes effect on the next start
+func (db *TimescaleDB) applyRetentionPolicy(ctx context.Context, tableName, ident string) error {
+	retention := db.config.Timescale.Retention
+	if retention <= 0 {
+		return nil
+	}
+
+	err := pgx.BeginFunc(ctx, db.pool, func(tx pgx.Tx) error {
+		if _, err := tx.Exec(ctx, `SELECT remove_retention_policy($1::regclass, if_exists => TRUE)`, ident); err != nil {
+			return err
+		}
+		_, err := tx.Exec(ctx, `SELECT add_retention_policy($1::regclass, $2::interval)`, ident, formatInterval(retention))
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to apply retention policy to %s: %w", tableName, err)
+	}
+
+	slog.Info("Applied retention policy", "table", tableName, "retention", retention)
+	return nil
+}
+
+// applyCompressionPolicy enables native compression segmented by device_id
+// and replaces any existing compression policy with one compressing chunks
+// older than the configured age. TimescaleDB builds without compression
+// support are skipped with a warning.
+func (db *TimescaleDB) applyCompressionPolicy(ctx context.Context, tableName, ident string) error {
+	compressAfter := db.config.Timescale.CompressAfter
+	if compressAfter <= 0 {
+		return nil
+	}
+
+	err := pgx.BeginFunc(ctx, db.pool, func(tx pgx.Tx) error {
+		// Compression settings can't be changed once chunks are compressed,
+		// so only enable it when it isn't already
+		var enabled bool
+		err := tx.QueryRow(ctx, `
+			SELECT compression_enabled FROM timescaledb_information.hypertables
+			WHERE hypertable_schema = $1 AND hypertable_name = $2
+		`, db.config.Database.Schema, tableName).Scan(&enabled)
+		if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+			return err
+		}
+
+		if !enabled {
+			_, err = tx.Exec(ctx, fmt.Sprintf(`
+				ALTER TABLE %s SET (timescaledb.compress, timescaledb.compress_segmentby = 'device_id')
+			`, ident))
+			if err != nil {
+				return err
+			}
+		}
+
+		if _, err := tx.Exec(ctx, `SELECT remove_compression_policy($1::regclass, if_exists => TRUE)`, ident); err != nil {
+			return err
+		}
+		_, err = tx.Exec(ctx, `SELECT add_compression_policy($1::regclass, $2::interval)`, ident, formatInterval(compressAfter))
+		return err
+	})
+	if isUnsupported(err) {
+		slog.Warn("TimescaleDB compression is not supported, skipping compression policy", "table", tableName, "error", err)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to apply compression policy to %s: %w", tableName, err)
+	}
+
+	slog.Info("Applied compression policy", "table", tableName, "compress_after", compressAfter)
+	return nil
+}
+
+// applyContinuousAggregate creates the table's continuous aggregate if it
+// doesn't exist and replaces its refresh policy, so changing the schedule
+// takes effect on the next start. Changing the bucket width of an existing
+// view requires dropping it first.
+func (db *TimescaleDB) applyContinuousAggregate(ctx context.Context, tableName, ident string) error {
+	agg := db.config.Timescale.ContinuousAggregate
+	if !agg.Enabled {
+		return nil
+	}
+	viewName := tableName + "_aggregate"
+	view := db.tableIdentifier(viewName).Sanitize()
+
+	// Creating a continuous aggregate can't run inside a transaction
+	_, err := db.pool.Exec(ctx, continuousAggregateSQL(view, ident, db.config.Timescale.TimeColumn, agg.BucketWidth))
+	if err == nil {
+		err = pgx.BeginFunc(ctx, db.pool, func(tx pgx.Tx) error {
+			if _, err := tx.Exec(ctx, `SELECT remove_continuous_aggregate_policy($1::regclass, if_exists => TRUE)`, view); err != nil {
+				return err
+			}
+			_, err := tx.Exec(ctx, `
+				SELECT add_continuous_aggregate_policy($1::regclass,
+					start_offset => $2::interval,
+					end_offset => $3::interval,
+					schedule_interval => $4::interval)
+			`, view, formatInterval(agg.StartOffset), formatInterval(agg.EndOffset), formatInterval(agg.ScheduleInterval))
+			return err
+		})
+	}
+	if isUnsupported(err) {
+		slog.Warn("TimescaleDB continuous aggregates are not supported, skipping", "table", tableName, "error", err)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to apply continuous aggregate to %s: %w", tableName, err)
+	}
+
+	slog.Info("Applied continuous aggregate", "table", tableName, "view", viewName, "bucket_width", agg.BucketWidth)
+	return nil
+}
+
+// continuousAggregateSQL returns the statement creating a continuous aggregate
+// of per-device averages over buckets of the given width of timeColumn. The
+// view starts empty and is filled by its refresh policy.
+func continuousAggregateSQL(view, ident, timeColumn string, bucketWidth time.Duration) string {
+	return fmt.Sprintf(`
+		CREATE MATERIALIZED VIEW IF NOT EXISTS %s
+		WITH (timescaledb.continuous) AS
+		SELECT time_bucket('%s'::interval, %s) AS bucket,
+			device_id,
+			avg(temperature) AS avg_temperature,
+			avg(humidity) AS avg_humidity,
+			avg(light) AS avg_light,
+			count(*) AS readings
+		FROM %s
+		GROUP BY bucket, device_id
+		WITH NO DATA
+	`, view, formatInterval(bucketWidth), pgx.Identifier{timeColumn}.Sanitize(), ident)
+}
+
+// isUnsupported reports whether err means the installed TimescaleDB lacks a
+// feature, e.g. an older version or the Apache-licensed build. A missing
+// table or column is a real error rather than a missing feature.
+func isUnsupported(err error) bool {
+	var pgErr *pgconn.PgError
+	if !errors.As(err, &pgErr) {
+		return false
+	}
+	switch pgErr.Code {
+	case "0A000", // feature_not_supported
+		"42883": // undefined_function
+		return true
+	}
+	return false
+}
@@ -0,0 +1,56 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+
+	"github.com/ponytojas/go-mqtt-timescale/internal/models"
+)
+
+// GetRecentReadings returns up to limit readings of a device from the default
+// table taken at or after since, newest first. It returns an empty slice when
+// there are none.
+func (db *TimescaleDB) GetRecentReadings(ctx context.Context, deviceID string, since time.Time, limit int) ([]*models.SensorData, error) {
+	if limit <= 0 {
+		return nil, fmt.Errorf("limit %d must be positive", limit)
+	}
+
+	tableName := db.config.Timescale.TableName
+	ident, err := db.quoteTable(tableName)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+
+	timeColumn := pgx.Identifier{db.config.Timescale.TimeColumn}.Sanitize()
+	rows, err := db.pool.Query(ctx, fmt.Sprintf(`
+		SELECT %[2]s, temperature, humidity, light, device_id, metrics
+		FROM %[1]s
+		WHERE device_id = $1 AND %[2]s >= $2
+		ORDER BY %[2]s DESC
+		LIMIT $3
+	`, ident, timeColumn), deviceID, since, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query readings from %s: %w", tableName, err)
+	}
+	defer rows.Close()
+
+	readings := make([]*models.SensorData, 0)
+	for rows.Next() {
+		var data models.SensorData
+		if err := rows.Scan(&data.Timestamp, &data.Temperature, &data.Humidity, &data.Light, &data.Device_ID, &data.Fields); err != nil {
+			return nil, fmt.Errorf("failed to scan reading: %w", err)
+		}
+		readings = append(readings, &data)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to query readings from %s: %w", tableName, err)
+	}
+
+	return readings, nil
+}
@@ -0,0 +1,130 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"syscall"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+
+	"github.com/ponytojas/go-mqtt-timescale/config"
+	"github.com/ponytojas/go-mqtt-timescale/internal/metrics"
+)
+
+// withRetry runs fn until it succeeds, fails with a non-retryable error, or
+// the configured number of retries is exhausted. The wait between attempts
+// doubles from the initial interval up to the maximum interval, and is cut
+// short if ctx is cancelled.
+func (db *TimescaleDB) withRetry(ctx context.Context, fn func(ctx context.Context) error) error {
+	cfg := db.config.Database
+	delay := cfg.RetryInitialInterval
+
+	for attempt := 0; ; attempt++ {
+		err := fn(ctx)
+		if err == nil || attempt >= cfg.MaxRetries || !isRetryable(err) {
+			return err
+		}
+
+		metrics.DBInsertRetries.Inc()
+		slog.Warn("Retrying database operation",
+			"attempt", attempt+1,
+			"max_retries", cfg.MaxRetries,
+			"delay", delay,
+			"error", err,
+		)
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return errors.Join(err, ctx.Err())
+		case <-timer.C:
+		}
+
+		delay *= 2
+		if delay > cfg.RetryMaxInterval {
+			delay = cfg.RetryMaxInterval
+		}
+	}
+}
+
+// maxConnectRetryInterval caps the wait between initial connection attempts
+const maxConnectRetryInterval = 30 * time.Second
+
+// connectWithRetry calls ping until the database answers, retrying transient
+// failures such as a refused connection or a server still starting up. The
+// wait between attempts doubles from the connect retry interval. It gives
+// up after the configured number of retries, on a non-retryable error such
+// as bad credentials, or when ctx is cancelled.
+func connectWithRetry(ctx context.Context, cfg config.DatabaseConfig, ping func(ctx context.Context) error) error {
+	delay := cfg.ConnectRetryInterval
+
+	for attempt := 0; ; attempt++ {
+		attemptCtx, cancel := context.WithTimeout(ctx, cfg.OperationTimeout)
+		err := ping(attemptCtx)
+		cancel()
+		if err == nil || attempt >= cfg.ConnectRetries || !isRetryable(err) || ctx.Err() != nil {
+			return err
+		}
+
+		slog.Warn("Database not reachable yet, retrying",
+			"attempt", attempt+1,
+			"connect_retries", cfg.ConnectRetries,
+			"delay", delay,
+			"error", err,
+		)
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return errors.Join(err, ctx.Err())
+		case <-timer.C:
+		}
+
+		delay *= 2
+		if delay > maxConnectRetryInterval {
+			delay = maxConnectRetryInterval
+		}
+	}
+}
+
+// isRetryable reports whether err is a transient failure, such as a lost
+// connection or a server restart, that may succeed if tried again. Errors
+// caused by the data itself, like constraint violations, are not retryable.
+func isRetryable(err error) bool {
+	if errors.Is(err, context.Canceled) {
+		return false
+	}
+
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		switch pgErr.Code {
+		case "57P01", // admin_shutdown
+			"57P02", // crash_shutdown
+			"57P03", // cannot_connect_now
+			"53300", // too_many_connections
+			"40001", // serialization_failure
+			"40P01": // deadlock_detected
+			return true
+		}
+		// Class 08 covers connection exceptions
+		return len(pgErr.Code) == 5 && pgErr.Code[:2] == "08"
+	}
+
+	// The per-attempt deadline elapsing usually means the server is stalled
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+
+	var netErr net.Error
+	return pgconn.SafeToRetry(err) ||
+		errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.As(err, &netErr)
+}
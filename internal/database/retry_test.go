@@ -0,0 +1,164 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+
+	"github.com/ponytojas/go-mqtt-timescale/config"
+)
+
+// flaky returns an operation failing with err on its first failures
+// attempts, and counting every attempt in attempts
+func flaky(failures int, err error, attempts *int) func(context.Context) error {
+	return func(context.Context) error {
+		*attempts++
+		if *attempts <= failures {
+			return err
+		}
+		return nil
+	}
+}
+
+func TestWithRetry(t *testing.T) {
+	refused := fmt.Errorf("dial: %w", syscall.ECONNREFUSED)
+	tests := []struct {
+		name         string
+		failures     int
+		err          error
+		wantErr      bool
+		wantAttempts int
+	}{
+		{"succeeds at once", 0, nil, false, 1},
+		{"succeeds after transient failures", 3, refused, false, 4},
+		{"admin shutdown is retried", 1, &pgconn.PgError{Code: "57P01"}, false, 2},
+		{"retries exhausted", 10, refused, true, 6},
+		{"constraint violation is not retried", 10, &pgconn.PgError{Code: "23505"}, true, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := config.GetDefaultConfig()
+			cfg.Database.MaxRetries = 5
+			cfg.Database.RetryInitialInterval = time.Millisecond
+			cfg.Database.RetryMaxInterval = 4 * time.Millisecond
+			db := newTestDB(cfg)
+
+			attempts := 0
+			start := time.Now()
+			err := db.withRetry(context.Background(), flaky(tt.failures, tt.err, &attempts))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if attempts != tt.wantAttempts {
+				t.Errorf("made %d attempts, want %d", attempts, tt.wantAttempts)
+			}
+			// 1, 2, 4, 4 and 4ms between at most six attempts
+			if elapsed := time.Since(start); elapsed > time.Second {
+				t.Errorf("retrying took %s, want the backoff capped", elapsed)
+			}
+		})
+	}
+}
+
+func TestWithRetryStopsWhenCancelledDuringBackoff(t *testing.T) {
+	cfg := config.GetDefaultConfig()
+	cfg.Database.RetryInitialInterval = time.Hour
+	db := newTestDB(cfg)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	attempts := 0
+	err := db.withRetry(ctx, flaky(10, io.ErrUnexpectedEOF, &attempts))
+	if !errors.Is(err, context.DeadlineExceeded) || !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("error = %v, want the last failure and the deadline", err)
+	}
+	if attempts != 1 {
+		t.Errorf("made %d attempts, want 1", attempts)
+	}
+}
+
+func TestConnectWithRetry(t *testing.T) {
+	refused := fmt.Errorf("dial: %w", syscall.ECONNREFUSED)
+	tests := []struct {
+		name         string
+		failures     int
+		err          error
+		wantErr      bool
+		wantAttempts int
+	}{
+		{"database up", 0, nil, false, 1},
+		{"refused until the database is up", 3, refused, false, 4},
+		{"still starting up", 2, &pgconn.PgError{Code: "57P03"}, false, 3},
+		{"retries exhausted", 10, refused, true, 5},
+		{"bad password is not retried", 10, &pgconn.PgError{Code: "28P01"}, true, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := config.GetDefaultConfig().Database
+			cfg.ConnectRetries = 4
+			cfg.ConnectRetryInterval = time.Millisecond
+
+			attempts := 0
+			err := connectWithRetry(context.Background(), cfg, flaky(tt.failures, tt.err, &attempts))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if tt.wantErr && !errors.Is(err, tt.err) {
+				t.Errorf("error = %v, want the last attempt's %v", err, tt.err)
+			}
+			if attempts != tt.wantAttempts {
+				t.Errorf("made %d attempts, want %d", attempts, tt.wantAttempts)
+			}
+		})
+	}
+}
+
+func TestConnectAttemptsHaveTheOperationTimeout(t *testing.T) {
+	cfg := config.GetDefaultConfig().Database
+	cfg.OperationTimeout = 3 * time.Second
+	err := connectWithRetry(context.Background(), cfg, func(ctx context.Context) error {
+		deadline, ok := ctx.Deadline()
+		if !ok {
+			return errors.New("no deadline")
+		}
+		if left := time.Until(deadline); left > cfg.OperationTimeout || left < cfg.OperationTimeout-time.Second {
+			return fmt.Errorf("deadline in %s", left)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Errorf("attempt: %v, want a deadline of %s", err, cfg.OperationTimeout)
+	}
+}
+
+func TestIsRetryable(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"connection refused", fmt.Errorf("dial: %w", syscall.ECONNREFUSED), true},
+		{"connection reset", syscall.ECONNRESET, true},
+		{"unexpected EOF", io.ErrUnexpectedEOF, true},
+		{"attempt deadline", context.DeadlineExceeded, true},
+		{"admin shutdown", &pgconn.PgError{Code: "57P01"}, true},
+		{"cannot connect now", &pgconn.PgError{Code: "57P03"}, true},
+		{"connection exception", &pgconn.PgError{Code: "08006"}, true},
+		{"deadlock", &pgconn.PgError{Code: "40P01"}, true},
+		{"unique violation", &pgconn.PgError{Code: "23505"}, false},
+		{"undefined column", &pgconn.PgError{Code: "42703"}, false},
+		{"cancelled", context.Canceled, false},
+		{"other", errors.New("boom"), false},
+	}
+	for _, tt := range tests {
+		if got := isRetryable(tt.err); got != tt.want {
+			t.Errorf("%s: isRetryable = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package database
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ponytojas/go-mqtt-timescale/config"
+)
+
+// writeSelfSigned writes a self-signed certificate and its key to dir as
+// name.crt and name.key, returning their paths
+func writeSelfSigned(t *testing.T, dir, name string) (certFile, keyFile string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile = filepath.Join(dir, name+".crt")
+	keyFile = filepath.Join(dir, name+".key")
+	for path, block := range map[string]*pem.Block{
+		certFile: {Type: "CERTIFICATE", Bytes: der},
+		keyFile:  {Type: "EC PRIVATE KEY", Bytes: keyDER},
+	} {
+		if err := os.WriteFile(path, pem.EncodeToMemory(block), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return certFile, keyFile
+}
+
+func TestPoolConfigTLS(t *testing.T) {
+	// A directory with a space, since the paths are quoted in the
+	// connection string
+	dir := filepath.Join(t.TempDir(), "db certs")
+	if err := os.Mkdir(dir, 0o700); err != nil {
+		t.Fatal(err)
+	}
+	caFile, _ := writeSelfSigned(t, dir, "ca")
+	certFile, keyFile := writeSelfSigned(t, dir, "client")
+
+	tests := []struct {
+		name             string
+		modify           func(*config.DatabaseConfig)
+		wantTLS          bool
+		wantVerified     bool // against the CA bundle
+		wantCertificates int
+	}{
+		{"disabled", func(*config.DatabaseConfig) {}, false, false, 0},
+		{"CA bundle", func(c *config.DatabaseConfig) {
+			c.SSLMode = "verify-full"
+			c.SSLRootCert = caFile
+		}, true, true, 0},
+		{"client certificate", func(c *config.DatabaseConfig) {
+			c.SSLMode = "verify-full"
+			c.SSLRootCert = caFile
+			c.SSLCert = certFile
+			c.SSLKey = keyFile
+		}, true, true, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := config.GetDefaultConfig()
+			cfg.Database.Host = "db.example.com"
+			tt.modify(&cfg.Database)
+
+			poolConfig, err := newPoolConfig(cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			tlsConfig := poolConfig.ConnConfig.TLSConfig
+			if (tlsConfig != nil) != tt.wantTLS {
+				t.Fatalf("TLS config = %v, want TLS %v", tlsConfig, tt.wantTLS)
+			}
+			if !tt.wantTLS {
+				return
+			}
+			if (tlsConfig.RootCAs != nil) != tt.wantVerified {
+				t.Errorf("root CAs set = %v, want %v", tlsConfig.RootCAs != nil, tt.wantVerified)
+			}
+			if tlsConfig.ServerName != "db.example.com" {
+				t.Errorf("server name = %q, want the host verified", tlsConfig.ServerName)
+			}
+			if len(tlsConfig.Certificates) != tt.wantCertificates {
+				t.Errorf("client certificates = %d, want %d", len(tlsConfig.Certificates), tt.wantCertificates)
+			}
+		})
+	}
+}
+
+func TestPoolConfigFailsOnUnreadableCA(t *testing.T) {
+	cfg := config.GetDefaultConfig()
+	cfg.Database.SSLMode = "verify-full"
+	cfg.Database.SSLRootCert = filepath.Join(t.TempDir(), "missing.pem")
+	if _, err := newPoolConfig(cfg); err == nil {
+		t.Error("newPoolConfig with a missing CA bundle succeeded")
+	}
+}
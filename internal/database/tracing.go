@@ -0,0 +1,49 @@
+package database
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracer creates the spans of database writes. It is a no-op until a tracer
+// provider is installed.
+var tracer = otel.Tracer("github.com/ponytojas/go-mqtt-timescale/internal/database")
+
+// linksKey is the context key carrying links to the traces of the messages
+// a batch was built from
+type linksKey struct{}
+
+// withLinks returns a context whose insert span links to the given traces
+func withLinks(ctx context.Context, links []trace.Link) context.Context {
+	if len(links) == 0 {
+		return ctx
+	}
+	return context.WithValue(ctx, linksKey{}, links)
+}
+
+// startInsertSpan starts the span of an insert into tableName. A batch
+// written by the writer goroutine doesn't belong to a single message, so its
+// span links to the message traces carried by ctx instead.
+func startInsertSpan(ctx context.Context, tableName, statement string, rows int) (context.Context, trace.Span) {
+	links, _ := ctx.Value(linksKey{}).([]trace.Link)
+	return tracer.Start(ctx, "db.insert",
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithLinks(links...),
+		trace.WithAttributes(
+			attribute.String("db.system", "postgresql"),
+			attribute.String("db.sql.table", tableName),
+			attribute.String("db.statement", statement),
+			attribute.Int("db.rows", rows),
+		),
+	)
+}
+
+// spanError marks span as failed with err
+func spanError(span trace.Span, err error) {
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+}
@@ -0,0 +1,69 @@
+package database
+
+import (
+	"context"
+	"testing"
+
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestInsertSpan(t *testing.T) {
+	rec := tracetest.NewSpanRecorder()
+	previous := tracer
+	tracer = sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(rec)).Tracer("test")
+	t.Cleanup(func() { tracer = previous })
+
+	msgCtx, msg := tracer.Start(context.Background(), "mqtt.message")
+	msg.End()
+	tests := []struct {
+		name       string
+		ctx        context.Context
+		wantParent trace.SpanID // invalid for a root span
+		wantLinks  int
+	}{
+		// A single insert runs within the message's span
+		{"child of the message", msgCtx, msg.SpanContext().SpanID(), 0},
+		// A batch is written by the writer goroutine on behalf of many
+		{"batch linked to its messages", withLinks(context.Background(), []trace.Link{{SpanContext: msg.SpanContext()}, {SpanContext: msg.SpanContext()}}), trace.SpanID{}, 2},
+		{"batch without traced messages", withLinks(context.Background(), nil), trace.SpanID{}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, span := startInsertSpan(tt.ctx, "readings", `INSERT INTO "readings"`, 3)
+			span.End()
+			ended := rec.Ended()
+			got := ended[len(ended)-1]
+
+			if got.Name() != "db.insert" || got.SpanKind() != trace.SpanKindClient {
+				t.Errorf("span = %s of kind %s, want a db.insert client span", got.Name(), got.SpanKind())
+			}
+			if got.Parent().SpanID() != tt.wantParent {
+				t.Errorf("parent = %s, want %s", got.Parent().SpanID(), tt.wantParent)
+			}
+			if len(got.Links()) != tt.wantLinks {
+				t.Errorf("span has %d links, want %d", len(got.Links()), tt.wantLinks)
+			}
+			for _, link := range got.Links() {
+				if !link.SpanContext.Equal(msg.SpanContext()) {
+					t.Errorf("link to %s, want the message span", link.SpanContext.SpanID())
+				}
+			}
+			attrs := attribute.NewSet(got.Attributes()...)
+			for key, want := range map[attribute.Key]string{
+				"db.system":    "postgresql",
+				"db.sql.table": "readings",
+				"db.statement": `INSERT INTO "readings"`,
+			} {
+				if v, _ := attrs.Value(key); v.AsString() != want {
+					t.Errorf("%s = %q, want %q", key, v.AsString(), want)
+				}
+			}
+			if rows, _ := attrs.Value("db.rows"); rows.AsInt64() != 3 {
+				t.Errorf("db.rows = %d, want 3", rows.AsInt64())
+			}
+		})
+	}
+}
@@ -0,0 +1,165 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+
+	"github.com/ponytojas/go-mqtt-timescale/config"
+)
+
+// columns are the columns written after the time column for every reading,
+// in insert order
+var columns = []string{"temperature", "humidity", "light", "device_id", "metrics", "location", "type"}
+
+// insertColumns returns the columns written for every reading, starting
+// with the time column and including ingest_time and retained when they are
+// tracked and the text columns
+func insertColumns(cfg *config.Config) []string {
+	cols := append([]string{cfg.Timescale.TimeColumn}, columns...)
+	if cfg.Timescale.TrackIngestTime {
+		cols = append(cols, "ingest_time")
+	}
+	if cfg.Timescale.TrackRetained {
+		cols = append(cols, "retained")
+	}
+	return append(cols, textColumns(cfg)...)
+}
+
+// textColumns returns the TEXT columns holding a reading's tags: the topic
+// columns followed by the tag columns
+func textColumns(cfg *config.Config) []string {
+	return append(append([]string(nil), cfg.MQTT.TopicColumns...), cfg.Timescale.TagColumns...)
+}
+
+// conflictClause returns the ON CONFLICT clause that turns an insert into an
+// upsert on the configured conflict columns, or "" when upserts are disabled
+func (db *TimescaleDB) conflictClause() string {
+	if !db.config.Timescale.Upsert {
+		return ""
+	}
+
+	conflict := db.conflictColumns()
+	isConflict := make(map[string]bool, len(conflict))
+	quoted := make([]string, len(conflict))
+	for i, column := range conflict {
+		isConflict[column] = true
+		quoted[i] = pgx.Identifier{column}.Sanitize()
+	}
+
+	var updates []string
+	for _, column := range db.columns {
+		if !isConflict[column] {
+			ident := pgx.Identifier{column}.Sanitize()
+			updates = append(updates, fmt.Sprintf("%s = EXCLUDED.%s", ident, ident))
+		}
+	}
+	if len(updates) == 0 {
+		return fmt.Sprintf(" ON CONFLICT (%s) DO NOTHING", strings.Join(quoted, ", "))
+	}
+	return fmt.Sprintf(" ON CONFLICT (%s) DO UPDATE SET %s", strings.Join(quoted, ", "), strings.Join(updates, ", "))
+}
+
+// conflictColumns returns the configured conflict columns, with time
+// standing for the configured time column
+func (db *TimescaleDB) conflictColumns() []string {
+	conflict := make([]string, len(db.config.Timescale.ConflictColumns))
+	for i, column := range db.config.Timescale.ConflictColumns {
+		if column == "time" {
+			column = db.config.Timescale.TimeColumn
+		}
+		conflict[i] = column
+	}
+	return conflict
+}
+
+// createUniqueIndex creates the unique index on the conflict columns that
+// ON CONFLICT requires
+func (db *TimescaleDB) createUniqueIndex(ctx context.Context, tableName, ident string) error {
+	conflict := db.conflictColumns()
+	quoted := make([]string, len(conflict))
+	for i, column := range conflict {
+		quoted[i] = pgx.Identifier{column}.Sanitize()
+	}
+	index := pgx.Identifier{tableName + "_" + strings.Join(conflict, "_") + "_key"}.Sanitize()
+
+	_, err := db.pool.Exec(ctx, fmt.Sprintf(`CREATE UNIQUE INDEX IF NOT EXISTS %s ON %s (%s)`,
+		index, ident, strings.Join(quoted, ", ")))
+	if err != nil {
+		return fmt.Errorf("failed to create unique index on %s: %w", tableName, err)
+	}
+
+	slog.Info("Unique index ensured", "table", tableName, "columns", conflict)
+	return nil
+}
+
+// insertSQL returns the statement inserting a single reading into ident
+func (db *TimescaleDB) insertSQL(ident string) string {
+	quoted := make([]string, len(db.columns))
+	params := make([]string, len(db.columns))
+	for i, column := range db.columns {
+		quoted[i] = pgx.Identifier{column}.Sanitize()
+		params[i] = fmt.Sprintf("$%d", i+1)
+	}
+	return fmt.Sprintf(`
+		INSERT INTO %s (%s)
+		VALUES (%s)%s
+	`, ident, strings.Join(quoted, ", "), strings.Join(params, ", "), db.conflictClause())
+}
+
+// insertStatementName returns the name the insert statement for tableName is
+// prepared under. Statements are keyed by table, so a reading routed to a
+// different table, such as one a reload subscribed, never reuses another
+// table's statement.
+func insertStatementName(tableName string) string {
+	return "insert_sensor_data_" + tableName
+}
+
+// execInsert runs the prepared insert statement for a table. The statement
+// is prepared the first time each pooled connection uses it, including
+// connections opened to replace one that was reset; later calls on the same
+// connection find it prepared and execute it by name without the server
+// parsing the SQL again.
+func (db *TimescaleDB) execInsert(ctx context.Context, tableName, query string, args []interface{}) (pgconn.CommandTag, error) {
+	conn, err := db.pool.Acquire(ctx)
+	if err != nil {
+		return pgconn.CommandTag{}, err
+	}
+	defer conn.Release()
+
+	name := insertStatementName(tableName)
+	if _, err := conn.Conn().Prepare(ctx, name, query); err != nil {
+		return pgconn.CommandTag{}, err
+	}
+	return conn.Exec(ctx, name, args...)
+}
+
+// upsertBatch writes rows with one upserting INSERT each, sent as a single
+// batch in a transaction since COPY can't resolve conflicts
+func (db *TimescaleDB) upsertBatch(ctx context.Context, ident string, rows [][]interface{}) (int64, error) {
+	query := db.insertSQL(ident)
+
+	batch := &pgx.Batch{}
+	for _, row := range rows {
+		batch.Queue(query, row...)
+	}
+
+	var count int64
+	err := pgx.BeginFunc(ctx, db.pool, func(tx pgx.Tx) error {
+		results := tx.SendBatch(ctx, batch)
+		for range rows {
+			tag, err := results.Exec()
+			if err != nil {
+				results.Close()
+				return err
+			}
+			count += tag.RowsAffected()
+		}
+		return results.Close()
+	})
+	return count, err
+}
@@ -0,0 +1,132 @@
+package deadletter
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// Message is a rejected MQTT message along with the reason it was rejected
+type Message struct {
+	Time    time.Time `json:"time"`
+	Topic   string    `json:"topic"`
+	Payload string    `json:"payload"`
+	Error   string    `json:"error"`
+}
+
+// NewMessage creates a dead-letter message for a payload rejected with reason
+func NewMessage(topic string, payload []byte, reason error) Message {
+	return Message{
+		Time:    time.Now().UTC(),
+		Topic:   topic,
+		Payload: string(payload),
+		Error:   reason.Error(),
+	}
+}
+
+// DeadLetter receives messages that could not be processed
+type DeadLetter interface {
+	Send(msg Message) error
+	Close() error
+}
+
+// Discard is a DeadLetter that drops every message
+type Discard struct{}
+
+// Send drops the message
+func (Discard) Send(Message) error { return nil }
+
+// Close does nothing
+func (Discard) Close() error { return nil }
+
+// FileDeadLetter appends messages to a file as JSON lines
+type FileDeadLetter struct {
+	mu   sync.Mutex
+	file *os.File
+	enc  *json.Encoder
+}
+
+// NewFileDeadLetter opens path for appending, creating it if needed
+func NewFileDeadLetter(path string) (*FileDeadLetter, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open dead-letter file %s: %w", path, err)
+	}
+	return &FileDeadLetter{file: file, enc: json.NewEncoder(file)}, nil
+}
+
+// Send writes the message as a single JSON line
+func (d *FileDeadLetter) Send(msg Message) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if err := d.enc.Encode(msg); err != nil {
+		return fmt.Errorf("failed to write dead-letter message: %w", err)
+	}
+	return nil
+}
+
+// Close closes the underlying file
+func (d *FileDeadLetter) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.file.Close()
+}
+
+// Publisher publishes MQTT messages. Publish must not block; the result is
+// delivered on the returned channel once the publish completes.
+type Publisher interface {
+	Publish(topic string, qos byte, retained bool, payload []byte) <-chan error
+}
+
+// MQTTDeadLetter re-publishes messages as JSON to a dead-letter topic
+type MQTTDeadLetter struct {
+	publisher Publisher
+	topic     string
+}
+
+// NewMQTTDeadLetter creates a DeadLetter publishing to topic
+func NewMQTTDeadLetter(publisher Publisher, topic string) *MQTTDeadLetter {
+	return &MQTTDeadLetter{publisher: publisher, topic: topic}
+}
+
+// Send publishes the message without waiting for the broker to acknowledge,
+// so a slow broker doesn't stall message processing
+func (d *MQTTDeadLetter) Send(msg Message) error {
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return fmt.Errorf("failed to encode dead-letter message: %w", err)
+	}
+	select {
+	case err := <-d.publisher.Publish(d.topic, 1, false, body):
+		return err
+	default:
+		return nil
+	}
+}
+
+// Close does nothing; the MQTT client is owned by the caller
+func (d *MQTTDeadLetter) Close() error { return nil }
+
+// Multi sends every message to all of its sinks
+type Multi []DeadLetter
+
+// Send sends the message to every sink, returning any errors combined
+func (m Multi) Send(msg Message) error {
+	var errs []error
+	for _, d := range m {
+		errs = append(errs, d.Send(msg))
+	}
+	return errors.Join(errs...)
+}
+
+// Close closes every sink
+func (m Multi) Close() error {
+	var errs []error
+	for _, d := range m {
+		errs = append(errs, d.Close())
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,111 @@
+package deadletter
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// recorder is a Publisher recording what it publishes
+type recorder struct {
+	topic   string
+	qos     byte
+	payload []byte
+}
+
+func (r *recorder) Publish(topic string, qos byte, retained bool, payload []byte) <-chan error {
+	r.topic, r.qos, r.payload = topic, qos, payload
+	done := make(chan error, 1)
+	done <- nil
+	return done
+}
+
+// failing is a DeadLetter whose sends fail
+type failing struct{ closed bool }
+
+func (f *failing) Send(Message) error {
+	return errors.New("sink down")
+}
+
+func (f *failing) Close() error {
+	f.closed = true
+	return nil
+}
+
+func TestFileDeadLetterWritesJSONLines(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dead.jsonl")
+	d, err := NewFileDeadLetter(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sent := []Message{
+		NewMessage("sensor/a", []byte(`{"device_id":`), errors.New("invalid JSON")),
+		NewMessage("sensor/b", []byte(`{"temperature":1}`), errors.New("device_id is missing")),
+	}
+	for _, msg := range sent {
+		if err := d.Send(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	var got []Message
+	for scanner.Scan() {
+		var msg Message
+		if err := json.Unmarshal(scanner.Bytes(), &msg); err != nil {
+			t.Fatalf("line %q is not JSON: %v", scanner.Text(), err)
+		}
+		got = append(got, msg)
+	}
+	if len(got) != len(sent) {
+		t.Fatalf("read %d lines, want %d", len(got), len(sent))
+	}
+	for i := range sent {
+		if got[i].Topic != sent[i].Topic || got[i].Payload != sent[i].Payload || got[i].Error != sent[i].Error || !got[i].Time.Equal(sent[i].Time) {
+			t.Errorf("line %d = %+v, want %+v", i, got[i], sent[i])
+		}
+	}
+}
+
+func TestMQTTDeadLetterPublishesJSON(t *testing.T) {
+	publisher := &recorder{}
+	msg := NewMessage("sensor/a", []byte("garbage"), errors.New("invalid JSON"))
+	if err := NewMQTTDeadLetter(publisher, "dead").Send(msg); err != nil {
+		t.Fatal(err)
+	}
+
+	var got Message
+	if err := json.Unmarshal(publisher.payload, &got); err != nil {
+		t.Fatal(err)
+	}
+	if publisher.topic != "dead" || publisher.qos != 1 || got.Payload != "garbage" || got.Error != "invalid JSON" {
+		t.Errorf("published %+v to %s with QoS %d", got, publisher.topic, publisher.qos)
+	}
+}
+
+func TestMultiSendsToEverySink(t *testing.T) {
+	publisher := &recorder{}
+	bad := &failing{}
+	m := Multi{bad, NewMQTTDeadLetter(publisher, "dead")}
+
+	if err := m.Send(NewMessage("sensor/a", nil, errors.New("bad"))); err == nil {
+		t.Error("expected the failing sink's error")
+	}
+	if publisher.topic != "dead" {
+		t.Error("message not sent to the sink after the failing one")
+	}
+	if err := m.Close(); err != nil || !bad.closed {
+		t.Errorf("Close = %v, closed = %v", err, bad.closed)
+	}
+}
@@ -0,0 +1,40 @@
+package dedup
+
+import (
+	"time"
+
+	"github.com/ponytojas/go-mqtt-timescale/internal/ttlmap"
+)
+
+// Cache remembers keys for a time window to detect duplicates. It holds at
+// most maxEntries keys, forgetting the least recently seen first once full.
+type Cache struct {
+	keys *ttlmap.Map[string, struct{}]
+}
+
+// New creates a Cache remembering keys for window. Close stops evicting
+// expired keys.
+func New(window time.Duration, maxEntries int) *Cache {
+	return &Cache{keys: ttlmap.New[string, struct{}](window, maxEntries)}
+}
+
+// Seen reports whether key was already seen within the window, and
+// remembers it for another window from now
+func (c *Cache) Seen(key string) bool {
+	var seen bool
+	c.keys.Update(key, func(_ struct{}, found bool) struct{} {
+		seen = found
+		return struct{}{}
+	})
+	return seen
+}
+
+// Len returns the number of keys remembered
+func (c *Cache) Len() int {
+	return c.keys.Len()
+}
+
+// Close stops evicting expired keys
+func (c *Cache) Close() {
+	c.keys.Close()
+}
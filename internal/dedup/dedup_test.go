@@ -0,0 +1,69 @@
+package dedup
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestSeen(t *testing.T) {
+	c := New(time.Minute, 0)
+	defer c.Close()
+
+	if c.Seen("d1@12:00") {
+		t.Error("first sighting reported as a duplicate")
+	}
+	if !c.Seen("d1@12:00") {
+		t.Error("duplicate inside the window not reported")
+	}
+	if c.Seen("d1@12:01") || c.Seen("d2@12:00") {
+		t.Error("different key reported as a duplicate")
+	}
+}
+
+func TestDuplicateOutsideTheWindowIsNew(t *testing.T) {
+	c := New(20*time.Millisecond, 0)
+	defer c.Close()
+
+	c.Seen("d1@12:00")
+	time.Sleep(40 * time.Millisecond)
+	if c.Seen("d1@12:00") {
+		t.Error("key seen before the window reported as a duplicate")
+	}
+}
+
+func TestCacheIsBoundedUnderLoad(t *testing.T) {
+	const maxEntries = 100
+	c := New(time.Hour, maxEntries)
+	defer c.Close()
+
+	for i := 0; i < 10*maxEntries; i++ {
+		c.Seen(fmt.Sprintf("d%d", i))
+	}
+	if c.Len() != maxEntries {
+		t.Errorf("remembering %d keys, want %d", c.Len(), maxEntries)
+	}
+	// The least recently seen keys made room for the newest
+	if c.Seen("d0") {
+		t.Error("oldest key still remembered")
+	}
+	if !c.Seen(fmt.Sprintf("d%d", 10*maxEntries-1)) {
+		t.Error("newest key forgotten")
+	}
+}
+
+func TestExpiredKeysAreEvictedInTheBackground(t *testing.T) {
+	c := New(20*time.Millisecond, 0)
+	defer c.Close()
+
+	for i := 0; i < 10; i++ {
+		c.Seen(fmt.Sprintf("ephemeral-%d", i))
+	}
+	deadline := time.Now().Add(time.Second)
+	for c.Len() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("still remembering %d expired keys", c.Len())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,84 @@
+package httpserver
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/ponytojas/go-mqtt-timescale/internal/models"
+)
+
+const (
+	// defaultReadingsLimit is used when a readings request has no limit
+	defaultReadingsLimit = 100
+	// maxReadingsLimit is the largest limit a readings request may ask for
+	maxReadingsLimit = 1000
+	// defaultReadingsWindow is how far back readings go when since is omitted
+	defaultReadingsWindow = 24 * time.Hour
+)
+
+// ReadingsReader fetches recent readings of a device
+type ReadingsReader interface {
+	GetRecentReadings(ctx context.Context, deviceID string, since time.Time, limit int) ([]*models.SensorData, error)
+}
+
+// HandleReadings registers the /readings API
+func (s *Server) HandleReadings(db ReadingsReader) {
+	s.mux.Handle("/readings", ReadingsHandler(db))
+}
+
+// ReadingsHandler returns a handler serving
+// GET /readings?device_id=X&since=RFC3339&limit=N as a JSON array of
+// readings, newest first
+func ReadingsHandler(db ReadingsReader) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		query := r.URL.Query()
+		deviceID := query.Get("device_id")
+		if deviceID == "" {
+			http.Error(w, "device_id is required", http.StatusBadRequest)
+			return
+		}
+
+		since := time.Now().Add(-defaultReadingsWindow)
+		if raw := query.Get("since"); raw != "" {
+			var err error
+			since, err = time.Parse(time.RFC3339, raw)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("since %q must be an RFC3339 timestamp", raw), http.StatusBadRequest)
+				return
+			}
+		}
+
+		limit := defaultReadingsLimit
+		if raw := query.Get("limit"); raw != "" {
+			var err error
+			limit, err = strconv.Atoi(raw)
+			if err != nil || limit < 1 || limit > maxReadingsLimit {
+				http.Error(w, fmt.Sprintf("limit %q must be between 1 and %d", raw, maxReadingsLimit), http.StatusBadRequest)
+				return
+			}
+		}
+
+		readings, err := db.GetRecentReadings(r.Context(), deviceID, since, limit)
+		if err != nil {
+			slog.Error("Error querying readings", "device_id", deviceID, "error", err)
+			http.Error(w, "failed to query readings", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(readings); err != nil {
+			slog.Error("Error writing readings response", "error", err)
+		}
+	})
+}
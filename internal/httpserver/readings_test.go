@@ -0,0 +1,119 @@
+package httpserver
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/ponytojas/go-mqtt-timescale/internal/models"
+)
+
+// fakeReader is a ReadingsReader recording its last query and answering
+// with readings, or err when set
+type fakeReader struct {
+	err      error
+	readings []*models.SensorData
+
+	called   bool
+	deviceID string
+	since    time.Time
+	limit    int
+}
+
+func (r *fakeReader) GetRecentReadings(ctx context.Context, deviceID string, since time.Time, limit int) ([]*models.SensorData, error) {
+	r.called = true
+	r.deviceID, r.since, r.limit = deviceID, since, limit
+	return r.readings, r.err
+}
+
+func TestReadingsHandler(t *testing.T) {
+	since := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name      string
+		method    string
+		query     string
+		err       error
+		want      int
+		wantLimit int // the limit queried, 0 when the reader isn't called
+	}{
+		{"valid query", http.MethodGet, "?device_id=d1&since=2024-05-01T12:00:00Z&limit=10", nil, http.StatusOK, 10},
+		{"default limit", http.MethodGet, "?device_id=d1", nil, http.StatusOK, defaultReadingsLimit},
+		{"limit at the cap", http.MethodGet, "?device_id=d1&limit=1000", nil, http.StatusOK, maxReadingsLimit},
+		{"missing device id", http.MethodGet, "?limit=10", nil, http.StatusBadRequest, 0},
+		{"limit over the cap", http.MethodGet, "?device_id=d1&limit=1001", nil, http.StatusBadRequest, 0},
+		{"zero limit", http.MethodGet, "?device_id=d1&limit=0", nil, http.StatusBadRequest, 0},
+		{"non-numeric limit", http.MethodGet, "?device_id=d1&limit=ten", nil, http.StatusBadRequest, 0},
+		{"malformed since", http.MethodGet, "?device_id=d1&since=yesterday", nil, http.StatusBadRequest, 0},
+		{"wrong method", http.MethodPost, "?device_id=d1", nil, http.StatusMethodNotAllowed, 0},
+		{"query error", http.MethodGet, "?device_id=d1", errors.New("connection refused"), http.StatusInternalServerError, defaultReadingsLimit},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := &fakeReader{err: tt.err, readings: []*models.SensorData{}}
+			rec := httptest.NewRecorder()
+			ReadingsHandler(db).ServeHTTP(rec, httptest.NewRequest(tt.method, "/readings"+tt.query, nil))
+
+			if rec.Code != tt.want {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.want, rec.Body)
+			}
+			if db.called != (tt.wantLimit > 0) {
+				t.Fatalf("reader called = %v, want %v", db.called, tt.wantLimit > 0)
+			}
+			if !db.called {
+				return
+			}
+			if db.deviceID != "d1" || db.limit != tt.wantLimit {
+				t.Errorf("queried device %q with limit %d, want d1 with limit %d", db.deviceID, db.limit, tt.wantLimit)
+			}
+		})
+	}
+
+	// since defaults to a day back
+	db := &fakeReader{readings: []*models.SensorData{}}
+	get(t, ReadingsHandler(db), "/readings?device_id=d1")
+	if ago := time.Since(db.since); ago < defaultReadingsWindow || ago > defaultReadingsWindow+time.Minute {
+		t.Errorf("since defaulted to %s ago, want %s", ago, defaultReadingsWindow)
+	}
+	get(t, ReadingsHandler(db), "/readings?device_id=d1&since=2024-05-01T12:00:00Z")
+	if !db.since.Equal(since) {
+		t.Errorf("since = %s, want %s", db.since, since)
+	}
+}
+
+func TestReadingsHandlerWritesJSON(t *testing.T) {
+	temperature := 21.5
+	ts := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name     string
+		readings []*models.SensorData
+		want     int
+	}{
+		{"readings", []*models.SensorData{{Device_ID: "d1", Timestamp: ts, Temperature: &temperature}}, 1},
+		{"no readings", []*models.SensorData{}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			ReadingsHandler(&fakeReader{readings: tt.readings}).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/readings?device_id=d1", nil))
+
+			if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+				t.Errorf("content type = %q, want application/json", ct)
+			}
+			// An empty result is an empty array rather than null
+			var got []*models.SensorData
+			if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil || got == nil {
+				t.Fatalf("body %q is not a JSON array: %v", rec.Body, err)
+			}
+			if len(got) != tt.want {
+				t.Fatalf("got %d readings, want %d", len(got), tt.want)
+			}
+			if tt.want > 0 && (got[0].Device_ID != "d1" || !got[0].Timestamp.Equal(ts) || *got[0].Temperature != temperature) {
+				t.Errorf("reading = %+v", got[0])
+			}
+		})
+	}
+}
@@ -0,0 +1,91 @@
+package httpserver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// readyTimeout bounds how long a readiness probe waits on its dependencies
+const readyTimeout = 2 * time.Second
+
+// ConnectionChecker reports whether the MQTT client is connected
+type ConnectionChecker interface {
+	IsConnected() bool
+}
+
+// Pinger checks that the database is reachable
+type Pinger interface {
+	Ping(ctx context.Context) error
+}
+
+// Server serves the service's HTTP endpoints
+type Server struct {
+	server *http.Server
+	mux    *http.ServeMux
+}
+
+// New creates a new Server listening on the given port
+func New(port int) *Server {
+	mux := http.NewServeMux()
+	return &Server{
+		server: &http.Server{
+			Addr:    fmt.Sprintf(":%d", port),
+			Handler: mux,
+		},
+		mux: mux,
+	}
+}
+
+// Handle registers a handler for the given pattern
+func (s *Server) Handle(pattern string, handler http.Handler) {
+	s.mux.Handle(pattern, handler)
+}
+
+// HandleHealth registers the /healthz liveness and /readyz readiness probes
+func (s *Server) HandleHealth(mqtt ConnectionChecker, db Pinger) {
+	s.mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("ok\n"))
+	})
+	s.mux.Handle("/readyz", ReadyHandler(mqtt, db))
+}
+
+// ReadyHandler returns a handler that responds 503 unless both the MQTT
+// client is connected and the database answers a ping
+func ReadyHandler(mqtt ConnectionChecker, db Pinger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !mqtt.IsConnected() {
+			http.Error(w, "mqtt: not connected", http.StatusServiceUnavailable)
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), readyTimeout)
+		defer cancel()
+		if err := db.Ping(ctx); err != nil {
+			http.Error(w, fmt.Sprintf("database: %v", err), http.StatusServiceUnavailable)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("ok\n"))
+	})
+}
+
+// Start serves requests in the background
+func (s *Server) Start() {
+	go func() {
+		slog.Info("HTTP server listening", "addr", s.server.Addr)
+		if err := s.server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("HTTP server error", "addr", s.server.Addr, "error", err)
+		}
+	}()
+}
+
+// Shutdown gracefully stops the server
+func (s *Server) Shutdown(ctx context.Context) error {
+	return s.server.Shutdown(ctx)
+}
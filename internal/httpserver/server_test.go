@@ -0,0 +1,74 @@
+package httpserver
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// fakeMQTT is a ConnectionChecker with a fixed state
+type fakeMQTT bool
+
+func (c fakeMQTT) IsConnected() bool {
+	return bool(c)
+}
+
+// fakeDB is a Pinger answering with err, or waiting for the context to end
+// when hang is set
+type fakeDB struct {
+	err  error
+	hang bool
+}
+
+func (db fakeDB) Ping(ctx context.Context) error {
+	if db.hang {
+		if deadline, ok := ctx.Deadline(); !ok || time.Until(deadline) > readyTimeout {
+			return errors.New("ping without the readiness timeout")
+		}
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	return db.err
+}
+
+// get serves a GET request for path and returns the response status
+func get(t *testing.T, handler http.Handler, path string) int {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+	return rec.Code
+}
+
+func TestHealthz(t *testing.T) {
+	s := New(0)
+	s.HandleHealth(fakeMQTT(false), fakeDB{err: errors.New("down")})
+	if code := get(t, s.mux, "/healthz"); code != http.StatusOK {
+		t.Errorf("/healthz = %d, want 200 even with the dependencies down", code)
+	}
+}
+
+func TestReadyz(t *testing.T) {
+	tests := []struct {
+		name      string
+		connected bool
+		db        fakeDB
+		want      int
+	}{
+		{"ready", true, fakeDB{}, http.StatusOK},
+		{"mqtt disconnected", false, fakeDB{}, http.StatusServiceUnavailable},
+		{"database down", true, fakeDB{err: errors.New("connection refused")}, http.StatusServiceUnavailable},
+		{"database hung", true, fakeDB{hang: true}, http.StatusServiceUnavailable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := New(0)
+			s.HandleHealth(fakeMQTT(tt.connected), tt.db)
+			if code := get(t, s.mux, "/readyz"); code != tt.want {
+				t.Errorf("/readyz = %d, want %d", code, tt.want)
+			}
+		})
+	}
+}
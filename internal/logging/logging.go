@@ -0,0 +1,60 @@
+package logging
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+
+	"github.com/ponytojas/go-mqtt-timescale/config"
+)
+
+// level is shared by every handler so it can be changed at runtime
+var level = new(slog.LevelVar)
+
+// Setup installs the default slog logger using the configured level and format
+func Setup(cfg config.LoggingConfig) error {
+	return SetupWriter(os.Stderr, cfg)
+}
+
+// SetupWriter installs the default slog logger writing to w
+func SetupWriter(w io.Writer, cfg config.LoggingConfig) error {
+	if err := SetLevel(cfg.Level); err != nil {
+		return err
+	}
+
+	opts := &slog.HandlerOptions{Level: level}
+
+	var handler slog.Handler
+	switch strings.ToLower(cfg.Format) {
+	case "json":
+		handler = slog.NewJSONHandler(w, opts)
+	case "text", "":
+		handler = slog.NewTextHandler(w, opts)
+	default:
+		return fmt.Errorf("unknown log format %q", cfg.Format)
+	}
+
+	slog.SetDefault(slog.New(handler))
+	return nil
+}
+
+// SetLevel changes the minimum level of the default logger
+func SetLevel(name string) error {
+	l, err := ParseLevel(name)
+	if err != nil {
+		return err
+	}
+	level.Set(l)
+	return nil
+}
+
+// ParseLevel converts a level name (debug, info, warn, error) into a slog.Level
+func ParseLevel(name string) (slog.Level, error) {
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(name)); err != nil {
+		return 0, fmt.Errorf("unknown log level %q", name)
+	}
+	return l, nil
+}
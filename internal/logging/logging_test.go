@@ -0,0 +1,93 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"testing"
+
+	"github.com/ponytojas/go-mqtt-timescale/config"
+)
+
+// capture installs a logger configured with cfg writing to the returned
+// buffer, restoring the previous default logger once the test ends
+func capture(t *testing.T, cfg config.LoggingConfig) *bytes.Buffer {
+	t.Helper()
+	previous, previousLevel := slog.Default(), level.Level()
+	t.Cleanup(func() {
+		slog.SetDefault(previous)
+		level.Set(previousLevel)
+	})
+	var buf bytes.Buffer
+	if err := SetupWriter(&buf, cfg); err != nil {
+		t.Fatal(err)
+	}
+	return &buf
+}
+
+func TestJSONLogsCarryFields(t *testing.T) {
+	buf := capture(t, config.LoggingConfig{Level: "info", Format: "json"})
+	slog.Info("stored", "device_id", "d1", "temperature", 21.5)
+
+	var entry map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Fatalf("log line is not JSON: %v\n%s", err, buf)
+	}
+	for key, want := range map[string]interface{}{"level": "INFO", "msg": "stored", "device_id": "d1", "temperature": 21.5} {
+		if entry[key] != want {
+			t.Errorf("%s = %v, want %v", key, entry[key], want)
+		}
+	}
+}
+
+func TestLevelFiltersLogs(t *testing.T) {
+	tests := []struct {
+		level  string
+		logged []string // of debug, info, warn and error
+	}{
+		{"debug", []string{"debug", "info", "warn", "error"}},
+		{"info", []string{"info", "warn", "error"}},
+		{"warn", []string{"warn", "error"}},
+		{"error", []string{"error"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.level, func(t *testing.T) {
+			buf := capture(t, config.LoggingConfig{Level: tt.level, Format: "text"})
+			slog.Debug("debug")
+			slog.Info("info")
+			slog.Warn("warn")
+			slog.Error("error")
+
+			if lines := strings.Count(buf.String(), "\n"); lines != len(tt.logged) {
+				t.Errorf("logged %d lines, want %v:\n%s", lines, tt.logged, buf)
+			}
+			for _, msg := range tt.logged {
+				if !strings.Contains(buf.String(), "msg="+msg) {
+					t.Errorf("%s line missing:\n%s", msg, buf)
+				}
+			}
+		})
+	}
+}
+
+func TestSetupRejectsUnknownSettings(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  config.LoggingConfig
+		want string
+	}{
+		{"level", config.LoggingConfig{Level: "verbose", Format: "json"}, `unknown log level "verbose"`},
+		{"format", config.LoggingConfig{Level: "info", Format: "xml"}, `unknown log format "xml"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			previous := slog.Default()
+			t.Cleanup(func() { slog.SetDefault(previous) })
+			err := SetupWriter(&bytes.Buffer{}, tt.cfg)
+			if err == nil || err.Error() != tt.want {
+				t.Errorf("error = %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
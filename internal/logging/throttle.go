@@ -0,0 +1,57 @@
+package logging
+
+import (
+	"context"
+	"log/slog"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// Throttle limits how often a repeated event, such as a lost connection
+// during a broker outage, is logged. The first event is logged and later ones
+// at most once per interval, with the number suppressed since the last line.
+// Each interval is stretched by up to 10% of jitter so several instances
+// sharing a log sink don't log in lockstep.
+type Throttle struct {
+	interval time.Duration
+
+	mu         sync.Mutex
+	next       time.Time // zero until the first event is logged
+	suppressed int
+}
+
+// NewThrottle creates a throttle logging at most once per interval. An
+// interval of 0 disables throttling.
+func NewThrottle(interval time.Duration) *Throttle {
+	return &Throttle{interval: interval}
+}
+
+// Log logs msg at level with args unless it is throttled
+func (t *Throttle) Log(level slog.Level, msg string, args ...any) {
+	t.mu.Lock()
+	now := time.Now()
+	if t.interval > 0 && now.Before(t.next) {
+		t.suppressed++
+		t.mu.Unlock()
+		return
+	}
+	suppressed := t.suppressed
+	t.suppressed = 0
+	t.next = now.Add(t.interval + time.Duration(rand.Int63n(int64(t.interval)/10+1)))
+	t.mu.Unlock()
+
+	if suppressed > 0 {
+		args = append(args, "suppressed", suppressed)
+	}
+	slog.Log(context.Background(), level, msg, args...)
+}
+
+// Reset forgets previous events so the next one is logged straight away,
+// e.g. once the connection is back up
+func (t *Throttle) Reset() {
+	t.mu.Lock()
+	t.next = time.Time{}
+	t.suppressed = 0
+	t.mu.Unlock()
+}
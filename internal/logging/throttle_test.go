@@ -0,0 +1,73 @@
+package logging
+
+import (
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ponytojas/go-mqtt-timescale/config"
+)
+
+func TestThrottleBoundsRepeatedEvents(t *testing.T) {
+	tests := []struct {
+		name     string
+		interval time.Duration
+		events   int
+		want     int // lines logged
+	}{
+		{"throttled", time.Hour, 1000, 1},
+		{"disabled", 0, 5, 5},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buf := capture(t, config.LoggingConfig{Level: "info", Format: "text"})
+			throttle := NewThrottle(tt.interval)
+			for i := 0; i < tt.events; i++ {
+				throttle.Log(slog.LevelWarn, "connection lost")
+			}
+			if lines := strings.Count(buf.String(), "connection lost"); lines != tt.want {
+				t.Errorf("logged %d lines for %d events, want %d", lines, tt.events, tt.want)
+			}
+		})
+	}
+}
+
+func TestThrottleReportsSuppressedEvents(t *testing.T) {
+	buf := capture(t, config.LoggingConfig{Level: "info", Format: "text"})
+	throttle := NewThrottle(20 * time.Millisecond)
+
+	throttle.Log(slog.LevelWarn, "connection lost")
+	for i := 0; i < 9; i++ {
+		throttle.Log(slog.LevelWarn, "connection lost")
+	}
+	// Past the interval and its jitter the next event is logged with a count
+	time.Sleep(30 * time.Millisecond)
+	throttle.Log(slog.LevelWarn, "connection lost")
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("logged %d lines, want 2:\n%s", len(lines), buf)
+	}
+	if strings.Contains(lines[0], "suppressed") || !strings.Contains(lines[1], "suppressed=9") {
+		t.Errorf("lines = %q, want the second to report 9 suppressed", lines)
+	}
+}
+
+func TestThrottleReset(t *testing.T) {
+	buf := capture(t, config.LoggingConfig{Level: "info", Format: "text"})
+	throttle := NewThrottle(time.Hour)
+
+	throttle.Log(slog.LevelWarn, "connection lost")
+	throttle.Log(slog.LevelWarn, "connection lost")
+	throttle.Reset()
+	throttle.Log(slog.LevelWarn, "connection lost")
+
+	if lines := strings.Count(buf.String(), "connection lost"); lines != 2 {
+		t.Errorf("logged %d lines, want 2 with the reset", lines)
+	}
+	// The event suppressed before the reset is forgotten
+	if strings.Contains(buf.String(), "suppressed") {
+		t.Errorf("log reports suppressed events across the reset:\n%s", buf)
+	}
+}
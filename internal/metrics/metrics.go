@@ -0,0 +1,175 @@
+package metrics
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Registry holds all application metrics
+var Registry = prometheus.NewRegistry()
+
+var factory = promauto.With(Registry)
+
+var (
+	// MQTTConnected counts the pipelines whose connection to the broker is up
+	MQTTConnected = factory.NewGauge(prometheus.GaugeOpts{
+		Name: "mqtt_connected",
+		Help: "Number of pipelines connected to their MQTT broker, 1 or 0 with a single pipeline.",
+	})
+
+	// MQTTConnectionsLost counts unexpected losses of the broker connection
+	MQTTConnectionsLost = factory.NewCounter(prometheus.CounterOpts{
+		Name: "mqtt_connections_lost_total",
+		Help: "Total number of times the connection to the MQTT broker was lost.",
+	})
+
+	// MessagesReceived counts MQTT messages received from the broker
+	MessagesReceived = factory.NewCounter(prometheus.CounterOpts{
+		Name: "mqtt_messages_received_total",
+		Help: "Total number of MQTT messages received.",
+	})
+
+	// ParseErrors counts MQTT messages that could not be parsed
+	ParseErrors = factory.NewCounter(prometheus.CounterOpts{
+		Name: "mqtt_parse_errors_total",
+		Help: "Total number of MQTT messages that failed to parse.",
+	})
+
+	// MessagesParsed counts MQTT messages parsed into sensor data
+	MessagesParsed = factory.NewCounter(prometheus.CounterOpts{
+		Name: "mqtt_messages_parsed_total",
+		Help: "Total number of MQTT messages parsed successfully.",
+	})
+
+	// OutOfRange counts readings rejected because a value was out of range
+	OutOfRange = factory.NewCounter(prometheus.CounterOpts{
+		Name: "mqtt_out_of_range_total",
+		Help: "Total number of readings with a value outside its configured range.",
+	})
+
+	// Duplicates counts readings dropped as duplicates
+	Duplicates = factory.NewCounter(prometheus.CounterOpts{
+		Name: "mqtt_duplicates_total",
+		Help: "Total number of duplicate readings dropped.",
+	})
+
+	// UnknownFields counts payload keys dropped because no column stores them
+	UnknownFields = factory.NewCounter(prometheus.CounterOpts{
+		Name: "mqtt_unknown_fields_total",
+		Help: "Total number of payload fields dropped because they aren't stored in any column.",
+	})
+
+	// RateLimited counts readings dropped by the per-device rate limiter
+	RateLimited = factory.NewCounter(prometheus.CounterOpts{
+		Name: "mqtt_rate_limited_total",
+		Help: "Total number of readings dropped because their device exceeded its rate limit.",
+	})
+
+	// DryRunMessages counts readings that would have been inserted in dry-run mode
+	DryRunMessages = factory.NewCounter(prometheus.CounterOpts{
+		Name: "dry_run_messages_total",
+		Help: "Total number of readings accepted but not inserted because of dry-run mode.",
+	})
+
+	// QueueDepth reports the readings waiting for the database writer
+	QueueDepth = factory.NewGauge(prometheus.GaugeOpts{
+		Name: "ingest_queue_depth",
+		Help: "Current number of readings waiting for the database writer.",
+	})
+
+	// QueueDropped counts readings dropped because the writer queue was full
+	QueueDropped = factory.NewCounter(prometheus.CounterOpts{
+		Name: "ingest_queue_dropped_total",
+		Help: "Total number of readings dropped because the writer queue was full.",
+	})
+
+	// DBInserts counts sensor data rows written to the database
+	DBInserts = factory.NewCounter(prometheus.CounterOpts{
+		Name: "db_inserts_total",
+		Help: "Total number of sensor data rows inserted.",
+	})
+
+	// DBInsertErrors counts failed insert statements
+	DBInsertErrors = factory.NewCounter(prometheus.CounterOpts{
+		Name: "db_insert_errors_total",
+		Help: "Total number of failed database inserts.",
+	})
+
+	// RowsLost counts readings that could neither be written nor spooled
+	RowsLost = factory.NewCounter(prometheus.CounterOpts{
+		Name: "ingest_rows_lost_total",
+		Help: "Total number of readings lost because they could neither be written nor spooled.",
+	})
+
+	// ShutdownDropped counts messages still in flight when the shutdown timeout elapsed
+	ShutdownDropped = factory.NewCounter(prometheus.CounterOpts{
+		Name: "mqtt_shutdown_dropped_total",
+		Help: "Total number of in-flight messages dropped because the shutdown timeout elapsed.",
+	})
+
+	// DBInsertRetries counts retried insert attempts
+	DBInsertRetries = factory.NewCounter(prometheus.CounterOpts{
+		Name: "db_insert_retries_total",
+		Help: "Total number of retried database insert attempts.",
+	})
+
+	// SpoolEnqueued counts rows written to the disk spool after a failed insert
+	SpoolEnqueued = factory.NewCounter(prometheus.CounterOpts{
+		Name: "spool_enqueued_total",
+		Help: "Total number of sensor data rows spooled to disk.",
+	})
+
+	// SpoolReplayed counts spooled rows written to the database
+	SpoolReplayed = factory.NewCounter(prometheus.CounterOpts{
+		Name: "spool_replayed_total",
+		Help: "Total number of spooled sensor data rows replayed into the database.",
+	})
+
+	// SpoolDropped counts spooled rows evicted or discarded without being written
+	SpoolDropped = factory.NewCounter(prometheus.CounterOpts{
+		Name: "spool_dropped_total",
+		Help: "Total number of spooled sensor data rows dropped.",
+	})
+
+	// SpoolBytes reports the current size of the disk spool
+	SpoolBytes = factory.NewGauge(prometheus.GaugeOpts{
+		Name: "spool_bytes",
+		Help: "Current size of the disk spool in bytes.",
+	})
+
+	// ErrorEventsDropped counts error events not published because of the
+	// error topic rate limit
+	ErrorEventsDropped = factory.NewCounter(prometheus.CounterOpts{
+		Name: "error_events_dropped_total",
+		Help: "Total number of error events dropped by the error topic rate limit.",
+	})
+
+	// BatchSize reports the number of buffered rows that triggers an insert
+	BatchSize = factory.NewGauge(prometheus.GaugeOpts{
+		Name: "db_batch_size",
+		Help: "Current number of buffered rows that triggers a batch insert.",
+	})
+
+	// DBInsertDuration observes the latency of insert statements
+	DBInsertDuration = factory.NewHistogram(prometheus.HistogramOpts{
+		Name:    "db_insert_duration_seconds",
+		Help:    "Latency of database insert statements.",
+		Buckets: prometheus.DefBuckets,
+	})
+)
+
+func init() {
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+}
+
+// Handler returns an HTTP handler serving the registry in Prometheus format
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{})
+}
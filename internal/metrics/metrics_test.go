@@ -0,0 +1,37 @@
+package metrics
+
+import (
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestHandlerServesCounters(t *testing.T) {
+	MessagesReceived.Add(3)
+	ParseErrors.Inc()
+	DBInserts.Add(2)
+	DBInsertErrors.Inc()
+	DBInsertDuration.Observe(0.01)
+
+	rec := httptest.NewRecorder()
+	Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body, _ := io.ReadAll(rec.Body)
+
+	for _, want := range []string{
+		"mqtt_messages_received_total",
+		"mqtt_parse_errors_total",
+		"db_inserts_total",
+		"db_insert_errors_total",
+		"db_insert_duration_seconds_bucket",
+	} {
+		if !strings.Contains(string(body), "\n"+want) {
+			t.Errorf("/metrics lacks %s", want)
+		}
+	}
+	if got := testutil.ToFloat64(MessagesReceived); got < 3 {
+		t.Errorf("mqtt_messages_received_total = %v, want at least 3", got)
+	}
+}
@@ -0,0 +1,110 @@
+package metrics
+
+import (
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// PoolStats is a snapshot of the database connection pools, summed over
+// every pipeline's pool
+type PoolStats struct {
+	AcquiredConns          int32   `json:"acquired_conns"`
+	IdleConns              int32   `json:"idle_conns"`
+	TotalConns             int32   `json:"total_conns"`
+	MaxConns               int32   `json:"max_conns"`
+	Acquires               int64   `json:"acquires"`
+	EmptyAcquires          int64   `json:"empty_acquires"`
+	AcquireDurationSeconds float64 `json:"acquire_duration_seconds"`
+}
+
+// add sums other into s
+func (s *PoolStats) add(other PoolStats) {
+	s.AcquiredConns += other.AcquiredConns
+	s.IdleConns += other.IdleConns
+	s.TotalConns += other.TotalConns
+	s.MaxConns += other.MaxConns
+	s.Acquires += other.Acquires
+	s.EmptyAcquires += other.EmptyAcquires
+	s.AcquireDurationSeconds += other.AcquireDurationSeconds
+}
+
+// poolCollector reads the registered pools on every scrape, so the metrics
+// are never staler than the scrape itself
+type poolCollector struct {
+	mu      sync.Mutex
+	nextID  int
+	sources map[int]func() PoolStats
+
+	acquired, idle, total, max           *prometheus.Desc
+	acquires, emptyAcquires, acquireTime *prometheus.Desc
+}
+
+var pools = &poolCollector{
+	sources:       make(map[int]func() PoolStats),
+	acquired:      prometheus.NewDesc("db_pool_acquired_conns", "Number of database connections currently in use.", nil, nil),
+	idle:          prometheus.NewDesc("db_pool_idle_conns", "Number of idle database connections in the pool.", nil, nil),
+	total:         prometheus.NewDesc("db_pool_total_conns", "Number of open database connections in the pool.", nil, nil),
+	max:           prometheus.NewDesc("db_pool_max_conns", "Maximum number of database connections the pool may open.", nil, nil),
+	acquires:      prometheus.NewDesc("db_pool_acquires_total", "Total number of connections acquired from the pool.", nil, nil),
+	emptyAcquires: prometheus.NewDesc("db_pool_empty_acquires_total", "Total number of acquires that waited because no connection was idle.", nil, nil),
+	acquireTime:   prometheus.NewDesc("db_pool_acquire_duration_seconds_total", "Total time spent acquiring connections from the pool.", nil, nil),
+}
+
+func init() {
+	Registry.MustRegister(pools)
+}
+
+// RegisterPool adds a connection pool to the pool metrics, read through
+// stat. The returned function removes it again.
+func RegisterPool(stat func() PoolStats) func() {
+	pools.mu.Lock()
+	defer pools.mu.Unlock()
+
+	id := pools.nextID
+	pools.nextID++
+	pools.sources[id] = stat
+	return func() {
+		pools.mu.Lock()
+		defer pools.mu.Unlock()
+		delete(pools.sources, id)
+	}
+}
+
+// snapshot sums the stats of the registered pools, or returns nil when no
+// pool is registered, for example when writing to a sink
+func (p *poolCollector) snapshot() *PoolStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if len(p.sources) == 0 {
+		return nil
+	}
+	var stats PoolStats
+	for _, stat := range p.sources {
+		stats.add(stat())
+	}
+	return &stats
+}
+
+// Describe implements prometheus.Collector
+func (p *poolCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, desc := range []*prometheus.Desc{p.acquired, p.idle, p.total, p.max, p.acquires, p.emptyAcquires, p.acquireTime} {
+		ch <- desc
+	}
+}
+
+// Collect implements prometheus.Collector
+func (p *poolCollector) Collect(ch chan<- prometheus.Metric) {
+	stats := p.snapshot()
+	if stats == nil {
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(p.acquired, prometheus.GaugeValue, float64(stats.AcquiredConns))
+	ch <- prometheus.MustNewConstMetric(p.idle, prometheus.GaugeValue, float64(stats.IdleConns))
+	ch <- prometheus.MustNewConstMetric(p.total, prometheus.GaugeValue, float64(stats.TotalConns))
+	ch <- prometheus.MustNewConstMetric(p.max, prometheus.GaugeValue, float64(stats.MaxConns))
+	ch <- prometheus.MustNewConstMetric(p.acquires, prometheus.CounterValue, float64(stats.Acquires))
+	ch <- prometheus.MustNewConstMetric(p.emptyAcquires, prometheus.CounterValue, float64(stats.EmptyAcquires))
+	ch <- prometheus.MustNewConstMetric(p.acquireTime, prometheus.CounterValue, stats.AcquireDurationSeconds)
+}
@@ -0,0 +1,105 @@
+package metrics
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestPoolCollector(t *testing.T) {
+	a := PoolStats{AcquiredConns: 2, IdleConns: 3, TotalConns: 5, MaxConns: 10, Acquires: 40, EmptyAcquires: 4, AcquireDurationSeconds: 0.5}
+	b := PoolStats{AcquiredConns: 1, IdleConns: 0, TotalConns: 1, MaxConns: 4, Acquires: 2, EmptyAcquires: 1, AcquireDurationSeconds: 0.25}
+	tests := []struct {
+		name    string
+		sources []PoolStats
+		want    string // the exposition of the pool metrics, "" for none
+	}{
+		{"no pools", nil, ""},
+		{"one pool", []PoolStats{a}, `
+# HELP db_pool_acquired_conns Number of database connections currently in use.
+# TYPE db_pool_acquired_conns gauge
+db_pool_acquired_conns 2
+# HELP db_pool_idle_conns Number of idle database connections in the pool.
+# TYPE db_pool_idle_conns gauge
+db_pool_idle_conns 3
+# HELP db_pool_total_conns Number of open database connections in the pool.
+# TYPE db_pool_total_conns gauge
+db_pool_total_conns 5
+# HELP db_pool_max_conns Maximum number of database connections the pool may open.
+# TYPE db_pool_max_conns gauge
+db_pool_max_conns 10
+# HELP db_pool_acquires_total Total number of connections acquired from the pool.
+# TYPE db_pool_acquires_total counter
+db_pool_acquires_total 40
+# HELP db_pool_empty_acquires_total Total number of acquires that waited because no connection was idle.
+# TYPE db_pool_empty_acquires_total counter
+db_pool_empty_acquires_total 4
+# HELP db_pool_acquire_duration_seconds_total Total time spent acquiring connections from the pool.
+# TYPE db_pool_acquire_duration_seconds_total counter
+db_pool_acquire_duration_seconds_total 0.5
+`},
+		// Each pipeline's pool is summed
+		{"two pools", []PoolStats{a, b}, `
+# HELP db_pool_acquired_conns Number of database connections currently in use.
+# TYPE db_pool_acquired_conns gauge
+db_pool_acquired_conns 3
+# HELP db_pool_idle_conns Number of idle database connections in the pool.
+# TYPE db_pool_idle_conns gauge
+db_pool_idle_conns 3
+# HELP db_pool_total_conns Number of open database connections in the pool.
+# TYPE db_pool_total_conns gauge
+db_pool_total_conns 6
+# HELP db_pool_max_conns Maximum number of database connections the pool may open.
+# TYPE db_pool_max_conns gauge
+db_pool_max_conns 14
+# HELP db_pool_acquires_total Total number of connections acquired from the pool.
+# TYPE db_pool_acquires_total counter
+db_pool_acquires_total 42
+# HELP db_pool_empty_acquires_total Total number of acquires that waited because no connection was idle.
+# TYPE db_pool_empty_acquires_total counter
+db_pool_empty_acquires_total 5
+# HELP db_pool_acquire_duration_seconds_total Total time spent acquiring connections from the pool.
+# TYPE db_pool_acquire_duration_seconds_total counter
+db_pool_acquire_duration_seconds_total 0.75
+`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, stats := range tt.sources {
+				stats := stats
+				t.Cleanup(RegisterPool(func() PoolStats { return stats }))
+			}
+			if err := testutil.CollectAndCompare(pools, strings.NewReader(tt.want)); err != nil {
+				t.Error(err)
+			}
+
+			// /stats reports the same totals
+			snapshot := Snapshot(1).Pool
+			if tt.sources == nil {
+				if snapshot != nil {
+					t.Errorf("stats pool = %+v, want none without a pool", snapshot)
+				}
+				return
+			}
+			var want PoolStats
+			for _, stats := range tt.sources {
+				want.add(stats)
+			}
+			if snapshot == nil || *snapshot != want {
+				t.Errorf("stats pool = %+v, want %+v", snapshot, want)
+			}
+		})
+	}
+}
+
+func TestUnregisteredPoolsAreNotCollected(t *testing.T) {
+	unregister := RegisterPool(func() PoolStats { return PoolStats{TotalConns: 3} })
+	if n := testutil.CollectAndCount(pools); n != 7 {
+		t.Fatalf("collected %d pool metrics, want 7", n)
+	}
+	unregister()
+	if n := testutil.CollectAndCount(pools); n != 0 {
+		t.Errorf("collected %d pool metrics after unregistering, want 0", n)
+	}
+}
@@ -0,0 +1,174 @@
+package metrics
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+const (
+	// maxTrackedDevices bounds how many devices have their messages counted
+	maxTrackedDevices = 1000
+	// defaultTopDevices is how many devices /stats lists unless ?top= is given
+	defaultTopDevices = 10
+)
+
+var (
+	// started is when the process started, for the uptime in /stats
+	started = time.Now()
+
+	// lastInsert holds the Unix nanoseconds of the last successful insert
+	lastInsert atomic.Int64
+
+	// Devices counts the messages parsed per device
+	Devices = NewDeviceCounter(maxTrackedDevices)
+)
+
+// RecordInsert records that rows were just written to the database
+func RecordInsert() {
+	lastInsert.Store(time.Now().UnixNano())
+}
+
+// DeviceCount is the number of messages counted for a device
+type DeviceCount struct {
+	DeviceID string `json:"device_id"`
+	Messages uint64 `json:"messages"`
+}
+
+// DeviceCounter counts messages per device, tracking at most a fixed number
+// of devices. When it is full, a new device replaces the one with the fewest
+// messages and inherits its count, so the busiest devices stay tracked and
+// a count is never lower than the device's real number of messages.
+type DeviceCounter struct {
+	mu     sync.Mutex
+	max    int
+	counts map[string]uint64
+}
+
+// NewDeviceCounter creates a counter tracking at most max devices
+func NewDeviceCounter(max int) *DeviceCounter {
+	return &DeviceCounter{max: max, counts: make(map[string]uint64)}
+}
+
+// Inc counts a message from a device
+func (d *DeviceCounter) Inc(deviceID string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if _, ok := d.counts[deviceID]; !ok && len(d.counts) >= d.max {
+		var minID string
+		var minCount uint64
+		for id, count := range d.counts {
+			if minID == "" || count < minCount {
+				minID, minCount = id, count
+			}
+		}
+		delete(d.counts, minID)
+		d.counts[deviceID] = minCount
+	}
+	d.counts[deviceID]++
+}
+
+// Top returns up to n devices with the most messages, busiest first
+func (d *DeviceCounter) Top(n int) []DeviceCount {
+	d.mu.Lock()
+	top := make([]DeviceCount, 0, len(d.counts))
+	for id, count := range d.counts {
+		top = append(top, DeviceCount{DeviceID: id, Messages: count})
+	}
+	d.mu.Unlock()
+
+	sort.Slice(top, func(i, j int) bool {
+		if top[i].Messages != top[j].Messages {
+			return top[i].Messages > top[j].Messages
+		}
+		return top[i].DeviceID < top[j].DeviceID
+	})
+	if len(top) > n {
+		top = top[:n]
+	}
+	return top
+}
+
+// Stats summarizes the runtime counters for /stats
+type Stats struct {
+	UptimeSeconds    int64         `json:"uptime_seconds"`
+	MessagesReceived uint64        `json:"messages_received"`
+	MessagesParsed   uint64        `json:"messages_parsed"`
+	ParseErrors      uint64        `json:"parse_errors"`
+	RowsInserted     uint64        `json:"rows_inserted"`
+	InsertErrors     uint64        `json:"insert_errors"`
+	LastInsert       *time.Time    `json:"last_insert"`
+	QueueDepth       int           `json:"queue_depth"`
+	BatchSize        int           `json:"batch_size"`
+	Pool             *PoolStats    `json:"pool"`
+	TopDevices       []DeviceCount `json:"top_devices"`
+}
+
+// Snapshot reads the current counters, listing the top busiest devices
+func Snapshot(top int) Stats {
+	stats := Stats{
+		UptimeSeconds:    int64(time.Since(started).Seconds()),
+		MessagesReceived: uint64(value(MessagesReceived)),
+		MessagesParsed:   uint64(value(MessagesParsed)),
+		ParseErrors:      uint64(value(ParseErrors)),
+		RowsInserted:     uint64(value(DBInserts)),
+		InsertErrors:     uint64(value(DBInsertErrors)),
+		QueueDepth:       int(value(QueueDepth)),
+		BatchSize:        int(value(BatchSize)),
+		Pool:             pools.snapshot(),
+		TopDevices:       Devices.Top(top),
+	}
+	if nanos := lastInsert.Load(); nanos != 0 {
+		last := time.Unix(0, nanos).UTC()
+		stats.LastInsert = &last
+	}
+	return stats
+}
+
+// value reads the current value of a counter or gauge
+func value(metric prometheus.Metric) float64 {
+	var m dto.Metric
+	if err := metric.Write(&m); err != nil {
+		return 0
+	}
+	if m.Counter != nil {
+		return m.Counter.GetValue()
+	}
+	return m.Gauge.GetValue()
+}
+
+// StatsHandler returns a handler serving GET /stats?top=N as JSON
+func StatsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		top := defaultTopDevices
+		if raw := r.URL.Query().Get("top"); raw != "" {
+			n, err := strconv.Atoi(raw)
+			if err != nil || n <= 0 || n > maxTrackedDevices {
+				http.Error(w, fmt.Sprintf("top %q must be between 1 and %d", raw, maxTrackedDevices), http.StatusBadRequest)
+				return
+			}
+			top = n
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(Snapshot(top)); err != nil {
+			slog.Error("Error writing stats response", "error", err)
+		}
+	})
+}
@@ -0,0 +1,142 @@
+package metrics
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestDeviceCounter(t *testing.T) {
+	tests := []struct {
+		name     string
+		max      int
+		messages []string // the device of each message, in order
+		top      int
+		want     []DeviceCount
+	}{
+		{"busiest first", 10, []string{"a", "b", "b", "c", "c", "c"}, 10,
+			[]DeviceCount{{"c", 3}, {"b", 2}, {"a", 1}}},
+		{"ties by device id", 10, []string{"b", "a"}, 10,
+			[]DeviceCount{{"a", 1}, {"b", 1}}},
+		{"top n", 10, []string{"a", "b", "b", "c", "c", "c"}, 2,
+			[]DeviceCount{{"c", 3}, {"b", 2}}},
+		// d replaces a, the least busy, and inherits its count
+		{"bounded", 3, []string{"a", "b", "b", "c", "c", "c", "d"}, 10,
+			[]DeviceCount{{"c", 3}, {"b", 2}, {"d", 2}}},
+		{"none", 10, nil, 10, []DeviceCount{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := NewDeviceCounter(tt.max)
+			for _, device := range tt.messages {
+				d.Inc(device)
+			}
+			if got := d.Top(tt.top); !slices.Equal(got, tt.want) {
+				t.Errorf("Top(%d) = %v, want %v", tt.top, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDeviceCounterStaysBounded(t *testing.T) {
+	d := NewDeviceCounter(5)
+	for i := 0; i < 1000; i++ {
+		d.Inc(fmt.Sprintf("device-%d", i))
+	}
+	if n := len(d.Top(1000)); n != 5 {
+		t.Errorf("tracking %d devices, want 5", n)
+	}
+}
+
+func TestStatsHandler(t *testing.T) {
+	tests := []struct {
+		name   string
+		method string
+		query  string
+		want   int
+	}{
+		{"default top", http.MethodGet, "", http.StatusOK},
+		{"top", http.MethodGet, "?top=3", http.StatusOK},
+		{"top at the cap", http.MethodGet, fmt.Sprintf("?top=%d", maxTrackedDevices), http.StatusOK},
+		{"top over the cap", http.MethodGet, fmt.Sprintf("?top=%d", maxTrackedDevices+1), http.StatusBadRequest},
+		{"zero top", http.MethodGet, "?top=0", http.StatusBadRequest},
+		{"non-numeric top", http.MethodGet, "?top=all", http.StatusBadRequest},
+		{"wrong method", http.MethodPost, "", http.StatusMethodNotAllowed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			StatsHandler().ServeHTTP(rec, httptest.NewRequest(tt.method, "/stats"+tt.query, nil))
+			if rec.Code != tt.want {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.want, rec.Body)
+			}
+			if tt.want != http.StatusOK {
+				return
+			}
+			if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+				t.Errorf("content type = %q, want application/json", ct)
+			}
+			var body map[string]json.RawMessage
+			if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+				t.Fatalf("body %q is not a JSON object: %v", rec.Body, err)
+			}
+			for _, key := range []string{
+				"uptime_seconds", "messages_received", "messages_parsed", "parse_errors",
+				"rows_inserted", "insert_errors", "last_insert", "queue_depth", "batch_size",
+				"pool", "top_devices",
+			} {
+				if _, ok := body[key]; !ok {
+					t.Errorf("stats lack %s: %s", key, rec.Body)
+				}
+			}
+		})
+	}
+}
+
+func TestStatsReflectProcessedMessages(t *testing.T) {
+	before := Snapshot(maxTrackedDevices)
+	MessagesReceived.Add(3)
+	MessagesParsed.Add(2)
+	ParseErrors.Inc()
+	DBInserts.Add(2)
+	for i := 0; i < 5; i++ {
+		Devices.Inc("stats-busiest")
+	}
+	insertedAt := time.Now()
+	RecordInsert()
+
+	rec := httptest.NewRecorder()
+	StatsHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/stats?top=1", nil))
+	var after Stats
+	if err := json.Unmarshal(rec.Body.Bytes(), &after); err != nil {
+		t.Fatalf("body %q is not stats: %v", rec.Body, err)
+	}
+
+	deltas := []struct {
+		name      string
+		got, want uint64
+	}{
+		{"messages received", after.MessagesReceived - before.MessagesReceived, 3},
+		{"messages parsed", after.MessagesParsed - before.MessagesParsed, 2},
+		{"parse errors", after.ParseErrors - before.ParseErrors, 1},
+		{"rows inserted", after.RowsInserted - before.RowsInserted, 2},
+	}
+	for _, d := range deltas {
+		if d.got != d.want {
+			t.Errorf("%s grew by %d, want %d", d.name, d.got, d.want)
+		}
+	}
+	if after.LastInsert == nil || after.LastInsert.Before(insertedAt.Add(-time.Second)) {
+		t.Errorf("last insert = %v, want about %s", after.LastInsert, insertedAt)
+	}
+	if len(after.TopDevices) != 1 || after.TopDevices[0].DeviceID != "stats-busiest" {
+		t.Errorf("top devices = %v, want only stats-busiest", after.TopDevices)
+	}
+	if after.UptimeSeconds < 0 {
+		t.Errorf("uptime = %d", after.UptimeSeconds)
+	}
+}
@@ -0,0 +1,57 @@
+package metrics
+
+// Summary accounts for the data the service handled since it started, for
+// the log line written on exit
+type Summary struct {
+	MessagesReceived uint64 // messages received from the broker
+	RowsInserted     uint64 // readings written to the database or sink
+
+	// Lost readings: dropped from a full queue, still in flight when the
+	// shutdown timeout elapsed, failed to be written or spooled, or dropped
+	// from the spool. Readings dropped deliberately, such as duplicates or
+	// rejected payloads, are not counted.
+	QueueDropped    uint64
+	ShutdownDropped uint64
+	RowsLost        uint64
+	SpoolDropped    uint64
+
+	// Readings not yet written: still queued, or in the disk spool to be
+	// replayed on the next start
+	QueueDepth int
+	SpoolBytes int64
+}
+
+// Summarize reads the summary from the counters
+func Summarize() Summary {
+	return Summary{
+		MessagesReceived: uint64(value(MessagesReceived)),
+		RowsInserted:     uint64(value(DBInserts)),
+		QueueDropped:     uint64(value(QueueDropped)),
+		ShutdownDropped:  uint64(value(ShutdownDropped)),
+		RowsLost:         uint64(value(RowsLost)),
+		SpoolDropped:     uint64(value(SpoolDropped)),
+		QueueDepth:       int(value(QueueDepth)),
+		SpoolBytes:       int64(value(SpoolBytes)),
+	}
+}
+
+// Dropped returns the number of readings lost, counting dropped in-flight
+// messages as one reading each
+func (s Summary) Dropped() uint64 {
+	return s.QueueDropped + s.ShutdownDropped + s.RowsLost + s.SpoolDropped
+}
+
+// LogArgs returns the summary as slog key/value pairs
+func (s Summary) LogArgs() []any {
+	return []any{
+		"received", s.MessagesReceived,
+		"inserted", s.RowsInserted,
+		"dropped", s.Dropped(),
+		"queue_dropped", s.QueueDropped,
+		"shutdown_dropped", s.ShutdownDropped,
+		"write_failed", s.RowsLost,
+		"spool_dropped", s.SpoolDropped,
+		"queued", s.QueueDepth,
+		"spool_bytes", s.SpoolBytes,
+	}
+}
@@ -0,0 +1,94 @@
+package metrics
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestSummaryDropped(t *testing.T) {
+	tests := []struct {
+		name    string
+		summary Summary
+		want    uint64
+	}{
+		{"clean run", Summary{MessagesReceived: 10, RowsInserted: 10}, 0},
+		// Readings still queued or spooled are not lost
+		{"pending", Summary{MessagesReceived: 10, RowsInserted: 5, QueueDepth: 3, SpoolBytes: 512}, 0},
+		{"queue full", Summary{QueueDropped: 2}, 2},
+		{"every kind of loss", Summary{QueueDropped: 1, ShutdownDropped: 2, RowsLost: 3, SpoolDropped: 4}, 10},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.summary.Dropped(); got != tt.want {
+				t.Errorf("Dropped() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSummaryLogArgs(t *testing.T) {
+	s := Summary{
+		MessagesReceived: 10, RowsInserted: 4,
+		QueueDropped: 1, ShutdownDropped: 2, RowsLost: 3, SpoolDropped: 4,
+		QueueDepth: 5, SpoolBytes: 6,
+	}
+	args := s.LogArgs()
+	if len(args)%2 != 0 {
+		t.Fatalf("odd number of log args: %v", args)
+	}
+	got := make(map[string]string)
+	for i := 0; i < len(args); i += 2 {
+		got[args[i].(string)] = fmt.Sprint(args[i+1])
+	}
+	for key, want := range map[string]string{
+		"received": "10", "inserted": "4", "dropped": "10",
+		"queue_dropped": "1", "shutdown_dropped": "2", "write_failed": "3", "spool_dropped": "4",
+		"queued": "5", "spool_bytes": "6",
+	} {
+		if got[key] != want {
+			t.Errorf("%s = %q, want %q", key, got[key], want)
+		}
+	}
+}
+
+func TestSummarizeReflectsARun(t *testing.T) {
+	// Other tests share the counters, so the run is measured as deltas
+	before := Summarize()
+	t.Cleanup(func() {
+		QueueDepth.Set(float64(before.QueueDepth))
+		SpoolBytes.Set(float64(before.SpoolBytes))
+	})
+
+	// 10 messages: 6 inserted, 1 dropped from a full queue, 1 in flight at
+	// the shutdown timeout, 1 failed write and 1 still queued, with a
+	// spooled batch awaiting replay
+	MessagesReceived.Add(10)
+	DBInserts.Add(6)
+	QueueDropped.Inc()
+	ShutdownDropped.Inc()
+	RowsLost.Inc()
+	QueueDepth.Set(1)
+	SpoolBytes.Set(2048)
+
+	after := Summarize()
+	deltas := []struct {
+		name      string
+		got, want uint64
+	}{
+		{"received", after.MessagesReceived - before.MessagesReceived, 10},
+		{"inserted", after.RowsInserted - before.RowsInserted, 6},
+		{"dropped", after.Dropped() - before.Dropped(), 3},
+		{"queue dropped", after.QueueDropped - before.QueueDropped, 1},
+		{"shutdown dropped", after.ShutdownDropped - before.ShutdownDropped, 1},
+		{"write failed", after.RowsLost - before.RowsLost, 1},
+		{"spool dropped", after.SpoolDropped - before.SpoolDropped, 0},
+	}
+	for _, d := range deltas {
+		if d.got != d.want {
+			t.Errorf("%s grew by %d, want %d", d.name, d.got, d.want)
+		}
+	}
+	if after.QueueDepth != 1 || after.SpoolBytes != 2048 {
+		t.Errorf("queued = %d, spool bytes = %d, want 1 and 2048", after.QueueDepth, after.SpoolBytes)
+	}
+}
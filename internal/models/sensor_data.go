@@ -4,10 +4,34 @@ import (
 	"time"
 )
 
+// SensorData is a single reading. Sensor values absent from the payload are
+// nil and stored as NULL.
 type SensorData struct {
-	Timestamp   time.Time `json:"timestamp"`
-	Temperature float64   `json:"temperature"`
-	Humidity    float64   `json:"humidity"`
-	Light       float64   `json:"light"`
-	Device_ID    string    `json:"device_id"`
+	Timestamp   time.Time          `json:"timestamp"`
+	Temperature *float64           `json:"temperature"`
+	Humidity    *float64           `json:"humidity"`
+	Light       *float64           `json:"light"`
+	Device_ID   string             `json:"device_id"`
+	Fields      map[string]float64 `json:"fields,omitempty"`
+
+	// Tags hold the topic segments bound to mqtt.topic_columns and the
+	// payload fields named by timescale.tag_columns
+	Tags map[string]string `json:"tags,omitempty"`
+
+	// IngestTime is when the service received the reading, set when
+	// timescale.track_ingest_time is enabled
+	IngestTime *time.Time `json:"ingest_time,omitempty"`
+
+	// Retained is set when the reading came from a retained message the
+	// broker sent on subscribe, rather than a live one
+	Retained bool `json:"retained,omitempty"`
+}
+
+// Value returns the value of an optional sensor reading, or nil when it's
+// absent, so that logs show the number rather than a pointer
+func Value(v *float64) interface{} {
+	if v == nil {
+		return nil
+	}
+	return *v
 }
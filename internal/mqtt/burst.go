@@ -0,0 +1,57 @@
+package mqtt
+
+import (
+	"fmt"
+	"time"
+)
+
+// expandBurst splits a reading whose burst fields hold arrays of samples
+// into the fields of one reading per sample, along with the interval between
+// samples read from the burst interval field. Fields that aren't burst
+// fields are copied into every sample. It returns nil when no burst field
+// holds an array.
+func (c *Client) expandBurst(rawData map[string]interface{}) ([]map[string]interface{}, time.Duration, error) {
+	count := -1
+	for _, field := range c.config.MQTT.BurstFields {
+		samples, ok := rawData[field].([]interface{})
+		if !ok {
+			continue
+		}
+		if count >= 0 && len(samples) != count {
+			return nil, 0, fmt.Errorf("burst fields must have the same number of samples, %s has %d instead of %d", field, len(samples), count)
+		}
+		count = len(samples)
+	}
+	if count < 0 {
+		return nil, 0, nil
+	}
+
+	intervalField := c.config.MQTT.BurstIntervalField
+	ms, ok := numberValue(rawData[intervalField])
+	if !ok || ms <= 0 {
+		return nil, 0, fmt.Errorf("%s must be a positive number of milliseconds in a burst", intervalField)
+	}
+	interval := time.Duration(ms * float64(time.Millisecond))
+
+	// Samples without a timestamp are spaced from the same receive time
+	if _, ok := rawData["timestamp"]; !ok {
+		rawData["timestamp"] = time.Now()
+	}
+
+	readings := make([]map[string]interface{}, count)
+	for i := range readings {
+		fields := make(map[string]interface{}, len(rawData))
+		for key, val := range rawData {
+			if key != intervalField {
+				fields[key] = val
+			}
+		}
+		for _, field := range c.config.MQTT.BurstFields {
+			if samples, ok := rawData[field].([]interface{}); ok {
+				fields[field] = samples[i]
+			}
+		}
+		readings[i] = fields
+	}
+	return readings, interval, nil
+}
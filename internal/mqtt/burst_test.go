@@ -0,0 +1,102 @@
+package mqtt
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBurstFields(t *testing.T) {
+	t0 := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name        string
+		burstFields []string
+		payload     string
+		wantErr     string // substring of the error, "" when accepted
+		wantTemps   []float64
+		wantHumid   []float64 // nil when humidity isn't checked
+		interval    time.Duration
+	}{
+		{"three samples", []string{"temperature"},
+			`{"device_id":"x","temperature":[20.1,20.3,20.5],"interval_ms":1000,"timestamp":"2024-05-01T12:00:00Z"}`,
+			"", []float64{20.1, 20.3, 20.5}, nil, time.Second},
+		{"several burst fields", []string{"temperature", "humidity"},
+			`{"device_id":"x","temperature":[20,21],"humidity":[40,41],"interval_ms":250,"timestamp":"2024-05-01T12:00:00Z"}`,
+			"", []float64{20, 21}, []float64{40, 41}, 250 * time.Millisecond},
+		{"other fields copied into every sample", []string{"temperature"},
+			`{"device_id":"x","temperature":[20,21],"humidity":40,"interval_ms":500,"timestamp":"2024-05-01T12:00:00Z"}`,
+			"", []float64{20, 21}, []float64{40, 40}, 500 * time.Millisecond},
+		{"scalar burst field", []string{"temperature"},
+			`{"device_id":"x","temperature":20,"timestamp":"2024-05-01T12:00:00Z"}`,
+			"", []float64{20}, nil, 0},
+		{"empty burst", []string{"temperature"},
+			`{"device_id":"x","temperature":[],"interval_ms":1000}`,
+			"", []float64{}, nil, 0},
+		{"arrays are rejected unless opted in", nil,
+			`{"device_id":"x","temperature":[20,21],"interval_ms":1000}`,
+			"temperature", nil, nil, 0},
+		{"different sample counts", []string{"temperature", "humidity"},
+			`{"device_id":"x","temperature":[20,21],"humidity":[40],"interval_ms":1000}`,
+			"burst fields must have the same number of samples", nil, nil, 0},
+		{"missing interval", []string{"temperature"},
+			`{"device_id":"x","temperature":[20,21]}`,
+			"interval_ms must be a positive number of milliseconds", nil, nil, 0},
+		{"non-numeric sample", []string{"temperature"},
+			`{"device_id":"x","temperature":[20,"warm"],"interval_ms":1000}`,
+			`sample 1: temperature: "warm" is not a number`, nil, nil, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig()
+			cfg.MQTT.BurstFields = tt.burstFields
+			rows, err := ingest(t, cfg, "sensor/x", tt.payload)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want one containing %q", err, tt.wantErr)
+				}
+				if len(rows) != 0 {
+					t.Errorf("stored %d readings, want none", len(rows))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(rows) != len(tt.wantTemps) {
+				t.Fatalf("stored %d readings, want %d", len(rows), len(tt.wantTemps))
+			}
+			for i, got := range rows {
+				if want := t0.Add(time.Duration(i) * tt.interval); !got.Timestamp.Equal(want) {
+					t.Errorf("sample %d at %s, want %s", i, got.Timestamp, want)
+				}
+				if !equalValue(got.Temperature, ptr(tt.wantTemps[i])) {
+					t.Errorf("sample %d temperature = %v, want %v", i, got.Temperature, tt.wantTemps[i])
+				}
+				if tt.wantHumid != nil && !equalValue(got.Humidity, ptr(tt.wantHumid[i])) {
+					t.Errorf("sample %d humidity = %v, want %v", i, got.Humidity, tt.wantHumid[i])
+				}
+				if got.Device_ID != "x" {
+					t.Errorf("sample %d device = %q, want x", i, got.Device_ID)
+				}
+			}
+		})
+	}
+}
+
+func TestBurstWithoutATimestampIsSpacedFromArrival(t *testing.T) {
+	cfg := testConfig()
+	cfg.MQTT.BurstFields = []string{"temperature"}
+	before := time.Now()
+	rows, err := ingest(t, cfg, "sensor/x", `{"device_id":"x","temperature":[20,21,22],"interval_ms":100}`)
+	if err != nil || len(rows) != 3 {
+		t.Fatalf("stored %d readings with error %v, want 3", len(rows), err)
+	}
+	if rows[0].Timestamp.Before(before) || time.Since(rows[0].Timestamp) > time.Minute {
+		t.Errorf("first sample at %s, want the time of arrival", rows[0].Timestamp)
+	}
+	for i := 1; i < len(rows); i++ {
+		if gap := rows[i].Timestamp.Sub(rows[i-1].Timestamp); gap != 100*time.Millisecond {
+			t.Errorf("sample %d is %s after the previous one, want 100ms", i, gap)
+		}
+	}
+}
@@ -1,201 +1,1056 @@
 package mqtt
 
 import (
-	"crypto/tls"
+	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
+	"math"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
-	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/santhosh-tekuri/jsonschema/v5"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+
 	"github.com/ponytojas/go-mqtt-timescale/config"
-	"github.com/ponytojas/go-mqtt-timescale/internal/database"
+	"github.com/ponytojas/go-mqtt-timescale/internal/deadletter"
+	"github.com/ponytojas/go-mqtt-timescale/internal/dedup"
+	"github.com/ponytojas/go-mqtt-timescale/internal/logging"
+	"github.com/ponytojas/go-mqtt-timescale/internal/metrics"
 	"github.com/ponytojas/go-mqtt-timescale/internal/models"
+	"github.com/ponytojas/go-mqtt-timescale/internal/ratelimit"
 )
 
+// knownFields are payload keys that map to dedicated columns or metadata
+// rather than the dynamic metrics column
+var knownFields = map[string]bool{
+	"timestamp":   true,
+	"temperature": true,
+	"humidity":    true,
+	"light":       true,
+	"device_id":   true,
+	"table":       true,
+}
+
 // Client handles MQTT connection and message processing
 type Client struct {
-	client   mqtt.Client
-	db       *database.TimescaleDB
-	config   *config.Config
-	stopChan chan struct{}
+	conn       transport
+	db         Storage
+	config     *config.Config
+	deadLetter deadletter.DeadLetter
+	template   *topicTemplate
+	dedup      *dedup.Cache       // nil when deduplication is disabled
+	location   *time.Location     // timestamps are converted to it, nil keeps their offset
+	fieldMap   map[string]string  // lowercase payload key to the known field it holds
+	fieldScale map[string]float64 // lowercase field name to the factor its values are multiplied by
+	tagNames   map[string]bool    // topic template segments stored in their own columns
+	tagFields  map[string]bool    // payload fields stored in their own columns
+	schema     *jsonschema.Schema // JSON payloads must match it, nil when none is configured
+	pathRoots  map[string]bool    // payload objects read by the field paths
+	stopChan   chan struct{}
+	stopOnce   sync.Once
+
+	// errorLimiter limits error events per kind, nil when no error topic is configured
+	errorLimiter *ratelimit.RateLimiter
+
+	// unknownLog throttles the logs of unknown payload fields, nil unless
+	// ingest.warn_unknown_fields is set
+	unknownLog *logging.Throttle
+
+	// workers process messages off the MQTT client's goroutines, nil when
+	// ingest.workers is 0
+	workers *workerPool
+
+	// settings holds the reloadable settings, swapped atomically by Reload
+	settings atomic.Pointer[settings]
+
+	// ctx is passed to message processing and cancelled when a shutdown
+	// deadline elapses
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// mu guards stopped so no new message is tracked once draining starts,
+	// and the subscriptions, keyed by topic
+	mu         sync.Mutex
+	stopped    bool
+	subscribed map[string]config.SubscriptionConfig
+	inflight   sync.WaitGroup
+	pending    atomic.Int64
+
+	// hooksMu guards the hooks registered with OnConnect and OnConnectionLost
+	hooksMu        sync.Mutex
+	connectHooks   []func()
+	connectionLost []func(error)
 }
 
 // NewClient creates a new MQTT client
-func NewClient(cfg *config.Config, db *database.TimescaleDB) (*Client, error) {
-	opts := mqtt.NewClientOptions()
-	brokerURL := cfg.GetMQTTBrokerURL()
-	log.Printf("Connecting to MQTT broker at %s", brokerURL)
-	opts.AddBroker(brokerURL)
-	opts.SetClientID(cfg.MQTT.ClientID)
+func NewClient(cfg *config.Config, db Storage) (*Client, error) {
+	id, err := clientID(&cfg.MQTT)
+	if err != nil {
+		return nil, err
+	}
+	slog.Info("Connecting to MQTT broker", "brokers", cfg.GetRedactedMQTTBrokerURLs(), "protocol_version", cfg.MQTT.ProtocolVersion, "client_id", id)
+	conn, err := newTransport(cfg, id)
+	if err != nil {
+		return nil, err
+	}
+	return newClient(cfg, db, conn)
+}
 
-	opts.SetCleanSession(false) // keep subscriptions/session state
-	opts.SetResumeSubs(true)    // auto-resubscribe after reconnect
-	opts.SetOrderMatters(false) // better throughput
-	opts.SetKeepAlive(30 * time.Second)
-	opts.SetPingTimeout(10 * time.Second)
-	opts.SetWriteTimeout(10 * time.Second)
-	opts.SetConnectRetry(true)
-	opts.SetConnectRetryInterval(2 * time.Second)
+// newClient creates a client on top of an existing transport, which lets
+// the message pipeline run against any connection to a broker
+func newClient(cfg *config.Config, db Storage, conn transport) (*Client, error) {
+	template, err := parseTopicTemplate(cfg.MQTT.TopicTemplate)
+	if err != nil {
+		return nil, err
+	}
 
-	if cfg.MQTT.Username != "" {
-		opts.SetUsername(cfg.MQTT.Username)
-		opts.SetPassword(cfg.MQTT.Password)
+	deadLetter, err := newDeadLetter(&cfg.DeadLetter, conn)
+	if err != nil {
+		return nil, err
 	}
 
-	// Configure TLS if using SSL or HTTPS
-	if strings.HasPrefix(brokerURL, "ssl://") || strings.HasPrefix(brokerURL, "wss://") {
-		log.Printf("Configuring TLS for secure connection to %s", brokerURL)
-		tlsConfig := &tls.Config{
-			MinVersion: tls.VersionTLS12,
+	var location *time.Location
+	if cfg.Timescale.StoreTimezone != "" {
+		location, err = time.LoadLocation(cfg.Timescale.StoreTimezone)
+		if err != nil {
+			return nil, fmt.Errorf("invalid store timezone: %w", err)
 		}
-		opts.SetTLSConfig(tlsConfig)
 	}
 
-	if cfg.MQTT.Username != "" {
-		opts.SetUsername(cfg.MQTT.Username)
-		opts.SetPassword(cfg.MQTT.Password)
+	schema, err := loadSchema(cfg.MQTT.PayloadSchema)
+	if err != nil {
+		return nil, err
 	}
 
-	opts.SetAutoReconnect(true)
-	opts.SetConnectionLostHandler(func(client mqtt.Client, err error) {
-		log.Printf("Connection lost: %v", err)
-	})
-	opts.SetReconnectingHandler(func(client mqtt.Client, opts *mqtt.ClientOptions) {
-		log.Println("Attempting to reconnect to MQTT broker...")
-	})
+	// Created last, its reaper runs until the client is disconnected
+	var seen *dedup.Cache
+	if cfg.Ingest.DedupWindow > 0 {
+		seen = dedup.New(cfg.Ingest.DedupWindow, cfg.Ingest.DedupMaxEntries)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	c := &Client{
+		conn:         conn,
+		db:           db,
+		config:       cfg,
+		deadLetter:   deadLetter,
+		template:     template,
+		dedup:        seen,
+		location:     location,
+		fieldMap:     newFieldMap(&cfg.MQTT),
+		fieldScale:   newFieldScale(cfg.MQTT.FieldScale),
+		tagNames:     newTagNames(cfg.MQTT.TopicColumns),
+		tagFields:    newTagNames(cfg.Timescale.TagColumns),
+		schema:       schema,
+		pathRoots:    newPathRoots(cfg.MQTT.FieldPaths),
+		errorLimiter: newErrorLimiter(cfg.MQTT.ErrorRate, cfg.MQTT.ErrorBurst, cfg.MQTT.ErrorTopic),
+		workers:      newWorkerPool(cfg.Ingest.Workers, cfg.Ingest.OrderByDevice),
+		stopChan:     make(chan struct{}),
+		ctx:          ctx,
+		cancel:       cancel,
+	}
+	if cfg.Ingest.WarnUnknownFields {
+		c.unknownLog = logging.NewThrottle(cfg.Logging.RepeatInterval)
+	}
+	c.settings.Store(newSettings(cfg, nil))
+
+	conn.SetConnectionHandlers(c.connectionUp, c.connectionDown)
+	c.OnConnect(c.resubscribe)
+	if cfg.MQTT.WillTopic != "" {
+		// The broker publishes the will when the connection drops, so the
+		// online status is published again on every connect
+		c.OnConnect(func() { c.publishStatus(cfg.MQTT.OnlinePayload) })
+	}
+	return c, nil
+}
+
+// OnConnect registers a function called whenever the connection to the
+// broker comes up, including the first time. Hooks run on the connection's
+// goroutine, in the order they were registered, and should return quickly.
+func (c *Client) OnConnect(hook func()) {
+	c.hooksMu.Lock()
+	defer c.hooksMu.Unlock()
+	c.connectHooks = append(c.connectHooks, hook)
+}
 
-	client := mqtt.NewClient(opts)
-	return &Client{
-		client:   client,
-		db:       db,
-		config:   cfg,
-		stopChan: make(chan struct{}),
-	}, nil
+// OnConnectionLost registers a function called with the error whenever the
+// connection to the broker is lost. A clean Disconnect doesn't call it.
+func (c *Client) OnConnectionLost(hook func(error)) {
+	c.hooksMu.Lock()
+	defer c.hooksMu.Unlock()
+	c.connectionLost = append(c.connectionLost, hook)
+}
+
+// connectionUp runs the connect hooks
+func (c *Client) connectionUp() {
+	c.hooksMu.Lock()
+	hooks := append([]func(){}, c.connectHooks...)
+	c.hooksMu.Unlock()
+	for _, hook := range hooks {
+		hook()
+	}
 }
 
-// Connect connects to the MQTT broker
+// connectionDown runs the connection lost hooks
+func (c *Client) connectionDown(err error) {
+	c.hooksMu.Lock()
+	hooks := append([]func(error){}, c.connectionLost...)
+	c.hooksMu.Unlock()
+	for _, hook := range hooks {
+		hook(err)
+	}
+}
+
+// resubscribe issues the recorded subscriptions on every connection, since
+// the broker drops them with a clean session or an expired one and
+// messages would otherwise silently stop arriving
+func (c *Client) resubscribe() {
+	c.mu.Lock()
+	subs := sortedSubscriptions(c.subscribed)
+	c.mu.Unlock()
+
+	for _, sub := range subs {
+		if err := c.conn.Subscribe(sub.Topic, sub.QoS, c.messageHandler(sub.Table)); err != nil {
+			slog.Error("Error resubscribing to topic", "topic", sub.Topic, "error", err)
+			continue
+		}
+		slog.Info("Resubscribed to topic", "topic", sub.Topic, "qos", sub.QoS, "table", sub.Table)
+	}
+}
+
+// newDeadLetter creates the configured dead-letter sinks, discarding
+// rejected messages when none are configured
+func newDeadLetter(cfg *config.DeadLetterConfig, publisher deadletter.Publisher) (deadletter.DeadLetter, error) {
+	var sinks deadletter.Multi
+	if cfg.File != "" {
+		file, err := deadletter.NewFileDeadLetter(cfg.File)
+		if err != nil {
+			return nil, err
+		}
+		sinks = append(sinks, file)
+	}
+	if cfg.Topic != "" {
+		sinks = append(sinks, deadletter.NewMQTTDeadLetter(publisher, cfg.Topic))
+	}
+
+	switch len(sinks) {
+	case 0:
+		return deadletter.Discard{}, nil
+	case 1:
+		return sinks[0], nil
+	default:
+		return sinks, nil
+	}
+}
+
+// Connect connects to the MQTT broker. Connection attempts are retried, so
+// it blocks until one succeeds.
 func (c *Client) Connect() error {
-	token := c.client.Connect()
-	if !token.WaitTimeout(10 * time.Second) {
-		return fmt.Errorf("MQTT connect timeout to %s", c.config.GetMQTTBrokerURL())
+	_, span := tracer.Start(context.Background(), "mqtt.connect")
+	defer span.End()
+
+	if err := c.conn.Connect(); err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return fmt.Errorf("failed to connect to MQTT broker: %w", err)
 	}
-	if token.Error() != nil {
-		return fmt.Errorf("failed to connect to MQTT broker: %w", token.Error())
+	slog.Info("Connected to MQTT broker")
+
+	if c.config.Status.HeartbeatInterval > 0 {
+		go c.heartbeatLoop(c.config.Status.HeartbeatInterval)
 	}
-	log.Printf("Connected to MQTT broker: %s", c.config.GetMQTTBrokerURL())
 	return nil
 }
 
-// Subscribe subscribes to the configured topic
+// Publish publishes a message without waiting for the broker; the result is
+// delivered on the returned channel
+func (c *Client) Publish(topic string, qos byte, retained bool, payload []byte) <-chan error {
+	return c.conn.Publish(topic, qos, retained, payload)
+}
+
+// publishStatus publishes a payload to the will topic with the will's QoS
+// and retain settings
+func (c *Client) publishStatus(payload string) {
+	topic := c.config.MQTT.WillTopic
+	select {
+	case err := <-c.conn.Publish(topic, c.config.MQTT.WillQoS, c.config.MQTT.WillRetained, []byte(payload)):
+		if err != nil {
+			slog.Error("Error publishing status", "topic", topic, "payload", payload, "error", err)
+			return
+		}
+	case <-time.After(5 * time.Second):
+		slog.Warn("Timeout publishing status", "topic", topic, "payload", payload)
+		return
+	}
+	slog.Info("Published status", "topic", topic, "payload", payload)
+}
+
+// Subscribe subscribes to every configured topic, routing each topic's
+// messages to its table. The subscriptions are re-issued on every
+// connection; if the client isn't connected yet they are first issued once
+// it is.
 func (c *Client) Subscribe() error {
-	handler := func(client mqtt.Client, msg mqtt.Message) {
-		log.Printf("Received message on topic %s: %s", msg.Topic(), string(msg.Payload()))
-		c.processMessage(msg.Payload())
+	subs := c.config.GetSubscriptions()
+	for i := range subs {
+		subs[i].Topic = sharedTopic(c.config.MQTT.SharedGroup, subs[i].Topic)
+	}
+
+	// Record the subscriptions before checking the connection so a connect
+	// in between issues them either here or from the connect hook
+	c.mu.Lock()
+	if c.subscribed == nil {
+		c.subscribed = make(map[string]config.SubscriptionConfig, len(subs))
+	}
+	for _, sub := range subs {
+		c.subscribed[sub.Topic] = sub
+	}
+	c.mu.Unlock()
+	if !c.conn.IsConnected() {
+		slog.Info("Not connected yet, subscribing once connected", "subscriptions", len(subs))
+		return nil
 	}
 
-	token := c.client.Subscribe(c.config.MQTT.Topic, 0, handler)
-	if token.Wait() && token.Error() != nil {
-		return fmt.Errorf("failed to subscribe to topic %s: %w", c.config.MQTT.Topic, token.Error())
+	for _, sub := range subs {
+		if err := c.conn.Subscribe(sub.Topic, sub.QoS, c.messageHandler(sub.Table)); err != nil {
+			return fmt.Errorf("failed to subscribe to topic %s: %w", sub.Topic, err)
+		}
+		slog.Info("Subscribed to topic", "topic", sub.Topic, "qos", sub.QoS, "table", sub.Table)
 	}
-	log.Printf("Subscribed to topic: %s", c.config.MQTT.Topic)
 	return nil
 }
 
-// Disconnect disconnects from the MQTT broker
+// sortedSubscriptions returns the subscriptions of a topic set sorted by
+// topic
+func sortedSubscriptions(set map[string]config.SubscriptionConfig) []config.SubscriptionConfig {
+	subs := make([]config.SubscriptionConfig, 0, len(set))
+	for _, sub := range set {
+		subs = append(subs, sub)
+	}
+	sort.Slice(subs, func(i, j int) bool { return subs[i].Topic < subs[j].Topic })
+	return subs
+}
+
+// sharedTopic returns the shared subscription to topic for group, or topic
+// itself when group is empty. Messages still arrive on their own topic.
+func sharedTopic(group, topic string) string {
+	if group == "" {
+		return topic
+	}
+	return "$share/" + group + "/" + topic
+}
+
+// messageHandler returns a handler that stores messages in the given table,
+// on the worker pool when there is one
+func (c *Client) messageHandler(tableName string) func(message) {
+	return func(msg message) {
+		if !c.track() {
+			slog.Warn("Dropping message received during shutdown", "topic", msg.Topic)
+			return
+		}
+		if c.workers == nil {
+			defer c.untrack()
+			c.handleMessage(tableName, msg)
+			return
+		}
+
+		dispatched := c.workers.dispatch(c.deviceKey(msg.Topic), func() {
+			defer c.untrack()
+			c.handleMessage(tableName, msg)
+		})
+		if !dispatched {
+			c.untrack()
+			slog.Warn("Dropping message received during shutdown", "topic", msg.Topic)
+		}
+	}
+}
+
+// handleMessage traces and processes a received message
+func (c *Client) handleMessage(tableName string, msg message) {
+	ctx, span := tracer.Start(c.ctx, "mqtt.message",
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(
+			attribute.String("messaging.destination.name", msg.Topic),
+			attribute.Int("messaging.message.body.size", len(msg.Payload)),
+		),
+	)
+	defer span.End()
+
+	slog.Debug("Received message", "topic", msg.Topic, "retained", msg.Retained, "payload", string(msg.Payload))
+	c.processMessage(ctx, tableName, msg.Topic, msg.Payload, msg.Retained)
+}
+
+// deviceKey returns the key routing a message to its worker: the device id
+// bound by the topic template, or else the topic. The broker only orders
+// messages within a topic, so routing by topic keeps each device's readings
+// in order as long as a device publishes on a single topic.
+func (c *Client) deviceKey(topic string) string {
+	if c.template != nil {
+		if values, ok := c.template.match(topic); ok {
+			if deviceID, ok := values["device_id"]; ok {
+				return deviceID
+			}
+		}
+	}
+	return topic
+}
+
+// track registers an in-flight message, returning false once the client
+// has been stopped
+func (c *Client) track() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.stopped {
+		return false
+	}
+	c.inflight.Add(1)
+	c.pending.Add(1)
+	return true
+}
+
+// untrack marks an in-flight message as finished
+func (c *Client) untrack() {
+	c.pending.Add(-1)
+	c.inflight.Done()
+}
+
+// IsConnected reports whether the connection to the broker is currently up.
+// It returns false while reconnecting.
+func (c *Client) IsConnected() bool {
+	return c.conn.IsConnected()
+}
+
+// Disconnect disconnects from the MQTT broker. A clean disconnect doesn't
+// trigger the will, so the offline status is published explicitly.
 func (c *Client) Disconnect() {
-	c.client.Disconnect(250)
-	log.Println("Disconnected from MQTT broker")
+	if c.config.MQTT.WillTopic != "" && c.conn.IsConnected() {
+		c.publishStatus(c.config.MQTT.WillPayload)
+	}
+	c.conn.Disconnect()
+	slog.Info("Disconnected from MQTT broker")
+
+	if err := c.deadLetter.Close(); err != nil {
+		slog.Error("Error closing dead-letter sink", "error", err)
+	}
+	c.settings.Load().close(nil)
+	if c.errorLimiter != nil {
+		c.errorLimiter.Close()
+	}
+	if c.dedup != nil {
+		c.dedup.Close()
+	}
+	if c.workers != nil {
+		c.workers.close()
+	}
 }
 
-// Stop stops the client
+// Stop stops the client from accepting new messages and signals in-flight
+// work to drain. Unless mqtt.unsubscribe_on_stop is off, it also
+// unsubscribes from every topic so the broker stops sending; otherwise a
+// persistent session keeps its subscriptions so the broker queues messages
+// for the next run. It is safe to call more than once.
 func (c *Client) Stop() {
-	close(c.stopChan)
+	c.stopOnce.Do(func() {
+		c.mu.Lock()
+		subs := sortedSubscriptions(c.subscribed)
+		c.stopped = true
+		c.subscribed = nil
+		c.mu.Unlock()
+		close(c.stopChan)
+
+		if !c.config.MQTT.UnsubscribeOnStop || len(subs) == 0 || !c.conn.IsConnected() {
+			return
+		}
+		topics := make([]string, len(subs))
+		for i, sub := range subs {
+			topics[i] = sub.Topic
+		}
+		if err := c.conn.Unsubscribe(topics...); err != nil {
+			slog.Warn("Error unsubscribing from topics", "topics", topics, "error", err)
+			return
+		}
+		slog.Info("Unsubscribed from topics", "topics", topics)
+	})
 }
 
-// WaitForStop waits for the client to stop
-func (c *Client) WaitForStop() {
+// WaitForStop waits for the client to be stopped and for in-flight messages
+// to finish processing. If they haven't finished within timeout, their
+// processing context is cancelled and the number of dropped messages is
+// returned.
+func (c *Client) WaitForStop(timeout time.Duration) int {
 	<-c.stopChan
+
+	drained := make(chan struct{})
+	go func() {
+		c.inflight.Wait()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+		c.cancel()
+		slog.Info("All in-flight messages processed")
+		return 0
+	case <-time.After(timeout):
+		dropped := int(c.pending.Load())
+		metrics.ShutdownDropped.Add(float64(dropped))
+		c.cancel()
+		slog.Warn("Shutdown timeout elapsed, dropping in-flight messages", "timeout", timeout, "dropped", dropped)
+		return dropped
+	}
 }
 
-// processMessage processes an MQTT message and stores it in the database
-func (c *Client) processMessage(payload []byte) {
-	var rawData map[string]interface{}
-	if err := json.Unmarshal(payload, &rawData); err != nil {
-		log.Printf("Error unmarshaling message: %v", err)
-		return
+// processMessage processes an MQTT message and stores it in the given table.
+// A JSON payload may be a single object or an array of objects, a CSV
+// payload one reading per line and a protobuf payload a single pb.Reading.
+// Readings that can't be parsed are sent to the dead-letter sink, and
+// readings are discarded if ctx is cancelled before they are queued. It
+// returns the errors readings were rejected with.
+func (c *Client) processMessage(ctx context.Context, tableName, topic string, payload []byte, retained bool) error {
+	metrics.MessagesReceived.Inc()
+
+	if limit := c.config.MQTT.MaxPayloadBytes; limit > 0 && len(payload) > limit {
+		err := fmt.Errorf("payload of %d bytes exceeds max_payload_bytes %d", len(payload), limit)
+		metrics.ParseErrors.Inc()
+		slog.Error("Rejecting oversized payload", "topic", topic, "bytes", len(payload), "max_payload_bytes", limit)
+		c.reject(topic, payload, err)
+		return err
+	}
+
+	switch c.config.MQTT.PayloadFormat {
+	case "csv":
+		return c.processCSV(ctx, tableName, topic, payload, retained)
+	case "protobuf":
+		return c.processProtobuf(ctx, tableName, topic, payload, retained)
+	}
+
+	trimmed := bytes.TrimSpace(payload)
+	if len(trimmed) == 0 || trimmed[0] != '[' {
+		return c.processReading(ctx, tableName, topic, payload, retained)
+	}
+
+	var elements []json.RawMessage
+	if err := json.Unmarshal(trimmed, &elements); err != nil {
+		err = fmt.Errorf("invalid JSON: %w", err)
+		metrics.ParseErrors.Inc()
+		slog.Error("Error unmarshaling message", "topic", topic, "error", err)
+		c.reject(topic, payload, err)
+		return err
+	}
+	if len(elements) == 0 {
+		slog.Debug("Ignoring empty array payload", "topic", topic)
+		return nil
+	}
+
+	// A bad element is dead-lettered on its own without dropping the rest
+	var errs []error
+	for _, element := range elements {
+		if err := c.processReading(ctx, tableName, topic, element, retained); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// processReading parses a single JSON reading, or the samples of a burst,
+// and queues them for insert
+func (c *Client) processReading(ctx context.Context, tableName, topic string, payload []byte, retained bool) error {
+	readings, tableHint, err := c.parseReadings(topic, payload)
+	if err != nil {
+		recordError(ctx, err)
+		metrics.ParseErrors.Inc()
+		slog.Error("Error parsing reading", "topic", topic, "error", err)
+		c.reject(topic, payload, err)
+		return err
+	}
+	if len(readings) == 0 {
+		slog.Debug("Ignoring burst without samples", "topic", topic)
+		return nil
+	}
+	var errs []error
+	for _, sensorData := range readings {
+		sensorData.Retained = retained
+		if err := c.handleReading(ctx, tableName, topic, payload, sensorData, tableHint); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// handleReading validates a parsed reading and queues it for insert into
+// tableName, or into tableHint when the payload named a table. It returns
+// the error the reading was rejected with; readings that are deliberately
+// dropped, such as duplicates, are not an error.
+func (c *Client) handleReading(ctx context.Context, tableName, topic string, payload []byte, sensorData *models.SensorData, tableHint string) error {
+	metrics.MessagesParsed.Inc()
+	metrics.Devices.Inc(sensorData.Device_ID)
+	if tableHint != "" {
+		tableName = tableHint
+	}
+
+	settings := c.settings.Load()
+
+	if err := validateSensorData(&settings.validation, sensorData); err != nil {
+		metrics.OutOfRange.Inc()
+		switch settings.validation.Mode {
+		case "null":
+			slog.Debug("Clearing out of range sensor values", "device_id", sensorData.Device_ID, "error", err)
+			clearOutOfRange(&settings.validation, sensorData)
+		case "drop":
+			slog.Debug("Dropping out of range sensor data", "device_id", sensorData.Device_ID, "error", err)
+			return nil
+		default:
+			recordError(ctx, err)
+			slog.Warn("Rejecting out of range sensor data", "device_id", sensorData.Device_ID, "error", err)
+			c.publishError(errorValidation, sensorData.Device_ID, err)
+			c.sendDeadLetter(topic, payload, err)
+			return err
+		}
+	}
+
+	// QoS 1 redeliveries carry the same device and timestamp
+	if c.dedup != nil && c.dedup.Seen(sensorData.Device_ID+"\x00"+sensorData.Timestamp.UTC().Format(time.RFC3339Nano)) {
+		metrics.Duplicates.Inc()
+		slog.Debug("Dropping duplicate sensor data", "device_id", sensorData.Device_ID, "time", sensorData.Timestamp)
+		return nil
+	}
+
+	if settings.limiter != nil && !settings.limiter.Allow(sensorData.Device_ID) {
+		metrics.RateLimited.Inc()
+		slog.Debug("Dropping sensor data over the device rate limit", "device_id", sensorData.Device_ID)
+		return nil
+	}
+
+	if ctx.Err() != nil {
+		slog.Warn("Discarding sensor data", "device_id", sensorData.Device_ID, "error", ctx.Err())
+		return nil
+	}
+
+	if c.config.Ingest.DryRun {
+		metrics.DryRunMessages.Inc()
+		slog.Info("Dry run, would insert sensor data",
+			"table", tableName,
+			"device_id", sensorData.Device_ID,
+			"time", sensorData.Timestamp.Format(time.RFC3339),
+			"temperature", models.Value(sensorData.Temperature),
+			"humidity", models.Value(sensorData.Humidity),
+			"light", models.Value(sensorData.Light),
+			"fields", sensorData.Fields,
+		)
+		return nil
+	}
+
+	// Queue for batched insert into database
+	if err := c.db.EnqueueSensorDataInto(ctx, tableName, sensorData); err != nil {
+		slog.Error("Error inserting sensor data", "device_id", sensorData.Device_ID, "error", err)
+		return err
+	}
+
+	slog.Info("Queued sensor data",
+		"table", tableName,
+		"device_id", sensorData.Device_ID,
+		"time", sensorData.Timestamp.Format(time.RFC3339),
+		"temperature", models.Value(sensorData.Temperature),
+		"humidity", models.Value(sensorData.Humidity),
+		"light", models.Value(sensorData.Light),
+	)
+	return nil
+}
+
+// parseReadings decodes a single JSON object into sensor data, or into one
+// reading per sample when its burst fields hold arrays. It also returns the
+// table named by the payload's table field, or "" if it has none.
+func (c *Client) parseReadings(topic string, payload []byte) ([]*models.SensorData, string, error) {
+	rawData, err := decodeObject(payload)
+	if err != nil {
+		return nil, "", fmt.Errorf("invalid JSON: %w", err)
+	}
+	if c.config.MQTT.HMACSecret != "" {
+		if err := verifySignature(payload, c.config.MQTT.HMACField, []byte(c.config.MQTT.HMACSecret)); err != nil {
+			return nil, "", err
+		}
+		delete(rawData, c.config.MQTT.HMACField)
+	}
+	// The schema is the contract for what devices send, so it is checked
+	// before field names are mapped
+	if c.schema != nil {
+		if err := validateSchema(c.schema, rawData); err != nil {
+			return nil, "", err
+		}
+	}
+
+	c.mapFields(rawData)
+	samples, interval, err := c.expandBurst(rawData)
+	if err != nil {
+		return nil, "", err
+	}
+	if samples == nil {
+		sensorData, tableHint, err := c.decodeFields(topic, rawData)
+		if err != nil {
+			return nil, "", err
+		}
+		return []*models.SensorData{sensorData}, tableHint, nil
+	}
+
+	readings := make([]*models.SensorData, 0, len(samples))
+	var tableHint string
+	for i, fields := range samples {
+		sensorData, hint, err := c.decodeFields(topic, fields)
+		if err != nil {
+			return nil, "", fmt.Errorf("sample %d: %w", i, err)
+		}
+		sensorData.Timestamp = sensorData.Timestamp.Add(time.Duration(i) * interval)
+		readings = append(readings, sensorData)
+		tableHint = hint
+	}
+	return readings, tableHint, nil
+}
+
+// decodeReading converts the decoded fields of a reading into sensor data,
+// returning the table named by its table field, or "" if it has none
+func (c *Client) decodeReading(topic string, rawData map[string]interface{}) (*models.SensorData, string, error) {
+	c.mapFields(rawData)
+	return c.decodeFields(topic, rawData)
+}
+
+// mapFields moves the values of nested paths and mapped keys into the
+// fields they hold
+func (c *Client) mapFields(rawData map[string]interface{}) {
+	c.applyFieldPaths(rawData)
+	c.applyFieldMap(rawData)
+}
+
+// decodeFields converts fields whose names are already mapped into sensor
+// data, returning the table named by its table field, or "" if it has none
+func (c *Client) decodeFields(topic string, rawData map[string]interface{}) (*models.SensorData, string, error) {
+	// Fill in fields bound by the topic template; values in the payload win.
+	// Segments bound to topic columns are kept apart as tags.
+	var tags map[string]string
+	if c.template != nil {
+		if values, ok := c.template.match(topic); ok {
+			for key, val := range values {
+				if c.tagNames[key] {
+					if tags == nil {
+						tags = make(map[string]string)
+					}
+					tags[key] = val
+					continue
+				}
+				if _, exists := rawData[key]; !exists {
+					rawData[key] = val
+				}
+			}
+		}
+	}
+
+	// String payload fields named by the tag columns are stored as tags
+	for key := range c.tagFields {
+		if val, ok := rawData[key].(string); ok {
+			if tags == nil {
+				tags = make(map[string]string)
+			}
+			tags[key] = val
+		}
 	}
 
 	// Parse timestamp
 	var timestamp time.Time
-	if tsStr, ok := rawData["timestamp"].(string); ok {
+	if rawTS, ok := rawData["timestamp"]; ok {
 		var err error
-		timestamp, err = time.Parse(time.RFC3339, tsStr)
+		timestamp, err = parseTimestamp(rawTS, c.config.MQTT.TimestampLayouts)
 		if err != nil {
-			log.Printf("Error parsing timestamp: %v", err)
+			slog.Warn("Error parsing timestamp, using current time", "error", err)
 			timestamp = time.Now() // Fallback to current time
 		}
 	} else {
+		slog.Debug("No timestamp in payload, using current time", "field", c.config.MQTT.TimestampField)
 		timestamp = time.Now() // Fallback to current time
 	}
+	if c.location != nil {
+		timestamp = timestamp.In(c.location)
+	}
 
-	// Extract sensor values
-	temperature, _ := getFloat64Value(rawData, "temperature")
-	humidity, _ := getFloat64Value(rawData, "humidity")
-	light, _ := getFloat64Value(rawData, "light")
-	device_id, ok := rawData["device_id"].(string)
-	if !ok {
-		log.Println("Error: device_id is missing or not a string")
-		return
+	// Extract sensor values, leaving absent and null ones nil
+	boolAsNumber := c.config.MQTT.BoolAsNumber
+	temperature, err := getOptionalFloat64(rawData, "temperature", boolAsNumber)
+	if err != nil {
+		return nil, "", err
+	}
+	humidity, err := getOptionalFloat64(rawData, "humidity", boolAsNumber)
+	if err != nil {
+		return nil, "", err
+	}
+	light, err := getOptionalFloat64(rawData, "light", boolAsNumber)
+	if err != nil {
+		return nil, "", err
+	}
+	// Integer ids are kept as sent, however many digits they have
+	var device_id string
+	switch v := rawData["device_id"].(type) {
+	case string:
+		device_id = v
+	case json.Number:
+		if !isInteger(v) {
+			return nil, "", fmt.Errorf("%s %s is not an integer", c.config.MQTT.DeviceIDField, v)
+		}
+		device_id = v.String()
+	default:
+		return nil, "", fmt.Errorf("%s is missing or not a string", c.config.MQTT.DeviceIDField)
+	}
+
+	// Tenants may direct a reading to one of the allowed tables
+	var tableHint string
+	if rawTable, ok := rawData["table"]; ok {
+		tableHint, ok = rawTable.(string)
+		if !ok {
+			return nil, "", errors.New("table is not a string")
+		}
+		if !c.config.IsAllowedTable(tableHint) {
+			return nil, "", fmt.Errorf("table %q is not allowed", tableHint)
+		}
+	}
+
+	// Route any other numeric keys into the dynamic fields
+	var fields map[string]float64
+	var unknown []string
+	for key, val := range rawData {
+		if knownFields[key] || c.tagFields[key] {
+			continue
+		}
+		if f, ok := numberValue(val); ok {
+			if fields == nil {
+				fields = make(map[string]float64)
+			}
+			fields[key] = f
+		} else if c.unknownLog != nil && !c.pathRoots[key] {
+			unknown = append(unknown, key)
+		}
+	}
+	if len(unknown) > 0 {
+		c.reportUnknownFields(device_id, unknown)
 	}
 
-	// Create sensor data
 	sensorData := &models.SensorData{
 		Timestamp:   timestamp,
 		Temperature: temperature,
 		Humidity:    humidity,
 		Light:       light,
 		Device_ID:   device_id,
+		Fields:      fields,
+		Tags:        tags,
 	}
+	c.applyFieldScale(sensorData)
+	return sensorData, tableHint, nil
+}
 
-	if light == 0 {
-		log.Println("Ignoring sensor data with light = 0")
-		return
+// newTagNames returns the set of topic or tag columns
+func newTagNames(columns []string) map[string]bool {
+	if len(columns) == 0 {
+		return nil
+	}
+	names := make(map[string]bool, len(columns))
+	for _, column := range columns {
+		names[column] = true
+	}
+	return names
+}
+
+// newFieldMap merges the field map with the configured timestamp and device
+// id keys, lowercasing payload keys so they match case-insensitively
+func newFieldMap(cfg *config.MQTTConfig) map[string]string {
+	fieldMap := make(map[string]string, len(cfg.FieldMap)+2)
+	for key, field := range cfg.FieldMap {
+		fieldMap[strings.ToLower(key)] = field
+	}
+	if cfg.TimestampField != "timestamp" {
+		fieldMap[strings.ToLower(cfg.TimestampField)] = "timestamp"
+	}
+	if cfg.DeviceIDField != "device_id" {
+		fieldMap[strings.ToLower(cfg.DeviceIDField)] = "device_id"
 	}
+	return fieldMap
+}
 
-	// Insert into database
-	if err := c.db.InsertSensorData(sensorData); err != nil {
-		log.Printf("Error inserting sensor data for device_id=%s: %v", device_id, err)
+// applyFieldMap renames payload keys to the known fields they are mapped
+// to. A key already holding the field wins over a mapped one, and the
+// configured timestamp and device id keys win over field map keys; other
+// keys mapped to the same field are applied in sorted order.
+func (c *Client) applyFieldMap(rawData map[string]interface{}) {
+	if len(c.fieldMap) == 0 {
 		return
 	}
+	var renames []string
+	for key := range rawData {
+		if field, ok := c.fieldMap[strings.ToLower(key)]; ok && field != key {
+			renames = append(renames, key)
+		}
+	}
+	configured := func(key string) bool {
+		return strings.EqualFold(key, c.config.MQTT.TimestampField) || strings.EqualFold(key, c.config.MQTT.DeviceIDField)
+	}
+	sort.Slice(renames, func(i, j int) bool {
+		if configured(renames[i]) != configured(renames[j]) {
+			return configured(renames[i])
+		}
+		return renames[i] < renames[j]
+	})
+	for _, key := range renames {
+		field := c.fieldMap[strings.ToLower(key)]
+		val := rawData[key]
+		delete(rawData, key)
+		if _, exists := rawData[field]; !exists {
+			rawData[field] = val
+		}
+	}
+}
 
-	log.Printf("Stored sensor data: device_id=%s time=%s temp=%.2f humidity=%.2f light=%.2f",
-		device_id, timestamp.Format(time.RFC3339), temperature, humidity, light)
+// reject reports a message that couldn't be parsed and sends it to the
+// dead-letter sink
+func (c *Client) reject(topic string, payload []byte, reason error) {
+	c.publishError(errorParse, "", reason)
+	c.sendDeadLetter(topic, payload, reason)
 }
 
-// getFloat64Value safely extracts a float64 value from the map
-func getFloat64Value(data map[string]interface{}, key string) (float64, bool) {
-	if val, ok := data[key]; ok {
-		switch v := val.(type) {
-		case float64:
-			return v, true
-		case string:
-			if f, err := parseFloat(v); err == nil {
-				return f, true
+// sendDeadLetter sends a message that couldn't be processed to the
+// dead-letter sink
+func (c *Client) sendDeadLetter(topic string, payload []byte, reason error) {
+	if err := c.deadLetter.Send(deadletter.NewMessage(topic, payload, reason)); err != nil {
+		slog.Error("Error sending message to dead-letter sink", "topic", topic, "error", err)
+	}
+}
+
+// parseTimestamp converts a payload timestamp into a time.Time. Strings are
+// parsed with the first of layouts that matches, numbers are treated as a
+// Unix epoch whose unit (seconds, milliseconds, microseconds or nanoseconds)
+// is inferred from the magnitude. Integers are converted exactly, so
+// nanosecond epochs keep every digit.
+func parseTimestamp(raw interface{}, layouts []string) (time.Time, error) {
+	switch v := raw.(type) {
+	case string:
+		for _, layout := range layouts {
+			if ts, err := time.Parse(layout, v); err == nil {
+				return ts, nil
+			}
+		}
+		return time.Time{}, fmt.Errorf("timestamp %q matches none of the configured layouts", v)
+	case time.Time: // already decoded, e.g. from protobuf
+		return v, nil
+	case json.Number:
+		if isInteger(v) {
+			n, err := v.Int64()
+			if err != nil {
+				return time.Time{}, fmt.Errorf("invalid epoch timestamp %s", v)
 			}
-		case int:
-			return float64(v), true
-		case int64:
-			return float64(v), true
+			return parseEpochInt(n)
+		}
+		f, err := v.Float64()
+		if err != nil {
+			return time.Time{}, fmt.Errorf("invalid epoch timestamp %s", v)
+		}
+		return parseEpoch(f)
+	case float64:
+		return parseEpoch(v)
+	case int:
+		return parseEpochInt(int64(v))
+	case int64:
+		return parseEpochInt(v)
+	default:
+		return time.Time{}, fmt.Errorf("unsupported timestamp type %T", raw)
+	}
+}
+
+// parseEpoch converts a Unix epoch number into a time.Time, inferring the unit
+func parseEpoch(v float64) (time.Time, error) {
+	if v < 0 || math.IsNaN(v) || math.IsInf(v, 0) {
+		return time.Time{}, fmt.Errorf("invalid epoch timestamp %v", v)
+	}
+
+	switch {
+	case v < 1e11: // seconds, valid until the year 5138
+		sec, frac := math.Modf(v)
+		return time.Unix(int64(sec), int64(frac*1e9)), nil
+	case v < 1e14: // milliseconds
+		return time.UnixMilli(int64(v)), nil
+	case v < 1e17: // microseconds
+		return time.UnixMicro(int64(v)), nil
+	default: // nanoseconds
+		return time.Unix(0, int64(v)), nil
+	}
+}
+
+// parseEpochInt converts an integer Unix epoch into a time.Time, inferring
+// the unit like parseEpoch
+func parseEpochInt(v int64) (time.Time, error) {
+	switch {
+	case v < 0:
+		return time.Time{}, fmt.Errorf("invalid epoch timestamp %d", v)
+	case v < 1e11: // seconds
+		return time.Unix(v, 0), nil
+	case v < 1e14: // milliseconds
+		return time.UnixMilli(v), nil
+	case v < 1e17: // microseconds
+		return time.UnixMicro(v), nil
+	default: // nanoseconds
+		return time.Unix(0, v), nil
+	}
+}
+
+// getFloat64Value extracts a sensor value from the map. Absent and null
+// values report false. Numbers and numeric strings are converted, booleans
+// become 1 or 0 when boolAsNumber is set, and any other value is an error so
+// the reading is dead-lettered rather than stored with a wrong value.
+func getFloat64Value(data map[string]interface{}, key string, boolAsNumber bool) (float64, bool, error) {
+	val, ok := data[key]
+	if !ok || val == nil {
+		return 0, false, nil
+	}
+
+	switch v := val.(type) {
+	case float64:
+		return v, true, nil
+	case json.Number:
+		f, ok := numberValue(v)
+		if !ok {
+			return 0, false, fmt.Errorf("%s: %s is out of range", key, v)
+		}
+		return f, true, nil
+	case int:
+		return float64(v), true, nil
+	case int64:
+		return float64(v), true, nil
+	case string:
+		f, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+		if err != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+			return 0, false, fmt.Errorf("%s: %q is not a number", key, v)
+		}
+		return f, true, nil
+	case bool:
+		if !boolAsNumber {
+			return 0, false, fmt.Errorf("%s: boolean %v is not a number", key, v)
 		}
+		if v {
+			return 1, true, nil
+		}
+		return 0, true, nil
+	default:
+		return 0, false, fmt.Errorf("%s: unsupported value type %T", key, val)
 	}
-	return 0, false
 }
 
-// parseFloat attempts to parse a string as a float64
-func parseFloat(s string) (float64, error) {
-	var f float64
-	_, err := fmt.Sscanf(s, "%f", &f)
-	return f, err
+// getOptionalFloat64 extracts a float64 value from the map, returning nil
+// when it is absent or null
+func getOptionalFloat64(data map[string]interface{}, key string, boolAsNumber bool) (*float64, error) {
+	v, ok, err := getFloat64Value(data, key, boolAsNumber)
+	if !ok {
+		return nil, err
+	}
+	return &v, nil
 }
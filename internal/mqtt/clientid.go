@@ -0,0 +1,32 @@
+package mqtt
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+
+	"github.com/ponytojas/go-mqtt-timescale/config"
+)
+
+// clientID returns the client id to connect with: the configured one,
+// followed by the hostname and a random suffix when they are enabled, so
+// replicas sharing a config don't take over each other's connection
+func clientID(cfg *config.MQTTConfig) (string, error) {
+	id := cfg.ClientID
+	if cfg.ClientIDAppendHostname {
+		host, err := os.Hostname()
+		if err != nil {
+			return "", fmt.Errorf("failed to read hostname for client id: %w", err)
+		}
+		id += "-" + host
+	}
+	if cfg.ClientIDAppendRandom {
+		suffix := make([]byte, 4)
+		if _, err := rand.Read(suffix); err != nil {
+			return "", fmt.Errorf("failed to generate client id suffix: %w", err)
+		}
+		id += "-" + hex.EncodeToString(suffix)
+	}
+	return id, nil
+}
@@ -0,0 +1,73 @@
+package mqtt
+
+import (
+	"os"
+	"regexp"
+	"testing"
+)
+
+func TestClientID(t *testing.T) {
+	host, err := os.Hostname()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name     string
+		hostname bool
+		random   bool
+		want     *regexp.Regexp
+		unique   bool // differs between calls
+	}{
+		{"as configured", false, false, regexp.MustCompile(`^ingest$`), false},
+		{"hostname", true, false, regexp.MustCompile(`^ingest-` + regexp.QuoteMeta(host) + `$`), false},
+		{"random", false, true, regexp.MustCompile(`^ingest-[0-9a-f]{8}$`), true},
+		{"hostname and random", true, true, regexp.MustCompile(`^ingest-` + regexp.QuoteMeta(host) + `-[0-9a-f]{8}$`), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig()
+			cfg.MQTT.ClientID = "ingest"
+			cfg.MQTT.ClientIDAppendHostname = tt.hostname
+			cfg.MQTT.ClientIDAppendRandom = tt.random
+
+			seen := make(map[string]bool)
+			for i := 0; i < 10; i++ {
+				id, err := clientID(&cfg.MQTT)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !tt.want.MatchString(id) {
+					t.Fatalf("client id = %q, want to match %s", id, tt.want)
+				}
+				seen[id] = true
+			}
+			if tt.unique && len(seen) != 10 {
+				t.Errorf("10 calls returned %d distinct ids, want a new one each call", len(seen))
+			}
+			if !tt.unique && len(seen) != 1 {
+				t.Errorf("10 calls returned %d distinct ids, want the same each call", len(seen))
+			}
+		})
+	}
+}
+
+func TestTransportsConnectWithTheGivenClientID(t *testing.T) {
+	cfg := testConfig()
+	v3, err := newV3Transport(cfg, "ingest-host-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := v3.client.OptionsReader()
+	if id := opts.ClientID(); id != "ingest-host-1" {
+		t.Errorf("v3 client id = %q, want ingest-host-1", id)
+	}
+
+	cfg.MQTT.ProtocolVersion = 5
+	v5, err := newV5Transport(cfg, "ingest-host-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id := v5.clientCfg.ClientConfig.ClientID; id != "ingest-host-1" {
+		t.Errorf("v5 client id = %q, want ingest-host-1", id)
+	}
+}
@@ -0,0 +1,102 @@
+package mqtt
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"strconv"
+	"strings"
+
+	"github.com/ponytojas/go-mqtt-timescale/internal/metrics"
+	"github.com/ponytojas/go-mqtt-timescale/internal/models"
+)
+
+// processCSV stores every line of a CSV payload as a reading. A malformed
+// line is dead-lettered on its own without dropping the rest. It returns the
+// errors the rejected lines were dead-lettered with.
+func (c *Client) processCSV(ctx context.Context, tableName, topic string, payload []byte, retained bool) error {
+	var errs []error
+	columns := c.config.MQTT.CSVColumns
+
+	reader := csv.NewReader(bytes.NewReader(payload))
+	reader.FieldsPerRecord = len(columns)
+	reader.TrimLeadingSpace = true
+
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return errors.Join(errs...)
+		}
+		if err != nil {
+			metrics.ParseErrors.Inc()
+			slog.Error("Error parsing CSV line", "topic", topic, "error", err)
+
+			// A wrong field count still yields the record, so reading can
+			// continue with the next line; any other error is not recoverable
+			err = fmt.Errorf("invalid CSV: %w", err)
+			if errors.Is(err, csv.ErrFieldCount) {
+				c.reject(topic, []byte(strings.Join(record, ",")), err)
+				errs = append(errs, err)
+				continue
+			}
+			c.reject(topic, payload, err)
+			return errors.Join(append(errs, err)...)
+		}
+
+		line := []byte(strings.Join(record, ","))
+		sensorData, tableHint, err := c.parseCSVRecord(topic, columns, record)
+		if err != nil {
+			metrics.ParseErrors.Inc()
+			slog.Error("Error parsing reading", "topic", topic, "error", err)
+			c.reject(topic, line, err)
+			errs = append(errs, err)
+			continue
+		}
+		sensorData.Retained = retained
+		if err := c.handleReading(ctx, tableName, topic, line, sensorData, tableHint); err != nil {
+			errs = append(errs, err)
+		}
+	}
+}
+
+// parseCSVRecord converts a CSV record whose fields are named by columns into
+// sensor data. Empty fields are treated as absent, and columns named "" are
+// ignored. Fields of tag columns are kept as strings.
+func (c *Client) parseCSVRecord(topic string, columns, record []string) (*models.SensorData, string, error) {
+	rawData := make(map[string]interface{}, len(columns))
+	for i, column := range columns {
+		value := strings.TrimSpace(record[i])
+		if column == "" || value == "" {
+			continue
+		}
+
+		// Tag columns hold text, like the device id
+		if c.tagFields[column] {
+			rawData[column] = value
+			continue
+		}
+
+		switch column {
+		case "device_id", "table":
+			rawData[column] = value
+		case "timestamp":
+			// Either an epoch number or an RFC3339 string
+			if f, err := strconv.ParseFloat(value, 64); err == nil {
+				rawData[column] = f
+			} else {
+				rawData[column] = value
+			}
+		default:
+			f, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				return nil, "", fmt.Errorf("column %s: %q is not a number", column, value)
+			}
+			rawData[column] = f
+		}
+	}
+	return c.decodeReading(topic, rawData)
+}
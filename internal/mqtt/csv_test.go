@@ -0,0 +1,103 @@
+package mqtt
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCSVPayloads(t *testing.T) {
+	ts := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name        string
+		payload     string
+		wantDevices []string
+		wantErr     string // substring of the error, "" when every line is stored
+		deadLetters int
+	}{
+		{
+			name:        "well-formed line",
+			payload:     "d1,21.5,40,300,2024-05-01T12:00:00Z",
+			wantDevices: []string{"d1"},
+		},
+		{
+			name:        "quoted fields and a trailing newline",
+			payload:     "\"d1\",\"21.5\",40,300,2024-05-01T12:00:00Z\r\n",
+			wantDevices: []string{"d1"},
+		},
+		{
+			name:        "epoch timestamp",
+			payload:     "d1,21.5,40,300,1714564800",
+			wantDevices: []string{"d1"},
+		},
+		{
+			name:        "several lines",
+			payload:     "d1,21.5,40,300,2024-05-01T12:00:00Z\nd2,21.5,40,300,2024-05-01T12:00:00Z\n",
+			wantDevices: []string{"d1", "d2"},
+		},
+		{
+			name:        "wrong field count",
+			payload:     "d1,21.5,40\nd2,21.5,40,300,2024-05-01T12:00:00Z",
+			wantDevices: []string{"d2"},
+			wantErr:     "wrong number of fields",
+			deadLetters: 1,
+		},
+		{
+			name:        "non-numeric value",
+			payload:     "d1,warm,40,300,2024-05-01T12:00:00Z\nd2,21.5,40,300,2024-05-01T12:00:00Z",
+			wantDevices: []string{"d2"},
+			wantErr:     `column temperature: "warm" is not a number`,
+			deadLetters: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig()
+			cfg.MQTT.PayloadFormat = "csv"
+			cfg.DeadLetter.Topic = "dead"
+			c, store, conn := newTestClient(t, cfg)
+
+			err := c.processMessage(context.Background(), "sensor_data", "sensor/x", []byte(tt.payload), false)
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Fatalf("unexpected error: %v", err)
+			case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+				t.Fatalf("error = %v, want one containing %q", err, tt.wantErr)
+			}
+
+			rows := store.rows("sensor_data")
+			var devices []string
+			for _, row := range rows {
+				devices = append(devices, row.Device_ID)
+				if !row.Timestamp.Equal(ts) || !equalValue(row.Temperature, ptr(21.5)) || !equalValue(row.Humidity, ptr(40)) || !equalValue(row.Light, ptr(300)) {
+					t.Errorf("stored %+v", row)
+				}
+			}
+			if !slices.Equal(devices, tt.wantDevices) {
+				t.Errorf("stored devices %v, want %v", devices, tt.wantDevices)
+			}
+			if got := len(conn.publishedTo("dead")); got != tt.deadLetters {
+				t.Errorf("dead-lettered %d lines, want %d", got, tt.deadLetters)
+			}
+		})
+	}
+}
+
+func TestCSVEmptyFieldsAreAbsent(t *testing.T) {
+	cfg := testConfig()
+	cfg.MQTT.PayloadFormat = "csv"
+	cfg.MQTT.CSVColumns = []string{"device_id", "", "temperature", "humidity"}
+
+	rows, err := ingest(t, cfg, "sensor/x", "d1,ignored,21.5,")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 1 {
+		t.Fatalf("stored %d readings, want 1", len(rows))
+	}
+	if !equalValue(rows[0].Temperature, ptr(21.5)) || rows[0].Humidity != nil {
+		t.Errorf("temperature %v and humidity %v, want 21.5 and nil", rows[0].Temperature, rows[0].Humidity)
+	}
+}
@@ -0,0 +1,260 @@
+package mqtt
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	mochi "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/hooks/auth"
+	"github.com/mochi-mqtt/server/v2/listeners"
+
+	"github.com/ponytojas/go-mqtt-timescale/config"
+)
+
+// broker is an embedded MQTT broker
+type broker struct {
+	*mochi.Server
+	address string // the address it listens on
+	stop    func() // closes it; safe to call more than once
+}
+
+// startBroker starts an embedded broker accepting any client on address,
+// stopped once the test ends. Port 0 picks a free port.
+func startBroker(t *testing.T, address string) *broker {
+	t.Helper()
+	server := mochi.New(&mochi.Options{
+		InlineClient: true,
+		Logger:       slog.New(slog.NewTextHandler(io.Discard, nil)),
+	})
+	if err := server.AddHook(new(auth.AllowHook), nil); err != nil {
+		t.Fatal(err)
+	}
+	tcp := listeners.NewTCP(listeners.Config{ID: "tcp", Address: address})
+	if err := server.AddListener(tcp); err != nil {
+		t.Fatalf("failed to listen on %s: %v", address, err)
+	}
+	go server.Serve()
+	b := &broker{Server: server, address: tcp.Address(), stop: sync.OnceFunc(func() { server.Close() })}
+	t.Cleanup(b.stop)
+	return b
+}
+
+// brokerConfig returns a configuration connecting to the broker at address,
+// retrying quickly after the connection drops
+func brokerConfig(address string, protocolVersion int) *config.Config {
+	cfg := testConfig()
+	cfg.MQTT.Brokers = []string{"tcp://" + address}
+	cfg.MQTT.ProtocolVersion = protocolVersion
+	cfg.MQTT.ClientID = fmt.Sprintf("e2e-v%d", protocolVersion)
+	cfg.MQTT.ReconnectInitialInterval = 50 * time.Millisecond
+	cfg.MQTT.ReconnectMaxInterval = 200 * time.Millisecond
+	cfg.MQTT.ConnectTimeout = 5 * time.Second
+	return cfg
+}
+
+// connectClient connects a client to the broker through the real transport
+// and subscribes it, disconnecting once the test ends
+func connectClient(t *testing.T, cfg *config.Config) (*Client, *memStore) {
+	t.Helper()
+	store := newMemStore()
+	c, err := NewClient(cfg, store)
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+	t.Cleanup(c.Disconnect)
+	if err := c.Connect(); err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+	if err := c.Subscribe(); err != nil {
+		t.Fatalf("Subscribe: %v", err)
+	}
+	return c, store
+}
+
+// eventually retries cond every few milliseconds until it holds, failing
+// the test if it doesn't within timeout
+func eventually(t *testing.T, timeout time.Duration, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out after %s waiting for %s", timeout, what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// publishUntilStored publishes payload to topic until the store holds want
+// readings. The subscription is issued asynchronously, so a message
+// published just after connecting may reach the broker before it.
+func publishUntilStored(t *testing.T, b *broker, store *memStore, topic, payload string, want int) {
+	t.Helper()
+	table := config.GetDefaultConfig().Timescale.TableName
+	eventually(t, 5*time.Second, "the reading to be stored", func() bool {
+		if len(store.rows(table)) >= want {
+			return true
+		}
+		if err := b.Publish(topic, []byte(payload), false, 0); err != nil {
+			t.Fatalf("Publish: %v", err)
+		}
+		time.Sleep(50 * time.Millisecond)
+		return len(store.rows(table)) >= want
+	})
+}
+
+func TestEndToEndReadingIsStored(t *testing.T) {
+	for _, version := range []int{3, 5} {
+		t.Run(fmt.Sprintf("v%d", version), func(t *testing.T) {
+			b := startBroker(t, "127.0.0.1:0")
+			_, store := connectClient(t, brokerConfig(b.address, version))
+
+			publishUntilStored(t, b, store, "sensor/d1",
+				`{"device_id":"d1","temperature":21.5,"humidity":40,"timestamp":"2024-05-01T12:00:00Z"}`, 1)
+
+			got := store.rows(config.GetDefaultConfig().Timescale.TableName)[0]
+			if got.Device_ID != "d1" || got.Temperature == nil || *got.Temperature != 21.5 || got.Humidity == nil || *got.Humidity != 40 {
+				t.Errorf("stored %+v", got)
+			}
+			if want := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC); !got.Timestamp.Equal(want) {
+				t.Errorf("timestamp = %s, want %s", got.Timestamp, want)
+			}
+		})
+	}
+}
+
+func TestEndToEndRetainedMessagesAreMarked(t *testing.T) {
+	for _, version := range []int{3, 5} {
+		t.Run(fmt.Sprintf("v%d", version), func(t *testing.T) {
+			b := startBroker(t, "127.0.0.1:0")
+			// Sent before the service subscribes, so only the retained
+			// store delivers it
+			if err := b.Publish("sensor/d1", []byte(`{"device_id":"d1","temperature":20}`), true, 0); err != nil {
+				t.Fatal(err)
+			}
+			_, store := connectClient(t, brokerConfig(b.address, version))
+			table := config.GetDefaultConfig().Timescale.TableName
+			// v3 subscribes from its connect handler too, so the retained
+			// message may be delivered twice
+			eventually(t, 5*time.Second, "the retained reading", func() bool { return len(store.rows(table)) >= 1 })
+
+			publishUntilStored(t, b, store, "sensor/d2", `{"device_id":"d2","temperature":21}`, len(store.rows(table))+1)
+			for _, row := range store.rows(table) {
+				if want := row.Device_ID == "d1"; row.Retained != want {
+					t.Errorf("%s: retained = %v, want %v", row.Device_ID, row.Retained, want)
+				}
+			}
+		})
+	}
+}
+
+func TestEndToEndResubscribesAfterBrokerRestart(t *testing.T) {
+	b := startBroker(t, "127.0.0.1:0")
+	c, store := connectClient(t, brokerConfig(b.address, 3))
+	publishUntilStored(t, b, store, "sensor/d1", `{"device_id":"d1","temperature":20}`, 1)
+
+	// A new broker on the same address knows nothing of the old session, so
+	// readings only arrive again if the client resubscribes on reconnect
+	b.stop()
+	eventually(t, 5*time.Second, "the connection to drop", func() bool { return !c.IsConnected() })
+	b = startBroker(t, b.address)
+	eventually(t, 5*time.Second, "the client to reconnect", c.IsConnected)
+
+	table := config.GetDefaultConfig().Timescale.TableName
+	publishUntilStored(t, b, store, "sensor/d1", `{"device_id":"d1","temperature":21}`, len(store.rows(table))+1)
+	rows := store.rows(table)
+	if last := rows[len(rows)-1]; last.Temperature == nil || *last.Temperature != 21 {
+		t.Errorf("last reading after the restart = %+v, want temperature 21", last)
+	}
+}
+
+func TestEndToEndSharedSubscription(t *testing.T) {
+	for _, version := range []int{3, 5} {
+		t.Run(fmt.Sprintf("v%d", version), func(t *testing.T) {
+			b := startBroker(t, "127.0.0.1:0")
+			cfg := brokerConfig(b.address, version)
+			cfg.MQTT.SharedGroup = "ingest"
+			_, store := connectClient(t, cfg)
+
+			publishUntilStored(t, b, store, "sensor/d1", `{"device_id":"d1","temperature":21.5}`, 1)
+			if got := store.rows(cfg.Timescale.TableName)[0]; got.Device_ID != "d1" {
+				t.Errorf("stored %+v, want d1's reading", got)
+			}
+			subs := b.Topics.Subscribers("sensor/d1")
+			if len(subs.Shared) != 1 || len(subs.Subscriptions) != 0 {
+				t.Errorf("broker has %d shared and %d plain subscriptions, want one shared", len(subs.Shared), len(subs.Subscriptions))
+			}
+		})
+	}
+}
+
+// startWebsocketBroker starts an embedded broker behind a websocket proxy
+// that only serves path, returning the proxy's host:port. Requests for
+// other paths are refused, so a client only connects if it keeps the path.
+func startWebsocketBroker(t *testing.T, path string) (*broker, string) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := l.Addr().String()
+	l.Close()
+
+	server := mochi.New(&mochi.Options{
+		InlineClient: true,
+		Logger:       slog.New(slog.NewTextHandler(io.Discard, nil)),
+	})
+	if err := server.AddHook(new(auth.AllowHook), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.AddListener(listeners.NewWebsocket(listeners.Config{ID: "ws", Address: address})); err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve()
+	b := &broker{Server: server, address: address, stop: sync.OnceFunc(func() { server.Close() })}
+	t.Cleanup(b.stop)
+
+	proxy := httputil.NewSingleHostReverseProxy(&url.URL{Scheme: "http", Host: address})
+	front := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != path {
+			http.NotFound(w, r)
+			return
+		}
+		proxy.ServeHTTP(w, r)
+	}))
+	t.Cleanup(front.Close)
+	return b, strings.TrimPrefix(front.URL, "http://")
+}
+
+func TestEndToEndOverWebsockets(t *testing.T) {
+	tests := []struct {
+		name   string
+		broker string // formatted with the proxy's host:port
+		wsPath string
+	}{
+		{"path in the URL", "ws://%s/mqtt", ""},
+		{"ws_path", "ws://%s", "mqtt"},
+	}
+	for _, tt := range tests {
+		for _, version := range []int{3, 5} {
+			t.Run(fmt.Sprintf("%s v%d", tt.name, version), func(t *testing.T) {
+				b, address := startWebsocketBroker(t, "/mqtt")
+				cfg := brokerConfig(address, version)
+				cfg.MQTT.Brokers = []string{fmt.Sprintf(tt.broker, address)}
+				cfg.MQTT.WSPath = tt.wsPath
+				_, store := connectClient(t, cfg)
+
+				publishUntilStored(t, b, store, "sensor/d1", `{"device_id":"d1","temperature":21.5}`, 1)
+			})
+		}
+	}
+}
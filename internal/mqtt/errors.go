@@ -0,0 +1,70 @@
+package mqtt
+
+import (
+	"log/slog"
+	"time"
+
+	"github.com/ponytojas/go-mqtt-timescale/internal/metrics"
+	"github.com/ponytojas/go-mqtt-timescale/internal/models"
+	"github.com/ponytojas/go-mqtt-timescale/internal/ratelimit"
+)
+
+// Kinds of error events
+const (
+	errorParse      = "parse"
+	errorValidation = "validation"
+	errorInsert     = "insert"
+)
+
+// errorEvent is published to the error topic for every operational error
+type errorEvent struct {
+	Time     time.Time `json:"time"`
+	Kind     string    `json:"kind"`
+	Message  string    `json:"message"`
+	DeviceID string    `json:"device_id,omitempty"`
+}
+
+// newErrorLimiter creates the limiter for error events, keyed by kind, or
+// returns nil when no error topic is configured
+func newErrorLimiter(rate float64, burst int, topic string) *ratelimit.RateLimiter {
+	if topic == "" {
+		return nil
+	}
+	// Kinds are few and fixed, so their buckets never need evicting
+	return ratelimit.New(rate, burst, 24*time.Hour)
+}
+
+// publishError publishes an error event when an error topic is configured.
+// Events over the rate limit of their kind are counted and dropped, so an
+// outage doesn't flood the broker.
+func (c *Client) publishError(kind, deviceID string, err error) {
+	if c.errorLimiter == nil {
+		return
+	}
+	if !c.errorLimiter.Allow(kind) {
+		metrics.ErrorEventsDropped.Inc()
+		slog.Debug("Dropping error event over the rate limit", "kind", kind)
+		return
+	}
+	c.publishJSON(c.config.MQTT.ErrorTopic, c.config.MQTT.ErrorQoS, false, errorEvent{
+		Time:     time.Now().UTC(),
+		Kind:     kind,
+		Message:  err.Error(),
+		DeviceID: deviceID,
+	})
+}
+
+// PublishInsertError publishes an insert error event for a batch that
+// failed to be written, naming its device when every row is from the same
+// one. It is meant to be used as the storage's error hook.
+func (c *Client) PublishInsertError(tableName string, batch []*models.SensorData, err error) {
+	var deviceID string
+	for i, data := range batch {
+		if i > 0 && data.Device_ID != deviceID {
+			deviceID = ""
+			break
+		}
+		deviceID = data.Device_ID
+	}
+	c.publishError(errorInsert, deviceID, err)
+}
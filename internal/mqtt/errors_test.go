@@ -0,0 +1,111 @@
+package mqtt
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/ponytojas/go-mqtt-timescale/internal/metrics"
+	"github.com/ponytojas/go-mqtt-timescale/internal/models"
+)
+
+// errorEvents returns the error events published to topic
+func errorEvents(t *testing.T, conn *fakeTransport, topic string) []errorEvent {
+	t.Helper()
+	var events []errorEvent
+	for _, msg := range conn.publishedTo(topic) {
+		var event errorEvent
+		if err := json.Unmarshal(msg.payload, &event); err != nil {
+			t.Fatalf("error event %q is not JSON: %v", msg.payload, err)
+		}
+		events = append(events, event)
+	}
+	return events
+}
+
+func TestErrorEvents(t *testing.T) {
+	insertErr := errors.New("failed to copy 2 sensor data rows into sensor_data: connection refused")
+	tests := []struct {
+		name       string
+		errorTopic string
+		trigger    func(*Client)
+		want       []errorEvent // compared without the time
+	}{
+		{"insert error", "errors", func(c *Client) {
+			c.PublishInsertError("sensor_data", []*models.SensorData{{Device_ID: "d1"}, {Device_ID: "d1"}}, insertErr)
+		}, []errorEvent{{Kind: "insert", Message: insertErr.Error(), DeviceID: "d1"}}},
+		{"insert error of several devices", "errors", func(c *Client) {
+			c.PublishInsertError("sensor_data", []*models.SensorData{{Device_ID: "d1"}, {Device_ID: "d2"}}, insertErr)
+		}, []errorEvent{{Kind: "insert", Message: insertErr.Error()}}},
+		{"parse error", "errors", func(c *Client) {
+			c.processMessage(context.Background(), "readings", "sensor/d1", []byte(`{"device_id":`), false)
+		}, []errorEvent{{Kind: "parse", Message: "invalid JSON"}}},
+		{"validation error", "errors", func(c *Client) {
+			c.processMessage(context.Background(), "readings", "sensor/d1", []byte(`{"device_id":"d1","temperature":150}`), false)
+		}, []errorEvent{{Kind: "validation", Message: "temperature", DeviceID: "d1"}}},
+		{"no error topic", "", func(c *Client) {
+			c.PublishInsertError("sensor_data", []*models.SensorData{{Device_ID: "d1"}}, insertErr)
+			c.processMessage(context.Background(), "readings", "sensor/d1", []byte(`{"device_id":`), false)
+		}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig()
+			cfg.MQTT.ErrorTopic = tt.errorTopic
+			maxTemperature := 100.0
+			cfg.Validation.Temperature.Max = &maxTemperature
+			c, _, conn := newTestClient(t, cfg)
+			tt.trigger(c)
+
+			events := errorEvents(t, conn, "errors")
+			if len(events) != len(tt.want) {
+				t.Fatalf("published %d error events, want %d: %+v", len(events), len(tt.want), events)
+			}
+			for i, got := range events {
+				want := tt.want[i]
+				if got.Kind != want.Kind || got.DeviceID != want.DeviceID || !strings.Contains(got.Message, want.Message) {
+					t.Errorf("event = %+v, want kind %s, device %q and a message containing %q", got, want.Kind, want.DeviceID, want.Message)
+				}
+				if time.Since(got.Time) > time.Minute || got.Time.Location() != time.UTC {
+					t.Errorf("event time = %s, want about now in UTC", got.Time)
+				}
+			}
+			for _, msg := range conn.publishedTo("errors") {
+				if msg.qos != cfg.MQTT.ErrorQoS || msg.retained {
+					t.Errorf("qos = %d, retained = %v, want qos %d and not retained", msg.qos, msg.retained, cfg.MQTT.ErrorQoS)
+				}
+			}
+		})
+	}
+}
+
+func TestErrorEventsAreRateLimitedPerKind(t *testing.T) {
+	cfg := testConfig()
+	cfg.MQTT.ErrorTopic = "errors"
+	cfg.MQTT.ErrorRate = 0.001
+	cfg.MQTT.ErrorBurst = 2
+	c, _, conn := newTestClient(t, cfg)
+
+	dropped := testutil.ToFloat64(metrics.ErrorEventsDropped)
+	for i := 0; i < 5; i++ {
+		c.PublishInsertError("sensor_data", []*models.SensorData{{Device_ID: "d1"}}, errors.New("connection refused"))
+	}
+	// Another kind has its own budget
+	c.processMessage(context.Background(), "readings", "sensor/d1", []byte(`{"device_id":`), false)
+
+	var kinds []string
+	for _, event := range errorEvents(t, conn, "errors") {
+		kinds = append(kinds, event.Kind)
+	}
+	if want := "insert insert parse"; strings.Join(kinds, " ") != want {
+		t.Errorf("published %v, want %s", kinds, want)
+	}
+	if got := testutil.ToFloat64(metrics.ErrorEventsDropped) - dropped; got != 3 {
+		t.Errorf("dropped %v events, want 3", got)
+	}
+}
@@ -0,0 +1,72 @@
+package mqtt
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+
+	"github.com/ponytojas/go-mqtt-timescale/config"
+)
+
+// errOffline is returned by the transport of an importer, which has no
+// broker to talk to
+var errOffline = errors.New("not connected to an MQTT broker")
+
+// offlineTransport is the transport of a client that only imports files
+type offlineTransport struct{}
+
+func (offlineTransport) SetConnectionHandlers(func(), func(error))   {}
+func (offlineTransport) Connect() error                              { return errOffline }
+func (offlineTransport) Subscribe(string, byte, func(message)) error { return errOffline }
+func (offlineTransport) Unsubscribe(...string) error                 { return nil }
+func (offlineTransport) IsConnected() bool                           { return false }
+func (offlineTransport) Disconnect()                                 {}
+func (offlineTransport) Publish(string, byte, bool, []byte) <-chan error {
+	done := make(chan error, 1)
+	done <- errOffline
+	return done
+}
+
+// NewImporter creates a client that feeds files through the message
+// pipeline into db without connecting to a broker
+func NewImporter(cfg *config.Config, db Storage) (*Client, error) {
+	return newClient(cfg, db, offlineTransport{})
+}
+
+// ImportResult counts the lines read by Import
+type ImportResult struct {
+	Lines  int // non-blank lines read
+	Failed int // lines with at least one rejected reading
+}
+
+// Import processes every line of r as a message received on topic, queueing
+// its readings for insert into tableName. Blank lines are skipped, and lines
+// that are rejected are dead-lettered and counted as failed. It stops early
+// only if r can't be read or ctx is done.
+func (c *Client) Import(ctx context.Context, tableName, topic string, r io.Reader) (ImportResult, error) {
+	var result ImportResult
+	reader := bufio.NewReader(r)
+	for number := 1; ; number++ {
+		line, err := reader.ReadBytes('\n')
+		if line = bytes.TrimSpace(line); len(line) > 0 {
+			result.Lines++
+			if procErr := c.processMessage(ctx, tableName, topic, line, false); procErr != nil {
+				result.Failed++
+				slog.Warn("Rejected import line", "line", number, "error", procErr)
+			}
+		}
+		if err == io.EOF {
+			return result, nil
+		}
+		if err != nil {
+			return result, fmt.Errorf("failed to read line %d: %w", number, err)
+		}
+		if ctx.Err() != nil {
+			return result, ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package mqtt
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/ponytojas/go-mqtt-timescale/internal/deadletter"
+)
+
+func TestImport(t *testing.T) {
+	cfg := testConfig()
+	cfg.DeadLetter.File = filepath.Join(t.TempDir(), "dead.jsonl")
+	store := newMemStore()
+	importer, err := NewImporter(cfg, store)
+	if err != nil {
+		t.Fatalf("NewImporter: %v", err)
+	}
+	file, err := os.Open(filepath.Join("testdata", "import.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	// Six readings on six non-blank lines, one of them cut short and the
+	// last without a trailing newline
+	result, err := importer.Import(context.Background(), "archive", "sensor/import", file)
+	importer.Disconnect()
+	if err != nil {
+		t.Fatalf("Import: %v", err)
+	}
+	if result != (ImportResult{Lines: 6, Failed: 1}) {
+		t.Errorf("result = %+v, want 6 lines with 1 failed", result)
+	}
+
+	rows := store.rows("archive")
+	want := []struct {
+		device string
+		minute int
+	}{{"d1", 0}, {"d2", 0}, {"d1", 2}, {"d2", 2}, {"d2", 3}, {"d1", 4}}
+	if len(rows) != len(want) {
+		t.Fatalf("stored %d readings, want %d", len(rows), len(want))
+	}
+	for i, w := range want {
+		at := time.Date(2024, 5, 1, 12, w.minute, 0, 0, time.UTC)
+		if rows[i].Device_ID != w.device || !rows[i].Timestamp.Equal(at) {
+			t.Errorf("reading %d = %s at %s, want %s at %s", i, rows[i].Device_ID, rows[i].Timestamp, w.device, at)
+		}
+	}
+
+	// The bad line is dead-lettered like a rejected message
+	data, err := os.ReadFile(cfg.DeadLetter.File)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var dead deadletter.Message
+	if err := json.Unmarshal(data, &dead); err != nil {
+		t.Fatalf("dead letter %q is not JSON: %v", data, err)
+	}
+	if dead.Topic != "sensor/import" || !strings.Contains(dead.Error, "invalid JSON") {
+		t.Errorf("dead letter = %+v, want the invalid line on sensor/import", dead)
+	}
+}
+
+func TestImportStopsEarly(t *testing.T) {
+	line := `{"device_id":"d1","temperature":21.5}` + "\n"
+	readErr := errors.New("disk on fire")
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	tests := []struct {
+		name      string
+		ctx       context.Context
+		r         io.Reader
+		wantErr   error
+		wantLines int
+	}{
+		{"read error", context.Background(), io.MultiReader(strings.NewReader(line+line), iotest.ErrReader(readErr)), readErr, 2},
+		{"cancelled", cancelled, strings.NewReader(line + line + line), context.Canceled, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			importer, err := NewImporter(testConfig(), newMemStore())
+			if err != nil {
+				t.Fatalf("NewImporter: %v", err)
+			}
+			t.Cleanup(importer.Disconnect)
+
+			result, err := importer.Import(tt.ctx, "archive", "sensor/import", tt.r)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("error = %v, want %v", err, tt.wantErr)
+			}
+			if result.Lines != tt.wantLines {
+				t.Errorf("read %d lines, want %d", result.Lines, tt.wantLines)
+			}
+		})
+	}
+}
+
+func TestImporterIsOffline(t *testing.T) {
+	importer, err := NewImporter(testConfig(), newMemStore())
+	if err != nil {
+		t.Fatalf("NewImporter: %v", err)
+	}
+	t.Cleanup(importer.Disconnect)
+	if importer.IsConnected() {
+		t.Error("importer reports a broker connection")
+	}
+	if err := importer.Connect(); !errors.Is(err, errOffline) {
+		t.Errorf("Connect = %v, want %v", err, errOffline)
+	}
+}
@@ -0,0 +1,128 @@
+package mqtt
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDecodeObject(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload string
+		key     string
+		want    interface{} // the value decoded for key
+		wantErr string      // substring of the error, "" when decoded
+	}{
+		{"integer kept as sent", `{"ts":1714564800123456789}`, "ts", json.Number("1714564800123456789"), ""},
+		{"fraction kept as sent", `{"temperature":21.50}`, "temperature", json.Number("21.50"), ""},
+		{"string", `{"device_id":"d1"}`, "device_id", "d1", ""},
+		{"trailing whitespace", "{\"device_id\":\"d1\"}\n", "device_id", "d1", ""},
+		{"trailing value", `{"device_id":"d1"} {}`, "", nil, "unexpected data after the top-level value"},
+		{"not an object", `[1]`, "", nil, "cannot unmarshal array"},
+		{"truncated", `{"device_id":`, "", nil, "unexpected EOF"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body, err := decodeObject([]byte(tt.payload))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want one containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := body[tt.key]; got != tt.want {
+				t.Errorf("%s = %#v (%T), want %#v (%T)", tt.key, got, got, tt.want, tt.want)
+			}
+		})
+	}
+}
+
+func TestNumberValue(t *testing.T) {
+	tests := []struct {
+		name   string
+		val    interface{}
+		want   float64
+		wantOK bool
+	}{
+		{"float", 21.5, 21.5, true},
+		{"json number", json.Number("21.5"), 21.5, true},
+		{"json integer", json.Number("415"), 415, true},
+		{"out of range", json.Number("1e400"), 0, false},
+		{"string", "21.5", 0, false},
+		{"bool", true, 0, false},
+		{"null", nil, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got, ok := numberValue(tt.val); got != tt.want || ok != tt.wantOK {
+				t.Errorf("numberValue(%v) = %v, %v, want %v, %v", tt.val, got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestIsInteger(t *testing.T) {
+	tests := []struct {
+		n    json.Number
+		want bool
+	}{
+		{"0", true},
+		{"1714564800123456789", true},
+		{"-42", true},
+		{"12345678901234567890123", true},
+		{"1.5", false},
+		{"1e9", false},
+		{"-", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got := isInteger(tt.n); got != tt.want {
+			t.Errorf("isInteger(%q) = %v, want %v", tt.n, got, tt.want)
+		}
+	}
+}
+
+func TestLargeIntegersKeepTheirPrecision(t *testing.T) {
+	// 1714564800123456789 is not representable as a float64, which would
+	// round it by up to 128ns
+	want := time.Unix(0, 1714564800123456789)
+	tests := []struct {
+		name       string
+		payload    string
+		wantDevice string
+		wantErr    string // substring of the error, "" when stored
+	}{
+		{"nanosecond timestamp", `{"device_id":"d1","temperature":21,"timestamp":1714564800123456789}`, "d1", ""},
+		{"integer device id", `{"device_id":98765432109876543210,"temperature":21,"timestamp":1714564800123456789}`, "98765432109876543210", ""},
+		{"in an array", `[{"device_id":12345678901234567,"temperature":21,"timestamp":1714564800123456789}]`, "12345678901234567", ""},
+		{"fractional device id", `{"device_id":1.5,"temperature":21}`, "", "device_id 1.5 is not an integer"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rows, err := ingest(t, testConfig(), "sensor/x", tt.payload)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want one containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(rows) != 1 {
+				t.Fatalf("stored %d readings, want 1", len(rows))
+			}
+			if rows[0].Device_ID != tt.wantDevice {
+				t.Errorf("device id = %q, want %q", rows[0].Device_ID, tt.wantDevice)
+			}
+			if !rows[0].Timestamp.Equal(want) {
+				t.Errorf("timestamp = %d, want %d", rows[0].Timestamp.UnixNano(), want.UnixNano())
+			}
+		})
+	}
+}
@@ -0,0 +1,30 @@
+package mqtt
+
+import "strings"
+
+// lookupPath resolves a dot separated path such as readings.temperature in
+// a decoded JSON object. It reports false when a key is missing or an
+// intermediate value isn't an object.
+func lookupPath(data map[string]interface{}, path string) (interface{}, bool) {
+	var current interface{} = data
+	for _, key := range strings.Split(path, ".") {
+		obj, ok := current.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if current, ok = obj[key]; !ok {
+			return nil, false
+		}
+	}
+	return current, true
+}
+
+// applyFieldPaths copies the values at the configured paths into the fields
+// they hold. A field whose path is missing keeps its flat value, if any.
+func (c *Client) applyFieldPaths(rawData map[string]interface{}) {
+	for field, path := range c.config.MQTT.FieldPaths {
+		if val, ok := lookupPath(rawData, path); ok {
+			rawData[field] = val
+		}
+	}
+}
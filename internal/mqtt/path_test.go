@@ -0,0 +1,92 @@
+package mqtt
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLookupPath(t *testing.T) {
+	data := map[string]interface{}{
+		"device_id": "flat",
+		"meta":      map[string]interface{}{"device_id": "x", "site": map[string]interface{}{"name": "plant-a"}},
+		"readings":  map[string]interface{}{"temperature": 21.5, "humidity": nil},
+		"tags":      []interface{}{"a"},
+	}
+	tests := []struct {
+		path   string
+		want   interface{}
+		wantOK bool
+	}{
+		{"device_id", "flat", true},
+		{"meta.device_id", "x", true},
+		{"meta.site.name", "plant-a", true},
+		{"readings.temperature", 21.5, true},
+		{"readings.humidity", nil, true},
+		{"readings.light", nil, false},
+		{"missing.temperature", nil, false},
+		{"device_id.name", nil, false}, // through a string
+		{"tags.0", nil, false},         // arrays aren't indexed
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			got, ok := lookupPath(data, tt.path)
+			if ok != tt.wantOK || got != tt.want {
+				t.Errorf("lookupPath(%q) = %v, %v, want %v, %v", tt.path, got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestFieldPaths(t *testing.T) {
+	nestedPaths := map[string]string{
+		"device_id":   "meta.device_id",
+		"temperature": "readings.temperature",
+		"timestamp":   "meta.time",
+	}
+	tests := []struct {
+		name     string
+		payload  string
+		wantErr  string // substring of the error, "" when accepted
+		device   string
+		temp     *float64
+		wantTime time.Time // zero for the time of arrival
+	}{
+		{"nested", `{"meta":{"device_id":"x","time":"2024-05-01T12:00:00Z"},"readings":{"temperature":21.5}}`, "",
+			"x", ptr(21.5), time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)},
+		{"flat fallback", `{"device_id":"flat","temperature":19}`, "", "flat", ptr(19), time.Time{}},
+		{"nested wins over flat", `{"device_id":"flat","meta":{"device_id":"x"},"readings":{"temperature":21.5}}`, "", "x", ptr(21.5), time.Time{}},
+		{"missing intermediate object", `{"meta":{"device_id":"x"}}`, "", "x", nil, time.Time{}},
+		{"intermediate value not an object", `{"meta":{"device_id":"x"},"readings":21.5}`, "", "x", nil, time.Time{}},
+		{"missing device id", `{"readings":{"temperature":21.5}}`, "device_id is missing", "", nil, time.Time{}},
+		{"nested value of the wrong type", `{"meta":{"device_id":"x"},"readings":{"temperature":"warm"}}`, `temperature: "warm" is not a number`, "", nil, time.Time{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig()
+			cfg.MQTT.FieldPaths = nestedPaths
+			before := time.Now()
+			rows, err := ingest(t, cfg, "sensor/x", tt.payload)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want one containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil || len(rows) != 1 {
+				t.Fatalf("stored %d readings with error %v, want 1", len(rows), err)
+			}
+			got := rows[0]
+			if got.Device_ID != tt.device || !equalValue(got.Temperature, tt.temp) {
+				t.Errorf("stored device %q with temperature %v, want %q with %v", got.Device_ID, got.Temperature, tt.device, tt.temp)
+			}
+			if tt.wantTime.IsZero() {
+				if got.Timestamp.Before(before.Truncate(time.Second)) {
+					t.Errorf("timestamp = %s, want the time of arrival", got.Timestamp)
+				}
+			} else if !got.Timestamp.Equal(tt.wantTime) {
+				t.Errorf("timestamp = %s, want %s", got.Timestamp, tt.wantTime)
+			}
+		})
+	}
+}
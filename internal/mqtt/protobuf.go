@@ -0,0 +1,62 @@
+package mqtt
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+
+	"google.golang.org/protobuf/proto"
+
+	"github.com/ponytojas/go-mqtt-timescale/internal/metrics"
+	"github.com/ponytojas/go-mqtt-timescale/internal/models"
+	"github.com/ponytojas/go-mqtt-timescale/internal/pb"
+)
+
+// processProtobuf stores a payload encoded as a pb.Reading, returning the
+// error it was rejected with
+func (c *Client) processProtobuf(ctx context.Context, tableName, topic string, payload []byte, retained bool) error {
+	sensorData, tableHint, err := c.parseProtobuf(topic, payload)
+	if err != nil {
+		metrics.ParseErrors.Inc()
+		slog.Error("Error parsing reading", "topic", topic, "error", err)
+		c.reject(topic, payload, err)
+		return err
+	}
+	sensorData.Retained = retained
+	return c.handleReading(ctx, tableName, topic, payload, sensorData, tableHint)
+}
+
+// parseProtobuf decodes a pb.Reading into sensor data, returning the table
+// it names, or "" if it has none
+func (c *Client) parseProtobuf(topic string, payload []byte) (*models.SensorData, string, error) {
+	var reading pb.Reading
+	if err := proto.Unmarshal(payload, &reading); err != nil {
+		return nil, "", fmt.Errorf("invalid protobuf: %w", err)
+	}
+
+	// Go through the same conversion as JSON so topic templates, the table
+	// hint and the metrics fields behave identically
+	rawData := make(map[string]interface{}, len(reading.Fields)+6)
+	for key, val := range reading.Fields {
+		rawData[key] = val
+	}
+	if reading.DeviceId != "" {
+		rawData["device_id"] = reading.DeviceId
+	}
+	if reading.Timestamp != nil {
+		rawData["timestamp"] = reading.Timestamp.AsTime()
+	}
+	if reading.Temperature != nil {
+		rawData["temperature"] = reading.GetTemperature()
+	}
+	if reading.Humidity != nil {
+		rawData["humidity"] = reading.GetHumidity()
+	}
+	if reading.Light != nil {
+		rawData["light"] = reading.GetLight()
+	}
+	if reading.Table != "" {
+		rawData["table"] = reading.Table
+	}
+	return c.decodeReading(topic, rawData)
+}
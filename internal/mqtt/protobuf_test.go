@@ -0,0 +1,100 @@
+package mqtt
+
+import (
+	"context"
+	"maps"
+	"testing"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"github.com/ponytojas/go-mqtt-timescale/internal/pb"
+)
+
+// marshal encodes reading, failing the test if it can't
+func marshal(t *testing.T, reading *pb.Reading) []byte {
+	t.Helper()
+	payload, err := proto.Marshal(reading)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return payload
+}
+
+func TestProtobufRoundTrip(t *testing.T) {
+	cfg := testConfig()
+	cfg.MQTT.PayloadFormat = "protobuf"
+	c, store, _ := newTestClient(t, cfg)
+
+	ts := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	payload := marshal(t, &pb.Reading{
+		DeviceId:    "d1",
+		Timestamp:   timestamppb.New(ts),
+		Temperature: proto.Float64(21.5),
+		Light:       proto.Float64(300),
+		Fields:      map[string]float64{"co2": 415},
+	})
+	if err := c.processMessage(context.Background(), "sensor_data", "sensor/d1", payload, false); err != nil {
+		t.Fatalf("processMessage: %v", err)
+	}
+
+	rows := store.rows("sensor_data")
+	if len(rows) != 1 {
+		t.Fatalf("stored %d readings, want 1", len(rows))
+	}
+	got := rows[0]
+	if got.Device_ID != "d1" || !got.Timestamp.Equal(ts) {
+		t.Errorf("reading = %s at %s, want d1 at %s", got.Device_ID, got.Timestamp, ts)
+	}
+	if !equalValue(got.Temperature, ptr(21.5)) || got.Humidity != nil || !equalValue(got.Light, ptr(300)) {
+		t.Errorf("values = %v, %v, %v, want 21.5, nil and 300", got.Temperature, got.Humidity, got.Light)
+	}
+	if want := map[string]float64{"co2": 415}; !maps.Equal(got.Fields, want) {
+		t.Errorf("fields = %v, want %v", got.Fields, want)
+	}
+}
+
+func TestProtobufTableHint(t *testing.T) {
+	cfg := testConfig()
+	cfg.MQTT.PayloadFormat = "protobuf"
+	cfg.Timescale.AllowedTables = []string{"tenant_a"}
+	c, store, _ := newTestClient(t, cfg)
+
+	payload := marshal(t, &pb.Reading{DeviceId: "d1", Temperature: proto.Float64(20), Table: "tenant_a"})
+	if err := c.processMessage(context.Background(), "sensor_data", "sensor/d1", payload, false); err != nil {
+		t.Fatalf("processMessage: %v", err)
+	}
+	if n := len(store.rows("tenant_a")); n != 1 {
+		t.Errorf("tenant_a holds %d readings, want 1", n)
+	}
+}
+
+func TestMalformedProtobufIsDeadLettered(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload []byte
+	}{
+		{"not protobuf", []byte("{\"device_id\":\"d1\"}\xff")},
+		{"truncated", marshal(t, &pb.Reading{DeviceId: "d1", Temperature: proto.Float64(20)})[:5]},
+		{"missing device id", marshal(t, &pb.Reading{Temperature: proto.Float64(20)})},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig()
+			cfg.MQTT.PayloadFormat = "protobuf"
+			cfg.DeadLetter.Topic = "dead"
+			c, store, conn := newTestClient(t, cfg)
+
+			if err := c.processMessage(context.Background(), "sensor_data", "sensor/d1", tt.payload, false); err == nil {
+				t.Fatal("expected an error")
+			}
+			if n := len(store.rows("sensor_data")); n != 0 {
+				t.Errorf("stored %d readings, want none", n)
+			}
+			if n := len(conn.publishedTo("dead")); n != 1 {
+				t.Errorf("dead-lettered %d messages, want 1", n)
+			}
+		})
+	}
+}
@@ -0,0 +1,42 @@
+package mqtt
+
+import (
+	"strings"
+
+	"github.com/ponytojas/go-mqtt-timescale/internal/models"
+)
+
+// newFieldScale returns the scale factors keyed by lowercase field name, or
+// nil when none is configured
+func newFieldScale(factors map[string]float64) map[string]float64 {
+	if len(factors) == 0 {
+		return nil
+	}
+	scale := make(map[string]float64, len(factors))
+	for field, factor := range factors {
+		scale[strings.ToLower(field)] = factor
+	}
+	return scale
+}
+
+// applyFieldScale multiplies the extracted values of sensorData by the
+// scale factors of their fields, converting them to physical units
+func (c *Client) applyFieldScale(sensorData *models.SensorData) {
+	if len(c.fieldScale) == 0 {
+		return
+	}
+	for field, value := range map[string]*float64{
+		"temperature": sensorData.Temperature,
+		"humidity":    sensorData.Humidity,
+		"light":       sensorData.Light,
+	} {
+		if factor, ok := c.fieldScale[field]; ok && value != nil {
+			*value *= factor
+		}
+	}
+	for key, value := range sensorData.Fields {
+		if factor, ok := c.fieldScale[strings.ToLower(key)]; ok {
+			sensorData.Fields[key] = value * factor
+		}
+	}
+}
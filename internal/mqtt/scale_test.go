@@ -0,0 +1,92 @@
+package mqtt
+
+import (
+	"math"
+	"testing"
+)
+
+// near reports whether an optional value is set and within rounding of want
+func near(got *float64, want float64) bool {
+	return got != nil && math.Abs(*got-want) < 1e-9
+}
+
+func TestFieldScale(t *testing.T) {
+	tests := []struct {
+		name     string
+		scale    map[string]float64
+		payload  string
+		wantTemp *float64
+		wantHum  *float64
+		wantCO2  float64 // 0 when absent
+	}{
+		{"scaled int", map[string]float64{"temperature": 0.01}, `{"device_id":"d1","temperature":2150}`, ptr(21.5), nil, 0},
+		{"scaled string", map[string]float64{"temperature": 0.01}, `{"device_id":"d1","temperature":"2150"}`, ptr(21.5), nil, 0},
+		{"scaled float", map[string]float64{"humidity": 0.1}, `{"device_id":"d1","humidity":405.5}`, nil, ptr(40.55), 0},
+		{"unscaled fields as sent", map[string]float64{"temperature": 0.01}, `{"device_id":"d1","temperature":2150,"humidity":40}`, ptr(21.5), ptr(40), 0},
+		{"no scale", nil, `{"device_id":"d1","temperature":2150}`, ptr(2150), nil, 0},
+		{"metrics field", map[string]float64{"co2": 10}, `{"device_id":"d1","temperature":21,"co2":41.5}`, ptr(21), nil, 415},
+		{"field names ignore case", map[string]float64{"Temperature": 0.01}, `{"device_id":"d1","temperature":2150}`, ptr(21.5), nil, 0},
+		{"negative factor", map[string]float64{"temperature": -1}, `{"device_id":"d1","temperature":5}`, ptr(-5), nil, 0},
+		{"missing value stays missing", map[string]float64{"temperature": 0.01}, `{"device_id":"d1","humidity":40}`, nil, ptr(40), 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig()
+			cfg.MQTT.FieldScale = tt.scale
+			rows, err := ingest(t, cfg, "sensor/d1", tt.payload)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(rows) != 1 {
+				t.Fatalf("stored %d readings, want 1", len(rows))
+			}
+			row := rows[0]
+			for _, v := range []struct {
+				name      string
+				got, want *float64
+			}{
+				{"temperature", row.Temperature, tt.wantTemp},
+				{"humidity", row.Humidity, tt.wantHum},
+			} {
+				if v.want == nil && v.got != nil || v.want != nil && !near(v.got, *v.want) {
+					t.Errorf("%s = %v, want %v", v.name, fmtValue(v.got), fmtValue(v.want))
+				}
+			}
+			if co2 := row.Fields["co2"]; math.Abs(co2-tt.wantCO2) > 1e-9 {
+				t.Errorf("co2 = %v, want %v", co2, tt.wantCO2)
+			}
+		})
+	}
+}
+
+// fmtValue formats an optional value for a failure message
+func fmtValue(v *float64) interface{} {
+	if v == nil {
+		return nil
+	}
+	return *v
+}
+
+func TestRangesApplyToScaledValues(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload string
+		stored  bool
+	}{
+		// 2150 is out of range before scaling, 21.50 isn't
+		{"in physical units", `{"device_id":"d1","temperature":2150}`, true},
+		{"out of range once scaled", `{"device_id":"d1","temperature":9000}`, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig()
+			cfg.MQTT.FieldScale = map[string]float64{"temperature": 0.01}
+			cfg.Validation = testRanges()
+			cfg.Validation.Mode = "reject"
+			rows, _ := ingest(t, cfg, "sensor/d1", tt.payload)
+			if stored := len(rows) == 1; stored != tt.stored {
+				t.Errorf("stored = %v, want %v", stored, tt.stored)
+			}
+		})
+	}
+}
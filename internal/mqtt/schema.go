@@ -0,0 +1,58 @@
+package mqtt
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/santhosh-tekuri/jsonschema/v5"
+)
+
+// loadSchema compiles the JSON Schema payloads are validated against, or
+// returns nil when no schema is configured
+func loadSchema(path string) (*jsonschema.Schema, error) {
+	if path == "" {
+		return nil, nil
+	}
+	schema, err := jsonschema.Compile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load payload schema: %w", err)
+	}
+	return schema, nil
+}
+
+// validateSchema checks a decoded JSON payload against the schema, naming
+// every violation and where in the payload it is. Violations are sorted,
+// since the schema's properties are checked in no particular order.
+func validateSchema(schema *jsonschema.Schema, payload map[string]interface{}) error {
+	err := schema.Validate(payload)
+	var verr *jsonschema.ValidationError
+	if !errors.As(err, &verr) {
+		return err
+	}
+
+	var reasons []string
+	for _, leaf := range leafErrors(verr) {
+		location := leaf.InstanceLocation
+		if location == "" {
+			location = "/"
+		}
+		reasons = append(reasons, location+": "+leaf.Message)
+	}
+	sort.Strings(reasons)
+	return fmt.Errorf("payload does not match schema: %s", strings.Join(reasons, "; "))
+}
+
+// leafErrors returns the innermost causes of a validation error, which name
+// the actual violations rather than the schema keywords containing them
+func leafErrors(err *jsonschema.ValidationError) []*jsonschema.ValidationError {
+	if len(err.Causes) == 0 {
+		return []*jsonschema.ValidationError{err}
+	}
+	var leaves []*jsonschema.ValidationError
+	for _, cause := range err.Causes {
+		leaves = append(leaves, leafErrors(cause)...)
+	}
+	return leaves
+}
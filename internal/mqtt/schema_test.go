@@ -0,0 +1,93 @@
+package mqtt
+
+import (
+	"context"
+	"encoding/json"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ponytojas/go-mqtt-timescale/internal/deadletter"
+)
+
+// readingSchema requires a string device_id and a numeric temperature
+const readingSchema = `{
+	"$schema": "https://json-schema.org/draft/2020-12/schema",
+	"type": "object",
+	"required": ["device_id", "temperature"],
+	"properties": {
+		"device_id": {"type": "string"},
+		"temperature": {"type": "number", "minimum": -50, "maximum": 100},
+		"meta": {
+			"type": "object",
+			"properties": {"firmware": {"type": "string"}}
+		}
+	}
+}`
+
+func TestPayloadSchema(t *testing.T) {
+	schemaFile := filepath.Join(t.TempDir(), "reading.schema.json")
+	writeFile(t, schemaFile, []byte(readingSchema))
+
+	tests := []struct {
+		name    string
+		schema  string
+		payload string
+		wantErr string // substring of the error, "" when accepted
+	}{
+		{"valid", schemaFile, `{"device_id":"d1","temperature":21.5}`, ""},
+		{"missing required field", schemaFile, `{"device_id":"d1"}`, "payload does not match schema: /: missing properties: 'temperature'"},
+		{"wrong type", schemaFile, `{"device_id":"d1","temperature":"warm"}`, "/temperature: expected number, but got string"},
+		{"out of range", schemaFile, `{"device_id":"d1","temperature":150}`, "/temperature: must be <= 100"},
+		{"nested violation", schemaFile, `{"device_id":"d1","temperature":21.5,"meta":{"firmware":2}}`, "/meta/firmware: expected string"},
+		{"every violation named", schemaFile, `{"device_id":7,"temperature":"warm"}`, "/device_id: expected string, but got number; /temperature"},
+		{"no schema", "", `{"device_id":"d1","temperature":21.5,"meta":{"firmware":2}}`, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig()
+			cfg.MQTT.PayloadSchema = tt.schema
+			cfg.DeadLetter.Topic = "dead"
+			c, store, conn := newTestClient(t, cfg)
+
+			err := c.processMessage(context.Background(), "readings", "sensor/d1", []byte(tt.payload), false)
+			rows := store.rows("readings")
+			if tt.wantErr == "" {
+				if err != nil || len(rows) != 1 {
+					t.Fatalf("stored %d readings with error %v, want the reading stored", len(rows), err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("error = %v, want one containing %q", err, tt.wantErr)
+			}
+			if len(rows) != 0 {
+				t.Errorf("stored %d readings, want none", len(rows))
+			}
+			dead := conn.publishedTo("dead")
+			if len(dead) != 1 {
+				t.Fatalf("dead-lettered %d messages, want 1", len(dead))
+			}
+			var msg deadletter.Message
+			if err := json.Unmarshal(dead[0].payload, &msg); err != nil {
+				t.Fatalf("dead letter %q is not JSON: %v", dead[0].payload, err)
+			}
+			if msg.Payload != tt.payload || !strings.Contains(msg.Error, tt.wantErr) {
+				t.Errorf("dead letter = %+v, want the payload and its validation error", msg)
+			}
+		})
+	}
+}
+
+func TestInvalidPayloadSchemaIsRejected(t *testing.T) {
+	dir := t.TempDir()
+	invalid := filepath.Join(dir, "invalid.json")
+	writeFile(t, invalid, []byte(`{"type": 12}`))
+	for _, path := range []string{invalid, filepath.Join(dir, "missing.json")} {
+		cfg := testConfig()
+		cfg.MQTT.PayloadSchema = path
+		if _, err := newClient(cfg, newMemStore(), newFakeTransport(false)); err == nil || !strings.Contains(err.Error(), "failed to load payload schema") {
+			t.Errorf("%s: newClient = %v, want a schema load error", filepath.Base(path), err)
+		}
+	}
+}
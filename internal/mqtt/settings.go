@@ -0,0 +1,54 @@
+package mqtt
+
+import (
+	"time"
+
+	"github.com/ponytojas/go-mqtt-timescale/config"
+	"github.com/ponytojas/go-mqtt-timescale/internal/ratelimit"
+)
+
+// settings are the parts of the configuration that can be reloaded while
+// messages are being processed. They are replaced as a whole, never modified.
+type settings struct {
+	validation config.ValidationConfig
+	ingest     config.IngestConfig
+	limiter    *ratelimit.RateLimiter // nil when rate limiting is disabled
+}
+
+// newSettings creates the runtime settings for cfg, reusing the rate limiter
+// of prev when the limits haven't changed so devices keep their buckets
+func newSettings(cfg *config.Config, prev *settings) *settings {
+	s := &settings{
+		validation: cfg.Validation,
+		ingest:     cfg.Ingest,
+	}
+
+	if prev != nil && prev.ingest.PerDeviceRate == cfg.Ingest.PerDeviceRate &&
+		prev.ingest.PerDeviceBurst == cfg.Ingest.PerDeviceBurst {
+		s.limiter = prev.limiter
+	} else if cfg.Ingest.PerDeviceRate > 0 {
+		// An idle bucket must have refilled completely before it's forgotten
+		idleTimeout := cfg.Ingest.DeviceTTL
+		if refill := time.Duration(float64(cfg.Ingest.PerDeviceBurst) / cfg.Ingest.PerDeviceRate * float64(time.Second)); refill > idleTimeout {
+			idleTimeout = refill
+		}
+		s.limiter = ratelimit.New(cfg.Ingest.PerDeviceRate, cfg.Ingest.PerDeviceBurst, idleTimeout)
+	}
+	return s
+}
+
+// close releases the rate limiter unless next still uses it
+func (s *settings) close(next *settings) {
+	if s.limiter != nil && (next == nil || next.limiter != s.limiter) {
+		s.limiter.Close()
+	}
+}
+
+// Reload applies the validation bounds and rate limits of cfg to messages
+// processed from now on. Other settings only take effect after a restart.
+func (c *Client) Reload(cfg *config.Config) {
+	prev := c.settings.Load()
+	next := newSettings(cfg, prev)
+	c.settings.Store(next)
+	prev.close(next)
+}
@@ -0,0 +1,58 @@
+package mqtt
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// verifySignature checks that the hex encoded HMAC-SHA256 in field matches
+// the payload signed with secret. The signature covers the canonical JSON of
+// the payload without field: keys sorted, no whitespace, numbers as sent.
+func verifySignature(payload []byte, field string, secret []byte) error {
+	body, err := decodeObject(payload)
+	if err != nil {
+		return fmt.Errorf("invalid JSON: %w", err)
+	}
+
+	raw, ok := body[field]
+	if !ok {
+		return fmt.Errorf("payload is missing the %s signature", field)
+	}
+	signature, ok := raw.(string)
+	if !ok {
+		return fmt.Errorf("%s signature must be a hex string", field)
+	}
+	want, err := hex.DecodeString(signature)
+	if err != nil {
+		return fmt.Errorf("%s signature must be a hex string", field)
+	}
+	delete(body, field)
+
+	canonical, err := canonicalJSON(body)
+	if err != nil {
+		return err
+	}
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(canonical)
+	if !hmac.Equal(mac.Sum(nil), want) {
+		return errors.New("payload signature does not match")
+	}
+	return nil
+}
+
+// canonicalJSON encodes v compactly with sorted object keys and without
+// escaping HTML characters, so signers in other languages can reproduce it
+func canonicalJSON(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		return nil, fmt.Errorf("failed to encode canonical JSON: %w", err)
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
@@ -0,0 +1,70 @@
+package mqtt
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+// sign returns the hex encoded HMAC-SHA256 of canonical with secret
+func sign(secret, canonical string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(canonical))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestPayloadSignatures(t *testing.T) {
+	valid := sign("s3cret", `{"device_id":"d1","temperature":21.5}`)
+	tests := []struct {
+		name    string
+		secret  string
+		field   string
+		payload string
+		wantErr string // substring of the error, "" when accepted
+	}{
+		{"valid", "s3cret", "hmac", `{"device_id":"d1","temperature":21.5,"hmac":"` + valid + `"}`, ""},
+		// The signature covers the canonical JSON, not the bytes sent
+		{"key order and whitespace", "s3cret", "hmac", `{ "hmac": "` + valid + `", "temperature": 21.5, "device_id": "d1" }`, ""},
+		{"numbers as sent", "s3cret", "hmac",
+			`{"device_id":"d1","temperature":21.50,"hmac":"` + sign("s3cret", `{"device_id":"d1","temperature":21.50}`) + `"}`, ""},
+		{"HTML characters unescaped", "s3cret", "hmac",
+			`{"device_id":"a<b>&c","temperature":1,"hmac":"` + sign("s3cret", `{"device_id":"a<b>&c","temperature":1}`) + `"}`, ""},
+		{"custom field", "s3cret", "sig", `{"device_id":"d1","temperature":21.5,"sig":"` + valid + `"}`, ""},
+		{"tampered", "s3cret", "hmac", `{"device_id":"d1","temperature":99,"hmac":"` + valid + `"}`, "payload signature does not match"},
+		{"wrong secret", "other", "hmac", `{"device_id":"d1","temperature":21.5,"hmac":"` + valid + `"}`, "payload signature does not match"},
+		{"missing signature", "s3cret", "hmac", `{"device_id":"d1","temperature":21.5}`, "payload is missing the hmac signature"},
+		{"signature not hex", "s3cret", "hmac", `{"device_id":"d1","temperature":21.5,"hmac":"zz"}`, "hmac signature must be a hex string"},
+		{"signature not a string", "s3cret", "hmac", `{"device_id":"d1","temperature":21.5,"hmac":12}`, "hmac signature must be a hex string"},
+		{"no secret", "", "hmac", `{"device_id":"d1","temperature":21.5}`, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig()
+			cfg.MQTT.HMACSecret = tt.secret
+			cfg.MQTT.HMACField = tt.field
+			cfg.DeadLetter.Topic = "dead"
+			c, store, conn := newTestClient(t, cfg)
+
+			err := c.processMessage(context.Background(), "readings", "sensor/d1", []byte(tt.payload), false)
+			rows := store.rows("readings")
+			if tt.wantErr == "" {
+				if err != nil || len(rows) != 1 {
+					t.Fatalf("stored %d readings with error %v, want 1", len(rows), err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("error = %v, want one containing %q", err, tt.wantErr)
+			}
+			if len(rows) != 0 {
+				t.Errorf("stored %d readings, want none", len(rows))
+			}
+			if n := len(conn.publishedTo("dead")); n != 1 {
+				t.Errorf("dead-lettered %d messages, want 1", n)
+			}
+		})
+	}
+}
@@ -0,0 +1,81 @@
+package mqtt
+
+import (
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/ponytojas/go-mqtt-timescale/internal/models"
+)
+
+// deviceStatus is published to a device's status topic after its readings
+// are inserted
+type deviceStatus struct {
+	DeviceID string    `json:"device_id"`
+	LastTime time.Time `json:"last_time"`
+}
+
+// heartbeat is published periodically to the heartbeat topic
+type heartbeat struct {
+	Time          time.Time `json:"time"`
+	UptimeSeconds int64     `json:"uptime_seconds"`
+}
+
+// PublishDeviceStatus publishes the latest reading time of every device in
+// the batch to its status topic. It does nothing unless status messages are
+// enabled, and is meant to be used as the database's insert hook.
+func (c *Client) PublishDeviceStatus(tableName string, batch []*models.SensorData) {
+	if !c.config.Status.Enabled {
+		return
+	}
+
+	latest := make(map[string]time.Time)
+	for _, data := range batch {
+		if data.Timestamp.After(latest[data.Device_ID]) {
+			latest[data.Device_ID] = data.Timestamp
+		}
+	}
+
+	for deviceID, lastTime := range latest {
+		topic := strings.ReplaceAll(c.config.Status.DeviceTopic, "{device_id}", deviceID)
+		c.publishJSON(topic, c.config.Status.QoS, true, deviceStatus{DeviceID: deviceID, LastTime: lastTime.UTC()})
+	}
+}
+
+// heartbeatLoop publishes a heartbeat every interval until the client is
+// stopped
+func (c *Client) heartbeatLoop(interval time.Duration) {
+	started := time.Now()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			c.publishJSON(c.config.Status.HeartbeatTopic, c.config.Status.QoS, false, heartbeat{
+				Time:          time.Now().UTC(),
+				UptimeSeconds: int64(time.Since(started).Seconds()),
+			})
+		case <-c.stopChan:
+			return
+		}
+	}
+}
+
+// publishJSON publishes v as JSON without waiting for the broker, so a slow
+// broker doesn't stall the caller
+func (c *Client) publishJSON(topic string, qos byte, retained bool, v interface{}) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		slog.Error("Error encoding status message", "topic", topic, "error", err)
+		return
+	}
+	select {
+	case err := <-c.Publish(topic, qos, retained, body):
+		if err != nil {
+			slog.Warn("Error publishing status message", "topic", topic, "error", err)
+		}
+	default:
+	}
+}
@@ -0,0 +1,104 @@
+package mqtt
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/ponytojas/go-mqtt-timescale/internal/models"
+)
+
+func TestPublishDeviceStatus(t *testing.T) {
+	t0 := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	batch := []*models.SensorData{
+		{Device_ID: "d1", Timestamp: t0},
+		{Device_ID: "d1", Timestamp: t0.Add(time.Minute)},
+		{Device_ID: "d1", Timestamp: t0.Add(-time.Minute)},
+		{Device_ID: "d2", Timestamp: t0.In(time.FixedZone("CEST", 2*60*60))},
+	}
+	tests := []struct {
+		name    string
+		enabled bool
+		topic   string
+		want    map[string]time.Time // last time published to each topic
+	}{
+		{"disabled", false, "status/{device_id}", nil},
+		{"latest reading of each device", true, "status/{device_id}", map[string]time.Time{
+			"status/d1": t0.Add(time.Minute),
+			"status/d2": t0,
+		}},
+		{"topic template", true, "fleet/{device_id}/last_seen", map[string]time.Time{
+			"fleet/d1/last_seen": t0.Add(time.Minute),
+			"fleet/d2/last_seen": t0,
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig()
+			cfg.Status.Enabled = tt.enabled
+			cfg.Status.DeviceTopic = tt.topic
+			cfg.Status.QoS = 1
+			c, _, conn := newTestClient(t, cfg)
+			c.PublishDeviceStatus(cfg.Timescale.TableName, batch)
+
+			conn.mu.Lock()
+			publishes := conn.publishes
+			conn.mu.Unlock()
+			if len(publishes) != len(tt.want) {
+				t.Fatalf("published %d status messages, want %d", len(publishes), len(tt.want))
+			}
+			for _, msg := range publishes {
+				want, ok := tt.want[msg.topic]
+				if !ok {
+					t.Fatalf("published to unexpected topic %q", msg.topic)
+				}
+				if !msg.retained || msg.qos != 1 {
+					t.Errorf("%s: retained = %v, qos = %d, want a retained message with qos 1", msg.topic, msg.retained, msg.qos)
+				}
+				var status deviceStatus
+				if err := json.Unmarshal(msg.payload, &status); err != nil {
+					t.Fatalf("%s: payload %q is not JSON: %v", msg.topic, msg.payload, err)
+				}
+				if !status.LastTime.Equal(want) || status.LastTime.Location() != time.UTC {
+					t.Errorf("%s: last_time = %s, want %s in UTC", msg.topic, status.LastTime, want)
+				}
+			}
+		})
+	}
+}
+
+func TestHeartbeatIsPublishedPeriodically(t *testing.T) {
+	cfg := testConfig()
+	cfg.Status.HeartbeatInterval = 10 * time.Millisecond
+	c, _, conn := newTestClient(t, cfg)
+	if err := c.Connect(); err != nil {
+		t.Fatal(err)
+	}
+
+	eventually(t, time.Second, "two heartbeats", func() bool {
+		return len(conn.publishedTo(cfg.Status.HeartbeatTopic)) >= 2
+	})
+	msg := conn.publishedTo(cfg.Status.HeartbeatTopic)[0]
+	if msg.retained {
+		t.Error("heartbeat is retained")
+	}
+	var beat heartbeat
+	if err := json.Unmarshal(msg.payload, &beat); err != nil {
+		t.Fatalf("payload %q is not JSON: %v", msg.payload, err)
+	}
+	if time.Since(beat.Time) > time.Minute || beat.UptimeSeconds < 0 {
+		t.Errorf("heartbeat = %+v", beat)
+	}
+}
+
+func TestHeartbeatIsDisabledByDefault(t *testing.T) {
+	cfg := testConfig()
+	c, _, conn := newTestClient(t, cfg)
+	if err := c.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if n := len(conn.publishedTo(cfg.Status.HeartbeatTopic)); n != 0 {
+		t.Errorf("published %d heartbeats, want none", n)
+	}
+}
@@ -0,0 +1,24 @@
+package mqtt
+
+import (
+	"context"
+
+	"github.com/ponytojas/go-mqtt-timescale/internal/models"
+)
+
+// Storage persists parsed sensor data. *database.TimescaleDB satisfies it;
+// the client only depends on this interface so the message pipeline can run
+// against any store.
+type Storage interface {
+	// InsertSensorData writes data to the default table
+	InsertSensorData(ctx context.Context, data *models.SensorData) error
+
+	// InsertSensorDataBatch writes every row of batch to the default table
+	InsertSensorDataBatch(ctx context.Context, batch []*models.SensorData) error
+
+	// EnqueueSensorDataInto queues data for insertion into the given table
+	EnqueueSensorDataInto(ctx context.Context, tableName string, data *models.SensorData) error
+
+	// Close writes anything still queued and releases the store
+	Close(ctx context.Context) error
+}
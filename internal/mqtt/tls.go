@@ -0,0 +1,70 @@
+package mqtt
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+
+	"github.com/ponytojas/go-mqtt-timescale/config"
+)
+
+// newTLSConfig builds the TLS configuration for the broker connection. With
+// no files configured it verifies the broker against the system roots.
+func newTLSConfig(cfg *config.MQTTConfig) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		InsecureSkipVerify: cfg.TLSInsecureSkipVerify,
+	}
+
+	if cfg.TLSCAFile != "" {
+		caPEM, err := os.ReadFile(cfg.TLSCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA file %s: %w", cfg.TLSCAFile, err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caPEM) {
+			return nil, fmt.Errorf("no valid certificates found in CA file %s", cfg.TLSCAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if cfg.TLSCertFile != "" || cfg.TLSKeyFile != "" {
+		if cfg.TLSCertFile == "" || cfg.TLSKeyFile == "" {
+			return nil, fmt.Errorf("both mqtt.tls_cert_file and mqtt.tls_key_file must be set for client certificate authentication")
+		}
+		cert, err := tls.LoadX509KeyPair(cfg.TLSCertFile, cfg.TLSKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate %s and key %s: %w", cfg.TLSCertFile, cfg.TLSKeyFile, err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
+
+// brokerTLSConfig returns the TLS configuration for ssl:// and wss://
+// brokers, or nil when no broker URL is secure
+func brokerTLSConfig(cfg *config.Config) (*tls.Config, error) {
+	secure := false
+	for _, brokerURL := range cfg.GetMQTTBrokerURLs() {
+		if strings.HasPrefix(brokerURL, "ssl://") || strings.HasPrefix(brokerURL, "wss://") {
+			secure = true
+		}
+	}
+	if !secure {
+		return nil, nil
+	}
+
+	slog.Info("Configuring TLS for secure connection")
+	tlsConfig, err := newTLSConfig(&cfg.MQTT)
+	if err != nil {
+		return nil, fmt.Errorf("failed to configure TLS: %w", err)
+	}
+	if tlsConfig.InsecureSkipVerify {
+		slog.Warn("TLS certificate verification is disabled")
+	}
+	return tlsConfig, nil
+}
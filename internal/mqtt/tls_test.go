@@ -0,0 +1,137 @@
+package mqtt
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ponytojas/go-mqtt-timescale/config"
+)
+
+// writeSelfSigned writes a self-signed certificate and its key to dir as
+// name.crt and name.key, returning their paths
+func writeSelfSigned(t *testing.T, dir, name string) (certFile, keyFile string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile = filepath.Join(dir, name+".crt")
+	keyFile = filepath.Join(dir, name+".key")
+	writeFile(t, certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+	writeFile(t, keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}))
+	return certFile, keyFile
+}
+
+// writeFile writes data to path, failing the test on error
+func writeFile(t *testing.T, path string, data []byte) {
+	t.Helper()
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNewTLSConfig(t *testing.T) {
+	dir := t.TempDir()
+	cert, key := writeSelfSigned(t, dir, "client")
+	_, otherKey := writeSelfSigned(t, dir, "other")
+	notPEM := filepath.Join(dir, "not.pem")
+	writeFile(t, notPEM, []byte("not a certificate"))
+
+	tests := []struct {
+		name     string
+		cfg      config.MQTTConfig
+		wantErr  string
+		roots    bool
+		certs    int
+		insecure bool
+	}{
+		{name: "system roots", cfg: config.MQTTConfig{}},
+		{name: "insecure", cfg: config.MQTTConfig{TLSInsecureSkipVerify: true}, insecure: true},
+		{name: "custom CA", cfg: config.MQTTConfig{TLSCAFile: cert}, roots: true},
+		{name: "client certificate", cfg: config.MQTTConfig{TLSCAFile: cert, TLSCertFile: cert, TLSKeyFile: key}, roots: true, certs: 1},
+		{name: "missing CA file", cfg: config.MQTTConfig{TLSCAFile: filepath.Join(dir, "missing.crt")}, wantErr: "failed to read CA file"},
+		{name: "CA file without certificates", cfg: config.MQTTConfig{TLSCAFile: notPEM}, wantErr: "no valid certificates found"},
+		{name: "certificate without key", cfg: config.MQTTConfig{TLSCertFile: cert}, wantErr: "both mqtt.tls_cert_file and mqtt.tls_key_file"},
+		{name: "mismatched key", cfg: config.MQTTConfig{TLSCertFile: cert, TLSKeyFile: otherKey}, wantErr: "failed to load client certificate"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tlsConfig, err := newTLSConfig(&tt.cfg)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want one containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if (tlsConfig.RootCAs != nil) != tt.roots {
+				t.Errorf("custom roots = %v, want %v", tlsConfig.RootCAs != nil, tt.roots)
+			}
+			if len(tlsConfig.Certificates) != tt.certs {
+				t.Errorf("%d client certificates, want %d", len(tlsConfig.Certificates), tt.certs)
+			}
+			if tlsConfig.InsecureSkipVerify != tt.insecure {
+				t.Errorf("insecure skip verify = %v, want %v", tlsConfig.InsecureSkipVerify, tt.insecure)
+			}
+		})
+	}
+}
+
+func TestBrokerTLSConfigOnlyForSecureBrokers(t *testing.T) {
+	for broker, secure := range map[string]bool{
+		"tcp://broker:1883": false,
+		"ws://broker:80":    false,
+		"ssl://broker:8883": true,
+		"wss://broker:443":  true,
+	} {
+		cfg := testConfig()
+		cfg.MQTT.Brokers = []string{broker}
+		tlsConfig, err := brokerTLSConfig(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (tlsConfig != nil) != secure {
+			t.Errorf("%s: TLS configured = %v, want %v", broker, tlsConfig != nil, secure)
+		}
+	}
+}
+
+func TestNewClientFailsOnUnreadableTLSFiles(t *testing.T) {
+	cfg := testConfig()
+	cfg.MQTT.Brokers = []string{"ssl://broker:8883"}
+	cfg.MQTT.TLSCAFile = filepath.Join(t.TempDir(), "missing.crt")
+	if _, err := NewClient(cfg, newMemStore()); err == nil || !strings.Contains(err.Error(), "failed to read CA file") {
+		t.Fatalf("NewClient error = %v, want one about the CA file", err)
+	}
+}
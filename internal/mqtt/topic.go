@@ -0,0 +1,74 @@
+package mqtt
+
+import (
+	"fmt"
+	"strings"
+)
+
+// topicTemplate matches topics against a pattern such as
+// "sensor/+device_id/data", binding named "+name" or "{name}" segments to
+// field names. A bare "+" matches any single segment and a trailing "#"
+// matches the rest.
+type topicTemplate struct {
+	segments []string
+}
+
+// parseTopicTemplate validates and compiles a topic template
+func parseTopicTemplate(template string) (*topicTemplate, error) {
+	if template == "" {
+		return nil, nil
+	}
+
+	segments := strings.Split(template, "/")
+	named := 0
+	for i, seg := range segments {
+		if strings.HasPrefix(seg, "{") && strings.HasSuffix(seg, "}") && len(seg) > 2 {
+			seg = "+" + seg[1:len(seg)-1]
+			segments[i] = seg
+		}
+		switch {
+		case seg == "#":
+			if i != len(segments)-1 {
+				return nil, fmt.Errorf("invalid topic template %q: # must be the last segment", template)
+			}
+		case seg == "+":
+		case strings.HasPrefix(seg, "+"):
+			named++
+		case strings.ContainsAny(seg, "+#"):
+			return nil, fmt.Errorf("invalid topic template %q: wildcard in segment %q", template, seg)
+		}
+	}
+	if named == 0 {
+		return nil, fmt.Errorf("invalid topic template %q: no named segments", template)
+	}
+
+	return &topicTemplate{segments: segments}, nil
+}
+
+// match returns the named segment values of topic, or false if the topic
+// doesn't fit the template
+func (t *topicTemplate) match(topic string) (map[string]string, bool) {
+	parts := strings.Split(topic, "/")
+	values := make(map[string]string)
+
+	for i, seg := range t.segments {
+		if seg == "#" {
+			return values, true
+		}
+		if i >= len(parts) {
+			return nil, false
+		}
+		switch {
+		case seg == "+":
+		case strings.HasPrefix(seg, "+"):
+			values[seg[1:]] = parts[i]
+		case seg != parts[i]:
+			return nil, false
+		}
+	}
+
+	if len(parts) != len(t.segments) {
+		return nil, false
+	}
+	return values, true
+}
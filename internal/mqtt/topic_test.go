@@ -0,0 +1,127 @@
+package mqtt
+
+import (
+	"maps"
+	"strings"
+	"testing"
+)
+
+func TestTopicTemplateMatch(t *testing.T) {
+	tests := []struct {
+		template string
+		topic    string
+		want     map[string]string // nil when the topic doesn't match
+	}{
+		{"sensor/+device_id/data", "sensor/dev1/data", map[string]string{"device_id": "dev1"}},
+		{"sensor/{device_id}/data", "sensor/dev1/data", map[string]string{"device_id": "dev1"}},
+		{"sensor/+device_id/data", "sensor/dev1/status", nil},
+		{"sensor/+device_id/data", "sensor/dev1", nil},
+		{"sensor/+device_id/data", "sensor/dev1/data/extra", nil},
+		{"site/+site/+/+device_id", "site/north/floor2/dev1", map[string]string{"site": "north", "device_id": "dev1"}},
+		{"sensor/+device_id/#", "sensor/dev1/a/b", map[string]string{"device_id": "dev1"}},
+		{"sensor/+device_id/#", "sensor/dev1", map[string]string{"device_id": "dev1"}}, // like sensor/# matching sensor
+	}
+	for _, tt := range tests {
+		t.Run(tt.template+" "+tt.topic, func(t *testing.T) {
+			tmpl, err := parseTopicTemplate(tt.template)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, ok := tmpl.match(tt.topic)
+			if ok != (tt.want != nil) || !maps.Equal(got, tt.want) {
+				t.Errorf("match = %v, %v, want %v", got, ok, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseTopicTemplateErrors(t *testing.T) {
+	tests := []struct {
+		template string
+		want     string
+	}{
+		{"sensor/+/data", "no named segments"},
+		{"sensor/#/+device_id", "# must be the last segment"},
+		{"sensor/dev+ice/+device_id", "wildcard in segment"},
+	}
+	for _, tt := range tests {
+		if _, err := parseTopicTemplate(tt.template); err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("parseTopicTemplate(%q) error = %v, want one containing %q", tt.template, err, tt.want)
+		}
+	}
+	if tmpl, err := parseTopicTemplate(""); tmpl != nil || err != nil {
+		t.Errorf("empty template = %v, %v, want no template", tmpl, err)
+	}
+}
+
+func TestDeviceIDFromTopic(t *testing.T) {
+	tests := []struct {
+		name    string
+		topic   string
+		payload string
+		want    string // "" when the reading is rejected
+	}{
+		{"from the topic", "sensor/dev1/data", `{"temperature":20}`, "dev1"},
+		{"payload wins", "sensor/dev1/data", `{"device_id":"dev2","temperature":20}`, "dev2"},
+		{"topic outside the template", "other/dev1", `{"temperature":20}`, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig()
+			cfg.MQTT.TopicTemplate = "sensor/+device_id/data"
+			rows, err := ingest(t, cfg, tt.topic, tt.payload)
+			if tt.want == "" {
+				if err == nil || len(rows) != 0 {
+					t.Fatalf("stored %v, want the reading rejected", rows)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(rows) != 1 || rows[0].Device_ID != tt.want {
+				t.Errorf("stored %v, want one reading from %s", rows, tt.want)
+			}
+		})
+	}
+}
+
+func TestTopicColumns(t *testing.T) {
+	tests := []struct {
+		name     string
+		template string
+		topic    string
+		want     map[string]string // nil when the reading is rejected
+	}{
+		{"three segments", "factory/+site/+line/+device_id", "factory/north/line2/d1", map[string]string{"site": "north", "line": "line2"}},
+		{"braces", "factory/{site}/{line}/{device_id}", "factory/north/line2/d1", map[string]string{"site": "north", "line": "line2"}},
+		{"topic too short", "factory/+site/+line/+device_id", "factory/north/d1", nil},
+		{"topic too deep", "factory/+site/+line/+device_id", "factory/north/line2/d1/extra", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig()
+			cfg.MQTT.TopicTemplate = tt.template
+			cfg.MQTT.TopicColumns = []string{"site", "line"}
+			if err := cfg.Validate(); err != nil {
+				t.Fatal(err)
+			}
+			rows, err := ingest(t, cfg, tt.topic, `{"temperature":20}`)
+			if tt.want == nil {
+				if err == nil || len(rows) != 0 {
+					t.Fatalf("stored %v, want the reading rejected", rows)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(rows) != 1 {
+				t.Fatalf("stored %d readings, want 1", len(rows))
+			}
+			if rows[0].Device_ID != "d1" || !maps.Equal(rows[0].Tags, tt.want) {
+				t.Errorf("stored %s with tags %v, want d1 with %v", rows[0].Device_ID, rows[0].Tags, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,30 @@
+package mqtt
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracer creates the spans of the message pipeline. It is a no-op until a
+// tracer provider is installed.
+var tracer = otel.Tracer("github.com/ponytojas/go-mqtt-timescale/internal/mqtt")
+
+// recordError marks the span in ctx as failed with err
+func recordError(ctx context.Context, err error) {
+	span := trace.SpanFromContext(ctx)
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+}
+
+// traceConnectionLost records a lost connection as a short failed span, so
+// outages show up alongside message traces
+func traceConnectionLost(err error) {
+	ctx, span := tracer.Start(context.Background(), "mqtt.connection_lost")
+	if err != nil {
+		recordError(ctx, err)
+	}
+	span.End()
+}
@@ -0,0 +1,168 @@
+package mqtt
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/ponytojas/go-mqtt-timescale/internal/models"
+)
+
+// recordSpans makes the package tracer record every span to the returned
+// recorder until the test ends
+func recordSpans(t *testing.T) *tracetest.SpanRecorder {
+	t.Helper()
+	rec := tracetest.NewSpanRecorder()
+	previous := tracer
+	tracer = sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(rec)).Tracer("test")
+	t.Cleanup(func() { tracer = previous })
+	return rec
+}
+
+// endedSpans returns the ended spans named name
+func endedSpans(rec *tracetest.SpanRecorder, name string) []sdktrace.ReadOnlySpan {
+	var spans []sdktrace.ReadOnlySpan
+	for _, span := range rec.Ended() {
+		if span.Name() == name {
+			spans = append(spans, span)
+		}
+	}
+	return spans
+}
+
+// spanStore is a Storage recording the span each reading was enqueued in
+type spanStore struct {
+	mu    sync.Mutex
+	spans []trace.SpanContext
+}
+
+func (s *spanStore) EnqueueSensorDataInto(ctx context.Context, tableName string, data *models.SensorData) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.spans = append(s.spans, trace.SpanContextFromContext(ctx))
+	return nil
+}
+
+func (s *spanStore) InsertSensorData(ctx context.Context, data *models.SensorData) error {
+	return s.EnqueueSensorDataInto(ctx, "", data)
+}
+
+func (s *spanStore) InsertSensorDataBatch(ctx context.Context, batch []*models.SensorData) error {
+	for _, data := range batch {
+		if err := s.InsertSensorData(ctx, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *spanStore) Close(ctx context.Context) error {
+	return nil
+}
+
+func (s *spanStore) enqueued() []trace.SpanContext {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.spans
+}
+
+func TestMessageSpans(t *testing.T) {
+	tests := []struct {
+		name       string
+		payload    string
+		wantStatus codes.Code
+		wantRows   int
+	}{
+		{"reading", `{"device_id":"d1","temperature":21.5}`, codes.Unset, 1},
+		{"array", `[{"device_id":"d1","temperature":21.5},{"device_id":"d1","temperature":22}]`, codes.Unset, 2},
+		{"invalid JSON", `{"device_id":`, codes.Error, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := recordSpans(t)
+			cfg := testConfig()
+			store := &spanStore{}
+			conn := newFakeTransport(false)
+			c, err := newClient(cfg, store, conn)
+			if err != nil {
+				t.Fatalf("newClient: %v", err)
+			}
+			t.Cleanup(c.Disconnect)
+			conn.up()
+			if err := c.Subscribe(); err != nil {
+				t.Fatal(err)
+			}
+
+			// Delivered through the worker pool like a received message
+			if !conn.deliver(conn.subscribes[0], message{Topic: "sensor/d1", Payload: []byte(tt.payload)}) {
+				t.Fatal("no handler subscribed")
+			}
+			eventually(t, time.Second, "the message span", func() bool {
+				return len(endedSpans(rec, "mqtt.message")) == 1
+			})
+
+			span := endedSpans(rec, "mqtt.message")[0]
+			if span.SpanKind() != trace.SpanKindConsumer {
+				t.Errorf("span kind = %s, want consumer", span.SpanKind())
+			}
+			attrs := attribute.NewSet(span.Attributes()...)
+			if topic, _ := attrs.Value("messaging.destination.name"); topic.AsString() != "sensor/d1" {
+				t.Errorf("topic attribute = %q, want sensor/d1", topic.AsString())
+			}
+			if size, _ := attrs.Value("messaging.message.body.size"); size.AsInt64() != int64(len(tt.payload)) {
+				t.Errorf("body size attribute = %d, want %d", size.AsInt64(), len(tt.payload))
+			}
+			if span.Status().Code != tt.wantStatus {
+				t.Errorf("status = %s, want %s", span.Status().Code, tt.wantStatus)
+			}
+
+			// Readings are enqueued within the message's span, so the
+			// insert span of the batch links to it
+			enqueued := store.enqueued()
+			if len(enqueued) != tt.wantRows {
+				t.Fatalf("enqueued %d readings, want %d", len(enqueued), tt.wantRows)
+			}
+			for _, sc := range enqueued {
+				if !sc.Equal(span.SpanContext()) {
+					t.Errorf("reading enqueued in span %s, want the message span %s", sc.SpanID(), span.SpanContext().SpanID())
+				}
+			}
+		})
+	}
+}
+
+func TestConnectionSpans(t *testing.T) {
+	rec := recordSpans(t)
+	c, _, _ := newTestClient(t, testConfig())
+	if err := c.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	traceConnectionLost(errors.New("connection reset"))
+
+	tests := []struct {
+		name       string
+		wantStatus codes.Code
+	}{
+		{"mqtt.connect", codes.Unset},
+		{"mqtt.connection_lost", codes.Error},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			spans := endedSpans(rec, tt.name)
+			if len(spans) != 1 {
+				t.Fatalf("recorded %d %s spans, want 1", len(spans), tt.name)
+			}
+			if spans[0].Status().Code != tt.wantStatus {
+				t.Errorf("status = %s, want %s", spans[0].Status().Code, tt.wantStatus)
+			}
+		})
+	}
+}
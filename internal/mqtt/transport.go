@@ -0,0 +1,49 @@
+package mqtt
+
+import (
+	"fmt"
+
+	"github.com/ponytojas/go-mqtt-timescale/config"
+)
+
+// message is an MQTT message received by a transport
+type message struct {
+	Topic    string
+	Payload  []byte
+	Retained bool // sent from the broker's retained store rather than live
+}
+
+// transport is a protocol specific MQTT connection. Implementations
+// reconnect on their own and report connection changes to the handlers,
+// which restore subscriptions after a reconnect.
+type transport interface {
+	// SetConnectionHandlers sets the functions called whenever the
+	// connection comes up and when it is lost. It is called before Connect.
+	SetConnectionHandlers(onUp func(), onLost func(error))
+	// Connect blocks until the first connection to the broker succeeds
+	Connect() error
+	// Subscribe subscribes to topic, calling handler for every message
+	Subscribe(topic string, qos byte, handler func(message)) error
+	// Unsubscribe removes the subscriptions to topics
+	Unsubscribe(topics ...string) error
+	// Publish publishes without blocking; the result is delivered on the
+	// returned channel once the publish completes
+	Publish(topic string, qos byte, retained bool, payload []byte) <-chan error
+	// IsConnected reports whether the connection is currently up
+	IsConnected() bool
+	// Disconnect closes the connection
+	Disconnect()
+}
+
+// newTransport creates the transport for the configured protocol version,
+// connecting as clientID
+func newTransport(cfg *config.Config, clientID string) (transport, error) {
+	switch cfg.MQTT.ProtocolVersion {
+	case 3:
+		return newV3Transport(cfg, clientID)
+	case 5:
+		return newV5Transport(cfg, clientID)
+	default:
+		return nil, fmt.Errorf("unsupported MQTT protocol version %d", cfg.MQTT.ProtocolVersion)
+	}
+}
@@ -0,0 +1,36 @@
+package mqtt
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestNewTransportDispatchesOnProtocolVersion(t *testing.T) {
+	tests := []struct {
+		version int
+		want    string // the transport type, "" for an error
+	}{
+		{3, "v3"},
+		{5, "v5"},
+		{4, ""},
+	}
+	for _, tt := range tests {
+		cfg := testConfig()
+		cfg.MQTT.ProtocolVersion = tt.version
+		conn, err := newTransport(cfg, "test")
+
+		var got string
+		switch conn.(type) {
+		case *v3Transport:
+			got = "v3"
+		case *v5Transport:
+			got = "v5"
+		}
+		if got != tt.want {
+			t.Errorf("protocol version %d built a %q transport, want %q", tt.version, got, tt.want)
+		}
+		if tt.want == "" && (err == nil || !strings.Contains(err.Error(), "unsupported MQTT protocol version 4")) {
+			t.Errorf("protocol version %d: error = %v", tt.version, err)
+		}
+	}
+}
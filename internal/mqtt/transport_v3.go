@@ -0,0 +1,170 @@
+package mqtt
+
+import (
+	"errors"
+	"log/slog"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/ponytojas/go-mqtt-timescale/config"
+	"github.com/ponytojas/go-mqtt-timescale/internal/logging"
+)
+
+// v3Transport is an MQTT 3.1.1 connection using paho.mqtt.golang
+type v3Transport struct {
+	client mqtt.Client
+	config *config.Config
+
+	lostLog, retryLog, pendingLog *logging.Throttle
+
+	onUp   func()
+	onLost func(error)
+}
+
+// newV3Transport creates an MQTT 3.1.1 transport
+func newV3Transport(cfg *config.Config, clientID string) (*v3Transport, error) {
+	opts := mqtt.NewClientOptions()
+	// paho fails over to the next broker when a connection attempt fails
+	for _, brokerURL := range cfg.GetMQTTBrokerURLs() {
+		opts.AddBroker(brokerURL)
+	}
+	opts.SetClientID(clientID)
+
+	opts.SetCleanSession(cfg.MQTT.CleanSession)
+	opts.SetResumeSubs(true) // resend subscribes not yet acknowledged before a reconnect
+	// Handlers run concurrently for better throughput, unless the worker
+	// pool has to see each device's messages in order
+	opts.SetOrderMatters(cfg.Ingest.OrderByDevice)
+	opts.SetKeepAlive(cfg.MQTT.KeepAlive)
+	opts.SetPingTimeout(cfg.MQTT.PingTimeout)
+	opts.SetWriteTimeout(10 * time.Second)
+	opts.SetConnectRetry(true) // retry the initial connection instead of failing
+	opts.SetConnectRetryInterval(cfg.MQTT.ReconnectInitialInterval)
+	opts.SetMaxReconnectInterval(cfg.MQTT.ReconnectMaxInterval)
+	opts.SetConnectTimeout(cfg.MQTT.ConnectTimeout)
+
+	if store := sessionStore(&cfg.MQTT); store != nil {
+		opts.SetStore(store)
+	}
+
+	if cfg.MQTT.Username != "" {
+		opts.SetUsername(cfg.MQTT.Username)
+		opts.SetPassword(cfg.MQTT.Password)
+	}
+
+	// Have the broker announce us as offline if we disappear unexpectedly
+	if cfg.MQTT.WillTopic != "" {
+		opts.SetWill(cfg.MQTT.WillTopic, cfg.MQTT.WillPayload, cfg.MQTT.WillQoS, cfg.MQTT.WillRetained)
+	}
+
+	tlsConfig, err := brokerTLSConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if tlsConfig != nil {
+		opts.SetTLSConfig(tlsConfig)
+	}
+
+	// During an outage these fire on every retry, so they are throttled
+	// until the connection is back up
+	t := &v3Transport{
+		config:     cfg,
+		lostLog:    logging.NewThrottle(cfg.Logging.RepeatInterval),
+		retryLog:   logging.NewThrottle(cfg.Logging.RepeatInterval),
+		pendingLog: logging.NewThrottle(cfg.Logging.RepeatInterval),
+	}
+	opts.SetAutoReconnect(true)
+	opts.SetConnectionLostHandler(func(client mqtt.Client, err error) {
+		traceConnectionLost(err)
+		t.lostLog.Log(slog.LevelWarn, "Connection lost", "error", err)
+		if t.onLost != nil {
+			t.onLost(err)
+		}
+	})
+	opts.SetReconnectingHandler(func(client mqtt.Client, opts *mqtt.ClientOptions) {
+		t.retryLog.Log(slog.LevelInfo, "Attempting to reconnect to MQTT broker")
+	})
+	opts.SetOnConnectHandler(func(client mqtt.Client) {
+		t.lostLog.Reset()
+		t.retryLog.Reset()
+		t.pendingLog.Reset()
+		if t.onUp != nil {
+			t.onUp()
+		}
+	})
+
+	t.client = mqtt.NewClient(opts)
+	return t, nil
+}
+
+// sessionStore returns the store keeping in-flight messages, or nil for
+// paho's default. With QoS 1 or 2 they are kept in memory so they survive a
+// reconnect, and with a persistent session on disk so they survive a restart.
+func sessionStore(cfg *config.MQTTConfig) mqtt.Store {
+	if !cfg.CleanSession && cfg.StoreDir != "" {
+		slog.Info("Persisting in-flight MQTT messages", "store_dir", cfg.StoreDir)
+		return mqtt.NewFileStore(cfg.StoreDir)
+	}
+	if cfg.QoS > 0 {
+		return mqtt.NewMemoryStore()
+	}
+	return nil
+}
+
+// SetConnectionHandlers sets the functions called when the connection comes
+// up and when it is lost
+func (t *v3Transport) SetConnectionHandlers(onUp func(), onLost func(error)) {
+	t.onUp = onUp
+	t.onLost = onLost
+}
+
+// Connect connects to the broker. Since connect retry is enabled, it blocks
+// until a connection attempt succeeds.
+func (t *v3Transport) Connect() error {
+	token := t.client.Connect()
+	for !token.WaitTimeout(t.config.MQTT.ConnectTimeout) {
+		t.pendingLog.Log(slog.LevelWarn, "Still trying to connect to MQTT broker", "brokers", t.config.GetRedactedMQTTBrokerURLs())
+	}
+	return token.Error()
+}
+
+// Subscribe subscribes to topic
+func (t *v3Transport) Subscribe(topic string, qos byte, handler func(message)) error {
+	token := t.client.Subscribe(topic, qos, func(client mqtt.Client, msg mqtt.Message) {
+		handler(message{Topic: msg.Topic(), Payload: msg.Payload(), Retained: msg.Retained()})
+	})
+	token.Wait()
+	return token.Error()
+}
+
+// Unsubscribe unsubscribes from topics, giving up after the connect timeout
+// so a dead connection doesn't hold up a shutdown
+func (t *v3Transport) Unsubscribe(topics ...string) error {
+	token := t.client.Unsubscribe(topics...)
+	if !token.WaitTimeout(t.config.MQTT.ConnectTimeout) {
+		return errors.New("timed out waiting for unsubscribe")
+	}
+	return token.Error()
+}
+
+// Publish publishes a message without waiting for the broker
+func (t *v3Transport) Publish(topic string, qos byte, retained bool, payload []byte) <-chan error {
+	result := make(chan error, 1)
+	token := t.client.Publish(topic, qos, retained, payload)
+	go func() {
+		<-token.Done()
+		result <- token.Error()
+	}()
+	return result
+}
+
+// IsConnected reports whether the connection is up. Unlike paho's
+// IsConnected it returns false while reconnecting.
+func (t *v3Transport) IsConnected() bool {
+	return t.client.IsConnectionOpen()
+}
+
+// Disconnect disconnects, waiting briefly for pending work to complete
+func (t *v3Transport) Disconnect() {
+	t.client.Disconnect(250)
+}
@@ -0,0 +1,162 @@
+package mqtt
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+
+	"github.com/ponytojas/go-mqtt-timescale/config"
+)
+
+// v3Options returns the paho options of a v3 transport built from cfg
+func v3Options(t *testing.T, cfg *config.Config) mqtt.ClientOptionsReader {
+	t.Helper()
+	conn, err := newV3Transport(cfg, cfg.MQTT.ClientID)
+	if err != nil {
+		t.Fatalf("newV3Transport: %v", err)
+	}
+	return conn.client.OptionsReader()
+}
+
+func TestV3ReconnectOptions(t *testing.T) {
+	cfg := testConfig()
+	cfg.MQTT.ReconnectInitialInterval = 3 * time.Second
+	cfg.MQTT.ReconnectMaxInterval = 2 * time.Minute
+	cfg.MQTT.ConnectTimeout = 15 * time.Second
+
+	opts := v3Options(t, cfg)
+	if got := opts.ConnectRetryInterval(); got != 3*time.Second {
+		t.Errorf("connect retry interval = %s, want 3s", got)
+	}
+	if got := opts.MaxReconnectInterval(); got != 2*time.Minute {
+		t.Errorf("max reconnect interval = %s, want 2m", got)
+	}
+	if got := opts.ConnectTimeout(); got != 15*time.Second {
+		t.Errorf("connect timeout = %s, want 15s", got)
+	}
+	if !opts.ConnectRetry() || !opts.AutoReconnect() {
+		t.Errorf("connect retry = %v, auto reconnect = %v, want both on", opts.ConnectRetry(), opts.AutoReconnect())
+	}
+}
+
+func TestV3KeepAlive(t *testing.T) {
+	tests := []struct {
+		name        string
+		keepAlive   time.Duration
+		pingTimeout time.Duration
+	}{
+		{"defaults", config.GetDefaultConfig().MQTT.KeepAlive, config.GetDefaultConfig().MQTT.PingTimeout},
+		{"short for a NAT", 15 * time.Second, 5 * time.Second},
+		{"long", 5 * time.Minute, 30 * time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig()
+			cfg.MQTT.KeepAlive = tt.keepAlive
+			cfg.MQTT.PingTimeout = tt.pingTimeout
+
+			opts := v3Options(t, cfg)
+			if got := opts.KeepAlive(); got != tt.keepAlive {
+				t.Errorf("keep alive = %s, want %s", got, tt.keepAlive)
+			}
+			if got := opts.PingTimeout(); got != tt.pingTimeout {
+				t.Errorf("ping timeout = %s, want %s", got, tt.pingTimeout)
+			}
+		})
+	}
+}
+
+func TestV3HandlersAreOrderedForOrderedDevices(t *testing.T) {
+	for _, ordered := range []bool{false, true} {
+		cfg := testConfig()
+		cfg.Ingest.Workers = 4
+		cfg.Ingest.OrderByDevice = ordered
+		opts := v3Options(t, cfg)
+		if got := opts.Order(); got != ordered {
+			t.Errorf("order matters = %v with order_by_device %v", got, ordered)
+		}
+	}
+}
+
+func TestV3Will(t *testing.T) {
+	tests := []struct {
+		name  string
+		topic string
+	}{
+		{"will topic set", "status/ingest"},
+		{"no will topic", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig()
+			cfg.MQTT.WillTopic = tt.topic
+			cfg.MQTT.WillPayload = "gone"
+			cfg.MQTT.WillQoS = 2
+			cfg.MQTT.WillRetained = true
+
+			opts := v3Options(t, cfg)
+			if opts.WillEnabled() != (tt.topic != "") {
+				t.Fatalf("will enabled = %v, want %v", opts.WillEnabled(), tt.topic != "")
+			}
+			if tt.topic == "" {
+				return
+			}
+			if opts.WillTopic() != tt.topic || string(opts.WillPayload()) != "gone" || opts.WillQos() != 2 || !opts.WillRetained() {
+				t.Errorf("will = %s %q qos %d retained %v", opts.WillTopic(), opts.WillPayload(), opts.WillQos(), opts.WillRetained())
+			}
+		})
+	}
+}
+
+func TestV3Session(t *testing.T) {
+	tests := []struct {
+		name         string
+		cleanSession bool
+		storeDir     string
+		qos          byte
+		want         string // the store type, "" for paho's default
+	}{
+		{"persistent session on disk", false, "/var/lib/ingest", 1, "file"},
+		{"persistent session in memory", false, "", 1, "memory"},
+		{"clean session", true, "", 1, "memory"},
+		{"QoS 0", true, "", 0, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig()
+			cfg.MQTT.CleanSession = tt.cleanSession
+			cfg.MQTT.StoreDir = tt.storeDir
+			cfg.MQTT.QoS = tt.qos
+
+			if opts := v3Options(t, cfg); opts.CleanSession() != tt.cleanSession {
+				t.Errorf("clean session = %v, want %v", opts.CleanSession(), tt.cleanSession)
+			}
+			var got string
+			switch sessionStore(&cfg.MQTT).(type) {
+			case *mqtt.FileStore:
+				got = "file"
+			case *mqtt.MemoryStore:
+				got = "memory"
+			}
+			if got != tt.want {
+				t.Errorf("store = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestV3BrokersAreAddedInOrder(t *testing.T) {
+	cfg := testConfig()
+	cfg.MQTT.Brokers = []string{"tcp://primary:1883", "tcp://standby:1883"}
+
+	opts := v3Options(t, cfg)
+	var got []string
+	for _, server := range opts.Servers() {
+		got = append(got, server.String())
+	}
+	if !slices.Equal(got, cfg.MQTT.Brokers) {
+		t.Errorf("servers = %v, want %v", got, cfg.MQTT.Brokers)
+	}
+}
@@ -0,0 +1,252 @@
+package mqtt
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"sync/atomic"
+	"time"
+
+	"github.com/eclipse/paho.golang/autopaho"
+	"github.com/eclipse/paho.golang/paho"
+	"github.com/ponytojas/go-mqtt-timescale/config"
+	"github.com/ponytojas/go-mqtt-timescale/internal/logging"
+)
+
+// v5Timeout bounds subscribe, publish and disconnect requests to the broker
+const v5Timeout = 10 * time.Second
+
+// v5Transport is an MQTT 5 connection using paho.golang's autopaho
+type v5Transport struct {
+	config    *config.Config
+	clientCfg autopaho.ClientConfig
+	router    *paho.StandardRouter
+
+	conn      *autopaho.ConnectionManager
+	cancel    context.CancelFunc
+	connected atomic.Bool
+
+	// During an outage connection errors repeat on every retry, so they are
+	// throttled until the connection is back up
+	connectLog, lostLog, pendingLog *logging.Throttle
+
+	onUp   func()
+	onLost func(error)
+}
+
+// newV5Transport creates an MQTT 5 transport
+func newV5Transport(cfg *config.Config, clientID string) (*v5Transport, error) {
+	var serverURLs []*url.URL
+	for _, brokerURL := range cfg.GetMQTTBrokerURLs() {
+		serverURL, err := url.Parse(brokerURL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid broker URL %s: %w", brokerURL, err)
+		}
+		serverURLs = append(serverURLs, serverURL)
+	}
+
+	tlsConfig, err := brokerTLSConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	t := &v5Transport{
+		config:     cfg,
+		router:     paho.NewStandardRouter(),
+		connectLog: logging.NewThrottle(cfg.Logging.RepeatInterval),
+		lostLog:    logging.NewThrottle(cfg.Logging.RepeatInterval),
+		pendingLog: logging.NewThrottle(cfg.Logging.RepeatInterval),
+	}
+
+	t.clientCfg = autopaho.ClientConfig{
+		ServerUrls:                    serverURLs, // tried in turn until one connects
+		TlsCfg:                        tlsConfig,
+		KeepAlive:                     uint16(cfg.MQTT.KeepAlive.Seconds()),
+		CleanStartOnInitialConnection: cfg.MQTT.CleanSession,
+		SessionExpiryInterval:         uint32(cfg.MQTT.SessionExpiryInterval.Seconds()),
+		ReconnectBackoff:              reconnectBackoff(cfg.MQTT.ReconnectInitialInterval, cfg.MQTT.ReconnectMaxInterval),
+		ConnectTimeout:                cfg.MQTT.ConnectTimeout,
+		OnConnectionUp:                t.onConnectionUp,
+		OnConnectError: func(err error) {
+			t.connectLog.Log(slog.LevelWarn, "Failed to connect to MQTT broker", "error", err)
+		},
+		ClientConfig: paho.ClientConfig{
+			ClientID: clientID,
+			OnPublishReceived: []func(paho.PublishReceived) (bool, error){
+				func(pr paho.PublishReceived) (bool, error) {
+					t.router.Route(pr.Packet.Packet())
+					return true, nil
+				},
+			},
+			OnClientError: func(err error) {
+				t.lostLog.Log(slog.LevelWarn, "Connection lost", "error", err)
+				t.connectionLost(err)
+			},
+			OnServerDisconnect: func(d *paho.Disconnect) {
+				t.lostLog.Log(slog.LevelWarn, "Disconnected by MQTT broker", "reason_code", d.ReasonCode)
+				t.connectionLost(fmt.Errorf("disconnected by broker with reason code %d", d.ReasonCode))
+			},
+		},
+	}
+
+	if cfg.MQTT.Username != "" {
+		t.clientCfg.ConnectUsername = cfg.MQTT.Username
+		t.clientCfg.ConnectPassword = []byte(cfg.MQTT.Password)
+	}
+
+	// Have the broker announce us as offline if we disappear unexpectedly
+	if cfg.MQTT.WillTopic != "" {
+		t.clientCfg.WillMessage = &paho.WillMessage{
+			Topic:   cfg.MQTT.WillTopic,
+			Payload: []byte(cfg.MQTT.WillPayload),
+			QoS:     cfg.MQTT.WillQoS,
+			Retain:  cfg.MQTT.WillRetained,
+		}
+	}
+
+	return t, nil
+}
+
+// reconnectBackoff doubles the delay between connection attempts from
+// initial up to max
+func reconnectBackoff(initial, max time.Duration) autopaho.Backoff {
+	return func(attempt int) time.Duration {
+		if attempt <= 0 {
+			return 0
+		}
+		delay := initial
+		for i := 1; i < attempt && delay < max; i++ {
+			delay *= 2
+		}
+		if delay > max {
+			delay = max
+		}
+		return delay
+	}
+}
+
+// SetConnectionHandlers sets the functions called when the connection comes
+// up and when it is lost
+func (t *v5Transport) SetConnectionHandlers(onUp func(), onLost func(error)) {
+	t.onUp = onUp
+	t.onLost = onLost
+}
+
+// onConnectionUp marks the connection as up
+func (t *v5Transport) onConnectionUp(cm *autopaho.ConnectionManager, connack *paho.Connack) {
+	t.connected.Store(true)
+	t.connectLog.Reset()
+	t.lostLog.Reset()
+	t.pendingLog.Reset()
+	if t.onUp != nil {
+		t.onUp()
+	}
+}
+
+// connectionLost marks the connection as down. A lost connection may be
+// reported both by the broker's DISCONNECT and the resulting client error,
+// so only the first report is passed on.
+func (t *v5Transport) connectionLost(err error) {
+	if !t.connected.Swap(false) {
+		return
+	}
+	traceConnectionLost(err)
+	if t.onLost != nil {
+		t.onLost(err)
+	}
+}
+
+// Connect starts the connection manager and blocks until the first
+// connection succeeds; it keeps retrying in the background until then
+func (t *v5Transport) Connect() error {
+	ctx, cancel := context.WithCancel(context.Background())
+	conn, err := autopaho.NewConnection(ctx, t.clientCfg)
+	if err != nil {
+		cancel()
+		return err
+	}
+	t.conn = conn
+	t.cancel = cancel
+
+	for {
+		waitCtx, waitCancel := context.WithTimeout(ctx, t.config.MQTT.ConnectTimeout)
+		err := conn.AwaitConnection(waitCtx)
+		waitCancel()
+		if err == nil {
+			return nil
+		}
+		if waitCtx.Err() == nil {
+			return err
+		}
+		t.pendingLog.Log(slog.LevelWarn, "Still trying to connect to MQTT broker", "brokers", t.config.GetRedactedMQTTBrokerURLs())
+	}
+}
+
+// Subscribe subscribes to topic
+func (t *v5Transport) Subscribe(topic string, qos byte, handler func(message)) error {
+	t.router.RegisterHandler(topic, func(p *paho.Publish) {
+		handler(message{Topic: p.Topic, Payload: p.Payload, Retained: p.Retain})
+	})
+
+	sub := paho.SubscribeOptions{Topic: topic, QoS: qos}
+	ctx, cancel := context.WithTimeout(context.Background(), v5Timeout)
+	defer cancel()
+	suback, err := t.conn.Subscribe(ctx, &paho.Subscribe{Subscriptions: []paho.SubscribeOptions{sub}})
+	if err != nil {
+		return err
+	}
+	// Reason codes of 0x80 and above indicate the subscription was refused
+	if len(suback.Reasons) > 0 && suback.Reasons[0] >= 0x80 {
+		return fmt.Errorf("subscription refused with reason code %d", suback.Reasons[0])
+	}
+	return nil
+}
+
+// Unsubscribe unsubscribes from topics
+func (t *v5Transport) Unsubscribe(topics ...string) error {
+	for _, topic := range topics {
+		t.router.UnregisterHandler(topic)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), v5Timeout)
+	defer cancel()
+	_, err := t.conn.Unsubscribe(ctx, &paho.Unsubscribe{Topics: topics})
+	return err
+}
+
+// Publish publishes a message without waiting for the broker
+func (t *v5Transport) Publish(topic string, qos byte, retained bool, payload []byte) <-chan error {
+	result := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), v5Timeout)
+		defer cancel()
+		_, err := t.conn.Publish(ctx, &paho.Publish{
+			Topic:   topic,
+			QoS:     qos,
+			Retain:  retained,
+			Payload: payload,
+		})
+		result <- err
+	}()
+	return result
+}
+
+// IsConnected reports whether the connection is up
+func (t *v5Transport) IsConnected() bool {
+	return t.conn != nil && t.connected.Load()
+}
+
+// Disconnect sends a DISCONNECT and stops reconnecting
+func (t *v5Transport) Disconnect() {
+	if t.conn == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), v5Timeout)
+	defer cancel()
+	if err := t.conn.Disconnect(ctx); err != nil {
+		slog.Warn("Error disconnecting from MQTT broker", "error", err)
+	}
+	t.connected.Store(false)
+	t.cancel()
+}
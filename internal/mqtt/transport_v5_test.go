@@ -0,0 +1,91 @@
+package mqtt
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ponytojas/go-mqtt-timescale/config"
+)
+
+// newTestV5Transport returns a v5 transport built from cfg
+func newTestV5Transport(t *testing.T, cfg *config.Config) *v5Transport {
+	t.Helper()
+	conn, err := newV5Transport(cfg, cfg.MQTT.ClientID)
+	if err != nil {
+		t.Fatalf("newV5Transport: %v", err)
+	}
+	return conn
+}
+
+func TestV5Session(t *testing.T) {
+	tests := []struct {
+		name         string
+		cleanSession bool
+		expiry       time.Duration
+		want         uint32
+	}{
+		{"persistent for an hour", false, time.Hour, 3600},
+		{"clean start", true, 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig()
+			cfg.MQTT.ProtocolVersion = 5
+			cfg.MQTT.CleanSession = tt.cleanSession
+			cfg.MQTT.SessionExpiryInterval = tt.expiry
+
+			clientCfg := newTestV5Transport(t, cfg).clientCfg
+			if clientCfg.CleanStartOnInitialConnection != tt.cleanSession {
+				t.Errorf("clean start = %v, want %v", clientCfg.CleanStartOnInitialConnection, tt.cleanSession)
+			}
+			if clientCfg.SessionExpiryInterval != tt.want {
+				t.Errorf("session expiry = %d, want %d", clientCfg.SessionExpiryInterval, tt.want)
+			}
+		})
+	}
+}
+
+func TestV5KeepAlive(t *testing.T) {
+	tests := []struct {
+		keepAlive time.Duration
+		want      uint16 // seconds
+	}{
+		{30 * time.Second, 30},
+		{15 * time.Second, 15},
+		{90 * time.Minute, 5400},
+	}
+	for _, tt := range tests {
+		t.Run(tt.keepAlive.String(), func(t *testing.T) {
+			cfg := testConfig()
+			cfg.MQTT.ProtocolVersion = 5
+			cfg.MQTT.KeepAlive = tt.keepAlive
+			if got := newTestV5Transport(t, cfg).clientCfg.KeepAlive; got != tt.want {
+				t.Errorf("keep alive = %ds, want %ds", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestV5Will(t *testing.T) {
+	cfg := testConfig()
+	cfg.MQTT.ProtocolVersion = 5
+	cfg.MQTT.WillTopic = "status/ingest"
+	will := newTestV5Transport(t, cfg).clientCfg.WillMessage
+	if will == nil || will.Topic != "status/ingest" || string(will.Payload) != cfg.MQTT.WillPayload || will.QoS != cfg.MQTT.WillQoS || will.Retain != cfg.MQTT.WillRetained {
+		t.Errorf("will = %+v", will)
+	}
+
+	cfg.MQTT.WillTopic = ""
+	if will := newTestV5Transport(t, cfg).clientCfg.WillMessage; will != nil {
+		t.Errorf("will = %+v without a will topic, want none", will)
+	}
+}
+
+func TestReconnectBackoff(t *testing.T) {
+	backoff := reconnectBackoff(time.Second, 5*time.Second)
+	for attempt, want := range []time.Duration{0, time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second} {
+		if got := backoff(attempt); got != want {
+			t.Errorf("attempt %d waits %s, want %s", attempt, got, want)
+		}
+	}
+}
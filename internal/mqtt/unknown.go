@@ -0,0 +1,31 @@
+package mqtt
+
+import (
+	"log/slog"
+	"sort"
+	"strings"
+
+	"github.com/ponytojas/go-mqtt-timescale/internal/metrics"
+)
+
+// newPathRoots returns the top-level keys of the configured field paths,
+// whose objects are read by the paths rather than stored themselves
+func newPathRoots(paths map[string]string) map[string]bool {
+	if len(paths) == 0 {
+		return nil
+	}
+	roots := make(map[string]bool, len(paths))
+	for _, path := range paths {
+		root, _, _ := strings.Cut(path, ".")
+		roots[root] = true
+	}
+	return roots
+}
+
+// reportUnknownFields counts payload keys of a reading that aren't stored
+// in any column and logs them, at most once per logging.repeat_interval
+func (c *Client) reportUnknownFields(deviceID string, keys []string) {
+	metrics.UnknownFields.Add(float64(len(keys)))
+	sort.Strings(keys)
+	c.unknownLog.Log(slog.LevelWarn, "Dropping payload fields that aren't stored in any column", "device_id", deviceID, "fields", keys)
+}
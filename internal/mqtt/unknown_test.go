@@ -0,0 +1,70 @@
+package mqtt
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/ponytojas/go-mqtt-timescale/config"
+	"github.com/ponytojas/go-mqtt-timescale/internal/metrics"
+)
+
+func TestUnknownFieldsAreCounted(t *testing.T) {
+	tests := []struct {
+		name    string
+		modify  func(*config.Config)
+		payload string
+		want    float64 // unknown fields counted
+	}{
+		{"known fields", func(*config.Config) {}, `{"device_id":"d1","temperature":21,"humidity":40,"light":300,"timestamp":"2024-05-01T12:00:00Z"}`, 0},
+		{"numeric fields go to metrics", func(*config.Config) {}, `{"device_id":"d1","temperature":21,"co2":415}`, 0},
+		{"string field", func(*config.Config) {}, `{"device_id":"d1","temperature":21,"note":"hello"}`, 1},
+		{"every unknown field", func(*config.Config) {}, `{"device_id":"d1","temperature":21,"note":"hello","ok":true,"meta":{"a":1},"list":[1]}`, 4},
+		{"tag columns", func(c *config.Config) { c.Timescale.TagColumns = []string{"firmware"} }, `{"device_id":"d1","temperature":21,"firmware":"1.2"}`, 0},
+		{"field path objects", func(c *config.Config) { c.MQTT.FieldPaths = map[string]string{"temperature": "sensor.temp"} }, `{"device_id":"d1","sensor":{"temp":21}}`, 0},
+		{"mapped fields", func(c *config.Config) { c.MQTT.FieldMap = map[string]string{"Temp": "temperature"} }, `{"device_id":"d1","Temp":21}`, 0},
+		{"custom device and timestamp fields", func(c *config.Config) {
+			c.MQTT.DeviceIDField = "dev"
+			c.MQTT.TimestampField = "ts"
+		}, `{"dev":"d1","temperature":21,"ts":"2024-05-01T12:00:00Z"}`, 0},
+		{"disabled", func(c *config.Config) { c.Ingest.WarnUnknownFields = false }, `{"device_id":"d1","temperature":21,"note":"hello"}`, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig()
+			cfg.Ingest.WarnUnknownFields = true
+			tt.modify(cfg)
+			before := testutil.ToFloat64(metrics.UnknownFields)
+			rows, err := ingest(t, cfg, "sensor/d1", tt.payload)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(rows) != 1 {
+				t.Fatalf("stored %d readings, want 1", len(rows))
+			}
+			if got := testutil.ToFloat64(metrics.UnknownFields) - before; got != tt.want {
+				t.Errorf("counted %v unknown fields, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUnknownFieldsAreLoggedRateLimited(t *testing.T) {
+	logs := captureLogs(t)
+	cfg := testConfig()
+	cfg.Ingest.WarnUnknownFields = true
+	c, _, _ := newTestClient(t, cfg)
+	for i := 0; i < 5; i++ {
+		c.processMessage(context.Background(), cfg.Timescale.TableName, "sensor/d1", []byte(`{"device_id":"d1","temperature":21,"zeta":"z","alpha":"a"}`), false)
+	}
+
+	if n := strings.Count(logs.String(), "Dropping payload fields"); n != 1 {
+		t.Errorf("logged unknown fields %d times, want once:\n%s", n, logs)
+	}
+	// Sorted so the log line is stable
+	if !strings.Contains(logs.String(), "device_id=d1 fields=\"[alpha zeta]\"") {
+		t.Errorf("log lacks the device and its sorted fields:\n%s", logs)
+	}
+}
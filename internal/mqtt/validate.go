@@ -0,0 +1,41 @@
+package mqtt
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/ponytojas/go-mqtt-timescale/config"
+	"github.com/ponytojas/go-mqtt-timescale/internal/models"
+)
+
+// validateSensorData checks the sensor values present in data against the
+// configured ranges, returning an error naming every value out of range
+func validateSensorData(cfg *config.ValidationConfig, data *models.SensorData) error {
+	var problems []string
+	check := func(name string, r config.RangeConfig, v *float64) {
+		if v != nil && !r.Contains(*v) {
+			problems = append(problems, fmt.Sprintf("%s %v out of range", name, *v))
+		}
+	}
+	check("temperature", cfg.Temperature, data.Temperature)
+	check("humidity", cfg.Humidity, data.Humidity)
+	check("light", cfg.Light, data.Light)
+
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid reading: %s", strings.Join(problems, ", "))
+	}
+	return nil
+}
+
+// clearOutOfRange sets every sensor value outside its range to nil so that
+// it is stored as NULL
+func clearOutOfRange(cfg *config.ValidationConfig, data *models.SensorData) {
+	unset := func(r config.RangeConfig, v **float64) {
+		if *v != nil && !r.Contains(**v) {
+			*v = nil
+		}
+	}
+	unset(cfg.Temperature, &data.Temperature)
+	unset(cfg.Humidity, &data.Humidity)
+	unset(cfg.Light, &data.Light)
+}
@@ -0,0 +1,94 @@
+package mqtt
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/ponytojas/go-mqtt-timescale/config"
+	"github.com/ponytojas/go-mqtt-timescale/internal/models"
+)
+
+// testRanges bounds temperature to [-40, 60] and humidity to [0, 100],
+// leaving light unchecked
+func testRanges() config.ValidationConfig {
+	return config.ValidationConfig{
+		Temperature: config.RangeConfig{Min: ptr(-40), Max: ptr(60)},
+		Humidity:    config.RangeConfig{Min: ptr(0), Max: ptr(100)},
+	}
+}
+
+func TestValidateSensorData(t *testing.T) {
+	tests := []struct {
+		name string
+		data models.SensorData
+		want []string // what the error names, nil when valid
+	}{
+		{"in range", models.SensorData{Temperature: ptr(21), Humidity: ptr(40)}, nil},
+		{"on the bounds", models.SensorData{Temperature: ptr(-40), Humidity: ptr(100)}, nil},
+		{"missing values", models.SensorData{}, nil},
+		{"unchecked value", models.SensorData{Light: ptr(1e9)}, nil},
+		{"one value out of range", models.SensorData{Temperature: ptr(-999), Humidity: ptr(40)}, []string{"temperature -999 out of range"}},
+		{"every value out of range", models.SensorData{Temperature: ptr(-999), Humidity: ptr(3000)}, []string{"temperature -999 out of range", "humidity 3000 out of range"}},
+	}
+	cfg := testRanges()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateSensorData(&cfg, &tt.data)
+			if (err != nil) != (tt.want != nil) {
+				t.Fatalf("error = %v, want one naming %v", err, tt.want)
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("error %q does not mention %q", err, want)
+				}
+			}
+		})
+	}
+}
+
+func TestOutOfRangeModes(t *testing.T) {
+	const (
+		inRange  = `{"device_id":"d1","temperature":21,"humidity":40}`
+		oneBad   = `{"device_id":"d1","temperature":-999,"humidity":40}`
+		everyBad = `{"device_id":"d1","temperature":-999,"humidity":3000}`
+	)
+	tests := []struct {
+		mode    string
+		payload string
+		wantErr bool
+		want    *models.SensorData // the values stored, nil when nothing is
+	}{
+		{"reject", inRange, false, &models.SensorData{Temperature: ptr(21), Humidity: ptr(40)}},
+		{"reject", oneBad, true, nil},
+		{"reject", everyBad, true, nil},
+		{"drop", oneBad, false, nil},
+		{"drop", everyBad, false, nil},
+		{"null", oneBad, false, &models.SensorData{Humidity: ptr(40)}},
+		{"null", everyBad, false, &models.SensorData{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.mode+" "+tt.payload, func(t *testing.T) {
+			cfg := testConfig()
+			cfg.Validation = testRanges()
+			cfg.Validation.Mode = tt.mode
+
+			rows, err := ingest(t, cfg, "sensor/d1", tt.payload)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if tt.want == nil {
+				if len(rows) != 0 {
+					t.Errorf("stored %d readings, want none", len(rows))
+				}
+				return
+			}
+			if len(rows) != 1 {
+				t.Fatalf("stored %d readings, want 1", len(rows))
+			}
+			if !equalValue(rows[0].Temperature, tt.want.Temperature) || !equalValue(rows[0].Humidity, tt.want.Humidity) {
+				t.Errorf("stored temperature %v and humidity %v, want %v and %v",
+					rows[0].Temperature, rows[0].Humidity, tt.want.Temperature, tt.want.Humidity)
+			}
+		})
+	}
+}
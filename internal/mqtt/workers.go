@@ -0,0 +1,92 @@
+package mqtt
+
+import (
+	"hash/fnv"
+	"sync"
+)
+
+// workerQueueSize is how many messages may wait for each worker before the
+// MQTT handler blocks
+const workerQueueSize = 100
+
+// workerPool processes messages on a fixed number of goroutines. Keyed pools
+// give every worker a queue of its own and route each key to the same one,
+// so messages with the same key are processed in the order they arrived;
+// otherwise all workers share a single queue.
+type workerPool struct {
+	queues []chan func()
+	done   chan struct{}
+	wg     sync.WaitGroup
+}
+
+// newWorkerPool starts workers goroutines, returning nil when workers is 0
+// so messages are processed on the MQTT client's goroutines
+func newWorkerPool(workers int, keyed bool) *workerPool {
+	if workers <= 0 {
+		return nil
+	}
+
+	p := &workerPool{done: make(chan struct{})}
+	if keyed {
+		p.queues = make([]chan func(), workers)
+		for i := range p.queues {
+			p.queues[i] = make(chan func(), workerQueueSize)
+		}
+	} else {
+		p.queues = []chan func(){make(chan func(), workers*workerQueueSize)}
+	}
+
+	for i := 0; i < workers; i++ {
+		p.wg.Add(1)
+		go p.work(p.queues[i%len(p.queues)])
+	}
+	return p
+}
+
+// work runs jobs from queue until the pool is closed
+func (p *workerPool) work(queue chan func()) {
+	defer p.wg.Done()
+	for {
+		select {
+		case job := <-queue:
+			job()
+		case <-p.done:
+			return
+		}
+	}
+}
+
+// worker returns the index of the queue jobs with key are routed to
+func (p *workerPool) worker(key string) int {
+	if len(p.queues) == 1 {
+		return 0
+	}
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32() % uint32(len(p.queues)))
+}
+
+// dispatch queues job on the worker for key, blocking while its queue is
+// full. It returns false without running job if the pool is closed.
+func (p *workerPool) dispatch(key string, job func()) bool {
+	// A queue with room would otherwise take the job after the workers
+	// stopped, leaving it tracked but never run
+	select {
+	case <-p.done:
+		return false
+	default:
+	}
+	select {
+	case p.queues[p.worker(key)] <- job:
+		return true
+	case <-p.done:
+		return false
+	}
+}
+
+// close stops the workers once their current jobs finish; jobs still queued
+// are not run
+func (p *workerPool) close() {
+	close(p.done)
+	p.wg.Wait()
+}
@@ -0,0 +1,178 @@
+package mqtt
+
+import (
+	"fmt"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestNoWorkersProcessesOnTheClient(t *testing.T) {
+	if p := newWorkerPool(0, true); p != nil {
+		t.Errorf("newWorkerPool(0) = %v, want nil", p)
+	}
+}
+
+func TestWorkerRouting(t *testing.T) {
+	tests := []struct {
+		name        string
+		keyed       bool
+		wantWorkers int // distinct queues 100 devices are routed to
+	}{
+		{"keyed", true, 4},
+		{"shared queue", false, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newWorkerPool(4, tt.keyed)
+			t.Cleanup(p.close)
+
+			used := make(map[int]bool)
+			for i := 0; i < 100; i++ {
+				key := fmt.Sprintf("device-%d", i)
+				w := p.worker(key)
+				for j := 0; j < 10; j++ {
+					if again := p.worker(key); again != w {
+						t.Fatalf("%s routed to worker %d, then %d", key, w, again)
+					}
+				}
+				used[w] = true
+			}
+			if len(used) != tt.wantWorkers {
+				t.Errorf("devices routed to %d workers, want %d", len(used), tt.wantWorkers)
+			}
+		})
+	}
+}
+
+func TestKeyedWorkersKeepEachKeyInOrder(t *testing.T) {
+	p := newWorkerPool(4, true)
+	t.Cleanup(p.close)
+
+	var mu sync.Mutex
+	got := make(map[string][]int)
+	var wg sync.WaitGroup
+	devices := []string{"d1", "d2", "d3", "d4", "d5", "d6"}
+	for seq := 0; seq < 200; seq++ {
+		for _, device := range devices {
+			device, seq := device, seq
+			wg.Add(1)
+			p.dispatch(device, func() {
+				defer wg.Done()
+				mu.Lock()
+				defer mu.Unlock()
+				got[device] = append(got[device], seq)
+			})
+		}
+	}
+	wg.Wait()
+
+	for _, device := range devices {
+		if len(got[device]) != 200 || !slices.IsSorted(got[device]) {
+			t.Errorf("%s processed %d jobs out of order: %v", device, len(got[device]), got[device])
+		}
+	}
+}
+
+func TestBusyWorkerDoesNotHoldUpOtherDevices(t *testing.T) {
+	p := newWorkerPool(4, true)
+	t.Cleanup(p.close)
+
+	// Find a device routed to another worker than d1
+	other := ""
+	for i := 0; other == ""; i++ {
+		if key := fmt.Sprintf("device-%d", i); p.worker(key) != p.worker("d1") {
+			other = key
+		}
+	}
+
+	release := make(chan struct{})
+	d1Done, otherDone := make(chan struct{}), make(chan struct{})
+	p.dispatch("d1", func() { <-release })
+	p.dispatch("d1", func() { close(d1Done) })
+	p.dispatch(other, func() { close(otherDone) })
+
+	select {
+	case <-otherDone:
+	case <-time.After(time.Second):
+		t.Fatalf("%s waited for d1's worker", other)
+	}
+	select {
+	case <-d1Done:
+		t.Fatal("d1's second message ran before its first finished")
+	default:
+	}
+	close(release)
+	select {
+	case <-d1Done:
+	case <-time.After(time.Second):
+		t.Fatal("d1's second message never ran")
+	}
+}
+
+func TestDispatchAfterCloseIsRefused(t *testing.T) {
+	p := newWorkerPool(2, true)
+	p.close()
+	if p.dispatch("d1", func() { t.Error("job ran on a closed pool") }) {
+		t.Error("dispatch on a closed pool = true, want false")
+	}
+}
+
+func TestClientKeepsEachDeviceInOrder(t *testing.T) {
+	cfg := testConfig()
+	cfg.MQTT.TopicTemplate = "sensor/+device_id"
+	cfg.Ingest.Workers = 4
+	cfg.Ingest.OrderByDevice = true
+	c, store, conn := newTestClient(t, cfg)
+	conn.up()
+	if err := c.Subscribe(); err != nil {
+		t.Fatal(err)
+	}
+
+	devices := []string{"d1", "d2", "d3"}
+	for seq := 0; seq < 50; seq++ {
+		for _, device := range devices {
+			payload := fmt.Sprintf(`{"temperature":%d}`, seq)
+			if !conn.deliver(conn.subscribes[0], message{Topic: "sensor/" + device, Payload: []byte(payload)}) {
+				t.Fatal("no handler subscribed")
+			}
+		}
+	}
+	eventually(t, 5*time.Second, "every reading", func() bool {
+		return len(store.rows(cfg.Timescale.TableName)) == 150
+	})
+
+	got := make(map[string][]float64)
+	for _, row := range store.rows(cfg.Timescale.TableName) {
+		got[row.Device_ID] = append(got[row.Device_ID], *row.Temperature)
+	}
+	for _, device := range devices {
+		if !slices.IsSorted(got[device]) {
+			t.Errorf("%s stored out of order: %v", device, got[device])
+		}
+	}
+}
+
+func TestDeviceKey(t *testing.T) {
+	tests := []struct {
+		name     string
+		template string
+		topic    string
+		want     string
+	}{
+		{"device from the template", "sensor/+device_id/data", "sensor/d1/data", "d1"},
+		{"topic outside the template", "sensor/+device_id/data", "other/d1", "other/d1"},
+		{"no template", "", "sensor/d1", "sensor/d1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig()
+			cfg.MQTT.TopicTemplate = tt.template
+			c, _, _ := newTestClient(t, cfg)
+			if got := c.deviceKey(tt.topic); got != tt.want {
+				t.Errorf("deviceKey(%q) = %q, want %q", tt.topic, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,74 @@
+package ratelimit
+
+import (
+	"time"
+
+	"github.com/ponytojas/go-mqtt-timescale/internal/ttlmap"
+)
+
+// bucket is a token bucket for a single key
+type bucket struct {
+	tokens   float64
+	lastSeen time.Time
+}
+
+// RateLimiter is a token-bucket rate limiter keyed by an arbitrary string,
+// such as a device ID. Buckets of keys that have been idle for longer than
+// the idle timeout are evicted in the background to bound memory.
+type RateLimiter struct {
+	rate  float64 // tokens added per second
+	burst float64 // bucket capacity
+
+	// buckets forget a key once it has been idle for the idle timeout. An
+	// idle bucket has refilled completely by then, so forgetting it changes
+	// nothing as long as the timeout is at least burst/rate.
+	buckets *ttlmap.Map[string, bucket]
+}
+
+// New creates a RateLimiter allowing rate events per second per key with
+// bursts of up to burst events. Keys idle for idleTimeout are forgotten.
+func New(rate float64, burst int, idleTimeout time.Duration) *RateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &RateLimiter{
+		rate:    rate,
+		burst:   float64(burst),
+		buckets: ttlmap.New[string, bucket](idleTimeout, 0),
+	}
+}
+
+// Allow reports whether an event for key may happen now, consuming a token
+// if so
+func (l *RateLimiter) Allow(key string) bool {
+	var allowed bool
+	l.buckets.Update(key, func(b bucket, found bool) bucket {
+		now := time.Now()
+		if !found {
+			b.tokens = l.burst
+		} else {
+			b.tokens += now.Sub(b.lastSeen).Seconds() * l.rate
+			if b.tokens > l.burst {
+				b.tokens = l.burst
+			}
+		}
+		b.lastSeen = now
+
+		if b.tokens >= 1 {
+			b.tokens--
+			allowed = true
+		}
+		return b
+	})
+	return allowed
+}
+
+// Len returns the number of keys currently tracked
+func (l *RateLimiter) Len() int {
+	return l.buckets.Len()
+}
+
+// Close stops evicting idle buckets
+func (l *RateLimiter) Close() {
+	l.buckets.Close()
+}
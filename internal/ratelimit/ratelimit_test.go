@@ -0,0 +1,85 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAllow(t *testing.T) {
+	tests := []struct {
+		name    string
+		rate    float64
+		burst   int
+		events  int
+		allowed int
+	}{
+		{"within the burst", 1, 5, 5, 5},
+		{"over the burst", 1, 5, 8, 5},
+		{"burst below one", 1, 0, 3, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := New(tt.rate, tt.burst, time.Minute)
+			defer l.Close()
+
+			allowed := 0
+			for i := 0; i < tt.events; i++ {
+				if l.Allow("d1") {
+					allowed++
+				}
+			}
+			if allowed != tt.allowed {
+				t.Errorf("allowed %d of %d events, want %d", allowed, tt.events, tt.allowed)
+			}
+		})
+	}
+}
+
+func TestThrottledDeviceDoesNotAffectOthers(t *testing.T) {
+	l := New(1, 2, time.Minute)
+	defer l.Close()
+
+	for i := 0; i < 100; i++ {
+		l.Allow("noisy")
+	}
+	if l.Allow("noisy") {
+		t.Error("noisy device allowed past its rate")
+	}
+	for i := 0; i < 2; i++ {
+		if !l.Allow("quiet") {
+			t.Errorf("quiet device throttled on event %d", i+1)
+		}
+	}
+}
+
+func TestTokensRefillAtTheRate(t *testing.T) {
+	l := New(100, 1, time.Minute)
+	defer l.Close()
+
+	if !l.Allow("d1") || l.Allow("d1") {
+		t.Fatal("want exactly one event allowed from a full bucket of one")
+	}
+	// One token every 10ms
+	time.Sleep(30 * time.Millisecond)
+	if !l.Allow("d1") {
+		t.Error("event refused after the bucket refilled")
+	}
+}
+
+func TestIdleDevicesAreEvicted(t *testing.T) {
+	l := New(1, 1, 20*time.Millisecond)
+	defer l.Close()
+
+	l.Allow("d1")
+	l.Allow("d2")
+	if l.Len() != 2 {
+		t.Fatalf("tracking %d devices, want 2", l.Len())
+	}
+	deadline := time.Now().Add(time.Second)
+	for l.Len() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("still tracking %d idle devices", l.Len())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
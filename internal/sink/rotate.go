@@ -0,0 +1,86 @@
+package sink
+
+import (
+	"fmt"
+	"os"
+)
+
+// rotatingFile is a file that is rotated once writing to it would make it
+// exceed maxSize. Rotated files are kept as path.1 (newest) to
+// path.<maxBackups> (oldest); older ones are removed.
+type rotatingFile struct {
+	path       string
+	maxSize    int64 // 0 disables rotation
+	maxBackups int
+
+	file *os.File
+	size int64
+}
+
+// openRotatingFile opens path for appending, creating it if needed
+func openRotatingFile(path string, maxSize int64, maxBackups int) (*rotatingFile, error) {
+	f := &rotatingFile{path: path, maxSize: maxSize, maxBackups: maxBackups}
+	if err := f.open(os.O_APPEND); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// open opens the file with the given extra flag, picking up its size
+func (f *rotatingFile) open(flag int) error {
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_WRONLY|flag, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to open sink file %s: %w", f.path, err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("failed to stat sink file %s: %w", f.path, err)
+	}
+	f.file = file
+	f.size = info.Size()
+	return nil
+}
+
+// Write writes p, rotating first if p would not fit. A single write larger
+// than maxSize still goes to a file of its own.
+func (f *rotatingFile) Write(p []byte) (int, error) {
+	if f.maxSize > 0 && f.size > 0 && f.size+int64(len(p)) > f.maxSize {
+		if err := f.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+// rotate shifts the backups up by one, moves the current file to path.1
+// and starts a new, empty file
+func (f *rotatingFile) rotate() error {
+	if err := f.file.Close(); err != nil {
+		return fmt.Errorf("failed to close sink file %s: %w", f.path, err)
+	}
+
+	if f.maxBackups > 0 {
+		for i := f.maxBackups - 1; i >= 1; i-- {
+			if err := os.Rename(f.backup(i), f.backup(i+1)); err != nil && !os.IsNotExist(err) {
+				return fmt.Errorf("failed to rotate sink file %s: %w", f.backup(i), err)
+			}
+		}
+		if err := os.Rename(f.path, f.backup(1)); err != nil {
+			return fmt.Errorf("failed to rotate sink file %s: %w", f.path, err)
+		}
+	}
+	return f.open(os.O_TRUNC)
+}
+
+// backup returns the name of the i-th rotated file
+func (f *rotatingFile) backup(i int) string {
+	return fmt.Sprintf("%s.%d", f.path, i)
+}
+
+// Close closes the current file
+func (f *rotatingFile) Close() error {
+	return f.file.Close()
+}
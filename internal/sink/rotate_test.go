@@ -0,0 +1,93 @@
+package sink
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRotatingFile(t *testing.T) {
+	tests := []struct {
+		name       string
+		maxSize    int64
+		maxBackups int
+		writes     []string
+		want       []string // the contents of path, path.1, path.2, ...
+	}{
+		{"no rotation", 0, 2, []string{"aaaa\n", "bbbb\n", "cccc\n"}, []string{"aaaa\nbbbb\ncccc\n"}},
+		{"fits exactly", 10, 2, []string{"aaaa\n", "bbbb\n"}, []string{"aaaa\nbbbb\n"}},
+		{"rotated", 10, 2, []string{"aaaa\n", "bbbb\n", "cccc\n"}, []string{"cccc\n", "aaaa\nbbbb\n"}},
+		{"backups shift", 10, 2, []string{"aaaa\n", "bbbb\n", "cccc\n", "dddd\n", "eeee\n"},
+			[]string{"eeee\n", "cccc\ndddd\n", "aaaa\nbbbb\n"}},
+		{"oldest backup removed", 5, 2, []string{"aaaa\n", "bbbb\n", "cccc\n", "dddd\n"},
+			[]string{"dddd\n", "cccc\n", "bbbb\n"}},
+		{"no backups", 10, 0, []string{"aaaa\n", "bbbb\n", "cccc\n"}, []string{"cccc\n"}},
+		{"oversized write", 4, 1, []string{"aa\n", "bbbbbbbb\n", "cc\n"}, []string{"cc\n", "bbbbbbbb\n"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "readings.jsonl")
+			f, err := openRotatingFile(path, tt.maxSize, tt.maxBackups)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, w := range tt.writes {
+				if _, err := f.Write([]byte(w)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := f.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			for i, want := range tt.want {
+				name := path
+				if i > 0 {
+					name = f.backup(i)
+				}
+				got, err := os.ReadFile(name)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if string(got) != want {
+					t.Errorf("%s = %q, want %q", filepath.Base(name), got, want)
+				}
+			}
+			if _, err := os.Stat(f.backup(len(tt.want))); !os.IsNotExist(err) {
+				t.Errorf("%s exists, want %d files", filepath.Base(f.backup(len(tt.want))), len(tt.want))
+			}
+		})
+	}
+}
+
+func TestRotatingFileAppendsToAnExistingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "readings.jsonl")
+	if err := os.WriteFile(path, []byte("aaaa\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	f, err := openRotatingFile(path, 10, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The existing size counts towards the limit
+	for _, w := range []string{"bbbb\n", "cccc\n"} {
+		if _, err := f.Write([]byte(w)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	f.Close()
+
+	got, _ := os.ReadFile(path)
+	backup, _ := os.ReadFile(f.backup(1))
+	if string(got) != "cccc\n" || string(backup) != "aaaa\nbbbb\n" {
+		t.Errorf("files = %q and %q, want %q and %q", got, backup, "cccc\n", "aaaa\nbbbb\n")
+	}
+}
+
+func TestOpenRotatingFileFails(t *testing.T) {
+	_, err := openRotatingFile(filepath.Join(t.TempDir(), "missing", "readings.jsonl"), 0, 0)
+	if err == nil || !strings.Contains(err.Error(), "failed to open sink file") {
+		t.Errorf("error = %v, want the open failure", err)
+	}
+}
@@ -0,0 +1,127 @@
+package sink
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+
+	"github.com/ponytojas/go-mqtt-timescale/config"
+	"github.com/ponytojas/go-mqtt-timescale/internal/metrics"
+	"github.com/ponytojas/go-mqtt-timescale/internal/models"
+)
+
+// record is a single reading written by a sink, with the table it was
+// routed to
+type record struct {
+	Table string `json:"table"`
+	*models.SensorData
+}
+
+// InsertHook is called with the rows written for a table
+type InsertHook func(tableName string, batch []*models.SensorData)
+
+// ErrorHook is called with the rows that failed to be written for a table
+type ErrorHook func(tableName string, batch []*models.SensorData, err error)
+
+// Sink writes readings as JSON lines instead of storing them in a database,
+// for devices that run without one. It satisfies mqtt.Storage.
+type Sink struct {
+	mu     sync.Mutex
+	w      io.Writer
+	closer io.Closer // nil when the writer isn't owned by the sink
+	table  string    // written for readings without a table
+
+	hook      atomic.Pointer[InsertHook]
+	errorHook atomic.Pointer[ErrorHook]
+}
+
+// New creates the sink selected by cfg.Type, which must be stdout or file.
+// Readings inserted without a table are written for tableName.
+func New(cfg config.SinkConfig, tableName string) (*Sink, error) {
+	switch cfg.Type {
+	case "stdout":
+		return &Sink{w: os.Stdout, table: tableName}, nil
+	case "file":
+		file, err := openRotatingFile(cfg.File.Path, int64(cfg.File.MaxSizeMB)*1024*1024, cfg.File.MaxBackups)
+		if err != nil {
+			return nil, err
+		}
+		return &Sink{w: file, closer: file, table: tableName}, nil
+	default:
+		return nil, fmt.Errorf("unsupported sink type %q", cfg.Type)
+	}
+}
+
+// InsertSensorData writes data for the default table
+func (s *Sink) InsertSensorData(ctx context.Context, data *models.SensorData) error {
+	return s.EnqueueSensorDataInto(ctx, s.table, data)
+}
+
+// InsertSensorDataBatch writes every row of batch for the default table,
+// stopping at the first that fails
+func (s *Sink) InsertSensorDataBatch(ctx context.Context, batch []*models.SensorData) error {
+	for _, data := range batch {
+		if err := s.EnqueueSensorDataInto(ctx, s.table, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// EnqueueSensorDataInto writes data as a single JSON line
+func (s *Sink) EnqueueSensorDataInto(ctx context.Context, tableName string, data *models.SensorData) error {
+	line, err := json.Marshal(record{Table: tableName, SensorData: data})
+	if err != nil {
+		return fmt.Errorf("failed to encode sensor data: %w", err)
+	}
+	line = append(line, '\n')
+
+	s.mu.Lock()
+	_, err = s.w.Write(line)
+	s.mu.Unlock()
+	if err != nil {
+		err = fmt.Errorf("failed to write sensor data: %w", err)
+		metrics.RowsLost.Inc()
+		if hook := s.errorHook.Load(); hook != nil {
+			(*hook)(tableName, []*models.SensorData{data}, err)
+		}
+		return err
+	}
+
+	metrics.DBInserts.Inc()
+	metrics.RecordInsert()
+	if hook := s.hook.Load(); hook != nil {
+		(*hook)(tableName, []*models.SensorData{data})
+	}
+	return nil
+}
+
+// SetInsertHook sets a function called after each reading is written
+func (s *Sink) SetInsertHook(hook InsertHook) {
+	s.hook.Store(&hook)
+}
+
+// SetErrorHook sets a function called when a reading can't be written
+func (s *Sink) SetErrorHook(hook ErrorHook) {
+	s.errorHook.Store(&hook)
+}
+
+// Ping always succeeds, a sink has no connection to check
+func (s *Sink) Ping(ctx context.Context) error {
+	return nil
+}
+
+// Close closes the sink's file, if any. Readings are written as they
+// arrive, so there is nothing left to flush.
+func (s *Sink) Close(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closer == nil {
+		return nil
+	}
+	return s.closer.Close()
+}
@@ -0,0 +1,206 @@
+package sink
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/ponytojas/go-mqtt-timescale/config"
+	"github.com/ponytojas/go-mqtt-timescale/internal/metrics"
+	"github.com/ponytojas/go-mqtt-timescale/internal/models"
+)
+
+// failingWriter is a writer whose writes always fail
+type failingWriter struct{}
+
+func (failingWriter) Write(p []byte) (int, error) {
+	return 0, errors.New("disk full")
+}
+
+func TestSinkWritesJSONLines(t *testing.T) {
+	temperature := 21.5
+	ts := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	var buf bytes.Buffer
+	s := &Sink{w: &buf}
+	var hooked []string
+	s.SetInsertHook(func(tableName string, batch []*models.SensorData) {
+		hooked = append(hooked, tableName+"/"+batch[0].Device_ID)
+	})
+	inserted := testutil.ToFloat64(metrics.DBInserts)
+
+	for _, r := range []struct{ table, device string }{{"indoor", "d1"}, {"outdoor", "d2"}} {
+		data := &models.SensorData{Device_ID: r.device, Timestamp: ts, Temperature: &temperature}
+		if err := s.EnqueueSensorDataInto(context.Background(), r.table, data); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// One JSON object per line, each with the table it was routed to
+	scanner := bufio.NewScanner(&buf)
+	var lines []record
+	for scanner.Scan() {
+		var r record
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			t.Fatalf("line %q is not JSON: %v", scanner.Text(), err)
+		}
+		lines = append(lines, r)
+	}
+	if len(lines) != 2 {
+		t.Fatalf("wrote %d lines, want 2", len(lines))
+	}
+	for i, want := range []struct{ table, device string }{{"indoor", "d1"}, {"outdoor", "d2"}} {
+		got := lines[i]
+		if got.Table != want.table || got.Device_ID != want.device || !got.Timestamp.Equal(ts) || *got.Temperature != temperature {
+			t.Errorf("line %d = %s %+v, want %s from %s", i, got.Table, got.SensorData, want.table, want.device)
+		}
+	}
+	if want := "indoor/d1 outdoor/d2"; strings.Join(hooked, " ") != want {
+		t.Errorf("insert hook saw %v, want %s", hooked, want)
+	}
+	// Counted as inserted for the summary logged on exit
+	if got := testutil.ToFloat64(metrics.DBInserts) - inserted; got != 2 {
+		t.Errorf("inserts += %v, want 2", got)
+	}
+}
+
+func TestSinkWritesTheRetainedFlag(t *testing.T) {
+	tests := []struct {
+		name     string
+		retained bool
+		want     bool // "retained":true is in the line
+	}{
+		{"live", false, false},
+		{"retained", true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			s := &Sink{w: &buf}
+			data := &models.SensorData{Device_ID: "d1", Timestamp: time.Now(), Retained: tt.retained}
+			if err := s.EnqueueSensorDataInto(context.Background(), "readings", data); err != nil {
+				t.Fatal(err)
+			}
+			if got := strings.Contains(buf.String(), `"retained":true`); got != tt.want {
+				t.Errorf("line %q has the retained flag = %v, want %v", buf.String(), got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSinkWriteError(t *testing.T) {
+	s := &Sink{w: failingWriter{}}
+	var hookErr error
+	s.SetErrorHook(func(tableName string, batch []*models.SensorData, err error) { hookErr = err })
+	s.SetInsertHook(func(string, []*models.SensorData) { t.Error("insert hook called for a failed write") })
+	lost := testutil.ToFloat64(metrics.RowsLost)
+
+	err := s.EnqueueSensorDataInto(context.Background(), "t", &models.SensorData{Device_ID: "d1"})
+	if err == nil || !strings.Contains(err.Error(), "disk full") {
+		t.Fatalf("error = %v, want the write error", err)
+	}
+	if !errors.Is(hookErr, err) {
+		t.Errorf("error hook got %v, want %v", hookErr, err)
+	}
+	if got := testutil.ToFloat64(metrics.RowsLost) - lost; got != 1 {
+		t.Errorf("rows lost += %v, want 1", got)
+	}
+}
+
+func TestNew(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		name    string
+		cfg     config.SinkConfig
+		wantErr string // substring of the error, "" when created
+	}{
+		{"stdout", config.SinkConfig{Type: "stdout"}, ""},
+		{"file", config.SinkConfig{Type: "file", File: config.FileSinkConfig{Path: filepath.Join(dir, "readings.jsonl"), MaxSizeMB: 1, MaxBackups: 3}}, ""},
+		{"unwritable file", config.SinkConfig{Type: "file", File: config.FileSinkConfig{Path: filepath.Join(dir, "missing", "readings.jsonl")}}, "failed to open sink file"},
+		{"timescale", config.SinkConfig{Type: "timescale"}, `unsupported sink type "timescale"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := New(tt.cfg, "readings")
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want one containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := s.Ping(context.Background()); err != nil {
+				t.Errorf("Ping: %v", err)
+			}
+			if err := s.Close(context.Background()); err != nil {
+				t.Errorf("Close: %v", err)
+			}
+		})
+	}
+}
+
+func TestSinkInsertsIntoTheDefaultTable(t *testing.T) {
+	var buf bytes.Buffer
+	s := &Sink{w: &buf, table: "readings"}
+	if err := s.InsertSensorData(context.Background(), &models.SensorData{Device_ID: "d1"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.InsertSensorDataBatch(context.Background(), []*models.SensorData{{Device_ID: "d2"}, {Device_ID: "d3"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	scanner := bufio.NewScanner(&buf)
+	var devices []string
+	for scanner.Scan() {
+		var r record
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			t.Fatalf("line %q is not JSON: %v", scanner.Text(), err)
+		}
+		if r.Table != "readings" {
+			t.Errorf("%s written for table %q, want readings", r.Device_ID, r.Table)
+		}
+		devices = append(devices, r.Device_ID)
+	}
+	if strings.Join(devices, ",") != "d1,d2,d3" {
+		t.Errorf("wrote devices %v, want d1, d2 and d3", devices)
+	}
+}
+
+func TestFileSinkRotates(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "readings.jsonl")
+	s, err := New(config.SinkConfig{Type: "file", File: config.FileSinkConfig{Path: path, MaxSizeMB: 1, MaxBackups: 1}}, "readings")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Around 100 bytes a line, so a few thousand readings exceed a megabyte
+	data := &models.SensorData{Device_ID: strings.Repeat("d", 50), Timestamp: time.Now()}
+	for i := 0; i < 20000; i++ {
+		if err := s.EnqueueSensorDataInto(context.Background(), "t", data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.Close(context.Background())
+
+	for _, name := range []string{path, path + ".1"} {
+		info, err := os.Stat(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Size() > 1024*1024 {
+			t.Errorf("%s holds %d bytes, over the 1MB limit", filepath.Base(name), info.Size())
+		}
+	}
+	if _, err := os.Stat(path + ".2"); !os.IsNotExist(err) {
+		t.Errorf("%s.2 exists beyond max_backups", filepath.Base(path))
+	}
+}
@@ -0,0 +1,223 @@
+package spool
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/ponytojas/go-mqtt-timescale/internal/metrics"
+	"github.com/ponytojas/go-mqtt-timescale/internal/models"
+)
+
+// segmentExt is the extension of spooled batch files
+const segmentExt = ".jsonl"
+
+// entry is a single spooled row
+type entry struct {
+	Table string             `json:"table"`
+	Data  *models.SensorData `json:"data"`
+}
+
+// InsertFunc writes a batch of rows to a table
+type InsertFunc func(ctx context.Context, tableName string, batch []*models.SensorData) error
+
+// Spool is a bounded on-disk queue of batches that could not be written to
+// the database. Each batch is stored in its own segment file, and the oldest
+// segments are dropped once the spool exceeds its maximum size.
+type Spool struct {
+	dir     string
+	maxSize int64
+
+	mu       sync.Mutex
+	segments []string // file names, oldest first
+	size     int64
+	next     uint64
+}
+
+// New opens the spool in dir, creating it if needed and picking up any
+// segments left by a previous run
+func New(dir string, maxSize int64) (*Spool, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create spool directory %s: %w", dir, err)
+	}
+
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read spool directory %s: %w", dir, err)
+	}
+
+	s := &Spool{dir: dir, maxSize: maxSize}
+	for _, file := range files {
+		name := file.Name()
+		if file.IsDir() || !strings.HasSuffix(name, segmentExt) {
+			continue
+		}
+		info, err := file.Info()
+		if err != nil {
+			return nil, fmt.Errorf("failed to stat spool segment %s: %w", name, err)
+		}
+		var seq uint64
+		if _, err := fmt.Sscanf(name, "%020d"+segmentExt, &seq); err != nil {
+			continue
+		}
+		if seq >= s.next {
+			s.next = seq + 1
+		}
+		s.segments = append(s.segments, name)
+		s.size += info.Size()
+	}
+	sort.Strings(s.segments)
+
+	if len(s.segments) > 0 {
+		slog.Info("Found spooled sensor data", "dir", dir, "segments", len(s.segments), "bytes", s.size)
+	}
+	metrics.SpoolBytes.Set(float64(s.size))
+	return s, nil
+}
+
+// Enqueue appends a batch for tableName to the spool, dropping the oldest
+// segments if the spool grows beyond its maximum size
+func (s *Spool) Enqueue(tableName string, batch []*models.SensorData) error {
+	if len(batch) == 0 {
+		return nil
+	}
+
+	var buf strings.Builder
+	enc := json.NewEncoder(&buf)
+	for _, data := range batch {
+		if err := enc.Encode(entry{Table: tableName, Data: data}); err != nil {
+			return fmt.Errorf("failed to encode spooled sensor data: %w", err)
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	name := fmt.Sprintf("%020d%s", s.next, segmentExt)
+	s.next++
+	if err := os.WriteFile(filepath.Join(s.dir, name), []byte(buf.String()), 0o644); err != nil {
+		return fmt.Errorf("failed to write spool segment %s: %w", name, err)
+	}
+	s.segments = append(s.segments, name)
+	s.size += int64(buf.Len())
+	metrics.SpoolEnqueued.Add(float64(len(batch)))
+
+	// Keep at least the segment just written, even if it alone exceeds the cap
+	for s.maxSize > 0 && s.size > s.maxSize && len(s.segments) > 1 {
+		dropped, err := s.removeOldest()
+		if err != nil {
+			return err
+		}
+		metrics.SpoolDropped.Add(float64(dropped))
+		slog.Warn("Spool is full, dropped oldest sensor data", "rows", dropped)
+	}
+	metrics.SpoolBytes.Set(float64(s.size))
+	return nil
+}
+
+// Replay writes spooled batches with insert, oldest first, and removes each
+// segment once it has been written. It stops at the first failure so the
+// remaining segments are retried on the next call. Segments rejected with an
+// error for which keep returns false are dropped instead of retried.
+func (s *Spool) Replay(ctx context.Context, insert InsertFunc, keep func(error) bool) (int, error) {
+	replayed := 0
+	for {
+		s.mu.Lock()
+		if len(s.segments) == 0 {
+			s.mu.Unlock()
+			return replayed, nil
+		}
+		name := s.segments[0]
+		s.mu.Unlock()
+
+		batches, err := s.read(name)
+		if err != nil {
+			return replayed, err
+		}
+
+		for tableName, batch := range batches {
+			if err := insert(ctx, tableName, batch); err != nil {
+				if keep(err) {
+					return replayed, err
+				}
+				slog.Error("Dropping spooled sensor data that can't be written", "segment", name, "table", tableName, "error", err)
+				metrics.SpoolDropped.Add(float64(len(batch)))
+				continue
+			}
+			replayed += len(batch)
+			metrics.SpoolReplayed.Add(float64(len(batch)))
+		}
+
+		s.mu.Lock()
+		// The segment may have been evicted while it was being replayed
+		if len(s.segments) > 0 && s.segments[0] == name {
+			if _, err := s.removeOldest(); err != nil {
+				s.mu.Unlock()
+				return replayed, err
+			}
+		}
+		metrics.SpoolBytes.Set(float64(s.size))
+		s.mu.Unlock()
+	}
+}
+
+// Len returns the number of spooled segments
+func (s *Spool) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.segments)
+}
+
+// read decodes a segment into batches keyed by table
+func (s *Spool) read(name string) (map[string][]*models.SensorData, error) {
+	file, err := os.Open(filepath.Join(s.dir, name))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open spool segment %s: %w", name, err)
+	}
+	defer file.Close()
+
+	batches := make(map[string][]*models.SensorData)
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var e entry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			// A partially written line from a crash; skip it
+			slog.Warn("Skipping corrupt spooled sensor data", "segment", name, "error", err)
+			continue
+		}
+		batches[e.Table] = append(batches[e.Table], e.Data)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read spool segment %s: %w", name, err)
+	}
+	return batches, nil
+}
+
+// removeOldest deletes the oldest segment, returning the number of rows it
+// held. s.mu must be held.
+func (s *Spool) removeOldest() (int, error) {
+	name := s.segments[0]
+	path := filepath.Join(s.dir, name)
+
+	rows := 0
+	if body, err := os.ReadFile(path); err == nil {
+		rows = strings.Count(string(body), "\n")
+	}
+	info, err := os.Stat(path)
+	if err == nil {
+		s.size -= info.Size()
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return 0, fmt.Errorf("failed to remove spool segment %s: %w", name, err)
+	}
+	s.segments = s.segments[1:]
+	return rows, nil
+}
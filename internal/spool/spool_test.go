@@ -0,0 +1,206 @@
+package spool
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/ponytojas/go-mqtt-timescale/internal/metrics"
+	"github.com/ponytojas/go-mqtt-timescale/internal/models"
+)
+
+// errDown is the error of an unreachable database
+var errDown = errors.New("database down")
+
+// batchOf returns a batch with one reading of each device
+func batchOf(devices ...string) []*models.SensorData {
+	batch := make([]*models.SensorData, len(devices))
+	for i, device := range devices {
+		batch[i] = &models.SensorData{Device_ID: device, Timestamp: time.Unix(1700000000, 0).UTC()}
+	}
+	return batch
+}
+
+// recorder is an InsertFunc recording the devices written to each table,
+// failing with err while it is set
+type recorder struct {
+	err    error
+	tables map[string][]string
+}
+
+// newRecorder returns a recorder whose inserts succeed
+func newRecorder() *recorder {
+	return &recorder{tables: make(map[string][]string)}
+}
+
+func (r *recorder) insert(ctx context.Context, tableName string, batch []*models.SensorData) error {
+	if r.err != nil {
+		return r.err
+	}
+	for _, data := range batch {
+		r.tables[tableName] = append(r.tables[tableName], data.Device_ID)
+	}
+	return nil
+}
+
+// retryable keeps segments that failed with errDown
+func retryable(err error) bool {
+	return errors.Is(err, errDown)
+}
+
+// openSpool opens a spool in a fresh directory
+func openSpool(t *testing.T, maxSize int64) (*Spool, string) {
+	t.Helper()
+	dir := filepath.Join(t.TempDir(), "spool")
+	s, err := New(dir, maxSize)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	return s, dir
+}
+
+func TestEnqueueThenReplay(t *testing.T) {
+	s, _ := openSpool(t, 0)
+	if err := s.Enqueue("indoor", batchOf("d1", "d2")); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Enqueue("outdoor", batchOf("d3")); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Enqueue("indoor", nil); err != nil {
+		t.Fatal(err)
+	}
+	if s.Len() != 2 {
+		t.Fatalf("spool holds %d segments, want 2", s.Len())
+	}
+
+	r := newRecorder()
+	replayed, err := s.Replay(context.Background(), r.insert, retryable)
+	if err != nil || replayed != 3 {
+		t.Fatalf("Replay = %d, %v, want 3 rows", replayed, err)
+	}
+	if got := r.tables["indoor"]; !slices.Equal(got, []string{"d1", "d2"}) {
+		t.Errorf("indoor got %v, want [d1 d2]", got)
+	}
+	if got := r.tables["outdoor"]; !slices.Equal(got, []string{"d3"}) {
+		t.Errorf("outdoor got %v, want [d3]", got)
+	}
+	if s.Len() != 0 {
+		t.Errorf("spool holds %d segments after replay, want 0", s.Len())
+	}
+}
+
+func TestReplayKeepsSegmentsWhileTheDatabaseIsDown(t *testing.T) {
+	s, _ := openSpool(t, 0)
+	for _, device := range []string{"d1", "d2"} {
+		if err := s.Enqueue("t", batchOf(device)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	r := newRecorder()
+	r.err = errDown
+	if replayed, err := s.Replay(context.Background(), r.insert, retryable); !errors.Is(err, errDown) || replayed != 0 {
+		t.Fatalf("Replay while down = %d, %v, want 0 rows and the insert error", replayed, err)
+	}
+	if s.Len() != 2 {
+		t.Fatalf("spool holds %d segments, want both kept", s.Len())
+	}
+
+	// Once the database recovers every spooled reading is written, oldest first
+	r.err = nil
+	if replayed, err := s.Replay(context.Background(), r.insert, retryable); err != nil || replayed != 2 {
+		t.Fatalf("Replay after recovery = %d, %v, want 2 rows", replayed, err)
+	}
+	if got := r.tables["t"]; !slices.Equal(got, []string{"d1", "d2"}) {
+		t.Errorf("replayed %v, want [d1 d2]", got)
+	}
+}
+
+func TestReplayDropsRejectedSegments(t *testing.T) {
+	s, _ := openSpool(t, 0)
+	if err := s.Enqueue("t", batchOf("d1")); err != nil {
+		t.Fatal(err)
+	}
+	before := testutil.ToFloat64(metrics.SpoolDropped)
+
+	r := newRecorder()
+	r.err = errors.New("invalid input syntax")
+	if replayed, err := s.Replay(context.Background(), r.insert, retryable); err != nil || replayed != 0 {
+		t.Fatalf("Replay = %d, %v, want 0 rows and no error", replayed, err)
+	}
+	if s.Len() != 0 {
+		t.Errorf("spool holds %d segments, want the rejected one dropped", s.Len())
+	}
+	if dropped := testutil.ToFloat64(metrics.SpoolDropped) - before; dropped != 1 {
+		t.Errorf("dropped %v rows, want 1", dropped)
+	}
+}
+
+func TestEnqueueEvictsOldestSegmentsOverTheCap(t *testing.T) {
+	// A one byte cap keeps only the segment just written
+	s, dir := openSpool(t, 1)
+	before := testutil.ToFloat64(metrics.SpoolDropped)
+	for _, batch := range [][]*models.SensorData{batchOf("d1", "d2"), batchOf("d3"), batchOf("d4")} {
+		if err := s.Enqueue("t", batch); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if s.Len() != 1 {
+		t.Fatalf("spool holds %d segments, want 1", s.Len())
+	}
+	if dropped := testutil.ToFloat64(metrics.SpoolDropped) - before; dropped != 3 {
+		t.Errorf("dropped %v rows, want 3", dropped)
+	}
+	if files, _ := os.ReadDir(dir); len(files) != 1 {
+		t.Errorf("spool directory holds %d files, want 1", len(files))
+	}
+
+	r := newRecorder()
+	if _, err := s.Replay(context.Background(), r.insert, retryable); err != nil {
+		t.Fatal(err)
+	}
+	if got := r.tables["t"]; !slices.Equal(got, []string{"d4"}) {
+		t.Errorf("replayed %v, want only the newest reading [d4]", got)
+	}
+}
+
+func TestNewPicksUpSegmentsOfAPreviousRun(t *testing.T) {
+	s, dir := openSpool(t, 0)
+	for _, device := range []string{"d1", "d2"} {
+		if err := s.Enqueue("t", batchOf(device)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// A partially written line left by a crash is skipped on replay
+	if err := os.WriteFile(filepath.Join(dir, "00000000000000000002.jsonl"), []byte(`{"table":"t","da`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, err := New(dir, 0)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	if reopened.Len() != 3 {
+		t.Fatalf("reopened spool holds %d segments, want 3", reopened.Len())
+	}
+	// New segments sort after the ones found
+	if err := reopened.Enqueue("t", batchOf("d3")); err != nil {
+		t.Fatal(err)
+	}
+
+	r := newRecorder()
+	if replayed, err := reopened.Replay(context.Background(), r.insert, retryable); err != nil || replayed != 3 {
+		t.Fatalf("Replay = %d, %v, want 3 rows", replayed, err)
+	}
+	if got := r.tables["t"]; !slices.Equal(got, []string{"d1", "d2", "d3"}) {
+		t.Errorf("replayed %v, want [d1 d2 d3]", got)
+	}
+}
@@ -0,0 +1,45 @@
+package tracing
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+
+	"github.com/ponytojas/go-mqtt-timescale/config"
+)
+
+func TestSetup(t *testing.T) {
+	previous := otel.GetTracerProvider()
+	t.Cleanup(func() { otel.SetTracerProvider(previous) })
+
+	tests := []struct {
+		name    string
+		cfg     config.OTelConfig
+		wantSDK bool // an SDK provider is installed rather than the no-op one
+	}{
+		{"disabled", config.OTelConfig{}, false},
+		{"endpoint", config.OTelConfig{Endpoint: "localhost:4317", Insecure: true, ServiceName: "test", SampleRatio: 1}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			otel.SetTracerProvider(previous)
+			shutdown, err := Setup(context.Background(), tt.cfg)
+			if err != nil {
+				t.Fatalf("Setup: %v", err)
+			}
+			if _, sdk := otel.GetTracerProvider().(*sdktrace.TracerProvider); sdk != tt.wantSDK {
+				t.Errorf("SDK provider installed = %v, want %v", sdk, tt.wantSDK)
+			}
+
+			// Nothing was traced, so there is nothing to flush
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			if err := shutdown(ctx); err != nil {
+				t.Errorf("shutdown: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,117 @@
+package ttlmap
+
+import (
+	"sync"
+	"time"
+)
+
+// reapable is a map the reaper evicts expired entries from
+type reapable interface {
+	reapInterval() time.Duration
+	reap(now time.Time)
+}
+
+// reaper evicts the expired entries of every map registered with it from a
+// single goroutine, reaping each map at its own interval
+type reaper struct {
+	mu   sync.Mutex
+	next map[reapable]time.Time // when each map is reaped next
+
+	wake chan struct{} // a map was registered
+	done chan struct{}
+	once sync.Once
+}
+
+// sharedReaper is the reaper of the maps created with New, started the first
+// time one is created
+var sharedReaper = sync.OnceValue(newReaper)
+
+// newReaper starts a reaper. Close stops it.
+func newReaper() *reaper {
+	r := &reaper{
+		next: make(map[reapable]time.Time),
+		wake: make(chan struct{}, 1),
+		done: make(chan struct{}),
+	}
+	go r.run()
+	return r
+}
+
+// Close stops the reaper. It is safe to call more than once.
+func (r *reaper) Close() {
+	r.once.Do(func() { close(r.done) })
+}
+
+// register starts reaping m
+func (r *reaper) register(m reapable) {
+	r.mu.Lock()
+	r.next[m] = time.Now().Add(m.reapInterval())
+	r.mu.Unlock()
+
+	select {
+	case r.wake <- struct{}{}:
+	default: // already woken
+	}
+}
+
+// unregister stops reaping m
+func (r *reaper) unregister(m reapable) {
+	r.mu.Lock()
+	delete(r.next, m)
+	r.mu.Unlock()
+}
+
+// run reaps the maps as they fall due until the reaper is closed
+func (r *reaper) run() {
+	for {
+		// Without a map there is nothing to wait for but the next one
+		var timer *time.Timer
+		var fire <-chan time.Time
+		if wait, ok := r.reapDue(time.Now()); ok {
+			timer = time.NewTimer(wait)
+			fire = timer.C
+		}
+
+		select {
+		case <-fire:
+		case <-r.wake:
+		case <-r.done:
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		select {
+		case <-r.done:
+			return
+		default:
+		}
+	}
+}
+
+// reapDue reaps the maps due at now and returns how long until the next one
+// is due, or false when no map is registered
+func (r *reaper) reapDue(now time.Time) (time.Duration, bool) {
+	r.mu.Lock()
+	var due []reapable
+	var earliest time.Time
+	for m, next := range r.next {
+		if !next.After(now) {
+			due = append(due, m)
+			next = now.Add(m.reapInterval())
+			r.next[m] = next
+		}
+		if earliest.IsZero() || next.Before(earliest) {
+			earliest = next
+		}
+	}
+	r.mu.Unlock()
+
+	// Reaped unlocked, so a map being reaped doesn't hold up registration
+	for _, m := range due {
+		m.reap(now)
+	}
+	if earliest.IsZero() {
+		return 0, false
+	}
+	return earliest.Sub(now), true
+}
@@ -0,0 +1,163 @@
+package ttlmap
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// entry is a key, its value and when it was last touched
+type entry[K comparable, V any] struct {
+	key     K
+	value   V
+	touched time.Time
+}
+
+// Map is a map whose entries are forgotten once they haven't been touched
+// for the TTL, so keys such as ephemeral device ids don't accumulate. The
+// shared reaper evicts expired entries in the background; with a maximum
+// size, the least recently touched entry also makes room for a new one. It
+// is safe for concurrent use.
+type Map[K comparable, V any] struct {
+	ttl        time.Duration
+	maxEntries int
+	reaper     *reaper
+
+	mu      sync.Mutex
+	order   *list.List // entries, least recently touched first
+	entries map[K]*list.Element
+}
+
+// New creates a map forgetting entries untouched for ttl, which must be
+// positive, and holding at most maxEntries of them; 0 leaves the size
+// unbounded. Its expired entries are evicted by the shared reaper until
+// Close is called.
+func New[K comparable, V any](ttl time.Duration, maxEntries int) *Map[K, V] {
+	return newWithReaper[K, V](sharedReaper(), ttl, maxEntries)
+}
+
+// newWithReaper is like New, but its expired entries are evicted by r
+func newWithReaper[K comparable, V any](r *reaper, ttl time.Duration, maxEntries int) *Map[K, V] {
+	m := &Map[K, V]{
+		ttl:        ttl,
+		maxEntries: maxEntries,
+		reaper:     r,
+		order:      list.New(),
+		entries:    make(map[K]*list.Element),
+	}
+	r.register(m)
+	return m
+}
+
+// Update stores the value fn returns for key and touches it. fn is called
+// with the current value, or the zero value and false when key is absent or
+// has expired, while the map is locked, so it must not use the map itself.
+func (m *Map[K, V]) Update(key K, fn func(value V, found bool) V) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	var zero V
+	if elem, ok := m.entries[key]; ok {
+		e := elem.Value.(*entry[K, V])
+		found := now.Sub(e.touched) <= m.ttl
+		if !found {
+			e.value = zero
+		}
+		e.value = fn(e.value, found)
+		e.touched = now
+		m.order.MoveToBack(elem)
+		return
+	}
+
+	m.entries[key] = m.order.PushBack(&entry[K, V]{key: key, value: fn(zero, false), touched: now})
+	for m.maxEntries > 0 && m.order.Len() > m.maxEntries {
+		m.remove(m.order.Front())
+	}
+}
+
+// Get returns the value of key and touches it, reporting false when key is
+// absent or has expired
+func (m *Map[K, V]) Get(key K) (V, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var zero V
+	elem, ok := m.entries[key]
+	if !ok {
+		return zero, false
+	}
+	e := elem.Value.(*entry[K, V])
+	now := time.Now()
+	if now.Sub(e.touched) > m.ttl {
+		m.remove(elem)
+		return zero, false
+	}
+	e.touched = now
+	m.order.MoveToBack(elem)
+	return e.value, true
+}
+
+// Delete forgets key
+func (m *Map[K, V]) Delete(key K) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if elem, ok := m.entries[key]; ok {
+		m.remove(elem)
+	}
+}
+
+// Keys returns the keys held, least recently touched first, including
+// expired ones the reaper hasn't evicted yet
+func (m *Map[K, V]) Keys() []K {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	keys := make([]K, 0, m.order.Len())
+	for elem := m.order.Front(); elem != nil; elem = elem.Next() {
+		keys = append(keys, elem.Value.(*entry[K, V]).key)
+	}
+	return keys
+}
+
+// Len returns the number of entries held, including expired ones the
+// reaper hasn't evicted yet
+func (m *Map[K, V]) Len() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.order.Len()
+}
+
+// Close stops evicting expired entries. It is safe to call more than once.
+func (m *Map[K, V]) Close() {
+	m.reaper.unregister(m)
+}
+
+// reapInterval returns how often the reaper evicts the map's expired
+// entries: twice per TTL
+func (m *Map[K, V]) reapInterval() time.Duration {
+	if interval := m.ttl / 2; interval > 0 {
+		return interval
+	}
+	return m.ttl
+}
+
+// reap evicts the entries untouched for longer than the TTL at now. Entries
+// are kept in the order they were touched, so only the front of the list
+// needs checking.
+func (m *Map[K, V]) reap(now time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for front := m.order.Front(); front != nil; front = m.order.Front() {
+		if now.Sub(front.Value.(*entry[K, V]).touched) <= m.ttl {
+			return
+		}
+		m.remove(front)
+	}
+}
+
+// remove forgets a single entry
+func (m *Map[K, V]) remove(elem *list.Element) {
+	m.order.Remove(elem)
+	delete(m.entries, elem.Value.(*entry[K, V]).key)
+}
@@ -0,0 +1,258 @@
+package ttlmap
+
+import (
+	"fmt"
+	"runtime"
+	"slices"
+	"testing"
+	"time"
+)
+
+// get returns the value of key and whether it was found, by touching it
+func get(m *Map[string, int], key string) (int, bool) {
+	var value int
+	var found bool
+	m.Update(key, func(v int, ok bool) int {
+		value, found = v, ok
+		return v
+	})
+	return value, found
+}
+
+// waitForLen waits up to a second for m to hold want entries
+func waitForLen(t *testing.T, m *Map[string, int], want int) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for m.Len() != want {
+		if time.Now().After(deadline) {
+			t.Fatalf("holding %d entries, want %d", m.Len(), want)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestUpdate(t *testing.T) {
+	tests := []struct {
+		name      string
+		ttl       time.Duration
+		wait      time.Duration // between storing the key and reading it
+		wantValue int
+		wantFound bool
+	}{
+		{"within the ttl", time.Hour, 0, 1, true},
+		// Not found whether or not the reaper has evicted it yet
+		{"expired", 10 * time.Millisecond, 20 * time.Millisecond, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := New[string, int](tt.ttl, 0)
+			defer m.Close()
+			if _, found := get(m, "d1"); found {
+				t.Fatal("absent key found")
+			}
+			m.Update("d1", func(v int, _ bool) int { return v + 1 })
+			time.Sleep(tt.wait)
+
+			if value, found := get(m, "d1"); value != tt.wantValue || found != tt.wantFound {
+				t.Errorf("d1 = %d, %v, want %d, %v", value, found, tt.wantValue, tt.wantFound)
+			}
+		})
+	}
+}
+
+func TestReap(t *testing.T) {
+	m := New[string, int](time.Minute, 0)
+	defer m.Close()
+	for _, key := range []string{"a", "b", "c"} {
+		get(m, key)
+	}
+	touched := time.Now()
+	// Touching moves a to the back, so b is the oldest
+	get(m, "a")
+
+	tests := []struct {
+		name string
+		at   time.Time
+		want int // entries left
+	}{
+		{"nothing expired", touched.Add(time.Minute - time.Second), 3},
+		{"all expired", touched.Add(time.Hour), 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m.reap(tt.at)
+			if m.Len() != tt.want {
+				t.Errorf("holding %d entries, want %d", m.Len(), tt.want)
+			}
+		})
+	}
+}
+
+func TestExpiredEntriesAreEvicted(t *testing.T) {
+	m := New[string, int](20*time.Millisecond, 0)
+	defer m.Close()
+	for i := 0; i < 10; i++ {
+		get(m, fmt.Sprintf("d%d", i))
+	}
+	if m.Len() != 10 {
+		t.Fatalf("holding %d entries, want 10", m.Len())
+	}
+	// Nothing touches the map, so only the reaper can evict them
+	waitForLen(t, m, 0)
+}
+
+func TestActiveKeysSurvive(t *testing.T) {
+	const ttl = 30 * time.Millisecond
+	m := New[string, int](ttl, 0)
+	defer m.Close()
+	m.Update("active", func(int, bool) int { return 1 })
+	get(m, "idle")
+
+	for deadline := time.Now().Add(5 * ttl); time.Now().Before(deadline); {
+		if value, found := get(m, "active"); !found || value != 1 {
+			t.Fatalf("active key = %d, %v, want 1, true", value, found)
+		}
+		time.Sleep(ttl / 5)
+	}
+	waitForLen(t, m, 1)
+	if _, found := get(m, "active"); !found {
+		t.Error("active key evicted")
+	}
+}
+
+func TestMaxEntries(t *testing.T) {
+	m := New[string, int](time.Hour, 3)
+	defer m.Close()
+	for _, key := range []string{"a", "b", "c"} {
+		get(m, key)
+	}
+	// a is touched again, so b is the least recently touched
+	get(m, "a")
+	get(m, "d")
+
+	if m.Len() != 3 {
+		t.Errorf("holding %d entries, want 3", m.Len())
+	}
+	for key, want := range map[string]bool{"a": true, "b": false, "c": true, "d": true} {
+		m.mu.Lock()
+		_, ok := m.entries[key]
+		m.mu.Unlock()
+		if ok != want {
+			t.Errorf("%s held = %v, want %v", key, ok, want)
+		}
+	}
+}
+
+func TestCloseStopsEvicting(t *testing.T) {
+	m := New[string, int](10*time.Millisecond, 0)
+	get(m, "d1")
+	m.Close()
+	m.Close()
+
+	// Expired entries are kept once the reaper no longer reaps the map
+	time.Sleep(50 * time.Millisecond)
+	if m.Len() != 1 {
+		t.Errorf("holding %d entries, want the expired one kept", m.Len())
+	}
+}
+
+func TestGetDeleteAndKeys(t *testing.T) {
+	m := New[string, int](time.Hour, 0)
+	defer m.Close()
+	for i, key := range []string{"a", "b", "c"} {
+		m.Update(key, func(int, bool) int { return i })
+	}
+
+	tests := []struct {
+		name     string
+		op       func()
+		wantKeys []string // least recently touched first
+	}{
+		{"stored in order", func() {}, []string{"a", "b", "c"}},
+		{"get touches", func() {
+			if v, ok := m.Get("a"); !ok || v != 0 {
+				t.Errorf("a = %d, %v, want 0, true", v, ok)
+			}
+		}, []string{"b", "c", "a"}},
+		// An absent key is not stored by looking it up
+		{"get absent", func() {
+			if _, ok := m.Get("z"); ok {
+				t.Error("absent key found")
+			}
+		}, []string{"b", "c", "a"}},
+		{"delete", func() { m.Delete("c") }, []string{"b", "a"}},
+		{"delete absent", func() { m.Delete("z") }, []string{"b", "a"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.op()
+			if got := m.Keys(); !slices.Equal(got, tt.wantKeys) {
+				t.Errorf("keys = %v, want %v", got, tt.wantKeys)
+			}
+		})
+	}
+}
+
+func TestGetForgetsExpiredEntries(t *testing.T) {
+	m := New[string, int](10*time.Millisecond, 0)
+	defer m.Close()
+	m.Update("d1", func(int, bool) int { return 1 })
+	time.Sleep(20 * time.Millisecond)
+
+	if _, ok := m.Get("d1"); ok {
+		t.Error("expired key found")
+	}
+	if m.Len() != 0 {
+		t.Errorf("holding %d entries, want the expired one forgotten", m.Len())
+	}
+}
+
+func TestMapsShareOneReaper(t *testing.T) {
+	// Started by the first map
+	New[string, int](time.Hour, 0).Close()
+	before := runtime.NumGoroutine()
+
+	maps := make([]*Map[string, int], 50)
+	for i := range maps {
+		maps[i] = New[string, int](time.Duration(i+1)*time.Millisecond, 0)
+		get(maps[i], "d1")
+	}
+	if started := runtime.NumGoroutine() - before; started > 0 {
+		t.Errorf("%d maps started %d goroutines, want none", len(maps), started)
+	}
+	// Each map is still reaped at its own TTL
+	for _, m := range maps {
+		waitForLen(t, m, 0)
+		m.Close()
+	}
+}
+
+func TestReaperReapsEachMapAtItsInterval(t *testing.T) {
+	r := newReaper()
+	defer r.Close()
+	short := newWithReaper[string, int](r, 20*time.Millisecond, 0)
+	defer short.Close()
+	long := newWithReaper[string, int](r, time.Hour, 0)
+	defer long.Close()
+	get(short, "d1")
+	get(long, "d1")
+
+	waitForLen(t, short, 0)
+	if long.Len() != 1 {
+		t.Errorf("long-lived map holds %d entries, want 1", long.Len())
+	}
+}
+
+func TestClosedReaperStops(t *testing.T) {
+	r := newReaper()
+	m := newWithReaper[string, int](r, 10*time.Millisecond, 0)
+	defer m.Close()
+	get(m, "d1")
+	r.Close()
+	r.Close()
+
+	time.Sleep(50 * time.Millisecond)
+	if m.Len() != 1 {
+		t.Errorf("holding %d entries, want the expired one kept", m.Len())
+	}
+}